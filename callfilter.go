@@ -0,0 +1,342 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Per-callee call filtering.
+// A CallFilter (kvContacts/dbCallFilterBucket) can block callers by caller ID,
+// by IP address or CIDR and by caller host; it can allow calls from contacts only
+// and it can require a caller name and/or a text message. Callers listed in
+// AllowIDs are never blocked. Contacts with ring policy "reject" are always blocked.
+// callFilterCheck() is evaluated:
+//   /online        - caller ID (without host) and IP only; contactsOnly is not checked
+//   /canbenotified - no text message yet
+//   /notifyCallee, callerOffer, addMissedCall - all caller info
+//   /voicemail     - all caller info; a voicemail does not need a text message
+// Blocked attempts are not stored as missed calls. They are stored in
+// kvCalls/dbBlockedCallsBucket (max callFilterLogMax per callee).
+// Endpoints (cookie or bearer token auth):
+//   GET|PUT "/api/v1/callfilter" CallFilter
+//   GET "/api/v1/blockedcalls" -> [BlockedCall,..]
+//   DELETE "/api/v1/blockedcalls"
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbCallFilterBucket = "callfilter"     // in kvContacts: calleeID -> CallFilter
+const dbBlockedCallsBucket = "blockedcalls" // in kvCalls: calleeID -> []BlockedCall
+
+const callFilterLogMax = 100
+const callFilterMaxEntries = 200
+
+var callFilterLogMutex sync.Mutex
+
+var errCallFiltered = errors.New("call blocked by call filter")
+
+type CallFilter struct {
+	BlockIDs []string `json:"blockIds"`     // caller ids, "id" or "id@host"
+	BlockIPs []string `json:"blockIps"`     // ip addresses or CIDRs
+	BlockHosts []string `json:"blockHosts"` // caller hosts; ".example.com" also blocks all subdomains
+	AllowIDs []string `json:"allowIds"`     // never blocked
+	ContactsOnly bool `json:"contactsOnly"`
+	RequireName bool `json:"requireName"`
+	RequireMsg bool `json:"requireMsg"`
+}
+
+// CallAttempt is the caller info available to callFilterCheck()
+type CallAttempt struct {
+	CallerID string   // may contain @callerHost
+	CallerName string
+	Msg string
+	Ip string         // with or without port
+	Stage string      // online, canbenotified, notify, offer, missedcall, voicemail
+}
+
+type BlockedCall struct {
+	Time int64 `json:"time"`
+	CallerID string `json:"callerId,omitempty"`
+	CallerName string `json:"callerName,omitempty"`
+	Ip string `json:"ip"`
+	Reason string `json:"reason"`
+	Stage string `json:"stage"`
+}
+
+// callFilterGet returns the call filter of calleeID (an empty filter if none is stored)
+func callFilterGet(calleeID string) (CallFilter, error) {
+	var filter CallFilter
+	err := kvContacts.Get(dbCallFilterBucket, calleeID, &filter)
+	if err==skv.ErrNotFound {
+		return CallFilter{}, nil
+	}
+	return filter, err
+}
+
+// callFilterSet validates and stores the call filter of calleeID
+func callFilterSet(calleeID string, filter *CallFilter) error {
+	clean := func(list []string, name string, check func(string) bool) ([]string, error) {
+		var result []string
+		for _,entry := range list {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			if entry=="" {
+				continue
+			}
+			if !check(entry) {
+				return nil, errors.New("invalid "+name+" "+entry)
+			}
+			result = append(result, entry)
+		}
+		if len(result) > callFilterMaxEntries {
+			return nil, errors.New("too many "+name)
+		}
+		return result, nil
+	}
+	isID := func(entry string) bool {
+		return len(entry)<=200 && strings.IndexAny(entry," |,")<0
+	}
+	isHost := func(entry string) bool {
+		return len(entry)<=200 && strings.IndexAny(entry," |,@/")<0
+	}
+	isIp := func(entry string) bool {
+		if strings.Index(entry,"/")>=0 {
+			_,_,err := net.ParseCIDR(entry)
+			return err==nil
+		}
+		return net.ParseIP(entry)!=nil
+	}
+	var err error
+	if filter.BlockIDs,err = clean(filter.BlockIDs, "blockIds", isID); err!=nil {
+		return err
+	}
+	if filter.AllowIDs,err = clean(filter.AllowIDs, "allowIds", isID); err!=nil {
+		return err
+	}
+	if filter.BlockHosts,err = clean(filter.BlockHosts, "blockHosts", isHost); err!=nil {
+		return err
+	}
+	if filter.BlockIPs,err = clean(filter.BlockIPs, "blockIps", isIp); err!=nil {
+		return err
+	}
+	for idx := range filter.BlockIDs {
+		filter.BlockIDs[idx] = contactLocalID(filter.BlockIDs[idx])
+	}
+	for idx := range filter.AllowIDs {
+		filter.AllowIDs[idx] = contactLocalID(filter.AllowIDs[idx])
+	}
+	return kvContacts.Put(dbCallFilterBucket, calleeID, filter, false)
+}
+
+// callFilterDelete removes the call filter and the blocked calls log of calleeID
+func callFilterDelete(calleeID string) {
+	err := kvContacts.Delete(dbCallFilterBucket, calleeID)
+	if err!=nil && err!=skv.ErrNotFound {
+		logError("callfilter delete", "calleeID",calleeID, "err",err)
+	}
+	err = kvCalls.Delete(dbBlockedCallsBucket, calleeID)
+	if err!=nil && err!=skv.ErrNotFound {
+		logError("callfilter delete log", "calleeID",calleeID, "err",err)
+	}
+}
+
+// callFilterIp returns ip without port
+func callFilterIp(ip string) net.IP {
+	if host,_,err := net.SplitHostPort(ip); err==nil {
+		ip = host
+	}
+	return net.ParseIP(ip)
+}
+
+// callFilterCheck returns the reason why attempt is blocked by the call filter of calleeID
+// or "" if the call is allowed
+func callFilterCheck(calleeID string, attempt CallAttempt) string {
+	if calleeID=="" || strings.HasPrefix(calleeID,"answie") || strings.HasPrefix(calleeID,"talkback") {
+		return ""
+	}
+	callerID := strings.ToLower(contactLocalID(attempt.CallerID))
+	callerHost := hostname
+	if idxAt := strings.Index(callerID,"@"); idxAt>=0 {
+		callerHost = callerID[idxAt+1:]
+	}
+
+	// contact ring policy "reject" applies without a stored filter
+	var contact Contact
+	isContact := false
+	if callerID!="" {
+		contact,isContact = contactGet(calleeID, callerID)
+		if isContact && contact.RingPolicy=="reject" {
+			return "contact rejected"
+		}
+	}
+
+	filter,err := callFilterGet(calleeID)
+	if err!=nil {
+		logError("callfilter get", "calleeID",calleeID, "err",err)
+		return ""
+	}
+	if callerID!="" {
+		for _,id := range filter.AllowIDs {
+			if id==callerID {
+				return ""
+			}
+		}
+		for _,id := range filter.BlockIDs {
+			if id==callerID {
+				return "caller id blocked"
+			}
+		}
+	}
+	if len(filter.BlockIPs)>0 {
+		if ip := callFilterIp(attempt.Ip); ip!=nil {
+			for _,entry := range filter.BlockIPs {
+				if strings.Index(entry,"/")>=0 {
+					_,ipNet,err := net.ParseCIDR(entry)
+					if err==nil && ipNet.Contains(ip) {
+						return "ip blocked"
+					}
+				} else if ip.Equal(net.ParseIP(entry)) {
+					return "ip blocked"
+				}
+			}
+		}
+	}
+	// the caller host is not known to /online (callerID has no @host there)
+	if attempt.Stage!="online" {
+		for _,host := range filter.BlockHosts {
+			if host==callerHost || (strings.HasPrefix(host,".") && strings.HasSuffix(callerHost,host)) {
+				return "host blocked"
+			}
+		}
+	}
+	// the caller may be a remote contact; /online can not tell
+	if filter.ContactsOnly && !isContact && attempt.Stage!="online" {
+		return "not a contact"
+	}
+	if filter.RequireName && attempt.Stage!="online" && strings.TrimSpace(attempt.CallerName)=="" {
+		return "caller name required"
+	}
+	// a voicemail is a message
+	if filter.RequireMsg && attempt.Stage!="online" && attempt.Stage!="canbenotified" &&
+			attempt.Stage!="voicemail" && strings.TrimSpace(attempt.Msg)=="" {
+		return "message required"
+	}
+	return ""
+}
+
+// callFilterBlocked logs a blocked call attempt (instead of a missed call)
+func callFilterBlocked(calleeID string, attempt CallAttempt, reason string) {
+	ip := attempt.Ip
+	if ipNoPort := callFilterIp(ip); ipNoPort!=nil {
+		ip = ipNoPort.String()
+	}
+	logInfo("callfilter blocked", "calleeID",calleeID, "callerID",attempt.CallerID, "ip",ip,
+		"reason",reason, "stage",attempt.Stage)
+	callFilterLogMutex.Lock()
+	defer callFilterLogMutex.Unlock()
+	var blockedCalls []BlockedCall
+	err := kvCalls.Get(dbBlockedCallsBucket, calleeID, &blockedCalls)
+	if err!=nil && err!=skv.ErrNotFound {
+		logError("callfilter get log", "calleeID",calleeID, "err",err)
+	}
+	now := time.Now().Unix()
+	if len(blockedCalls)>0 {
+		last := blockedCalls[len(blockedCalls)-1]
+		if last.CallerID==attempt.CallerID && last.Ip==ip && now-last.Time < 60 {
+			// same attempt seen by a previous stage (or a repeating caller)
+			return
+		}
+	}
+	blockedCalls = append(blockedCalls, BlockedCall{Time:now, CallerID:attempt.CallerID,
+		CallerName:attempt.CallerName, Ip:ip, Reason:reason, Stage:attempt.Stage})
+	if len(blockedCalls) > callFilterLogMax {
+		blockedCalls = blockedCalls[len(blockedCalls)-callFilterLogMax:]
+	}
+	err = kvCalls.Put(dbBlockedCallsBucket, calleeID, blockedCalls, false)
+	if err!=nil {
+		logError("callfilter put log", "calleeID",calleeID, "err",err)
+	}
+}
+
+// callFilter checks attempt and logs it if it is blocked; it returns the reason or ""
+func callFilter(calleeID string, attempt CallAttempt) string {
+	reason := callFilterCheck(calleeID, attempt)
+	if reason!="" {
+		callFilterBlocked(calleeID, attempt, reason)
+	}
+	return reason
+}
+
+// callFilterReject tells the caller (c) that its callerOffer was rejected and disconnects it
+func (c *WsClient) callFilterReject(reason string) {
+	// NOTE: the text must not contain '|'
+	text := "Not available"
+	switch reason {
+		case "caller name required": text = "Please enter your name before calling"
+		case "message required": text = "Please enter a message before calling"
+	}
+	c.Write([]byte("rejected|"+text)) // ignore any error
+	// stop callerWatchdog
+	c.isOnline.Set(false)
+	select {
+		case c.calleeAnswerReceived <- struct{}{}:
+		default:
+	}
+	c.hub.closeCaller("callfilter "+reason)
+}
+
+// apiCallFilter serves GET and PUT "/api/v1/callfilter"
+func apiCallFilter(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if r.Method=="PUT" {
+		var filter CallFilter
+		if !apiReadJson(w, r, &filter) {
+			return
+		}
+		err := callFilterSet(calleeID, &filter)
+		if err!=nil {
+			logWarn("/api/v1/callfilter put fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		logInfo("/api/v1/callfilter put", "calleeID",calleeID, "rip",remoteAddr)
+		apiJson(w, http.StatusOK, filter)
+		return
+	}
+	filter,err := callFilterGet(calleeID)
+	if err!=nil {
+		logError("/api/v1/callfilter get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	apiJson(w, http.StatusOK, filter)
+}
+
+// apiBlockedCalls serves GET and DELETE "/api/v1/blockedcalls"
+func apiBlockedCalls(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	callFilterLogMutex.Lock()
+	defer callFilterLogMutex.Unlock()
+	if r.Method=="DELETE" {
+		err := kvCalls.Delete(dbBlockedCallsBucket, calleeID)
+		if err!=nil && err!=skv.ErrNotFound {
+			logError("/api/v1/blockedcalls delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var blockedCalls []BlockedCall
+	err := kvCalls.Get(dbBlockedCallsBucket, calleeID, &blockedCalls)
+	if err!=nil && err!=skv.ErrNotFound {
+		logError("/api/v1/blockedcalls get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if blockedCalls==nil {
+		blockedCalls = []BlockedCall{}
+	}
+	apiJson(w, http.StatusOK, blockedCalls)
+}
@@ -0,0 +1,558 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Call waiting and call transfer.
+// While a callee is in a call, one more caller can connect: instead of
+// being rejected as "callee busy", it becomes the hub's WaitingClient.
+// Its callerOffer (and any further message) is held back and the callee is
+// notified. The callee may put the active call on hold and take the
+// waiting call, end the active call and take the waiting call, or reject
+// the waiting caller. Only one call can be on hold; "switchHeld" swaps the
+// active and the held call.
+// A call can be transferred to another calleeID or mapping ID, either blind
+// ("transfer") or attended: "consult" puts the call on hold, the callee
+// then calls the target as usual and "transferComplete" hands the held
+// caller over to the target.
+// The caller's ws-connection is closed shortly after peer connect (see
+// disconCallerOnPeerConnected). Messages to a caller who is not ws-connected
+// anymore are answered by "transferRelay|" to the callee: the callee client
+// must deliver them via its data channel.
+// Config keyword callWaiting (default true) enables call waiting.
+//
+// server -> callee:
+//   callWaiting|callerID\tcallerName  a caller is waiting
+//   waitingGone|                      the waiting caller has hung up or timed out
+//   heldGone|                         the caller on hold has hung up
+//   consult|targetID                  the active call is on hold, ready to call targetID
+//   transferred|targetID              the caller was told to call targetID
+//   transferRelay|targetID            the caller must be told via data channel to call targetID
+//   transferFailed|targetID\treason
+// server -> caller:
+//   waiting|                          the callee is busy, the caller is waiting
+//   hold| resume|                     the call was put on hold / was resumed
+//   transfer|targetID                 the caller should hang up and call targetID
+//   cancel|busy                       the waiting call was rejected
+// callee -> server:
+//   acceptWaiting|hold or |end        hold or end the active call, take the waiting call
+//   rejectWaiting|
+//   switchHeld|                       swap active and held call (resume if no active call)
+//   endHeld|                          end the call on hold
+//   transfer|targetID                 blind transfer of the active call
+//   consult|targetID                  attended transfer: put the active call on hold
+//   transferComplete|                 attended transfer: hand the held call over to targetID
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"github.com/mehrvarz/webcall/skv"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+)
+
+// max number of messages held back from a waiting caller
+const maxWaitingMsgs = 100
+
+// max secs a caller waits for the callee to accept
+const maxWaitingSecs = 60
+
+// HubCall holds the per-call state of a hub, so that a call can be put on hold
+type HubCall struct {
+	callerClient *WsClient // nil if the caller is not ws-connected anymore
+	callerID string
+	callerIpNoPort string
+	connectedCallerIp string
+	turnUsername string
+	cdr *CallDetailRecord
+	lastCallStartTime int64
+	lastCallerContactTime int64
+	localP2p bool
+	remoteP2p bool
+	calleePeerCon bool
+	calleeMediaCon bool
+	calleePickupSent bool
+}
+
+func callWaitingEnabled() bool {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return callWaiting
+}
+
+// takeCallLocked removes the active call from the hub and returns it
+// ConnectedCallerIp is left untouched, so the callee stays busy for other callers
+// must be called with h.HubMutex locked
+func (h *Hub) takeCallLocked() *HubCall {
+	h.cdrMutex.Lock()
+	call := &HubCall{
+		callerClient: h.CallerClient,
+		callerID: h.CallerID,
+		callerIpNoPort: h.CallerIpNoPort,
+		connectedCallerIp: h.ConnectedCallerIp,
+		turnUsername: h.TurnUsername,
+		cdr: h.cdr,
+		lastCallStartTime: h.lastCallStartTime,
+		lastCallerContactTime: h.lastCallerContactTime,
+		localP2p: h.LocalP2p,
+		remoteP2p: h.RemoteP2p,
+	}
+	h.cdr = nil
+	h.cdrMutex.Unlock()
+	h.CallerClient = nil
+	h.CallerID = ""
+	h.CallerIpNoPort = ""
+	h.TurnUsername = ""
+	h.lastCallStartTime = 0
+	h.lastCallerContactTime = 0
+	h.LocalP2p = false
+	h.RemoteP2p = false
+	if h.CalleeClient!=nil {
+		call.calleePeerCon = h.CalleeClient.isConnectedToPeer.Get()
+		call.calleeMediaCon = h.CalleeClient.isMediaConnectedToPeer.Get()
+		call.calleePickupSent = h.CalleeClient.pickupSent.Get()
+		h.CalleeClient.isConnectedToPeer.Set(false)
+		h.CalleeClient.isMediaConnectedToPeer.Set(false)
+		h.CalleeClient.pickupSent.Set(false)
+	}
+	return call
+}
+
+// putCallLocked makes call the active call of the hub
+// the caller must store call.connectedCallerIp via StoreCallerIpInHubMap() after unlocking
+// must be called with h.HubMutex locked
+func (h *Hub) putCallLocked(call *HubCall) {
+	h.CallerClient = call.callerClient
+	h.CallerID = call.callerID
+	h.CallerIpNoPort = call.callerIpNoPort
+	h.TurnUsername = call.turnUsername
+	h.lastCallStartTime = call.lastCallStartTime
+	h.lastCallerContactTime = call.lastCallerContactTime
+	h.LocalP2p = call.localP2p
+	h.RemoteP2p = call.remoteP2p
+	h.cdrMutex.Lock()
+	h.cdr = call.cdr
+	h.cdrMutex.Unlock()
+	if h.CalleeClient!=nil {
+		h.CalleeClient.isConnectedToPeer.Set(call.calleePeerCon)
+		h.CalleeClient.isMediaConnectedToPeer.Set(call.calleeMediaCon)
+		h.CalleeClient.pickupSent.Set(call.calleePickupSent)
+	}
+}
+
+// hasActiveCallLocked returns false if the callee is neither ringing nor talking
+// (for instance after the active call was put on hold by "consult")
+func (h *Hub) hasActiveCallLocked() bool {
+	return h.CallerClient!=nil || h.lastCallStartTime>0 ||
+		(h.CalleeClient!=nil && h.CalleeClient.isConnectedToPeer.Get())
+}
+
+// endCallLocked ends a call that is not the active call (the held call)
+func (h *Hub) endCallLocked(call *HubCall, cause string) {
+	if call.lastCallStartTime>0 {
+		countCallSecs(time.Now().Unix() - call.lastCallStartTime, call.localP2p && call.remoteP2p)
+	}
+	if call.cdr!=nil {
+		cdrFinish(call.cdr, cause, call.localP2p, call.remoteP2p)
+	}
+	turnCredentialsEnd(call.turnUsername)
+	if call.callerClient!=nil {
+		call.callerClient.closeDetached(cause)
+	}
+}
+
+// closeDetached closes the ws-connection of a caller that is not (anymore) the hub's CallerClient
+// unlike Close(), it does not touch the hub's active call
+func (c *WsClient) closeDetached(reason string) {
+	c.log.Debug("wsclose", "closeDetached", "online",c.isOnline.Get(), "reason",reason)
+	c.isDetached.Set(true)
+	if c.isOnline.Get() {
+		c.wsConn.WriteMessage(websocket.CloseMessage, nil) // ignore any error
+		c.wsConn.Close()
+	}
+}
+
+// endCallWaitingLocked drops the waiting caller and ends the held call (callee is gone)
+// must be called with h.HubMutex locked
+func (h *Hub) endCallWaitingLocked(cause string) {
+	if h.WaitingClient!=nil {
+		h.dropWaitingLocked(cause, "cancel|c")
+	}
+	if h.heldCall!=nil {
+		held := h.heldCall
+		h.heldCall = nil
+		h.transferTarget = ""
+		if held.callerClient!=nil {
+			held.callerClient.Write([]byte("cancel|c"))
+		}
+		h.endCallLocked(held, cause)
+	}
+}
+
+// dropWaitingLocked rejects the waiting caller; it is stored as a missed call
+// must be called with h.HubMutex locked
+func (h *Hub) dropWaitingLocked(cause string, callerMsg string) {
+	waiting := h.WaitingClient
+	h.WaitingClient = nil
+	h.waitingMsgs = nil
+	if waiting==nil {
+		return
+	}
+	waiting.log.Info("drop waiting caller", "cause",cause)
+	turnCredentialsEnd(waiting.turnUsername)
+	if waiting.callerOfferForwarded.Get() {
+		// the callee was notified of this caller
+		if h.CalleeClient!=nil {
+			h.CalleeClient.Write([]byte("waitingGone|"))
+			userKey := h.CalleeClient.calleeID + "_" + strconv.FormatInt(int64(h.registrationStartTime),10)
+			var dbUser DbUser
+			err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+			if err!=nil {
+				waiting.log.Error("failed to get dbUser", "err",err)
+			} else if dbUser.StoreMissedCalls {
+				addMissedCall(h.CalleeClient.calleeID, CallerInfo{waiting.RemoteAddr, waiting.callerName,
+					time.Now().Unix(), waiting.callerID, waiting.callerTextMsg }, cause)
+			}
+		}
+		cdrRejected(waiting.calleeID, waiting, cause)
+	}
+	if callerMsg!="" {
+		waiting.Write([]byte(callerMsg))
+	}
+	waiting.closeDetached(cause)
+}
+
+// callWaitingMessage handles the messages of the waiting caller and of the caller on hold
+// it returns false if c is neither
+func (h *Hub) callWaitingMessage(c *WsClient, cmd string, message []byte) bool {
+	h.HubMutex.Lock()
+	defer h.HubMutex.Unlock()
+	if c==h.WaitingClient {
+		if cmd=="cancel" {
+			h.dropWaitingLocked("caller cancel", "")
+			return true
+		}
+		if cmd=="heartbeat" || cmd=="check" {
+			return false
+		}
+		if len(h.waitingMsgs) < maxWaitingMsgs {
+			// message is a read buffer that will be reused
+			h.waitingMsgs = append(h.waitingMsgs, append([]byte(nil), message...))
+		}
+		if cmd=="callerOffer" && !c.callerOfferForwarded.Get() && h.CalleeClient!=nil {
+			c.callerOfferForwarded.Set(true)
+			c.log.Info("CALL🔔 waiting", "calleeAddr",h.CalleeClient.RemoteAddr, "ua",c.userAgent)
+			err := h.CalleeClient.Write([]byte("callWaiting|"+c.callerID+"\t"+c.callerName))
+			if err!=nil {
+				c.log.Error("send callWaiting to callee fail", "err",err)
+			}
+			c.Write([]byte("waiting|"))
+			time.AfterFunc(maxWaitingSecs*time.Second, func() {
+				h.HubMutex.Lock()
+				if h.WaitingClient==c {
+					h.dropWaitingLocked("waiting timeout", "cancel|busy")
+				}
+				h.HubMutex.Unlock()
+			})
+		}
+		return true
+	}
+	if h.heldCall!=nil && c==h.heldCall.callerClient {
+		if cmd=="cancel" {
+			// the caller on hold has hung up
+			held := h.heldCall
+			h.heldCall = nil
+			h.transferTarget = ""
+			c.log.Info("held caller hangup")
+			h.endCallLocked(held, "caller cancel on hold")
+			if h.CalleeClient!=nil {
+				h.CalleeClient.Write([]byte("heldGone|"))
+			}
+			return true
+		}
+		if cmd=="heartbeat" || cmd=="check" {
+			return false
+		}
+		// everything else is dropped while on hold
+		return true
+	}
+	return false
+}
+
+// callWaitingClosed is called when the ws-connection of a caller has been closed
+// it returns true if c was the waiting caller, the caller on hold or detached from the hub
+func (h *Hub) callWaitingClosed(c *WsClient) bool {
+	h.HubMutex.Lock()
+	defer h.HubMutex.Unlock()
+	if c==h.WaitingClient {
+		h.dropWaitingLocked("caller gone", "")
+		return true
+	}
+	if h.heldCall!=nil && c==h.heldCall.callerClient {
+		// the caller may still be peer connected; we only lose the ability to notify it
+		h.heldCall.callerClient = nil
+		return true
+	}
+	return c.isDetached.Get()
+}
+
+// acceptWaiting makes the waiting caller the active caller
+// the active call is put on hold (mode "hold") or ended (mode "end")
+func (h *Hub) acceptWaiting(mode string) {
+	h.HubMutex.Lock()
+	waiting := h.WaitingClient
+	if waiting==nil || h.CalleeClient==nil {
+		h.HubMutex.Unlock()
+		return
+	}
+	if !waiting.callerOfferForwarded.Get() {
+		// the waiting caller has not sent its callerOffer yet
+		h.CalleeClient.log.Warn("acceptWaiting before callerOffer")
+		h.HubMutex.Unlock()
+		return
+	}
+	if mode!="end" && h.heldCall!=nil {
+		h.CalleeClient.log.Warn("acceptWaiting: there is a held call already")
+		h.CalleeClient.Write([]byte("status|Only one call can be on hold."))
+		h.HubMutex.Unlock()
+		return
+	}
+	if mode!="end" && !h.hasActiveCallLocked() {
+		// the active call has ended in the meantime: there is nothing to hold
+		mode = "end"
+	}
+	h.WaitingClient = nil
+	msgs := h.waitingMsgs
+	h.waitingMsgs = nil
+
+	h.setDeadline(0,"acceptWaiting")
+	active := h.takeCallLocked()
+	if mode=="end" {
+		if active.callerClient!=nil {
+			active.callerClient.Write([]byte("cancel|c"))
+		}
+		h.endCallLocked(active, "callee took waiting call")
+	} else {
+		h.CalleeClient.log.Info("hold active call", "callerID",active.callerID)
+		if active.callerClient!=nil {
+			active.callerClient.Write([]byte("hold|"))
+			active.callerClient.isDetached.Set(true)
+		}
+		h.heldCall = active
+	}
+
+	// the waiting caller becomes the active caller
+	waiting.log.Info("accept waiting caller", "mode",mode)
+	h.putCallLocked(&HubCall{callerClient:waiting, callerID:waiting.callerID,
+		callerIpNoPort:waiting.RemoteAddrNoPort, turnUsername:waiting.turnUsername,
+		lastCallerContactTime:time.Now().Unix()})
+	h.CallDurationSecs = 0
+	h.cdrStart(waiting)
+	emitEvent(Event{Type:"ring", CalleeID:waiting.calleeID, CallerID:waiting.callerID,
+		CallerName:waiting.callerName})
+	callee := h.CalleeClient
+	if waiting.callerID!="" || waiting.callerName!="" {
+		callee.Write([]byte("callerInfo|"+waiting.callerID+"\t"+waiting.callerName))
+	}
+	if turnMsg := turnCredentialsMsg(waiting.turnUsername, callee.RemoteAddrNoPort); turnMsg!=nil {
+		// before the callerOffer
+		callee.Write(turnMsg)
+	}
+	for _,msg := range msgs {
+		err := callee.Write(msg)
+		if err!=nil {
+			h.HubMutex.Unlock()
+			h.closeCallee("send waiting msg to callee: "+err.Error())
+			return
+		}
+	}
+	callee.Write([]byte("ua|"+waiting.userAgent))
+	waiting.Write([]byte("ua|"+callee.userAgent))
+	maxRingSecs := h.maxRingSecs
+	h.HubMutex.Unlock()
+
+	go waiting.callerWatchdog()
+	if maxRingSecs>0 {
+		h.setDeadline(maxRingSecs,"acceptWaiting ringsecs")
+	}
+	err := StoreCallerIpInHubMap(waiting.globalCalleeID, waiting.RemoteAddr, false)
+	if err!=nil {
+		waiting.log.Error("acceptWaiting StoreCallerIp", "globalCalleeID",waiting.globalCalleeID, "err",err)
+	}
+}
+
+// rejectWaiting sends "cancel|busy" to the waiting caller
+func (h *Hub) rejectWaiting() {
+	h.HubMutex.Lock()
+	h.dropWaitingLocked("callee busy", "cancel|busy")
+	h.HubMutex.Unlock()
+}
+
+// switchHeld swaps the active call and the call on hold
+// if there is no active call (anymore), the held call is resumed
+func (h *Hub) switchHeld() {
+	h.HubMutex.Lock()
+	held := h.heldCall
+	if held==nil || h.CalleeClient==nil {
+		h.HubMutex.Unlock()
+		return
+	}
+	h.transferTarget = ""
+	h.heldCall = nil
+	if h.hasActiveCallLocked() {
+		active := h.takeCallLocked()
+		if active.callerClient!=nil {
+			active.callerClient.Write([]byte("hold|"))
+			active.callerClient.isDetached.Set(true)
+		}
+		h.heldCall = active
+	}
+	h.CalleeClient.log.Info("resume held call", "callerID",held.callerID, "holdOther",h.heldCall!=nil)
+	h.putCallLocked(held)
+	if held.callerClient!=nil {
+		held.callerClient.isDetached.Set(false)
+		held.callerClient.Write([]byte("resume|"))
+	}
+	globalCalleeID := h.CalleeClient.globalCalleeID
+	h.HubMutex.Unlock()
+
+	err := StoreCallerIpInHubMap(globalCalleeID, held.connectedCallerIp, false)
+	if err!=nil {
+		logError("switchHeld StoreCallerIp", "globalCalleeID",globalCalleeID, "err",err)
+	}
+}
+
+// endHeld ends the call on hold (the callee has hung it up or lost its peer connection)
+func (h *Hub) endHeld() {
+	h.HubMutex.Lock()
+	defer h.HubMutex.Unlock()
+	held := h.heldCall
+	if held==nil {
+		return
+	}
+	h.heldCall = nil
+	h.transferTarget = ""
+	if h.CalleeClient!=nil {
+		h.CalleeClient.log.Info("end held call", "callerID",held.callerID)
+	}
+	if held.callerClient!=nil {
+		held.callerClient.Write([]byte("cancel|c"))
+	}
+	h.endCallLocked(held, "callee ended held call")
+	if !h.hasActiveCallLocked() {
+		// callee is free again
+		h.peerConHasEnded("callee ended held call")
+	}
+}
+
+// transferTargetID checks that targetID is a registered calleeID or a mapping ID
+// it returns the calleeID behind targetID
+func transferTargetID(targetID string) (string,string) {
+	if targetID=="" || len(targetID)>40 || strings.ContainsAny(targetID,"|\t") {
+		return "","invalid"
+	}
+	calleeID := targetID
+	mappingMutex.RLock()
+	mappingData,ok := mapping[targetID]
+	mappingMutex.RUnlock()
+	if ok {
+		calleeID = mappingData.CalleeId
+	}
+	err := kvMain.Get(dbRegisteredIDs, calleeID, nil)
+	if err==skv.ErrNotFound {
+		return "","not found"
+	}
+	if err!=nil {
+		return "","error"
+	}
+	return calleeID,""
+}
+
+// transfer tells the active caller to call targetID (blind transfer) and ends the call
+func (h *Hub) transfer(c *WsClient, targetID string) {
+	calleeID,reason := transferTargetID(targetID)
+	if reason=="" && calleeID==c.calleeID {
+		reason = "self"
+	}
+	h.HubMutex.RLock()
+	if reason=="" && (h.CallerClient==nil && !c.isConnectedToPeer.Get()) {
+		reason = "no call"
+	}
+	if reason!="" {
+		h.HubMutex.RUnlock()
+		c.log.Info("transfer failed", "targetID",targetID, "reason",reason)
+		c.Write([]byte("transferFailed|"+targetID+"\t"+reason))
+		return
+	}
+	caller := h.CallerClient
+	h.HubMutex.RUnlock()
+
+	c.log.Info("transfer", "targetID",targetID, "callerOnline",caller!=nil)
+	if caller==nil || caller.Write([]byte("transfer|"+targetID))!=nil {
+		// the callee client delivers the transfer via data channel and then hangs up
+		c.Write([]byte("transferRelay|"+targetID))
+		return
+	}
+	c.Write([]byte("transferred|"+targetID))
+	h.closePeerCon("transfer "+targetID)
+}
+
+// consult puts the active call on hold before the callee calls targetID (attended transfer)
+func (h *Hub) consult(c *WsClient, targetID string) {
+	calleeID,reason := transferTargetID(targetID)
+	if reason=="" && calleeID==c.calleeID {
+		reason = "self"
+	}
+	h.HubMutex.Lock()
+	if reason=="" && h.heldCall!=nil {
+		reason = "held call exists"
+	}
+	if reason=="" && !h.hasActiveCallLocked() {
+		reason = "no call"
+	}
+	if reason!="" {
+		h.HubMutex.Unlock()
+		c.log.Info("consult failed", "targetID",targetID, "reason",reason)
+		c.Write([]byte("transferFailed|"+targetID+"\t"+reason))
+		return
+	}
+	h.setDeadline(0,"consult")
+	active := h.takeCallLocked()
+	if active.callerClient!=nil {
+		active.callerClient.Write([]byte("hold|"))
+		active.callerClient.isDetached.Set(true)
+	}
+	h.heldCall = active
+	h.transferTarget = targetID
+	h.HubMutex.Unlock()
+	c.log.Info("consult", "targetID",targetID, "callerID",active.callerID)
+	c.Write([]byte("consult|"+targetID))
+}
+
+// transferComplete tells the caller on hold to call the consult target
+func (h *Hub) transferComplete(c *WsClient) {
+	h.HubMutex.Lock()
+	held := h.heldCall
+	targetID := h.transferTarget
+	if held==nil || targetID=="" {
+		h.HubMutex.Unlock()
+		c.log.Info("transferComplete failed: no consult")
+		c.Write([]byte("transferFailed|"+targetID+"\tno consult"))
+		return
+	}
+	h.heldCall = nil
+	h.transferTarget = ""
+	delivered := held.callerClient!=nil && held.callerClient.Write([]byte("transfer|"+targetID))==nil
+	h.endCallLocked(held, "transfer "+targetID)
+	if !h.hasActiveCallLocked() {
+		// callee is free again
+		h.peerConHasEnded("transfer "+targetID)
+	}
+	h.HubMutex.Unlock()
+
+	c.log.Info("transferComplete", "targetID",targetID, "callerID",held.callerID, "delivered",delivered)
+	if delivered {
+		c.Write([]byte("transferred|"+targetID))
+	} else {
+		c.Write([]byte("transferRelay|"+targetID))
+	}
+}
@@ -0,0 +1,297 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Call detail records (CDR).
+// A CDR is started when a caller's callerOffer is forwarded to the callee
+// (ring start), gets its pickup time when the callee sends "pickup" and is
+// stored when the call attempt ends: in peerConHasEnded(), closeCaller() or
+// closeCallee(), with the cause that ended it ("cancel", "deadline", ...).
+// Call attempts rejected right away ("callee busy") are stored immediately.
+// CDRs are stored in kvCalls/dbCdrBucket, one entry per record under the
+// key calleeID|id, so storing a CDR does not touch the other records.
+// Callees can query their own CDRs via "/rtcsig/cdr" and "/api/v1/cdr",
+// admins (localhost) all CDRs via "/rtcsig/dumpcdr". All three take the
+// url args format=json|csv, from and to (unix secs).
+// Config keywords: cdrMaxPerCallee (default 1000) and cdrMaxDays
+// (default 90, 0 = keep forever); cdrCleanup() enforces both every 3 hours.
+// In csv exports, string values starting with = + - @ are prefixed with '
+// so that spreadsheets do not evaluate them as formulas.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbCdrBucket = "cdr" // in kvCalls: calleeID|id -> CallDetailRecord
+
+type CallDetailRecord struct {
+	Id string `json:"id"`
+	CalleeID string `json:"calleeId"`
+	CallerID string `json:"callerId"`
+	CallerName string `json:"callerName"`
+	CalleeIp string `json:"calleeIp"`
+	CallerIp string `json:"callerIp"`
+	RingStart int64 `json:"ringStart"` // unix secs
+	Pickup int64 `json:"pickup"`       // unix secs, 0 = not picked up
+	End int64 `json:"end"`             // unix secs
+	RingSecs int64 `json:"ringSecs"`
+	TalkSecs int64 `json:"talkSecs"`
+	LocalP2p bool `json:"localP2p"`
+	RemoteP2p bool `json:"remoteP2p"`
+	Cause string `json:"cause"`
+	RelayBytes int64 `json:"relayBytes"` // TURN relay traffic of the call (embedded TURN server)
+	turnUsername string
+}
+
+var cdrCsvHeader = []string{"id","calleeId","callerId","callerName","calleeIp","callerIp",
+	"ringStart","pickup","end","ringSecs","talkSecs","localP2p","remoteP2p","cause","relayBytes"}
+
+func (cdr *CallDetailRecord) csvRecord() []string {
+	return []string{csvSafe(cdr.Id), csvSafe(cdr.CalleeID), csvSafe(cdr.CallerID), csvSafe(cdr.CallerName),
+		csvSafe(cdr.CalleeIp), csvSafe(cdr.CallerIp),
+		strconv.FormatInt(cdr.RingStart,10), strconv.FormatInt(cdr.Pickup,10),
+		strconv.FormatInt(cdr.End,10), strconv.FormatInt(cdr.RingSecs,10),
+		strconv.FormatInt(cdr.TalkSecs,10), strconv.FormatBool(cdr.LocalP2p),
+		strconv.FormatBool(cdr.RemoteP2p), csvSafe(cdr.Cause), strconv.FormatInt(cdr.RelayBytes,10)}
+}
+
+// csvSafe prevents value from being evaluated as a formula by spreadsheets
+func csvSafe(value string) string {
+	if value!="" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'"+value
+	}
+	return value
+}
+
+// cdrKey returns the dbCdrBucket key of cdr; the ids (unix nanos, base36) sort by time
+func cdrKey(cdr *CallDetailRecord) string {
+	return cdr.CalleeID+"|"+cdr.Id
+}
+
+func newCdr(calleeID string, caller *WsClient, calleeIp string, cause string) *CallDetailRecord {
+	timeNow := time.Now()
+	return &CallDetailRecord{
+		Id: strconv.FormatInt(timeNow.UnixNano(),36),
+		CalleeID: calleeID,
+		CallerID: caller.callerID,
+		CallerName: caller.callerName,
+		CalleeIp: calleeIp,
+		CallerIp: caller.RemoteAddrNoPort,
+		RingStart: timeNow.Unix(),
+		Cause: cause,
+		turnUsername: caller.turnUsername,
+	}
+}
+
+// cdrStart is called when the callerOffer of caller c has been forwarded to the callee
+func (h *Hub) cdrStart(c *WsClient) {
+	if h.CalleeClient==nil {
+		return
+	}
+	cdr := newCdr(h.CalleeClient.calleeID, c, h.CalleeClient.RemoteAddrNoPort, "")
+	h.cdrMutex.Lock()
+	prevCdr := h.cdr
+	h.cdr = cdr
+	h.cdrMutex.Unlock()
+	if prevCdr!=nil {
+		// should not happen: the previous call attempt was not ended
+		prevCdr.End = cdr.RingStart
+		prevCdr.Cause = "superseded"
+		cdrStore(prevCdr)
+	}
+}
+
+// cdrPickup is called when the callee has picked up the call
+func (h *Hub) cdrPickup() {
+	h.cdrMutex.Lock()
+	if h.cdr!=nil && h.cdr.Pickup==0 {
+		h.cdr.Pickup = time.Now().Unix()
+		h.cdr.RingSecs = h.cdr.Pickup - h.cdr.RingStart
+	}
+	h.cdrMutex.Unlock()
+}
+
+// cdrEnd stores the CDR of the current call attempt (if there is one)
+// it must be called before h.LocalP2p and h.RemoteP2p are cleared
+func (h *Hub) cdrEnd(cause string) {
+	h.cdrMutex.Lock()
+	cdr := h.cdr
+	h.cdr = nil
+	h.cdrMutex.Unlock()
+	if cdr==nil {
+		return
+	}
+	cdrFinish(cdr, cause, h.LocalP2p, h.RemoteP2p)
+}
+
+// cdrFinish sets the end time and cause of a call attempt and stores it
+func cdrFinish(cdr *CallDetailRecord, cause string, localP2p bool, remoteP2p bool) {
+	cdr.End = time.Now().Unix()
+	if cdr.Pickup>0 {
+		cdr.TalkSecs = cdr.End - cdr.Pickup
+		cdr.LocalP2p = localP2p
+		cdr.RemoteP2p = remoteP2p
+	} else {
+		cdr.RingSecs = cdr.End - cdr.RingStart
+	}
+	cdr.Cause = cause
+	cdr.RelayBytes = turnRelayBytes(cdr.turnUsername)
+	cdrStore(cdr)
+}
+
+// cdrRejected stores the CDR of a call attempt that was rejected before ringing
+func cdrRejected(calleeID string, caller *WsClient, cause string) {
+	cdr := newCdr(calleeID, caller, "", cause)
+	cdr.End = cdr.RingStart
+	cdrStore(cdr)
+}
+
+func cdrStore(cdr *CallDetailRecord) {
+	err := kvCalls.Put(dbCdrBucket, cdrKey(cdr), cdr, false)
+	if err!=nil {
+		logError("cdrStore put", "calleeID",cdr.CalleeID, "err",err)
+		return
+	}
+	logDebug("cdr", "cdrStore", "calleeID",cdr.CalleeID, "callerID",cdr.CallerID,
+		"ringSecs",cdr.RingSecs, "talkSecs",cdr.TalkSecs, "cause",cdr.Cause)
+}
+
+// cdrCleanup is called by ticker3hours to remove the records older than cdrMaxDays
+// and the oldest records beyond cdrMaxPerCallee
+func cdrCleanup() {
+	readConfigLock.RLock()
+	maxPerCallee := cdrMaxPerCallee
+	maxDays := cdrMaxDays
+	readConfigLock.RUnlock()
+
+	var minRingStart int64
+	if maxDays>0 {
+		minRingStart = time.Now().Unix() - int64(maxDays)*24*60*60
+	}
+	var deleteKeys []string
+	calleeKeys := make(map[string][]string) // in key order, so the oldest record comes first
+	err := kvCalls.ForEach(dbCdrBucket, func(key string, value skv.Value) error {
+		var cdr CallDetailRecord
+		if err := value.Decode(&cdr); err!=nil {
+			logError("cdrCleanup decode", "key",key, "err",err)
+			return nil
+		}
+		if cdr.RingStart < minRingStart {
+			deleteKeys = append(deleteKeys, key)
+		} else {
+			calleeKeys[cdr.CalleeID] = append(calleeKeys[cdr.CalleeID], key)
+		}
+		return nil
+	})
+	if err!=nil {
+		logError("cdrCleanup", "err",err)
+		return
+	}
+	for _,keys := range calleeKeys {
+		if maxPerCallee>0 && len(keys) > maxPerCallee {
+			deleteKeys = append(deleteKeys, keys[:len(keys)-maxPerCallee]...)
+		}
+	}
+	for _,key := range deleteKeys {
+		err = kvCalls.Delete(dbCdrBucket, key)
+		if err!=nil {
+			logError("cdrCleanup delete", "key",key, "err",err)
+		}
+	}
+	logDebug("timer", "cdrCleanup", "deleted",len(deleteKeys))
+}
+
+// cdrQuery returns the CDRs of calleeID (or of all callees if calleeID is empty)
+// with a ring start in the range from..to (unix secs, 0 = open)
+func cdrQuery(calleeID string, from int64, to int64) ([]CallDetailRecord, error) {
+	result := []CallDetailRecord{}
+	collect := func(key string, value skv.Value) error {
+		var cdr CallDetailRecord
+		if err := value.Decode(&cdr); err!=nil {
+			return err
+		}
+		if (from<=0 || cdr.RingStart>=from) && (to<=0 || cdr.RingStart<=to) {
+			result = append(result, cdr)
+		}
+		return nil
+	}
+	if calleeID!="" {
+		err := kvCalls.ForEachPrefix(dbCdrBucket, calleeID+"|", collect)
+		return result, err
+	}
+	err := kvCalls.ForEach(dbCdrBucket, collect)
+	return result, err
+}
+
+// cdrQueryArgs evaluates the url args from and to
+func cdrQueryArgs(r *http.Request) (int64, int64) {
+	from,_ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	to,_ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+	return from, to
+}
+
+// cdrWrite sends cdrSlice as json (default) or csv (url arg format=csv)
+func cdrWrite(w http.ResponseWriter, r *http.Request, cdrSlice []CallDetailRecord) error {
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.ToLower(r.URL.Query().Get("format"))=="csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="cdr.csv"`)
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write(cdrCsvHeader)
+		for idx := range cdrSlice {
+			csvWriter.Write(cdrSlice[idx].csvRecord())
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(cdrSlice)
+}
+
+// httpGetCdr serves "/rtcsig/cdr" (the CDRs of the logged in callee)
+func httpGetCdr(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if calleeID=="" {
+		logWarn("/cdr calleeID empty", "urlID",urlID, "rip",remoteAddr)
+		return
+	}
+	if cookie==nil {
+		logWarn("/cdr fail no cookie", "calleeID",calleeID, "rip",remoteAddr)
+		return
+	}
+	// if calleeID!=urlID, that's likely someone trying to run more than one callee in the same browser
+	if urlID!="" && urlID!=calleeID {
+		logWarn("/cdr urlID != calleeID", "urlID",urlID, "calleeID",calleeID, "rip",remoteAddr)
+		return
+	}
+	from,to := cdrQueryArgs(r)
+	cdrSlice,err := cdrQuery(calleeID, from, to)
+	if err!=nil {
+		logError("/cdr query", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		return
+	}
+	err = cdrWrite(w, r, cdrSlice)
+	if err!=nil {
+		logError("/cdr write", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+	}
+}
+
+// apiGetCdr serves GET "/api/v1/cdr"
+func apiGetCdr(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	from,to := cdrQueryArgs(r)
+	cdrSlice,err := cdrQuery(calleeID, from, to)
+	if err!=nil {
+		logError("/api/v1/cdr query", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	err = cdrWrite(w, r, cdrSlice)
+	if err!=nil {
+		logError("/api/v1/cdr write", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+	}
+}
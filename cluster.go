@@ -0,0 +1,561 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Cluster mode lets several webcall nodes share one set of callees.
+// It is enabled by setting clusterNodeID (unique per node), clusterNodeUrl
+// (the http base url under which the other nodes can reach this node) and
+// clusterSecret (same on all nodes) in config.ini. All nodes must use
+// dbBackend=sql with the same dbSqlSource, so that they also share
+// registrations, contacts, missed calls, etc.
+//
+// Each node keeps its own callees in the local hubMap (see skvLayer.go).
+// In addition, the state of every local hub (ws urls, wsClientID,
+// ConnectedCallerIp, hidden flags) is published to kvCluster. dbLayer.go
+// consults kvCluster for callees that are not found locally and hands them
+// out as globHub. Since /online returns the ws url of the node that hosts the
+// callee, callers always connect to that node directly. The few signaling
+// events that originate on another node (waitingCallers, pickup of a waiting
+// caller, caller ip and hidden state changes) are forwarded to the hosting
+// node via http POST /cluster/.
+//
+// Entries of a node that stops publishing are ignored after clusterStaleSecs,
+// so after a crash (or during a rolling restart) the callees of that node
+// simply log in again on one of the other nodes.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"crypto/subtle"
+	"sync/atomic"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+var	kvCluster skv.KV
+const dbClusterName = "rtccluster.db"
+const dbClusterHubs = "clusterHubs"           // calleeID -> map[globalID]ClusterHub
+const dbClusterCallerIps = "clusterCallerIps" // callerIp (no port) -> ClusterCallerIp
+const dbClusterNodes = "clusterNodes"         // nodeID -> ClusterNode
+
+const clusterStaleSecs = 90
+const clusterSyncSecs = 30
+
+type ClusterHub struct {
+	GlobalID string
+	NodeID string
+	WsUrl string
+	WssUrl string
+	WsClientID uint64
+	ConnectedCallerIp string
+	IsCalleeHidden bool
+	IsUnHiddenForCallerAddr string
+	Updated int64
+}
+
+type ClusterCallerIp struct {
+	GlobalID string
+	CalleeID string
+	NodeID string
+	Updated int64
+}
+
+type ClusterNode struct {
+	NodeUrl string
+	Updated int64
+}
+
+// clusterSyncChan receives globalIDs of local hubs whose state has changed
+var clusterSyncChan chan string
+var clusterHubCount int64 // number of callees online on all nodes (updated by clusterTicker)
+var clusterHttpClient = &http.Client{Timeout: 5 * time.Second}
+
+func isClusterMode() bool {
+	return kvCluster != nil
+}
+
+// clusterInit is called once on startup, after the other db's have been opened
+func clusterInit() error {
+	if clusterNodeID=="" {
+		return nil
+	}
+	if dbBackend!="sql" {
+		return errors.New("cluster mode requires dbBackend=sql")
+	}
+	if clusterNodeUrl=="" || clusterSecret=="" {
+		return errors.New("cluster mode requires clusterNodeUrl and clusterSecret")
+	}
+	kv,err := dbOpen(dbClusterName)
+	if err!=nil {
+		return err
+	}
+	for _,bucketName := range []string{dbClusterHubs, dbClusterCallerIps, dbClusterNodes} {
+		err = kv.CreateBucket(bucketName)
+		if err!=nil {
+			kv.Close()
+			return err
+		}
+	}
+	kvCluster = kv
+
+	// entries of this node from a previous run are outdated
+	clusterRemoveNode()
+	err = kvCluster.Put(dbClusterNodes, clusterNodeID,
+		ClusterNode{clusterNodeUrl, time.Now().Unix()}, false)
+	if err!=nil {
+		return err
+	}
+
+	clusterSyncChan = make(chan string, 1000)
+	go func() {
+		for globalID := range clusterSyncChan {
+			clusterSyncHub(globalID)
+		}
+	}()
+	go clusterTicker()
+	logInfo("cluster started", "node",clusterNodeID, "url",clusterNodeUrl)
+	return nil
+}
+
+// clusterShutdown removes all entries of this node, so that the other nodes
+// don't need to wait for clusterStaleSecs
+func clusterShutdown() {
+	if !isClusterMode() {
+		return
+	}
+	clusterRemoveNode()
+	err := kvCluster.Close()
+	if err!=nil {
+		logError("cluster db close", "db",dbClusterName, "err",err)
+	}
+}
+
+// clusterNotify schedules the local hub globalID to be (re-)published
+func clusterNotify(globalID string) {
+	if !isClusterMode() || globalID=="" {
+		return
+	}
+	select {
+	case clusterSyncChan <- globalID:
+	default:
+		// chan is full; clusterTicker will catch up
+		logWarn("clusterNotify sync chan full", "globalID",globalID)
+	}
+}
+
+func clusterCalleeID(globalID string) string {
+	if idx := strings.Index(globalID,"!"); idx>=0 {
+		return globalID[:idx]
+	}
+	return globalID
+}
+
+func clusterWsUrls() (string,string) {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	myWsUrl := wsUrl
+	if myWsUrl=="" {
+		myWsUrl = fmt.Sprintf("ws://%s:%d/ws", hostname, wsPort)
+	}
+	myWssUrl := wssUrl
+	if myWssUrl=="" {
+		myWssUrl = fmt.Sprintf("wss://%s:%d/ws", hostname, wssPort)
+	}
+	return myWsUrl, myWssUrl
+}
+
+// clusterSyncHub writes the current state of the local hub globalID to kvCluster
+// or removes it from kvCluster, if globalID is not in the local hubMap anymore
+func clusterSyncHub(globalID string) {
+	var clusterHub *ClusterHub
+	hubMapMutex.RLock()
+	hub,ok := hubMap[globalID]
+	if ok && hub!=nil && hub.CalleeLogin.Get() {
+		myWsUrl, myWssUrl := clusterWsUrls()
+		clusterHub = &ClusterHub{globalID, clusterNodeID, myWsUrl, myWssUrl, hub.WsClientID,
+			hub.ConnectedCallerIp, hub.IsCalleeHidden, hub.IsUnHiddenForCallerAddr, time.Now().Unix()}
+	}
+	hubMapMutex.RUnlock()
+
+	calleeID := clusterCalleeID(globalID)
+	err := kvCluster.Update(func(tx skv.Tx) error {
+		var hubs map[string]ClusterHub
+		err := tx.Get(dbClusterHubs, calleeID, &hubs)
+		if err!=nil {
+			hubs = make(map[string]ClusterHub)
+		}
+		oldCallerIp := ""
+		if oldHub,ok := hubs[globalID]; ok {
+			oldCallerIp = ipNoPort(oldHub.ConnectedCallerIp)
+		}
+		newCallerIp := ""
+		if clusterHub!=nil {
+			newCallerIp = ipNoPort(clusterHub.ConnectedCallerIp)
+			hubs[globalID] = *clusterHub
+		} else {
+			delete(hubs,globalID)
+		}
+
+		if oldCallerIp!="" && oldCallerIp!=newCallerIp {
+			var callerIpEntry ClusterCallerIp
+			if tx.Get(dbClusterCallerIps, oldCallerIp, &callerIpEntry)==nil &&
+					callerIpEntry.GlobalID==globalID {
+				tx.Delete(dbClusterCallerIps, oldCallerIp)
+			}
+		}
+		if newCallerIp!="" {
+			err = tx.Put(dbClusterCallerIps, newCallerIp,
+				ClusterCallerIp{globalID, calleeID, clusterNodeID, time.Now().Unix()})
+			if err!=nil {
+				return err
+			}
+		}
+
+		if len(hubs)==0 {
+			err = tx.Delete(dbClusterHubs, calleeID)
+			if err==skv.ErrNotFound {
+				err = nil
+			}
+			return err
+		}
+		return tx.Put(dbClusterHubs, calleeID, hubs)
+	})
+	if err!=nil {
+		logError("clusterSyncHub", "globalID",globalID, "err",err)
+	} else {
+		logDebug("cluster", "clusterSyncHub", "globalID",globalID, "online",clusterHub!=nil)
+	}
+}
+
+// clusterRemoveNode removes all hubs and caller ip's published by this node
+func clusterRemoveNode() {
+	err := kvCluster.Update(func(tx skv.Tx) error {
+		err := tx.ForEach(dbClusterHubs, func(calleeID string, v skv.Value) error {
+			var hubs map[string]ClusterHub
+			if v.Decode(&hubs)!=nil {
+				return tx.Delete(dbClusterHubs, calleeID)
+			}
+			changed := false
+			for globalID,clusterHub := range hubs {
+				if clusterHub.NodeID==clusterNodeID {
+					delete(hubs,globalID)
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+			if len(hubs)==0 {
+				return tx.Delete(dbClusterHubs, calleeID)
+			}
+			return tx.Put(dbClusterHubs, calleeID, hubs)
+		})
+		if err!=nil {
+			return err
+		}
+		err = tx.ForEach(dbClusterCallerIps, func(callerIp string, v skv.Value) error {
+			var callerIpEntry ClusterCallerIp
+			if v.Decode(&callerIpEntry)!=nil || callerIpEntry.NodeID==clusterNodeID {
+				return tx.Delete(dbClusterCallerIps, callerIp)
+			}
+			return nil
+		})
+		if err!=nil {
+			return err
+		}
+		err = tx.Delete(dbClusterNodes, clusterNodeID)
+		if err==skv.ErrNotFound {
+			err = nil
+		}
+		return err
+	})
+	if err!=nil {
+		logError("clusterRemoveNode", "node",clusterNodeID, "err",err)
+	}
+}
+
+// clusterTicker keeps the entries of this node from becoming stale,
+// removes entries of nodes that have gone away and counts all online callees
+func clusterTicker() {
+	ticker := time.NewTicker(clusterSyncSecs * time.Second)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if shutdownStarted.Get() {
+			break
+		}
+		err := kvCluster.Put(dbClusterNodes, clusterNodeID,
+			ClusterNode{clusterNodeUrl, time.Now().Unix()}, false)
+		if err!=nil {
+			logError("clusterTicker node heartbeat", "node",clusterNodeID, "err",err)
+		}
+
+		var localIDs []string
+		hubMapMutex.RLock()
+		for globalID := range hubMap {
+			localIDs = append(localIDs, globalID)
+		}
+		hubMapMutex.RUnlock()
+		for _,globalID := range localIDs {
+			clusterSyncHub(globalID)
+		}
+
+		// remove stale entries of all nodes (incl. entries of this node that are gone from hubMap)
+		nowUnix := time.Now().Unix()
+		var hubCount int64
+		err = kvCluster.Update(func(tx skv.Tx) error {
+			err := tx.ForEach(dbClusterHubs, func(calleeID string, v skv.Value) error {
+				var hubs map[string]ClusterHub
+				if v.Decode(&hubs)!=nil {
+					return tx.Delete(dbClusterHubs, calleeID)
+				}
+				changed := false
+				for globalID,clusterHub := range hubs {
+					if nowUnix - clusterHub.Updated > clusterStaleSecs {
+						delete(hubs,globalID)
+						changed = true
+					}
+				}
+				hubCount += int64(len(hubs))
+				if !changed {
+					return nil
+				}
+				if len(hubs)==0 {
+					return tx.Delete(dbClusterHubs, calleeID)
+				}
+				return tx.Put(dbClusterHubs, calleeID, hubs)
+			})
+			if err!=nil {
+				return err
+			}
+			err = tx.ForEach(dbClusterCallerIps, func(callerIp string, v skv.Value) error {
+				var callerIpEntry ClusterCallerIp
+				if v.Decode(&callerIpEntry)!=nil || nowUnix - callerIpEntry.Updated > clusterStaleSecs {
+					return tx.Delete(dbClusterCallerIps, callerIp)
+				}
+				return nil
+			})
+			if err!=nil {
+				return err
+			}
+			return tx.ForEach(dbClusterNodes, func(nodeID string, v skv.Value) error {
+				var clusterNode ClusterNode
+				if v.Decode(&clusterNode)!=nil || nowUnix - clusterNode.Updated > clusterStaleSecs {
+					logInfo("clusterTicker remove stale node", "node",nodeID)
+					return tx.Delete(dbClusterNodes, nodeID)
+				}
+				return nil
+			})
+		})
+		if err!=nil {
+			logError("clusterTicker cleanup", "node",clusterNodeID, "err",err)
+		} else {
+			atomic.StoreInt64(&clusterHubCount, hubCount)
+		}
+		logDebug("cluster", "clusterTicker", "node",clusterNodeID, "local",len(localIDs), "global",hubCount)
+	}
+}
+
+// clusterGetOnlineCallee looks for calleeID on the other nodes
+// it evaluates the hub flags in the same way as locGetOnlineCallee()
+// the returned Hub is a read-only copy of the remote hub state
+func clusterGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string) (string,*Hub,error) {
+	var hubs map[string]ClusterHub
+	err := kvCluster.Get(dbClusterHubs, calleeID, &hubs)
+	if err==skv.ErrNotFound {
+		return "", nil, nil
+	} else if err!=nil {
+		return "", nil, err
+	}
+	nowUnix := time.Now().Unix()
+	for key,clusterHub := range hubs {
+		if clusterHub.NodeID==clusterNodeID || nowUnix - clusterHub.Updated > clusterStaleSecs {
+			// local hubs are handled by locGetOnlineCallee(); stale hubs are ignored
+			continue
+		}
+		hub := &Hub{
+			ConnectedCallerIp: clusterHub.ConnectedCallerIp,
+			IsCalleeHidden: clusterHub.IsCalleeHidden,
+			IsUnHiddenForCallerAddr: clusterHub.IsUnHiddenForCallerAddr,
+			WsUrl: clusterHub.WsUrl,
+			WssUrl: clusterHub.WssUrl,
+			WsClientID: clusterHub.WsClientID,
+		}
+		logDebug("searchhub", "clusterGetOnlineCallee found", "calleeID",calleeID, "key",key,
+			"node",clusterHub.NodeID, "callerIP",hub.ConnectedCallerIp, "hidden",hub.IsCalleeHidden)
+		if hub.ConnectedCallerIp!="" && hub.ConnectedCallerIp!=callerIpAddr {
+			if ejectOn1stFound {
+				if reportBusyCallee {
+					return key, hub, nil
+				}
+				return "", nil, nil
+			}
+			continue
+		}
+		if !hub.IsCalleeHidden || reportHiddenCallee {
+			return key, hub, nil
+		}
+		if hub.IsUnHiddenForCallerAddr!="" && callerIpAddr == hub.IsUnHiddenForCallerAddr {
+			return key, hub, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// clusterSearchCallerIp returns the calleeID that is in a call with callerIp on any node
+func clusterSearchCallerIp(callerIp string) (bool,string,error) {
+	var callerIpEntry ClusterCallerIp
+	err := kvCluster.Get(dbClusterCallerIps, ipNoPort(callerIp), &callerIpEntry)
+	if err==skv.ErrNotFound {
+		return false, "", nil
+	} else if err!=nil {
+		return false, "", err
+	}
+	if time.Now().Unix() - callerIpEntry.Updated > clusterStaleSecs {
+		return false, "", nil
+	}
+	return true, callerIpEntry.CalleeID, nil
+}
+
+// clusterIsOnline returns true if calleeID is online on any node of the cluster (this one included)
+func clusterIsOnline(calleeID string) bool {
+	var hubs map[string]ClusterHub
+	return kvCluster.Get(dbClusterHubs, calleeID, &hubs)==nil && len(hubs)>0
+}
+
+// clusterNodeUrlOf returns the url of the node hosting globalID
+func clusterNodeUrlOf(globalID string) (string,error) {
+	var hubs map[string]ClusterHub
+	err := kvCluster.Get(dbClusterHubs, clusterCalleeID(globalID), &hubs)
+	if err!=nil {
+		return "", err
+	}
+	clusterHub,ok := hubs[globalID]
+	if !ok {
+		return "", skv.ErrNotFound
+	}
+	if clusterHub.NodeID==clusterNodeID {
+		return "", errors.New("hub is local")
+	}
+	var clusterNode ClusterNode
+	err = kvCluster.Get(dbClusterNodes, clusterHub.NodeID, &clusterNode)
+	if err!=nil {
+		return "", err
+	}
+	return clusterNode.NodeUrl, nil
+}
+
+// clusterForward sends a command to the node hosting globalID
+// for cmd and arg see httpClusterHandler()
+func clusterForward(globalID string, cmd string, arg string) error {
+	if !isClusterMode() {
+		return skv.ErrNotFound
+	}
+	nodeUrl,err := clusterNodeUrlOf(globalID)
+	if err!=nil {
+		return err
+	}
+	return clusterPost(nodeUrl, cmd, globalID, arg)
+}
+
+// clusterBroadcast sends a command to all other nodes
+// it is used when we don't know which node is responsible
+func clusterBroadcast(cmd string, arg string) {
+	if !isClusterMode() {
+		return
+	}
+	var nodeUrls []string
+	err := kvCluster.ForEach(dbClusterNodes, func(nodeID string, v skv.Value) error {
+		var clusterNode ClusterNode
+		if nodeID!=clusterNodeID && v.Decode(&clusterNode)==nil {
+			nodeUrls = append(nodeUrls, clusterNode.NodeUrl)
+		}
+		return nil
+	})
+	if err!=nil {
+		logError("clusterBroadcast", "cmd",cmd, "err",err)
+		return
+	}
+	for _,nodeUrl := range nodeUrls {
+		go func(nodeUrl string) {
+			err := clusterPost(nodeUrl, cmd, "", arg)
+			if err!=nil {
+				logWarn("clusterBroadcast", "cmd",cmd, "url",nodeUrl, "err",err)
+			}
+		}(nodeUrl)
+	}
+}
+
+func clusterPost(nodeUrl string, cmd string, globalID string, arg string) error {
+	form := url.Values{}
+	form.Set("id", globalID)
+	form.Set("arg", arg)
+	req,err := http.NewRequest("POST", strings.TrimSuffix(nodeUrl,"/")+"/cluster/"+cmd,
+		strings.NewReader(form.Encode()))
+	if err!=nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Cluster-Secret", clusterSecret)
+	req.Header.Set("X-Cluster-Node", clusterNodeID)
+	resp,err := clusterHttpClient.Do(req)
+	if err!=nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body,_ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode!=http.StatusOK {
+		return fmt.Errorf("status=%d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// httpClusterHandler receives the commands sent by clusterForward() and clusterBroadcast()
+//   /cluster/callerip  id=globalID arg=callerIp   -> StoreCallerIpInHubMap()
+//   /cluster/hidden    id=globalID arg=true|false -> SetCalleeHiddenState()
+//   /cluster/unhidden  id=globalID arg=callerIp   -> SetUnHiddenForCaller()
+//   /cluster/send      id=globalID arg=message    -> write message to the callee client
+//   /cluster/pickup    arg=callerAddrPort         -> wake up a waiting caller (see httpNotifyCallee)
+func httpClusterHandler(w http.ResponseWriter, r *http.Request) {
+	if !isClusterMode() ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Cluster-Secret")), []byte(clusterSecret))!=1 {
+		logWarn("httpCluster denied", "path",r.URL.Path, "rip",r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	cmd := strings.TrimPrefix(r.URL.Path, "/cluster/")
+	globalID := r.PostFormValue("id")
+	arg := r.PostFormValue("arg")
+	logDebug("cluster", "httpCluster", "cmd",cmd, "globalID",globalID, "node",r.Header.Get("X-Cluster-Node"))
+
+	var err error
+	switch cmd {
+	case "callerip":
+		err = locStoreCallerIpInHubMap(globalID, arg, false)
+		clusterNotify(globalID)
+	case "hidden":
+		err = locSetCalleeHiddenState(globalID, arg=="true")
+		clusterNotify(globalID)
+	case "unhidden":
+		err = locSetUnHiddenForCaller(globalID, arg)
+		clusterNotify(globalID)
+	case "send":
+		err = locSendToCallee(globalID, []byte(arg))
+	case "pickup":
+		if !locPickupWaitingCaller(arg) {
+			err = skv.ErrNotFound
+		}
+	default:
+		http.Error(w, "unknown cmd", http.StatusBadRequest)
+		return
+	}
+	if err!=nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
@@ -0,0 +1,64 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for the X-Cluster-Secret check of the /cluster/ handler
+package main
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestClusterHandlerSecret(t *testing.T) {
+	kvCluster = testMemKV(t, dbClusterHubs, dbClusterCallerIps, dbClusterNodes)
+	defer func() { kvCluster = nil }()
+	clusterSecret = "secret123"
+	defer func() { clusterSecret = "" }()
+	waitingCallerChanLock.Lock()
+	waitingCallerChanMap = make(map[string]chan int)
+	c := make(chan int, 1)
+	waitingCallerChanMap["127.0.0.1:5000"] = c
+	waitingCallerChanLock.Unlock()
+
+	for _,test := range []struct {
+		secret string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"secret124", http.StatusForbidden},
+		{"secret12", http.StatusForbidden},
+		{"secret123", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/cluster/pickup", strings.NewReader("arg=127.0.0.1:5000"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.secret!="" {
+			r.Header.Set("X-Cluster-Secret", test.secret)
+		}
+		httpClusterHandler(w, r)
+		if w.Code!=test.status {
+			t.Fatalf("secret=%q status=%d %s, want %d", test.secret, w.Code, w.Body.String(), test.status)
+		}
+		select {
+		case <-c:
+			if test.status!=http.StatusOK {
+				t.Fatalf("secret=%q: waiting caller picked up", test.secret)
+			}
+		default:
+			if test.status==http.StatusOK {
+				t.Fatalf("secret=%q: waiting caller not picked up", test.secret)
+			}
+		}
+	}
+
+	// without cluster mode every request is denied, even with the right secret
+	kvCluster = nil
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/cluster/pickup", strings.NewReader("arg=127.0.0.1:5000"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Cluster-Secret", "secret123")
+	httpClusterHandler(w, r)
+	if w.Code!=http.StatusForbidden {
+		t.Fatalf("no cluster mode: status=%d, want %d", w.Code, http.StatusForbidden)
+	}
+}
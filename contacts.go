@@ -0,0 +1,545 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Structured contacts of a callee.
+// kvContacts/dbContactRecordsBucket: calleeID -> map[contactID]Contact
+// contactID is the callerID of the contact; "@host" is cut off for the local server.
+// The legacy dbContactsBucket (calleeID -> map[contactID]"contactName|callerId|callerName")
+// is migrated into Contact records on startup (contactsMigrateAll) and on first access
+// (contactsLoad). The /rtcsig getcontacts, getcontact and setcontact requests still
+// deliver and accept the compound name format (see Contact.compoundName).
+// Ring policies per contact:
+//   ""/"ring" - ring as usual
+//   "silent"  - no push notifications for this contact (a missed call is stored)
+//   "reject"  - /online reports "notavail" to this contact
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/contacts?q=&group=&favorite=" -> [Contact,..]
+//   POST "/api/v1/contacts" Contact -> Contact
+//   GET|POST "/api/v1/contacts?format=vcard|csv" export, import (see contactsIO.go)
+//   GET|PUT|DELETE "/api/v1/contacts/{id}"
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbContactRecordsBucket = "contactrecords" // in kvContacts: calleeID -> map[contactID]Contact
+
+var contactRingPolicies = []string{"ring", "silent", "reject"}
+
+var errContactUnchanged = errors.New("contact unchanged")
+
+// contactsMutex serializes read-modify-write of the contacts of all callees
+var contactsMutex sync.Mutex
+
+type Contact struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	RemoteIDs []string `json:"remoteIds,omitempty"`   // more ids of this contact, "id@host"
+	CallerID string `json:"callerId,omitempty"`     // own id to call back with
+	CallerName string `json:"callerName,omitempty"` // own nickname to use when calling this contact
+	Notes string `json:"notes,omitempty"`
+	Favorite bool `json:"favorite"`
+	Groups []string `json:"groups,omitempty"`
+	RingPolicy string `json:"ringPolicy,omitempty"`
+	Created int64 `json:"created"`
+	LastCalled int64 `json:"lastCalled,omitempty"`
+}
+
+// ApiContactUpdate is the body of PUT "/api/v1/contacts/{id}"; omitted fields keep their value
+type ApiContactUpdate struct {
+	Name *string `json:"name"`
+	RemoteIDs *[]string `json:"remoteIds"`
+	CallerID *string `json:"callerId"`
+	CallerName *string `json:"callerName"`
+	Notes *string `json:"notes"`
+	Favorite *bool `json:"favorite"`
+	Groups *[]string `json:"groups"`
+	RingPolicy *string `json:"ringPolicy"`
+}
+
+// contactFromCompound creates a Contact from a legacy "contactName|callerId|callerName" value
+func contactFromCompound(contactID string, compoundName string) Contact {
+	contact := Contact{ID:contactID}
+	tokenSlice := strings.Split(compoundName, "|")
+	for idx, tok := range tokenSlice {
+		switch idx {
+			case 0: contact.Name = tok
+			case 1: contact.CallerID = tok
+			case 2: contact.CallerName = tok
+		}
+	}
+	return contact
+}
+
+// compoundName returns the contact in the format used by the callee client
+func (contact Contact) compoundName() string {
+	return contact.Name+"|"+contact.CallerID+"|"+contact.CallerName
+}
+
+// contactLocalID cuts off "@host" from contactID if host is the local server
+func contactLocalID(contactID string) string {
+	if idxAt := strings.Index(contactID,"@"+hostname); idxAt>=0 {
+		return contactID[:idxAt]
+	}
+	return contactID
+}
+
+// contactFind returns the key under which contactID is stored in contacts
+// like setContact always did, it also tries the lowercase and the capitalized contactID
+func contactFind(contacts map[string]Contact, contactID string) (string, bool) {
+	if contactID=="" {
+		return "", false
+	}
+	for _,id := range []string{contactID, strings.ToLower(contactID),
+			strings.ToUpper(contactID[0:1])+contactID[1:]} {
+		if _,ok := contacts[id]; ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// contactsLoad returns the contacts of calleeID (never nil)
+// legacy contacts found in dbContactsBucket are converted and stored in dbContactRecordsBucket
+func contactsLoad(calleeID string) (map[string]Contact, error) {
+	var contacts map[string]Contact
+	err := kvContacts.Get(dbContactRecordsBucket, calleeID, &contacts)
+	if err==nil {
+		if contacts==nil {
+			contacts = make(map[string]Contact)
+		}
+		for id,contact := range contacts {
+			contact.ID = id
+			contacts[id] = contact
+		}
+		return contacts, nil
+	}
+	if err!=skv.ErrNotFound {
+		return nil, err
+	}
+	contacts = make(map[string]Contact)
+	var idNameMap map[string]string // legacy: callerID -> compoundName
+	err = kvContacts.Get(dbContactsBucket, calleeID, &idNameMap)
+	if err==skv.ErrNotFound {
+		return contacts, nil
+	}
+	if err!=nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for id,compoundName := range idNameMap {
+		contact := contactFromCompound(id, compoundName)
+		contact.Created = now
+		contacts[id] = contact
+	}
+	err = kvContacts.Put(dbContactRecordsBucket, calleeID, contacts, false)
+	if err!=nil {
+		return nil, err
+	}
+	err = kvContacts.Delete(dbContactsBucket, calleeID)
+	if err!=nil {
+		logWarn("contacts delete legacy entry", "calleeID",calleeID, "err",err)
+	}
+	logInfo("contacts migrated", "calleeID",calleeID, "count",len(contacts))
+	return contacts, nil
+}
+
+// contactsMigrateAll converts all legacy contacts; called on startup
+func contactsMigrateAll() {
+	var calleeIDs []string
+	err := kvContacts.ForEach(dbContactsBucket, func(k string, _ skv.Value) error {
+		calleeIDs = append(calleeIDs, k)
+		return nil
+	})
+	if err!=nil {
+		logError("contacts migrate", "err",err)
+		return
+	}
+	contactsMutex.Lock()
+	defer contactsMutex.Unlock()
+	for _,calleeID := range calleeIDs {
+		if _,err = contactsLoad(calleeID); err!=nil {
+			logError("contacts migrate", "calleeID",calleeID, "err",err)
+		}
+	}
+}
+
+// contactsModify loads the contacts of calleeID, hands them to modify() and stores them
+// if modify() returns an error, nothing is stored
+func contactsModify(calleeID string, modify func(contacts map[string]Contact) error) error {
+	contactsMutex.Lock()
+	defer contactsMutex.Unlock()
+	contacts,err := contactsLoad(calleeID)
+	if err!=nil {
+		return err
+	}
+	err = modify(contacts)
+	if err!=nil {
+		return err
+	}
+	readConfigLock.RLock()
+	maxContacts := contactsMax
+	readConfigLock.RUnlock()
+	if maxContacts>0 && len(contacts) > maxContacts {
+		return fmt.Errorf("max %d contacts", maxContacts)
+	}
+	return kvContacts.Put(dbContactRecordsBucket, calleeID, contacts, false)
+}
+
+// contactsDelete removes all contacts of calleeID (legacy and records)
+func contactsDelete(calleeID string) error {
+	contactsMutex.Lock()
+	defer contactsMutex.Unlock()
+	err := kvContacts.Delete(dbContactsBucket, calleeID)
+	if err!=nil && err!=skv.ErrNotFound {
+		return err
+	}
+	err = kvContacts.Delete(dbContactRecordsBucket, calleeID)
+	if err!=nil && err!=skv.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// contactCheck validates and normalizes a contact before it is stored
+func contactCheck(contact *Contact) error {
+	contact.Name = strings.TrimSpace(contact.Name)
+	if contact.Name=="" {
+		contact.Name = "unknown"
+	}
+	// the callee client splits the compound name on '|'
+	if strings.Index(contact.Name+contact.CallerID+contact.CallerName,"|")>=0 {
+		return errors.New("name, callerId and callerName must not contain '|'")
+	}
+	if len(contact.Name)>100 || len(contact.CallerID)>100 || len(contact.CallerName)>100 {
+		return errors.New("name, callerId or callerName too long")
+	}
+	if len(contact.Notes)>2000 {
+		return errors.New("notes too long")
+	}
+	var remoteIDs []string
+	for _,id := range contact.RemoteIDs {
+		id = contactLocalID(strings.TrimSpace(id))
+		if id=="" {
+			continue
+		}
+		if len(id)>200 || strings.IndexAny(id," |,")>=0 {
+			return errors.New("invalid remote id "+id)
+		}
+		remoteIDs = append(remoteIDs, id)
+	}
+	if len(remoteIDs)>20 {
+		return errors.New("too many remote ids")
+	}
+	contact.RemoteIDs = remoteIDs
+	var groups []string
+	for _,group := range contact.Groups {
+		group = strings.TrimSpace(group)
+		if group=="" {
+			continue
+		}
+		if len(group)>50 {
+			return errors.New("group name too long")
+		}
+		groups = append(groups, group)
+	}
+	if len(groups)>20 {
+		return errors.New("too many groups")
+	}
+	contact.Groups = groups
+	if contact.RingPolicy=="ring" {
+		contact.RingPolicy = ""
+	}
+	if contact.RingPolicy!="" {
+		known := false
+		for _,policy := range contactRingPolicies {
+			if contact.RingPolicy==policy {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("unknown ringPolicy "+contact.RingPolicy)
+		}
+	}
+	return nil
+}
+
+// contactGet returns the contact of calleeID matching contactID or any of its remote ids
+func contactGet(calleeID string, contactID string) (Contact, bool) {
+	contactID = contactLocalID(contactID)
+	contactsMutex.Lock()
+	contacts,err := contactsLoad(calleeID)
+	contactsMutex.Unlock()
+	if err!=nil {
+		logError("contacts load", "calleeID",calleeID, "err",err)
+		return Contact{}, false
+	}
+	if id,ok := contactFind(contacts, contactID); ok {
+		return contacts[id], true
+	}
+	for _,contact := range contacts {
+		for _,id := range contact.RemoteIDs {
+			if strings.EqualFold(id, contactID) {
+				return contact, true
+			}
+		}
+	}
+	return Contact{}, false
+}
+
+// contactRingPolicy returns the ring policy calleeID has set for callerID ("" if none)
+func contactRingPolicy(calleeID string, callerID string) string {
+	if calleeID=="" || callerID=="" {
+		return ""
+	}
+	contact,ok := contactGet(calleeID, callerID)
+	if !ok {
+		return ""
+	}
+	return contact.RingPolicy
+}
+
+// contactCalled sets LastCalled of an existing contact
+func contactCalled(calleeID string, callerID string) {
+	callerID = contactLocalID(callerID)
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		id,ok := contactFind(contacts, callerID)
+		if !ok {
+			return errContactUnchanged
+		}
+		contact := contacts[id]
+		contact.LastCalled = time.Now().Unix()
+		contacts[id] = contact
+		return nil
+	})
+	if err!=nil && err!=errContactUnchanged {
+		logError("contacts set lastCalled", "calleeID",calleeID, "callerID",callerID, "err",err)
+	}
+}
+
+// apiContacts serves GET "/api/v1/contacts?q=&group=&favorite=" and POST "/api/v1/contacts"
+// with url arg format, contacts are exported and imported (see contactsIO.go)
+func apiContacts(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	format := contactsFormat(r)
+	if r.Method=="POST" {
+		if format!="" {
+			apiImportContacts(w, r, calleeID, format, remoteAddr)
+		} else {
+			apiAddContact(w, r, calleeID, remoteAddr)
+		}
+		return
+	}
+	if format!="" {
+		apiExportContacts(w, r, calleeID, format, remoteAddr)
+		return
+	}
+	contactsMutex.Lock()
+	contacts,err := contactsLoad(calleeID)
+	contactsMutex.Unlock()
+	if err!=nil {
+		logError("/api/v1/contacts get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	group := r.URL.Query().Get("group")
+	favoritesOnly := r.URL.Query().Get("favorite")=="true"
+	list := []Contact{}
+	for _,contact := range contacts {
+		if favoritesOnly && !contact.Favorite {
+			continue
+		}
+		if query!="" && strings.Index(strings.ToLower(contact.ID+" "+contact.Name+" "+
+				strings.Join(contact.RemoteIDs," ")+" "+contact.Notes), query)<0 {
+			continue
+		}
+		if group!="" {
+			inGroup := false
+			for _,g := range contact.Groups {
+				if g==group {
+					inGroup = true
+					break
+				}
+			}
+			if !inGroup {
+				continue
+			}
+		}
+		list = append(list, contact)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	apiJson(w, http.StatusOK, list)
+}
+
+// apiAddContact creates a new contact; it fails if the contact id exists already
+func apiAddContact(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	var contact Contact
+	if !apiReadJson(w, r, &contact) {
+		return
+	}
+	if !apiContactsEnabled(w, calleeID) {
+		return
+	}
+	contact.ID = contactLocalID(strings.TrimSpace(contact.ID))
+	if contact.ID=="" || strings.IndexAny(contact.ID," |,")>=0 {
+		apiError(w, http.StatusBadRequest, "bad_request", "invalid contact id")
+		return
+	}
+	if err := contactCheck(&contact); err!=nil {
+		apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	exists := false
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		if _,ok := contactFind(contacts, contact.ID); ok {
+			exists = true
+			return errContactUnchanged
+		}
+		contact.Created = time.Now().Unix()
+		contact.LastCalled = 0
+		contacts[contact.ID] = contact
+		return nil
+	})
+	if exists {
+		apiError(w, http.StatusConflict, "contact_exists", "")
+		return
+	}
+	if err!=nil {
+		logWarn("/api/v1/contacts add fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if logWantedFor("contacts") {
+		logInfo("/api/v1/contacts add", "calleeID",calleeID, "contactID",contact.ID, "rip",remoteAddr)
+	}
+	apiJson(w, http.StatusCreated, contact)
+}
+
+// apiContact serves GET, PUT and DELETE "/api/v1/contacts/{id}"
+// PUT creates the contact if it does not exist yet
+func apiContact(w http.ResponseWriter, r *http.Request, calleeID string, contactID string, remoteAddr string) {
+	contactID = contactLocalID(contactID)
+	if contactID=="" {
+		apiError(w, http.StatusBadRequest, "bad_request", "contact id missing")
+		return
+	}
+
+	if r.Method=="GET" {
+		contactsMutex.Lock()
+		contacts,err := contactsLoad(calleeID)
+		contactsMutex.Unlock()
+		if err!=nil {
+			logError("/api/v1/contacts get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		id,ok := contactFind(contacts, contactID)
+		if !ok {
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		apiJson(w, http.StatusOK, contacts[id])
+		return
+	}
+
+	if r.Method=="DELETE" {
+		found := false
+		err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+			id,ok := contactFind(contacts, contactID)
+			if !ok {
+				return skv.ErrNotFound
+			}
+			found = true
+			delete(contacts, id)
+			return nil
+		})
+		if !found {
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		if err!=nil {
+			logError("/api/v1/contacts delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		if logWantedFor("contacts") {
+			logInfo("/api/v1/contacts delete", "calleeID",calleeID, "contactID",contactID, "rip",remoteAddr)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// PUT
+	var req ApiContactUpdate
+	if !apiReadJson(w, r, &req) {
+		return
+	}
+	if !apiContactsEnabled(w, calleeID) {
+		return
+	}
+	if strings.IndexAny(contactID," |,")>=0 {
+		apiError(w, http.StatusBadRequest, "bad_request", "invalid contact id")
+		return
+	}
+	var contact Contact
+	var checkErr error
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		id,ok := contactFind(contacts, contactID)
+		if ok {
+			contact = contacts[id]
+		} else {
+			id = contactID
+			contact = Contact{ID:id, Created:time.Now().Unix()}
+		}
+		if req.Name!=nil { contact.Name = *req.Name }
+		if req.RemoteIDs!=nil { contact.RemoteIDs = *req.RemoteIDs }
+		if req.CallerID!=nil { contact.CallerID = *req.CallerID }
+		if req.CallerName!=nil { contact.CallerName = *req.CallerName }
+		if req.Notes!=nil { contact.Notes = *req.Notes }
+		if req.Favorite!=nil { contact.Favorite = *req.Favorite }
+		if req.Groups!=nil { contact.Groups = *req.Groups }
+		if req.RingPolicy!=nil { contact.RingPolicy = *req.RingPolicy }
+		checkErr = contactCheck(&contact)
+		if checkErr!=nil {
+			return checkErr
+		}
+		contacts[id] = contact
+		return nil
+	})
+	if err!=nil {
+		if checkErr==nil {
+			logWarn("/api/v1/contacts put fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		}
+		apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if logWantedFor("contacts") {
+		logInfo("/api/v1/contacts put", "calleeID",calleeID, "contactID",contact.ID, "rip",remoteAddr)
+	}
+	apiJson(w, http.StatusOK, contact)
+}
+
+// apiContactsEnabled responds with an error and returns false if calleeID does not store contacts
+func apiContactsEnabled(w http.ResponseWriter, calleeID string) bool {
+	_,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil {
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return false
+	}
+	if !dbUser.StoreContacts {
+		apiError(w, http.StatusConflict, "contacts_disabled", "storeContacts is not enabled")
+		return false
+	}
+	return true
+}
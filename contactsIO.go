@@ -0,0 +1,486 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Bulk import and export of the contacts of a callee as vCard 4.0 or CSV.
+// vCard mapping:
+//   FN                   Contact.Name
+//   X-WEBCALL-ID         Contact.ID (first) and Contact.RemoteIDs, "id" or "id@host"
+//   IMPP                 "https://host/user/id" for every WebCall ID (import accepts these as well)
+//   NOTE                 Contact.Notes
+//   CATEGORIES           Contact.Groups
+//   X-WEBCALL-FAVORITE, X-WEBCALL-RINGPOLICY, X-WEBCALL-CALLERID, X-WEBCALL-CALLERNAME
+// CSV columns: see contactsCsvHeader; remoteIds and groups are separated by ';'
+// vCards and CSV rows without a WebCall ID are skipped on import.
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/contacts?format=vcard|csv" -> file
+//   POST "/api/v1/contacts?format=vcard|csv&mode=merge|replace" file -> ApiContactsImport
+// mode=merge (default) overwrites contacts with the same ID and keeps all others,
+// mode=replace removes all contacts not contained in the import.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const contactsImportMaxLen = 1024*1024
+
+var contactsCsvHeader = []string{"id","name","remoteIds","callerId","callerName","notes",
+	"favorite","groups","ringPolicy","created","lastCalled"}
+
+type ApiContactsImport struct {
+	Added int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+	Skipped int `json:"skipped"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (contact Contact) csvRecord() []string {
+	lastCalled := ""
+	if contact.LastCalled>0 {
+		lastCalled = strconv.FormatInt(contact.LastCalled,10)
+	}
+	return []string{contact.ID, contact.Name, strings.Join(contact.RemoteIDs,";"),
+		contact.CallerID, contact.CallerName, contact.Notes, strconv.FormatBool(contact.Favorite),
+		strings.Join(contact.Groups,";"), contact.RingPolicy,
+		strconv.FormatInt(contact.Created,10), lastCalled}
+}
+
+// contactsFormat returns "vcard", "csv" or "" for the url arg format
+func contactsFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+		case "vcard", "vcf": return "vcard"
+		case "csv": return "csv"
+	}
+	return ""
+}
+
+// vcardEscape escapes a vCard text value
+func vcardEscape(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\r\n", "\\n", -1)
+	value = strings.Replace(value, "\n", "\\n", -1)
+	value = strings.Replace(value, ",", "\\,", -1)
+	return strings.Replace(value, ";", "\\;", -1)
+}
+
+// vcardUnescape reverses vcardEscape
+func vcardUnescape(value string) string {
+	var sb strings.Builder
+	escaped := false
+	for _,c := range value {
+		if escaped {
+			if c=='n' || c=='N' {
+				sb.WriteRune('\n')
+			} else {
+				sb.WriteRune(c)
+			}
+			escaped = false
+		} else if c=='\\' {
+			escaped = true
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// vcardSplit splits a list value on unescaped commas
+func vcardSplit(value string) []string {
+	var list []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i]=='\\' {
+			i++
+		} else if value[i]==',' {
+			list = append(list, vcardUnescape(value[start:i]))
+			start = i+1
+		}
+	}
+	return append(list, vcardUnescape(value[start:]))
+}
+
+// vcardLine writes one content line, folded at 75 octets (without splitting utf-8 sequences)
+func vcardLine(buf *bytes.Buffer, line string) {
+	maxLen := 75
+	for len(line) > maxLen {
+		cut := maxLen
+		for cut>0 && line[cut]&0xC0==0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut]+"\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		maxLen = 74
+	}
+	buf.WriteString(line+"\r\n")
+}
+
+// contactImpp returns the call link of a WebCall ID
+func contactImpp(id string) string {
+	host := hostname
+	if idxAt := strings.Index(id,"@"); idxAt>=0 {
+		host = id[idxAt+1:]
+		id = id[:idxAt]
+	}
+	return "https://"+host+"/user/"+url.PathEscape(id)
+}
+
+// contactFromImpp returns the WebCall ID of a call link ("" if uri is not a call link)
+func contactFromImpp(uri string) string {
+	u,err := url.Parse(uri)
+	if err!=nil || (u.Scheme!="https" && u.Scheme!="http") || u.Hostname()=="" {
+		return ""
+	}
+	if !strings.HasPrefix(u.Path,"/user/") {
+		return ""
+	}
+	id := strings.TrimPrefix(u.Path,"/user/")
+	if id=="" || strings.Index(id,"/")>=0 {
+		return ""
+	}
+	return contactLocalID(id+"@"+u.Hostname())
+}
+
+// contactsVcard returns contacts as vCard 4.0
+func contactsVcard(contacts []Contact) []byte {
+	var buf bytes.Buffer
+	for _,contact := range contacts {
+		vcardLine(&buf, "BEGIN:VCARD")
+		vcardLine(&buf, "VERSION:4.0")
+		vcardLine(&buf, "FN:"+vcardEscape(contact.Name))
+		for _,id := range append([]string{contact.ID}, contact.RemoteIDs...) {
+			vcardLine(&buf, "X-WEBCALL-ID:"+vcardEscape(id))
+			vcardLine(&buf, "IMPP:"+contactImpp(id))
+		}
+		if contact.Notes!="" {
+			vcardLine(&buf, "NOTE:"+vcardEscape(contact.Notes))
+		}
+		if len(contact.Groups)>0 {
+			var groups []string
+			for _,group := range contact.Groups {
+				groups = append(groups, vcardEscape(group))
+			}
+			vcardLine(&buf, "CATEGORIES:"+strings.Join(groups,","))
+		}
+		if contact.Favorite {
+			vcardLine(&buf, "X-WEBCALL-FAVORITE:true")
+		}
+		if contact.RingPolicy!="" {
+			vcardLine(&buf, "X-WEBCALL-RINGPOLICY:"+contact.RingPolicy)
+		}
+		if contact.CallerID!="" {
+			vcardLine(&buf, "X-WEBCALL-CALLERID:"+vcardEscape(contact.CallerID))
+		}
+		if contact.CallerName!="" {
+			vcardLine(&buf, "X-WEBCALL-CALLERNAME:"+vcardEscape(contact.CallerName))
+		}
+		vcardLine(&buf, "END:VCARD")
+	}
+	return buf.Bytes()
+}
+
+// contactsFromVcard parses vCards (versions 3.0 and 4.0 are both fine)
+// it returns the contacts with at least one WebCall ID and the number of skipped vCards
+func contactsFromVcard(data []byte) ([]Contact, int, error) {
+	// unfold lines
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), contactsImportMaxLen)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(),"\r")
+		if (strings.HasPrefix(line," ") || strings.HasPrefix(line,"\t")) && len(lines)>0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line!="" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err!=nil {
+		return nil, 0, err
+	}
+
+	var contacts []Contact
+	skipped := 0
+	var contact *Contact
+	var ids []string
+	for _,line := range lines {
+		idxColon := strings.Index(line,":")
+		if idxColon<0 {
+			continue
+		}
+		value := line[idxColon+1:]
+		// property name without parameters and group
+		name := strings.ToUpper(line[:idxColon])
+		if idxSemi := strings.Index(name,";"); idxSemi>=0 {
+			name = name[:idxSemi]
+		}
+		if idxDot := strings.LastIndex(name,"."); idxDot>=0 {
+			name = name[idxDot+1:]
+		}
+
+		if name=="BEGIN" && strings.EqualFold(value,"VCARD") {
+			contact = &Contact{}
+			ids = nil
+			continue
+		}
+		if contact==nil {
+			continue
+		}
+		switch name {
+			case "END":
+				if len(ids)==0 {
+					skipped++
+				} else {
+					contact.ID = ids[0]
+					contact.RemoteIDs = ids[1:]
+					contacts = append(contacts, *contact)
+				}
+				contact = nil
+			case "FN": contact.Name = vcardUnescape(value)
+			case "NOTE": contact.Notes = vcardUnescape(value)
+			case "CATEGORIES": contact.Groups = append(contact.Groups, vcardSplit(value)...)
+			case "X-WEBCALL-FAVORITE": contact.Favorite = strings.EqualFold(value,"true")
+			case "X-WEBCALL-RINGPOLICY": contact.RingPolicy = strings.ToLower(value)
+			case "X-WEBCALL-CALLERID": contact.CallerID = vcardUnescape(value)
+			case "X-WEBCALL-CALLERNAME": contact.CallerName = vcardUnescape(value)
+			case "X-WEBCALL-ID", "IMPP":
+				id := ""
+				if name=="IMPP" {
+					id = contactFromImpp(value)
+				} else {
+					id = contactLocalID(strings.TrimSpace(vcardUnescape(value)))
+				}
+				if id=="" {
+					break
+				}
+				known := false
+				for _,knownID := range ids {
+					if strings.EqualFold(knownID,id) {
+						known = true
+						break
+					}
+				}
+				if !known {
+					ids = append(ids, id)
+				}
+		}
+	}
+	return contacts, skipped, nil
+}
+
+// contactsFromCsv parses CSV with a header line; column "id" is required, all others are optional
+func contactsFromCsv(data []byte) ([]Contact, int, error) {
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.FieldsPerRecord = -1
+	header,err := csvReader.Read()
+	if err!=nil {
+		return nil, 0, err
+	}
+	columns := make(map[string]int)
+	for idx,column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = idx
+	}
+	if _,ok := columns["id"]; !ok {
+		return nil, 0, errors.New("csv header has no id column")
+	}
+	field := func(record []string, column string) string {
+		idx,ok := columns[strings.ToLower(column)]
+		if !ok || idx>=len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[idx])
+	}
+	list := func(value string) []string {
+		if value=="" {
+			return nil
+		}
+		return strings.Split(value,";")
+	}
+
+	var contacts []Contact
+	skipped := 0
+	for {
+		record,err := csvReader.Read()
+		if err==io.EOF {
+			break
+		}
+		if err!=nil {
+			return nil, 0, err
+		}
+		contact := Contact{ID:contactLocalID(field(record,"id"))}
+		if contact.ID=="" {
+			skipped++
+			continue
+		}
+		contact.Name = field(record,"name")
+		contact.RemoteIDs = list(field(record,"remoteIds"))
+		contact.CallerID = field(record,"callerId")
+		contact.CallerName = field(record,"callerName")
+		contact.Notes = field(record,"notes")
+		contact.Favorite = strings.EqualFold(field(record,"favorite"),"true")
+		contact.Groups = list(field(record,"groups"))
+		contact.RingPolicy = strings.ToLower(field(record,"ringPolicy"))
+		contact.Created,_ = strconv.ParseInt(field(record,"created"),10,64)
+		contact.LastCalled,_ = strconv.ParseInt(field(record,"lastCalled"),10,64)
+		contacts = append(contacts, contact)
+	}
+	return contacts, skipped, nil
+}
+
+// contactsImport stores the imported contacts; see mode merge and replace above
+func contactsImport(calleeID string, imported []Contact, replace bool) (ApiContactsImport, error) {
+	var result ApiContactsImport
+	var valid []Contact
+	for _,contact := range imported {
+		if strings.IndexAny(contact.ID," |,")>=0 {
+			result.Skipped++
+			result.Errors = append(result.Errors, contact.ID+": invalid contact id")
+			continue
+		}
+		if err := contactCheck(&contact); err!=nil {
+			result.Skipped++
+			result.Errors = append(result.Errors, contact.ID+": "+err.Error())
+			continue
+		}
+		valid = append(valid, contact)
+	}
+	if len(result.Errors) > 20 {
+		result.Errors = append(result.Errors[:20], "...")
+	}
+
+	now := time.Now().Unix()
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		imported := make(map[string]bool)
+		for _,contact := range valid {
+			id,ok := contactFind(contacts, contact.ID)
+			if ok {
+				// keep the timestamps of the existing contact
+				oldContact := contacts[id]
+				contact.ID = id
+				contact.Created = oldContact.Created
+				if contact.LastCalled < oldContact.LastCalled {
+					contact.LastCalled = oldContact.LastCalled
+				}
+				if !imported[id] {
+					result.Updated++
+				}
+			} else {
+				id = contact.ID
+				if contact.Created<=0 || contact.Created>now {
+					contact.Created = now
+				}
+				if contact.LastCalled>now {
+					contact.LastCalled = 0
+				}
+				result.Added++
+			}
+			contacts[id] = contact
+			imported[id] = true
+		}
+		if replace {
+			for id := range contacts {
+				if !imported[id] {
+					delete(contacts, id)
+					result.Removed++
+				}
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// apiExportContacts serves GET "/api/v1/contacts?format=vcard|csv"
+func apiExportContacts(w http.ResponseWriter, r *http.Request, calleeID string, format string, remoteAddr string) {
+	contactsMutex.Lock()
+	contacts,err := contactsLoad(calleeID)
+	contactsMutex.Unlock()
+	if err!=nil {
+		logError("/api/v1/contacts export", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	list := []Contact{}
+	for _,contact := range contacts {
+		list = append(list, contact)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	w.Header().Set("Cache-Control", "no-store")
+	if format=="csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write(contactsCsvHeader)
+		for idx := range list {
+			csvWriter.Write(list[idx].csvRecord())
+		}
+		csvWriter.Flush()
+		err = csvWriter.Error()
+	} else {
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+		_,err = w.Write(contactsVcard(list))
+	}
+	if err!=nil {
+		logError("/api/v1/contacts export write", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+	}
+}
+
+// apiImportContacts serves POST "/api/v1/contacts?format=vcard|csv&mode=merge|replace"
+func apiImportContacts(w http.ResponseWriter, r *http.Request, calleeID string, format string, remoteAddr string) {
+	mode := r.URL.Query().Get("mode")
+	if mode!="" && mode!="merge" && mode!="replace" {
+		apiError(w, http.StatusBadRequest, "bad_request", "mode must be merge or replace")
+		return
+	}
+	data,err := ioutil.ReadAll(io.LimitReader(r.Body, contactsImportMaxLen+1))
+	if err!=nil {
+		apiError(w, http.StatusBadRequest, "bad_request", "")
+		return
+	}
+	if len(data) > contactsImportMaxLen {
+		apiError(w, http.StatusRequestEntityTooLarge, "bad_request",
+			fmt.Sprintf("max %d bytes", contactsImportMaxLen))
+		return
+	}
+	if !apiContactsEnabled(w, calleeID) {
+		return
+	}
+	var imported []Contact
+	skipped := 0
+	if format=="csv" {
+		imported,skipped,err = contactsFromCsv(data)
+	} else {
+		imported,skipped,err = contactsFromVcard(data)
+	}
+	if err!=nil {
+		apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	result,err := contactsImport(calleeID, imported, mode=="replace")
+	if err!=nil {
+		logWarn("/api/v1/contacts import fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	result.Skipped += skipped
+	logInfo("/api/v1/contacts import", "calleeID",calleeID, "format",format, "mode",mode,
+		"added",result.Added, "updated",result.Updated, "removed",result.Removed,
+		"skipped",result.Skipped, "rip",remoteAddr)
+	apiJson(w, http.StatusOK, result)
+}
@@ -1,8 +1,37 @@
 // WebCall Copyright 2022 timur.mobi. All rights reserved.
 // By default dbLayer.go will forward all calls to skvLayer.go
 // In the future other db-layers may be implemented
+// dbOpen() selects the skv storage backend for the persistent KV stores
+// based on config.ini dbBackend (bolt, memory or sql)
+// CalleeStore is the read-modify-write helper for per-callee values
+// (webpush devices, notify channels, event hooks, voicemails, missed calls)
 package main
 
+import (
+	"fmt"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+func dbOpen(dbName string) (skv.KV,error) {
+	switch dbBackend {
+	case "", "bolt":
+		return skv.DbOpen(dbName,dbPath)
+	case "memory":
+		// not persistent: for tests and throw-away instances only
+		return skv.MemOpen()
+	case "sql":
+		if dbSqlSource=="" {
+			return nil, errors.New("dbBackend=sql requires dbSqlSource")
+		}
+		return skv.SqlOpen(dbName,dbSqlDriver,dbSqlSource)
+	}
+	return nil, errors.New("unknown dbBackend "+dbBackend)
+}
+
 func isLocalDb() bool {
 	return true
 }
@@ -10,31 +39,67 @@ func isLocalDb() bool {
 func GetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,*Hub,error) { // actual calleeID, hostingServerIp
 	urlID, locHub, err := locGetOnlineCallee(calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
 		callerIpAddr, comment)
-	return urlID, locHub, nil, err
+	if err!=nil || urlID!="" || !isClusterMode() {
+		return urlID, locHub, nil, err
+	}
+	// calleeID may be hosted by another node
+	urlID, globHub, err := clusterGetOnlineCallee(calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
+		callerIpAddr)
+	return urlID, nil, globHub, err
 }
 
 func StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
+	// the new hub will be published to the cluster by PublishCalleeInHubMap() once the callee has sent "init"
 	return locStoreCalleeInHubMap(key, nil, multiCallees, remoteAddrWithPort, wsClientID, skipConfirm)
 }
 
+// PublishCalleeInHubMap makes the current state of a local hub visible to the other cluster nodes
+func PublishCalleeInHubMap(globalID string) {
+	clusterNotify(globalID)
+}
+
 func SetUnHiddenForCaller(calleeId string, callerIp string) (error) {
-	return locSetUnHiddenForCaller(calleeId, callerIp)
+	err := locSetUnHiddenForCaller(calleeId, callerIp)
+	if err==skv.ErrNotFound && isClusterMode() {
+		return clusterForward(calleeId, "unhidden", callerIp)
+	}
+	clusterNotify(calleeId)
+	return err
 }
 
 func StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
-	return locStoreCallerIpInHubMap(calleeId, callerIp, skipConfirm)
+	err := locStoreCallerIpInHubMap(calleeId, callerIp, skipConfirm)
+	if err==skv.ErrNotFound && isClusterMode() {
+		return clusterForward(calleeId, "callerip", callerIp)
+	}
+	clusterNotify(calleeId)
+	return err
 }
 
 func SetCalleeHiddenState(calleeId string, hidden bool) (error) {
-	return locSetCalleeHiddenState(calleeId, hidden)
+	err := locSetCalleeHiddenState(calleeId, hidden)
+	if err==skv.ErrNotFound && isClusterMode() {
+		return clusterForward(calleeId, "hidden", fmt.Sprintf("%v",hidden))
+	}
+	clusterNotify(calleeId)
+	return err
 }
 
 func GetRandomCalleeID() (string,error) {
-	return locGetRandomCalleeID()
+	for {
+		newCalleeId,err := locGetRandomCalleeID()
+		if err!=nil || !isClusterMode() || !clusterIsOnline(newCalleeId) {
+			return newCalleeId,err
+		}
+	}
 }
 
 func SearchCallerIpInHubMap(ipAddr string) (bool,string,error) {
-	return locSearchCallerIpInHubMap(ipAddr)
+	found,calleeID,err := locSearchCallerIpInHubMap(ipAddr)
+	if err!=nil || found || !isClusterMode() {
+		return found,calleeID,err
+	}
+	return clusterSearchCallerIp(ipAddr)
 }
 
 func DeleteFromHubMap(globalID string) (int64,int64) {
@@ -42,6 +107,126 @@ func DeleteFromHubMap(globalID string) (int64,int64) {
 	if err!=nil {
 		return int64(0),int64(0)
 	}
+	if isClusterMode() {
+		clusterNotify(globalID)
+		return hublen,atomic.LoadInt64(&clusterHubCount)
+	}
 	return hublen,int64(0)
 }
 
+// SendToCallee writes message to the ws client of callee globalID (on whatever node it is hosted)
+func SendToCallee(globalID string, message []byte) error {
+	err := locSendToCallee(globalID, message)
+	if err==skv.ErrNotFound && isClusterMode() {
+		return clusterForward(globalID, "send", string(message))
+	}
+	return err
+}
+
+// PickupWaitingCaller wakes up the frozen /notifyCallee xhr of callerAddrPort (on whatever node it is waiting)
+func PickupWaitingCaller(callerAddrPort string) bool {
+	if locPickupWaitingCaller(callerAddrPort) {
+		return true
+	}
+	// the caller may be waiting on another node
+	clusterBroadcast("pickup", callerAddrPort)
+	return false
+}
+
+// CalleeStore keeps one value per callee (a slice or a map) in a bucket.
+// modify() serializes the read-modify-write of the values, so that concurrent
+// changes to the value of the same callee do not get lost.
+type CalleeStore struct {
+	kv *skv.KV // the kv variable, which is opened after CalleeStore is created
+	bucket string
+	keepEmpty bool // store empty values instead of removing the entry
+	mutex sync.Mutex
+}
+
+func newCalleeStore(kv *skv.KV, bucket string) *CalleeStore {
+	return &CalleeStore{kv:kv, bucket:bucket}
+}
+
+// load decodes the value of calleeID into value (a pointer)
+// it returns false if there is none stored (value is unchanged then)
+func (s *CalleeStore) load(calleeID string, value interface{}) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(calleeID, value)
+}
+
+func (s *CalleeStore) get(calleeID string, value interface{}) (bool, error) {
+	err := (*s.kv).Get(s.bucket, calleeID, value)
+	if err==skv.ErrNotFound {
+		return false, nil
+	}
+	return err==nil, err
+}
+
+// put stores value (a pointer to a slice or map); an empty value removes the entry unless keepEmpty is set
+func (s *CalleeStore) put(calleeID string, value interface{}) error {
+	if !s.keepEmpty && reflect.ValueOf(value).Elem().Len()==0 {
+		err := (*s.kv).Delete(s.bucket, calleeID)
+		if err==skv.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	return (*s.kv).Put(s.bucket, calleeID, value, false)
+}
+
+// modify loads the value of calleeID into value (a pointer to a slice or map), calls modify()
+// (with found=false if there is no value stored) and stores the value if modify() returns true
+// if modify() returns an error, nothing is stored
+func (s *CalleeStore) modify(calleeID string, value interface{}, modify func(found bool) (bool,error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	found,err := s.get(calleeID, value)
+	if err!=nil {
+		return err
+	}
+	store,err := modify(found)
+	if err!=nil || !store {
+		return err
+	}
+	return s.put(calleeID, value)
+}
+
+// delete removes the value of calleeID
+func (s *CalleeStore) delete(calleeID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := (*s.kv).Delete(s.bucket, calleeID)
+	if err==skv.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// prune calls prune() with the value of every callee (decoded into a new value of newValue())
+// and stores the values for which prune() returns true; it returns the number of stored values
+func (s *CalleeStore) prune(newValue func() interface{}, prune func(calleeID string, value interface{}) bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prunedMap := make(map[string]interface{})
+	err := (*s.kv).ForEach(s.bucket, func(calleeID string, data skv.Value) error {
+		value := newValue()
+		if err := data.Decode(value); err!=nil {
+			logError("CalleeStore prune decode", "bucket",s.bucket, "calleeID",calleeID, "err",err)
+			return nil
+		}
+		if prune(calleeID, value) {
+			prunedMap[calleeID] = value
+		}
+		return nil
+	})
+	if err!=nil {
+		return 0, err
+	}
+	for calleeID,value := range prunedMap {
+		if err = s.put(calleeID, value); err!=nil {
+			logError("CalleeStore prune store", "bucket",s.bucket, "calleeID",calleeID, "err",err)
+		}
+	}
+	return len(prunedMap), nil
+}
@@ -20,7 +20,7 @@ type DbUser struct {
 	AltIDs string
 	LastLoginTime int64
 	LastLogoffTime int64
-	Int2 int                // bit 0: hidden callee mode 0/1
+	Int2 int                // bit 0: hidden callee mode 0/1, bit4: dialsounds muted, bit8: presence not shared, bit16: voicemail
 	CallCounter int         // incremented by wsHub processTimeValues()
 	ConnectedToPeerSecs int // incremented by wsHub processTimeValues()
 	LocalP2pCounter int     // incremented by wsHub processTimeValues()
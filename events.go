@@ -0,0 +1,468 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Call lifecycle events and outgoing event webhooks.
+// emitEvent() is called for:
+//   login      - callee has logged in (first "init|")
+//   logoff     - callee has logged off (closeCallee)
+//   ring       - the callerOffer was forwarded to the callee
+//   pickup     - callee has picked up the call
+//   hangup     - peer connection has ended (PEER DISCON), with duration and p2p/relay
+//   missedcall - addMissedCall()
+//   voicemail  - a caller has left a voicemail (see voicemail.go)
+// Every event is appended to the event log of the callee (kvCalls/dbEventLogBucket,
+// max eventLogMax per callee) and POSTed as JSON to the callee's webhooks
+// (kvNotif/dbEventHooksBucket) and to the server-wide webhooks (config keywords
+// eventWebhookUrls, comma separated, signed with eventWebhookSecret).
+// Requests are signed like notification webhooks (see notifier.go):
+//   X-WebCall-Event: event type
+//   X-WebCall-Delivery: event id
+//   X-WebCall-Timestamp: unix secs
+//   X-WebCall-Signature: sha256=<hex of HMAC-SHA256 over "timestamp.body">
+// The urls of callee webhooks must be https urls of public hosts (see notifyCheckUrl);
+// they are checked again before each delivery.
+// Pending deliveries are stored in kvNotif/dbEventQueueBucket and retried by
+// eventTicker() after eventBackoffSecs. Logged events can be sent again with
+// a replay request.
+//
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/events?since=" -> [Event,..]
+//   POST "/api/v1/events/replay" {"since":unix,"hook":id} -> {"queued":n}
+//   GET "/api/v1/eventhooks" -> [EventHook,..]
+//   POST "/api/v1/eventhooks" {"url":..,"events":[..]} -> hook (with secret)
+//   DELETE "/api/v1/eventhooks/{id}"
+// Localhost:
+//   "/rtcsig/replayevents?since=&id=" replays to the server-wide webhooks
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbEventLogBucket = "eventlog"     // in kvCalls: calleeID -> []Event
+const dbEventHooksBucket = "eventhooks" // in kvNotif: calleeID -> []EventHook
+const dbEventQueueBucket = "eventqueue" // in kvNotif: eventId|hookId -> EventDelivery
+
+const eventTickSecs = 5
+
+// delay before the 1st, 2nd, ... retry of a failed delivery
+var eventBackoffSecs = []int64{10, 30, 60, 300, 900}
+
+var eventTypes = []string{"login", "logoff", "ring", "pickup", "hangup", "missedcall", "voicemail"}
+
+var eventLogStore = newCalleeStore(&kvCalls, dbEventLogBucket)
+var eventHooksStore = newCalleeStore(&kvNotif, dbEventHooksBucket)
+
+// serializes the changes of the queue and eventInflight
+var eventMutex sync.Mutex
+
+// keys of the deliveries currently being sent
+var eventInflight = map[string]bool{}
+
+type Event struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Time int64 `json:"time"`
+	CalleeID string `json:"calleeId"`
+	CallerID string `json:"callerId,omitempty"`
+	CallerName string `json:"callerName,omitempty"`
+	Duration int64 `json:"duration,omitempty"` // hangup: talk secs
+	Con string `json:"con,omitempty"`          // hangup: local/remote "p2p" or "relay"
+	Cause string `json:"cause,omitempty"`
+}
+
+type EventHook struct {
+	Id string `json:"id"`
+	Url string `json:"url"`
+	Secret string `json:"secret"`
+	Events []string `json:"events,omitempty"` // empty = all events
+	Created int64 `json:"created"`
+}
+
+type EventDelivery struct {
+	Event Event
+	HookId string // empty for server-wide webhooks
+	Url string
+	Secret string
+	Attempts int
+	NextTry int64
+	LastError string
+}
+
+func (hook *EventHook) wants(eventType string) bool {
+	if len(hook.Events)==0 {
+		return true
+	}
+	for _,t := range hook.Events {
+		if t==eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// emitEvent logs ev and queues it for all webhooks; it does not block
+func emitEvent(ev Event) {
+	if ev.CalleeID=="" {
+		return
+	}
+	timeNow := time.Now()
+	ev.Id = strconv.FormatInt(timeNow.UnixNano(),36)
+	ev.Time = timeNow.Unix()
+	go func() {
+		eventLogAppend(ev)
+		eventQueue(ev, "")
+	}()
+}
+
+// eventLogAppend stores ev in the event log of the callee
+func eventLogAppend(ev Event) {
+	readConfigLock.RLock()
+	maxEvents := eventLogMax
+	readConfigLock.RUnlock()
+	if maxEvents<=0 {
+		return
+	}
+	var events []Event
+	err := eventLogStore.modify(ev.CalleeID, &events, func(bool) (bool,error) {
+		events = append(events, ev)
+		if len(events) > maxEvents {
+			events = events[len(events)-maxEvents:]
+		}
+		return true, nil
+	})
+	if err!=nil {
+		logError("event log store", "calleeID",ev.CalleeID, "err",err)
+	}
+}
+
+// eventLog returns the logged events of calleeID since the given unix time
+func eventLog(calleeID string, since int64) ([]Event, error) {
+	var events []Event
+	if _,err := eventLogStore.load(calleeID, &events); err!=nil {
+		return nil, err
+	}
+	idx := 0
+	for idx<len(events) && events[idx].Time < since {
+		idx++
+	}
+	return events[idx:], nil
+}
+
+// eventServerHooks returns the server-wide webhooks from config
+func eventServerHooks() []EventHook {
+	readConfigLock.RLock()
+	urls := eventWebhookUrls
+	secret := eventWebhookSecret
+	readConfigLock.RUnlock()
+	var hooks []EventHook
+	for _,url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url!="" {
+			hooks = append(hooks, EventHook{Url:url, Secret:secret})
+		}
+	}
+	return hooks
+}
+
+// eventHooks returns the webhooks of calleeID
+func eventHooks(calleeID string) ([]EventHook, error) {
+	var hooks []EventHook
+	_,err := eventHooksStore.load(calleeID, &hooks)
+	return hooks, err
+}
+
+// eventQueue queues ev for the server-wide webhooks and the webhooks of the callee
+// hookId limits the delivery to one callee webhook ("server" for the server-wide webhooks)
+func eventQueue(ev Event, hookId string) int {
+	var deliveries []EventDelivery
+	if hookId=="" || hookId=="server" {
+		for _,hook := range eventServerHooks() {
+			deliveries = append(deliveries, EventDelivery{Event:ev, Url:hook.Url, Secret:hook.Secret})
+		}
+	}
+	if hookId!="server" {
+		hooks,err := eventHooks(ev.CalleeID)
+		if err!=nil {
+			logError("event get hooks", "calleeID",ev.CalleeID, "err",err)
+		}
+		for _,hook := range hooks {
+			if (hookId=="" || hookId==hook.Id) && hook.wants(ev.Type) {
+				deliveries = append(deliveries,
+					EventDelivery{Event:ev, HookId:hook.Id, Url:hook.Url, Secret:hook.Secret})
+			}
+		}
+	}
+	for idx,delivery := range deliveries {
+		// the url index keeps the server-wide deliveries apart
+		key := fmt.Sprintf("%s|%s|%d", ev.Id, delivery.HookId, idx)
+		err := kvNotif.Put(dbEventQueueBucket, key, delivery, false)
+		if err!=nil {
+			logError("event queue put", "key",key, "err",err)
+			continue
+		}
+		go eventDeliver(key)
+	}
+	return len(deliveries)
+}
+
+// eventDeliver sends the queued delivery key; it is removed on success or permanent failure
+func eventDeliver(key string) {
+	eventMutex.Lock()
+	if eventInflight[key] {
+		eventMutex.Unlock()
+		return
+	}
+	var delivery EventDelivery
+	err := kvNotif.Get(dbEventQueueBucket, key, &delivery)
+	if err!=nil {
+		eventMutex.Unlock()
+		return
+	}
+	eventInflight[key] = true
+	eventMutex.Unlock()
+
+	client := notifyConfigClient
+	body,err := json.Marshal(delivery.Event)
+	if err==nil && delivery.HookId!="" {
+		// the url of a callee webhook may resolve to an internal address by now
+		client = notifyClient
+		_,err = notifyCheckUrl(delivery.Url)
+	}
+	if err==nil {
+		timestamp := fmt.Sprintf("%d", time.Now().Unix())
+		header := map[string]string{
+			"X-WebCall-Event": delivery.Event.Type,
+			"X-WebCall-Delivery": delivery.Event.Id,
+			"X-WebCall-Timestamp": timestamp,
+		}
+		if delivery.Secret!="" {
+			header["X-WebCall-Signature"] = "sha256="+notifySign(delivery.Secret, timestamp, body)
+		}
+		err = notifyPost(client, "POST", delivery.Url, "application/json", body, header)
+	}
+
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	delete(eventInflight, key)
+	delivery.Attempts++
+	if err==nil {
+		logDebug("event", "event delivered", "key",key, "type",delivery.Event.Type, "attempts",delivery.Attempts)
+		err = kvNotif.Delete(dbEventQueueBucket, key)
+	} else if notifyIsPermanent(err) || delivery.Attempts > len(eventBackoffSecs) {
+		logWarn("event delivery failed", "key",key, "calleeID",delivery.Event.CalleeID,
+			"type",delivery.Event.Type, "attempts",delivery.Attempts, "err",err)
+		err = kvNotif.Delete(dbEventQueueBucket, key)
+	} else {
+		logInfo("event delivery retry", "key",key, "attempts",delivery.Attempts, "err",err)
+		delivery.LastError = err.Error()
+		delivery.NextTry = time.Now().Unix() + eventBackoffSecs[delivery.Attempts-1]
+		err = kvNotif.Put(dbEventQueueBucket, key, delivery, false)
+	}
+	if err!=nil {
+		logError("event queue update", "key",key, "err",err)
+	}
+}
+
+// eventTicker sends the deliveries that are due for a retry
+func eventTicker() {
+	ticker := time.NewTicker(eventTickSecs*time.Second)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if shutdownStarted.Get() {
+			break
+		}
+		timeNow := time.Now().Unix()
+		var due []string
+		err := kvNotif.ForEach(dbEventQueueBucket, func(key string, value skv.Value) error {
+			var delivery EventDelivery
+			if err := value.Decode(&delivery); err==nil && delivery.NextTry<=timeNow {
+				due = append(due, key)
+			}
+			return nil
+		})
+		if err!=nil {
+			logError("eventTicker", "bucket",dbEventQueueBucket, "err",err)
+			continue
+		}
+		for _,key := range due {
+			go eventDeliver(key)
+		}
+	}
+}
+
+// eventReplay queues the logged events of calleeID since the given time again
+func eventReplay(calleeID string, since int64, hookId string) (int, error) {
+	events,err := eventLog(calleeID, since)
+	if err!=nil {
+		return 0, err
+	}
+	queued := 0
+	for _,ev := range events {
+		queued += eventQueue(ev, hookId)
+	}
+	logInfo("event replay", "calleeID",calleeID, "since",since, "hook",hookId, "events",len(events),
+		"queued",queued)
+	return queued, nil
+}
+
+// eventAddHook validates and stores a new webhook for calleeID
+func eventAddHook(calleeID string, hook EventHook) (EventHook, error) {
+	if _,err := notifyCheckUrl(hook.Url); err!=nil {
+		return hook, err
+	}
+	for _,t := range hook.Events {
+		known := false
+		for _,eventType := range eventTypes {
+			if t==eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return hook, errors.New("unknown event type "+t)
+		}
+	}
+	if hook.Secret=="" {
+		secret := make([]byte, 24)
+		if _,err := rand.Read(secret); err!=nil {
+			return hook, err
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hash := sha256.Sum256([]byte(hook.Url))
+	hook.Id = hex.EncodeToString(hash[:6])
+	hook.Created = time.Now().Unix()
+
+	readConfigLock.RLock()
+	maxHooks := eventHooksMax
+	readConfigLock.RUnlock()
+	var hooks []EventHook
+	err := eventHooksStore.modify(calleeID, &hooks, func(bool) (bool,error) {
+		for idx := range hooks {
+			if hooks[idx].Id==hook.Id {
+				hooks = append(hooks[:idx], hooks[idx+1:]...)
+				break
+			}
+		}
+		if maxHooks>0 && len(hooks) >= maxHooks {
+			return false, fmt.Errorf("max %d webhooks", maxHooks)
+		}
+		hooks = append(hooks, hook)
+		return true, nil
+	})
+	return hook, err
+}
+
+// eventRemoveHook removes the webhook with the given id; it returns false if there is no such hook
+func eventRemoveHook(calleeID string, id string) (bool, error) {
+	removed := false
+	var hooks []EventHook
+	err := eventHooksStore.modify(calleeID, &hooks, func(bool) (bool,error) {
+		for idx := range hooks {
+			if hooks[idx].Id==id {
+				hooks = append(hooks[:idx], hooks[idx+1:]...)
+				removed = true
+				break
+			}
+		}
+		return removed, nil
+	})
+	return removed, err
+}
+
+type ApiEventReplay struct {
+	Since int64 `json:"since"`
+	Hook string `json:"hook"`
+}
+
+// apiGetEvents serves GET "/api/v1/events?since="
+func apiGetEvents(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	since,_ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	events,err := eventLog(calleeID, since)
+	if err!=nil {
+		logError("/api/v1/events", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if events==nil {
+		events = []Event{}
+	}
+	apiJson(w, http.StatusOK, events)
+}
+
+// apiEventReplay serves POST "/api/v1/events/replay"
+func apiEventReplay(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	var req ApiEventReplay
+	if !apiReadJson(w, r, &req) {
+		return
+	}
+	if req.Hook=="server" {
+		// the server-wide webhooks can only be replayed from localhost
+		apiError(w, http.StatusBadRequest, "invalid_hook", "")
+		return
+	}
+	queued,err := eventReplay(calleeID, req.Since, req.Hook)
+	if err!=nil {
+		logError("/api/v1/events/replay", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	apiJson(w, http.StatusOK, map[string]int{"queued":queued})
+}
+
+// apiEventHooks serves GET and POST "/api/v1/eventhooks"
+func apiEventHooks(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if r.Method=="POST" {
+		var hook EventHook
+		if !apiReadJson(w, r, &hook) {
+			return
+		}
+		hook,err := eventAddHook(calleeID, hook)
+		if err!=nil {
+			logWarn("/api/v1/eventhooks add fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusBadRequest, "invalid_hook", err.Error())
+			return
+		}
+		logInfo("/api/v1/eventhooks add", "calleeID",calleeID, "hook",hook.Id, "rip",remoteAddr)
+		apiJson(w, http.StatusCreated, hook)
+		return
+	}
+	hooks,err := eventHooks(calleeID)
+	if err!=nil {
+		logError("/api/v1/eventhooks get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if hooks==nil {
+		hooks = []EventHook{}
+	}
+	apiJson(w, http.StatusOK, hooks)
+}
+
+// apiDeleteEventHook serves DELETE "/api/v1/eventhooks/{id}"
+func apiDeleteEventHook(w http.ResponseWriter, r *http.Request, calleeID string, id string, remoteAddr string) {
+	found,err := eventRemoveHook(calleeID, id)
+	if err!=nil {
+		logError("/api/v1/eventhooks delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -7,9 +7,10 @@ require (
 	github.com/lesismal/nbio v1.2.6
 	github.com/mehrvarz/turn/v2 v2.0.12
 	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450
-	github.com/nxadm/tail v1.4.8 // indirect
+	github.com/nxadm/tail v1.4.8
 	github.com/pion/logging v0.2.2
 	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20210513122933-cd7d49e622d5
 	gopkg.in/ini.v1 v1.63.0
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
 )
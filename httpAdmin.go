@@ -6,19 +6,15 @@ import (
 	"fmt"
 	"time"
 	"strconv"
-	"errors"
-	"bytes"
 	"strings"
 	"io"
 	"os"
-	"encoding/gob"
-	bolt "go.etcd.io/bbolt"
 	"github.com/nxadm/tail" // https://pkg.go.dev/github.com/nxadm/tail
 	"github.com/mehrvarz/webcall/skv"
 	"github.com/mehrvarz/webcall/atombool"
 )
 
-func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath string, urlID string, remoteAddr string) bool {
+func httpAdmin(kv skv.KV, w http.ResponseWriter, r *http.Request, urlPath string, urlID string, remoteAddr string) bool {
 	printFunc := func(w http.ResponseWriter, format string, a ...interface{}) {
 		// printFunc writes to the console AND to the localhost http client
 		fmt.Printf(format, a...)
@@ -28,36 +24,27 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 	if urlPath=="/dumpuser" {
 		bucketName := dbUserBucket
 		printFunc(w,"/dumpuser dbName=%s bucketName=%s\n", dbMainName, bucketName)
-		db := kv.Db
 		nowTimeUnix := time.Now().Unix()
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			if b==nil {
-				return errors.New("read bucket error "+bucketName)
+		err := kv.ForEach(bucketName, func(k string, v skv.Value) error {
+			var dbUser DbUser
+			v.Decode(&dbUser)
+			lastActivity := dbUser.LastLogoffTime;
+			if dbUser.LastLoginTime > dbUser.LastLogoffTime {
+				lastActivity = dbUser.LastLoginTime
 			}
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				var dbUser DbUser
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbUser)
-				lastActivity := dbUser.LastLogoffTime;
-				if dbUser.LastLoginTime > dbUser.LastLogoffTime {
-					lastActivity = dbUser.LastLoginTime
-				}
-				secsSinceLastActivity := "-"
-				if lastActivity > 0 {
-					secsSinceLastActivity = fmt.Sprintf("%d",nowTimeUnix-lastActivity)
-				}
-				fmt.Fprintf(w, "user %22s calls=%4d p2p=%4d/%4d talk=%6d %d %s %s %s\n",
-					k,
-					dbUser.CallCounter,
-					dbUser.LocalP2pCounter, dbUser.RemoteP2pCounter,
-					dbUser.ConnectedToPeerSecs,
-					dbUser.Int2,
-					time.Unix(dbUser.LastLoginTime,0).Format("2006-01-02 15:04:05"),
-					time.Unix(dbUser.LastLogoffTime,0).Format("2006-01-02 15:04:05"),
-					secsSinceLastActivity)
+			secsSinceLastActivity := "-"
+			if lastActivity > 0 {
+				secsSinceLastActivity = fmt.Sprintf("%d",nowTimeUnix-lastActivity)
 			}
+			fmt.Fprintf(w, "user %22s calls=%4d p2p=%4d/%4d talk=%6d %d %s %s %s\n",
+				k,
+				dbUser.CallCounter,
+				dbUser.LocalP2pCounter, dbUser.RemoteP2pCounter,
+				dbUser.ConnectedToPeerSecs,
+				dbUser.Int2,
+				time.Unix(dbUser.LastLoginTime,0).Format("2006-01-02 15:04:05"),
+				time.Unix(dbUser.LastLogoffTime,0).Format("2006-01-02 15:04:05"),
+				secsSinceLastActivity)
 			return nil
 		})
 		if err!=nil {
@@ -72,17 +59,11 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		// show the list of callee-IDs that have been registered and are not yet outdated
 		bucketName := dbRegisteredIDs
 		printFunc(w,"/dumpregistered dbName=%s bucketName=%s\n", dbMainName, bucketName)
-		db := kv.Db
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				var dbEntry DbEntry
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
-				fmt.Fprintf(w,"registered id=%s %d=%s\n",
-					k, dbEntry.StartTime, time.Unix(dbEntry.StartTime,0).Format("2006-01-02 15:04:05"))
-			}
+		err := kv.ForEach(bucketName, func(k string, v skv.Value) error {
+			var dbEntry DbEntry
+			v.Decode(&dbEntry)
+			fmt.Fprintf(w,"registered id=%s %d=%s\n",
+				k, dbEntry.StartTime, time.Unix(dbEntry.StartTime,0).Format("2006-01-02 15:04:05"))
 			return nil
 		})
 		if err!=nil {
@@ -96,15 +77,9 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 	if urlPath=="/dumpblocked" {
 		// show the list of callee-IDs that are blocked (for various reasons)
 		printFunc(w,"/dumpblocked dbName=%s bucketName=%s\n", dbMainName, dbBlockedIDs)
-		db := kv.Db
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(dbBlockedIDs))
-			c := b.Cursor()
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				dbUserKey := string(k)
-				// dbUserKey format: 'calleeID_unixtime'
-				fmt.Fprintf(w,"blocked key=%s\n",dbUserKey)
-			}
+		err := kv.ForEach(dbBlockedIDs, func(dbUserKey string, _ skv.Value) error {
+			// dbUserKey format: 'calleeID_unixtime'
+			fmt.Fprintf(w,"blocked key=%s\n",dbUserKey)
 			return nil
 		})
 		if err!=nil {
@@ -115,6 +90,218 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		return true
 	}
 
+	if urlPath=="/dumpbuckets" {
+		// show the buckets of all db's and the number of entries in each
+		for _,db := range []struct{name string; kv skv.KV}{
+				{dbMainName,kvMain}, {dbCallsName,kvCalls}, {dbContactsName,kvContacts},
+				{dbNotifName,kvNotif}, {dbHashedPwName,kvHashedPw}} {
+			bucketNames,err := db.kv.Buckets()
+			if err!=nil {
+				printFunc(w,"# /dumpbuckets db=%s err=%v\n", db.name, err)
+				continue
+			}
+			for _,bucketName := range bucketNames {
+				count := 0
+				db.kv.ForEach(bucketName, func(k string, _ skv.Value) error {
+					count++
+					return nil
+				})
+				fmt.Fprintf(w,"db=%s backend=%s bucket=%s entries=%d\n", db.name, dbBackend, bucketName, count)
+			}
+		}
+		return true
+	}
+
+	if urlPath=="/migratepw" {
+		// one-shot migration: replace all cleartext passwords in dbRegisteredIDs with argon2id hashes
+		// entries without a real pw ("nopw", created by /setmapping) are left untouched
+		bucketName := dbRegisteredIDs
+		printFunc(w,"/migratepw dbName=%s bucketName=%s\n", dbMainName, bucketName)
+		var idList []string
+		err := kv.ForEach(bucketName, func(k string, v skv.Value) error {
+			var dbEntry DbEntry
+			v.Decode(&dbEntry)
+			if dbEntry.Password!="" && dbEntry.Password!="nopw" && !pwIsHashed(dbEntry.Password) {
+				idList = append(idList,k)
+			}
+			return nil
+		})
+		if err!=nil {
+			printFunc(w,"# /migratepw err=%v\n", err)
+			return true
+		}
+		countMigrated := 0
+		for _,id := range idList {
+			// read the entry again: it may have been upgraded by /login in the meantime
+			var dbEntry DbEntry
+			err = kv.Get(bucketName,id,&dbEntry)
+			if err!=nil {
+				printFunc(w,"# /migratepw id=%s get err=%v\n", id, err)
+				continue
+			}
+			if pwIsHashed(dbEntry.Password) {
+				continue
+			}
+			hashedPw,err := pwHash(dbEntry.Password)
+			if err!=nil {
+				printFunc(w,"# /migratepw id=%s pwHash err=%v\n", id, err)
+				continue
+			}
+			dbEntry.Password = hashedPw
+			err = kv.Put(bucketName, id, dbEntry, false)
+			if err!=nil {
+				printFunc(w,"# /migratepw id=%s put err=%v\n", id, err)
+				continue
+			}
+			countMigrated++
+		}
+
+		// cookies created before pw hashing hold the cleartext pw: replace it with the hashed pw
+		// if it still matches, otherwise drop the cookie (the callee will need to enter the pw again)
+		var cookieList []string
+		err = kvHashedPw.ForEach(dbHashedPwBucket, func(k string, v skv.Value) error {
+			var pwIdCombo PwIdCombo
+			v.Decode(&pwIdCombo)
+			if !pwIsHashed(pwIdCombo.Pw) {
+				cookieList = append(cookieList,k)
+			}
+			return nil
+		})
+		if err!=nil {
+			printFunc(w,"# /migratepw db=%s err=%v\n", dbHashedPwName, err)
+		}
+		countCookies := 0
+		for _,cookieValue := range cookieList {
+			var pwIdCombo PwIdCombo
+			err = kvHashedPw.Get(dbHashedPwBucket, cookieValue, &pwIdCombo)
+			if err!=nil {
+				continue
+			}
+			var dbEntry DbEntry
+			err = kv.Get(bucketName, pwIdCombo.CalleeId, &dbEntry)
+			if err==nil && pwVerify(pwIdCombo.Pw, dbEntry.Password) {
+				pwIdCombo.Pw = dbEntry.Password
+				err = kvHashedPw.Put(dbHashedPwBucket, cookieValue, pwIdCombo, false)
+				if err==nil {
+					countCookies++
+				}
+			} else {
+				err = kvHashedPw.Delete(dbHashedPwBucket, cookieValue)
+			}
+			if err!=nil {
+				printFunc(w,"# /migratepw cookie=%s err=%v\n", cookieValue, err)
+			}
+		}
+		printFunc(w,"/migratepw migrated ids=%d/%d cookies=%d/%d\n",
+			countMigrated, len(idList), countCookies, len(cookieList))
+		return true
+	}
+
+	if urlPath=="/revoketokens" {
+		// reject all bearer tokens of urlID issued until now
+		if urlID=="" {
+			printFunc(w,"# /revoketokens url arg 'id' not given\n")
+			return true
+		}
+		err := tokenRevokeAll(urlID)
+		if err!=nil {
+			printFunc(w,"# /revoketokens id=%s err=%v\n", urlID, err)
+		} else {
+			printFunc(w,"/revoketokens id=%s done\n", urlID)
+		}
+		return true
+	}
+
+	if urlPath=="/dumpcdr" {
+		// CDRs of urlID (or of all callees if urlID is empty) as json or csv (format=csv)
+		from,to := cdrQueryArgs(r)
+		cdrSlice,err := cdrQuery(urlID, from, to)
+		if err!=nil {
+			printFunc(w,"# /dumpcdr id=%s err=%v\n", urlID, err)
+			return true
+		}
+		fmt.Printf("/dumpcdr id=%s records=%d\n", urlID, len(cdrSlice))
+		cdrWrite(w, r, cdrSlice)
+		return true
+	}
+
+	if urlPath=="/genvapidkeys" {
+		// a new VAPID key pair for web push (to be copied into config.ini)
+		publicKey,privateKey,err := webpushGenerateVapidKeys()
+		if err!=nil {
+			printFunc(w,"# /genvapidkeys err=%v\n", err)
+			return true
+		}
+		printFunc(w,"vapidPublicKey = %s\nvapidPrivateKey = %s\n", publicKey, privateKey)
+		return true
+	}
+
+	if urlPath=="/dumpwebpush" {
+		// web push devices of urlID
+		devices,err := webpushDevices(urlID)
+		if err!=nil {
+			printFunc(w,"# /dumpwebpush id=%s err=%v\n", urlID, err)
+			return true
+		}
+		for _,device := range devices {
+			printFunc(w,"%s created=%d lastUsed=%d ua=%s endpoint=%s\n",
+				device.Id, device.Created, device.LastUsed, device.UA, device.Subscription.Endpoint)
+		}
+		return true
+	}
+
+	if urlPath=="/dumpoutbox" {
+		// notification outbox entries (of urlID, or all)
+		err := kvNotif.ForEach(dbNotifyOutboxBucket, func(key string, value skv.Value) error {
+			if urlID!="" && !strings.HasPrefix(key, urlID+"|") {
+				return nil
+			}
+			var entry OutboxEntry
+			if err := value.Decode(&entry); err!=nil {
+				printFunc(w,"# %s decode err=%v\n", key, err)
+				return nil
+			}
+			printFunc(w,"%s created=%d closed=%d %s\n", key, entry.Created, entry.Closed, entry.ClosedReason)
+			for _,delivery := range entry.Deliveries {
+				printFunc(w,"  %s %s %s attempts=%d nextTry=%d sent=%d err=%s\n", delivery.ChannelId,
+					delivery.Type, delivery.Status, delivery.Attempts, delivery.NextTry, delivery.SentTime,
+					delivery.LastError)
+			}
+			return nil
+		})
+		if err!=nil {
+			printFunc(w,"# /dumpoutbox err=%v\n", err)
+		}
+		return true
+	}
+
+	if urlPath=="/replayevents" {
+		// send the logged events (of urlID, or of all callees) to the server-wide webhooks again
+		since,_ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		calleeIDs := []string{urlID}
+		if urlID=="" {
+			calleeIDs = nil
+			err := kvCalls.ForEach(dbEventLogBucket, func(key string, value skv.Value) error {
+				calleeIDs = append(calleeIDs, key)
+				return nil
+			})
+			if err!=nil {
+				printFunc(w,"# /replayevents err=%v\n", err)
+				return true
+			}
+		}
+		queued := 0
+		for _,calleeID := range calleeIDs {
+			count,err := eventReplay(calleeID, since, "server")
+			if err!=nil {
+				printFunc(w,"# /replayevents id=%s err=%v\n", calleeID, err)
+			}
+			queued += count
+		}
+		printFunc(w,"/replayevents callees=%d queued=%d\n", len(calleeIDs), queued)
+		return true
+	}
+
 	if urlPath=="/deluserid" {
 		// get time from url-arg
 		url_arg_array, ok := r.URL.Query()["time"]
@@ -234,7 +421,11 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 			printFunc(w,"# /makeregistered url arg 'pw' not given\n")
 			return true
 		}
-		urlPw := url_arg_array[0]
+		urlPw, err := pwHash(url_arg_array[0])
+		if err!=nil {
+			printFunc(w,"# /makeregistered pwHash err=%v\n", err)
+			return true
+		}
 
 		fmt.Printf("/makeregistered dbName=%s\n", dbMainName)
 
@@ -308,18 +499,69 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		timeNow := time.Now()
 
 		recentTurnCalleeIpMutex.Lock()
-		for ipAddr := range recentTurnCalleeIps {
-			turnCallee, ok := recentTurnCalleeIps[ipAddr]
+		for username := range recentTurnCalleeIps {
+			turnCallee, ok := recentTurnCalleeIps[username]
 			if ok {
-				timeSinceCallerDisconnect := timeNow.Sub(turnCallee.TimeStored)
-				printFunc(w,"/dumpturn calleeID=%s since caller disconnect %v\n",
-					turnCallee.CalleeID, timeSinceCallerDisconnect.Seconds())
+				timeSinceMinted := timeNow.Sub(turnCallee.TimeStored)
+				printFunc(w,"/dumpturn calleeID=%s since minted %v expires in %d used=%v ended=%v\n",
+					turnCallee.CalleeID, timeSinceMinted.Seconds(), turnCallee.Expires-timeNow.Unix(),
+					turnCallee.Used, turnCallee.ended(timeNow.Unix()))
 			}
 		}
 		recentTurnCalleeIpMutex.Unlock()
 		return true
 	}
 
+	if urlPath=="/dumprelay" {
+		// TURN relay sessions and the stored daily relay usage (see turnrelay.go)
+		timeNowUnix := time.Now().Unix()
+		turnRelayMutex.Lock()
+		for addr,session := range turnRelaySessions {
+			printFunc(w,"/dumprelay session %-22s calleeID=%s bytes=%d dropped=%d idle=%ds\n",
+				addr, session.CalleeID, session.Bytes, session.Dropped, timeNowUnix-session.LastActive)
+		}
+		turnRelayMutex.Unlock()
+		err := kvMain.ForEach(dbRelayUsageBucket, func(k string, v skv.Value) error {
+			var relayUsage RelayUsage
+			v.Decode(&relayUsage)
+			if urlID=="" || urlID==k {
+				printFunc(w,"/dumprelay usage calleeID=%s day=%s bytes=%d quota=%d\n",
+					k, relayUsage.Day, relayUsage.Bytes, relayUsage.Quota)
+			}
+			return nil
+		})
+		if err!=nil {
+			printFunc(w,"# /dumprelay ForEach err=%v\n", err)
+		}
+		return true
+	}
+
+	if urlPath=="/relayquota" {
+		// set the daily relay quota of urlID in bytes (0 = turnRelayDailyBytes, -1 = unlimited)
+		if urlID=="" {
+			printFunc(w,"# /relayquota url arg 'id' not given\n")
+			return true
+		}
+		url_arg_array, ok := r.URL.Query()["quota"]
+		if !ok || len(url_arg_array[0]) < 1 {
+			printFunc(w,"# /relayquota url arg 'quota' not given\n")
+			return true
+		}
+		quota,err := strconv.ParseInt(url_arg_array[0], 10, 64)
+		if err!=nil || quota < -1 {
+			printFunc(w,"# /relayquota url arg 'quota' invalid (%s)\n", url_arg_array[0])
+			return true
+		}
+		relayUsage,err := turnRelayQuotaSet(urlID, quota)
+		if err!=nil {
+			printFunc(w,"# /relayquota id=%s err=%v\n", urlID, err)
+			return true
+		}
+		printFunc(w,"/relayquota id=%s quota=%d (stored usage day=%s bytes=%d)\n",
+			urlID, relayUsage.Quota, relayUsage.Day, relayUsage.Bytes)
+		return true
+	}
+
 	if urlPath=="/dumpping" {
 		hubMapMutex.RLock()
 		defer hubMapMutex.RUnlock()
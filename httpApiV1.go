@@ -0,0 +1,765 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// httpApiV1Handler() implements the versioned JSON API under "/api/v1/".
+// It offers what the "/rtcsig/" text endpoints offer for login, online,
+// settings, contacts, mapping, missed calls and registration, but with
+// JSON request and response bodies, http status codes and machine-readable
+// error codes. Errors are always returned as {"error":code,"message":text}.
+// The OpenAPI description is served as "/api/v1/openapi.json"
+// (see webroot/api/v1/openapi.json).
+//
+// /login, /online, /newid and /register run the same code as their
+// "/rtcsig/" counterparts (calleeLogin(), calleeOnline(), newCalleeID() and
+// registerCallee()) and translate the results into JSON.
+// All other endpoints work on the db's directly.
+// Clients authenticate with the same "webcallid" session cookie that is
+// used by "/rtcsig/" (and that is set by /api/v1/login and /api/v1/register),
+// or with a bearer token obtained via /api/v1/token (see httpToken.go).
+
+package main
+
+import (
+	"net/http"
+	"fmt"
+	"io"
+	"time"
+	"strings"
+	"strconv"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const apiV1Prefix = "/api/v1"
+const apiMaxBodyLen = 8192
+
+type ApiError struct {
+	Error string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+type ApiLoginRequest struct {
+	ID string `json:"id"`
+	Pw string `json:"pw,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type ApiLoginResponse struct {
+	ID string `json:"id"`
+	WsUrl string `json:"wsUrl"`
+	ConnectedToPeerSecs int64 `json:"connectedToPeerSecs"`
+	ServiceSecs int64 `json:"serviceSecs"`
+	Hidden bool `json:"hidden"`
+	DialSoundsMuted bool `json:"dialSoundsMuted"`
+}
+
+type ApiOnlineResponse struct {
+	ID string `json:"id"`
+	Status string `json:"status"` // "available", "busy" or "offline"
+	WsUrl string `json:"wsUrl,omitempty"`
+	OfflineSecs int64 `json:"offlineSecs,omitempty"`
+}
+
+type ApiRegisterRequest struct {
+	ID string `json:"id"`
+	Pw string `json:"pw"`
+}
+
+type ApiID struct {
+	ID string `json:"id"`
+}
+
+type ApiSettings struct {
+	Nickname *string `json:"nickname,omitempty"`
+	TwName *string `json:"twname,omitempty"`
+	TwID *string `json:"twid,omitempty"`
+	StoreContacts *bool `json:"storeContacts,omitempty"`
+	StoreMissedCalls *bool `json:"storeMissedCalls,omitempty"`
+	DialSounds *bool `json:"dialSounds,omitempty"` // read-only (set via websocket)
+	SharePresence *bool `json:"sharePresence,omitempty"`
+	Voicemail *bool `json:"voicemail,omitempty"`
+}
+
+type ApiMapping struct {
+	ID string `json:"id"`
+	Active bool `json:"active"`
+	Assign string `json:"assign"`
+}
+
+type ApiMappingUpdate struct {
+	Active *bool `json:"active,omitempty"`
+	Assign *string `json:"assign,omitempty"`
+}
+
+type ApiMissedCall struct {
+	ID string `json:"id"` // see missedcalls.go
+	CallerID string `json:"callerId"`
+	CallerName string `json:"callerName"`
+	AddrPort string `json:"addrPort"`
+	CallTime int64 `json:"callTime"`
+	Msg string `json:"msg,omitempty"`
+	Cause string `json:"cause,omitempty"`
+	Read bool `json:"read"`
+	CalledBack bool `json:"calledBack"`
+}
+
+func httpApiV1Handler(w http.ResponseWriter, r *http.Request) {
+	startRequestTime := time.Now()
+	remoteAddr, remoteAddrWithPort := apiRemoteAddr(r)
+
+	// path = resource[/id]
+	path := strings.TrimPrefix(r.URL.Path, apiV1Prefix+"/")
+	resource := path
+	resourceID := ""
+	if idx := strings.Index(path,"/"); idx>=0 {
+		resource = path[:idx]
+		resourceID = path[idx+1:]
+	}
+	logDebug("apiv1", "/api/v1", "method",r.Method, "resource",resource, "resourceID",resourceID,
+		"rip",remoteAddrWithPort)
+	defer func() {
+		metricsHttpDuration.Observe(metricsEndpoint(apiV1Prefix,resource), time.Since(startRequestTime).Seconds())
+	}()
+
+	if resource=="openapi.json" {
+		data,err := embeddedFS.ReadFile("webroot/api/v1/openapi.json")
+		if err!=nil {
+			logError("/api/v1 openapi.json", "err",err)
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	if isBot(r.UserAgent(),r.Referer()) {
+		logWarn("/api/v1 bot denied", "path",r.URL.Path, "ua",r.UserAgent(), "rip",remoteAddr)
+		apiError(w, http.StatusForbidden, "forbidden", "")
+		return
+	}
+
+	readConfigLock.RLock()
+	maxClientRequestsPer30minTmp := maxClientRequestsPer30min
+	myMaintenanceMode := maintenanceMode
+	readConfigLock.RUnlock()
+	if maxClientRequestsPer30minTmp>0 && remoteAddr!=outboundIP && remoteAddr!="127.0.0.1" {
+		if clientRequestAdd(remoteAddr,1) {
+			logDebug("overload", "/api/v1 too many requests/30m", "rip",remoteAddr,
+				"max",maxClientRequestsPer30minTmp, "path",r.URL.Path)
+			apiError(w, http.StatusTooManyRequests, "too_many_requests",
+				"Too many requests in short order. Please take a pause.")
+			return
+		}
+	}
+	if myMaintenanceMode {
+		apiError(w, http.StatusServiceUnavailable, "maintenance", "")
+		return
+	}
+
+	// endpoints that do not require a session
+	switch resource {
+	case "login":
+		if apiMethod(w, r, "POST") {
+			apiLogin(w, r, remoteAddr, remoteAddrWithPort, startRequestTime)
+		}
+		return
+	case "online":
+		if apiMethod(w, r, "GET") {
+			apiOnline(w, r, resourceID, remoteAddr)
+		}
+		return
+	case "newid":
+		if apiMethod(w, r, "GET") {
+			apiNewId(w, r, remoteAddr)
+		}
+		return
+	case "register":
+		if apiMethod(w, r, "POST") {
+			apiRegister(w, r, remoteAddr, startRequestTime)
+		}
+		return
+	case "token":
+		if apiMethod(w, r, "POST") {
+			apiToken(w, r, resourceID, remoteAddr)
+		}
+		return
+	}
+
+	if bearer := tokenFromRequest(r,false); bearer!="" {
+		if _,err := tokenAuth(bearer); err!=nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apiError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+	}
+
+	calleeID := apiAuth(r)
+	if calleeID=="" {
+		switch resource {
+		case "logout", "settings", "contacts", "mapping", "missedcalls", "cdr", "webpush", "notify", "events", "eventhooks", "callfilter", "blockedcalls", "voicemail":
+			apiError(w, http.StatusUnauthorized, "unauthorized", "no valid session")
+		default:
+			apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		}
+		return
+	}
+
+	switch resource {
+	case "logout":
+		if apiMethod(w, r, "POST") {
+			if bearer := tokenFromRequest(r,false); bearer!="" {
+				tokenRevoke(bearer)
+			}
+			clearCookie(w, r, calleeID, remoteAddr, "/api/v1/logout")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "settings":
+		if resourceID!="" {
+			apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		} else if apiMethod(w, r, "GET", "PUT") {
+			apiSettings(w, r, calleeID, remoteAddr)
+		}
+	case "contacts":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "POST") {
+				apiContacts(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "GET", "PUT", "DELETE") {
+			apiContact(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "mapping":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "POST") {
+				apiMappings(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "PUT", "DELETE") {
+			apiMapping(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "missedcalls":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "PUT") {
+				apiMissedCalls(w, r, calleeID, remoteAddr)
+			}
+		} else if resourceID=="unread" {
+			if apiMethod(w, r, "GET") {
+				apiMissedCallsUnread(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "PUT", "DELETE") {
+			apiMissedCall(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "cdr":
+		if resourceID!="" {
+			apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		} else if apiMethod(w, r, "GET") {
+			apiGetCdr(w, r, calleeID, remoteAddr)
+		}
+	case "webpush":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "POST") {
+				apiWebPush(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "DELETE") {
+			apiDeleteWebPush(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "notify":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "POST", "PUT") {
+				apiNotify(w, r, calleeID, remoteAddr)
+			}
+		} else if resourceID=="test" {
+			if apiMethod(w, r, "POST") {
+				apiNotifyTest(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "DELETE") {
+			apiDeleteNotify(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "events":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET") {
+				apiGetEvents(w, r, calleeID, remoteAddr)
+			}
+		} else if resourceID=="replay" {
+			if apiMethod(w, r, "POST") {
+				apiEventReplay(w, r, calleeID, remoteAddr)
+			}
+		} else {
+			apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		}
+	case "eventhooks":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET", "POST") {
+				apiEventHooks(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "DELETE") {
+			apiDeleteEventHook(w, r, calleeID, resourceID, remoteAddr)
+		}
+	case "callfilter":
+		if apiMethod(w, r, "GET", "PUT") {
+			apiCallFilter(w, r, calleeID, remoteAddr)
+		}
+	case "blockedcalls":
+		if apiMethod(w, r, "GET", "DELETE") {
+			apiBlockedCalls(w, r, calleeID, remoteAddr)
+		}
+	case "voicemail":
+		if resourceID=="" {
+			if apiMethod(w, r, "GET") {
+				apiVoicemails(w, r, calleeID, remoteAddr)
+			}
+		} else if apiMethod(w, r, "GET", "PUT", "DELETE") {
+			apiVoicemail(w, r, calleeID, resourceID, remoteAddr)
+		}
+	default:
+		apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+	}
+}
+
+// apiRemoteAddr returns the client address without and with port (same as httpApiHandler)
+func apiRemoteAddr(r *http.Request) (string,string) {
+	remoteAddrWithPort := r.RemoteAddr
+	if strings.HasPrefix(remoteAddrWithPort,"[::1]") {
+		remoteAddrWithPort = "127.0.0.1"+remoteAddrWithPort[5:]
+	}
+	altIp := r.Header.Get("X-Real-IP")
+	if len(altIp) >= 7 && !strings.HasPrefix(remoteAddrWithPort,altIp) {
+		remoteAddrWithPort = altIp
+		altPort := r.Header.Get("X-Real-Port")
+		if altPort!="" {
+			remoteAddrWithPort = remoteAddrWithPort + ":"+altPort
+		}
+	}
+	remoteAddr := remoteAddrWithPort
+	idxPort := strings.Index(remoteAddrWithPort,":")
+	if idxPort>=0 {
+		remoteAddr = remoteAddrWithPort[:idxPort]
+	}
+	return remoteAddr, remoteAddrWithPort
+}
+
+// apiAuth returns the calleeID of the session cookie, or "" if there is no valid session
+func apiAuth(r *http.Request) string {
+	if bearer := tokenFromRequest(r,false); bearer!="" {
+		dbToken,err := tokenAuth(bearer)
+		if err!=nil {
+			return ""
+		}
+		return dbToken.CalleeID
+	}
+	cookie, err := r.Cookie("webcallid")
+	if err!=nil {
+		return ""
+	}
+	// cookie.Value has format: calleeID + "&" + random
+	idxAmpasent := strings.Index(cookie.Value,"&")
+	if idxAmpasent<0 {
+		return ""
+	}
+	var pwIdCombo PwIdCombo
+	err = kvHashedPw.Get(dbHashedPwBucket,cookie.Value,&pwIdCombo)
+	if err!=nil || pwIdCombo.Pw=="" {
+		return ""
+	}
+	calleeID := pwIdCombo.CalleeId
+	if argIdx := strings.Index(calleeID,"&"); argIdx>=0 {
+		calleeID = calleeID[:argIdx]
+	}
+	if calleeID != cookie.Value[:idxAmpasent] {
+		return ""
+	}
+	return calleeID
+}
+
+// apiMethod returns true if r.Method is one of methods, otherwise it responds with 405
+func apiMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _,method := range methods {
+		if r.Method==method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods,", "))
+	apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "")
+	return false
+}
+
+func apiJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err!=nil {
+		logError("/api/v1 json encode", "err",err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	apiJson(w, status, ApiError{code, message})
+}
+
+func apiReadJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBodyLen)).Decode(v)
+	if err!=nil {
+		apiError(w, http.StatusBadRequest, "bad_request", "invalid json body")
+		return false
+	}
+	return true
+}
+
+func apiID(id string) string {
+	return strings.TrimSpace(strings.ToLower(id))
+}
+
+func apiLogin(w http.ResponseWriter, r *http.Request, remoteAddr string, remoteAddrWithPort string, startRequestTime time.Time) {
+	var req ApiLoginRequest
+	if !apiReadJson(w, r, &req) {
+		return
+	}
+	urlID := apiID(req.ID)
+	if urlID=="" {
+		apiError(w, http.StatusBadRequest, "bad_request", "id missing")
+		return
+	}
+
+	// without a pw, login via the session cookie or bearer token (same as "/rtcsig/login")
+	var cookie *http.Cookie
+	var pwIdCombo PwIdCombo
+	cookiePw := ""
+	if req.Pw=="" && apiAuth(r)==urlID {
+		if tokenFromRequest(r,false)!="" {
+			cookie = tokenSession(urlID)
+		} else {
+			cookie,_ = r.Cookie("webcallid")
+			kvHashedPw.Get(dbHashedPwBucket,cookie.Value,&pwIdCombo)
+			cookiePw = pwIdCombo.Pw
+		}
+	}
+	// same as the pw posted to "/rtcsig/login"
+	postPw := strings.ToLower(strings.TrimSpace(req.Pw))
+	result := calleeLogin(w, r, urlID, cookie, cookiePw, postPw, req.Version, remoteAddr, remoteAddrWithPort,
+		false, startRequestTime, pwIdCombo, r.UserAgent())
+
+	switch result.Status {
+	case loginOK:
+		apiJson(w, http.StatusOK, ApiLoginResponse{ID: urlID, WsUrl: result.WsAddr,
+			ConnectedToPeerSecs: int64(result.ConnectedToPeerSecs),
+			ServiceSecs: int64(result.ServiceSecs),
+			Hidden: result.Hidden,
+			DialSoundsMuted: result.DialSoundsMuted})
+	case loginError:
+		apiError(w, http.StatusUnauthorized, "invalid_credentials", "")
+	case loginNotRegistered:
+		apiError(w, http.StatusNotFound, "not_registered", "")
+	case loginAlreadyLoggedIn:
+		apiError(w, http.StatusConflict, "already_logged_in", "this id is logged in elsewhere")
+	case loginNoService:
+		apiError(w, http.StatusServiceUnavailable, "no_service", "")
+	case loginTooMany:
+		apiError(w, http.StatusTooManyRequests, "too_many_requests", result.Msg)
+	case loginOutdated:
+		apiError(w, http.StatusUpgradeRequired, "client_outdated", result.Msg)
+	case loginReconnectBlocked:
+		apiError(w, http.StatusForbidden, "reconnect_blocked", result.Msg)
+	default:
+		apiError(w, http.StatusForbidden, "forbidden", "")
+	}
+}
+
+func apiOnline(w http.ResponseWriter, r *http.Request, id string, remoteAddr string) {
+	urlID := apiID(id)
+	if urlID=="" {
+		apiError(w, http.StatusBadRequest, "bad_request", "id missing")
+		return
+	}
+	dialID := urlID
+	mappingMutex.RLock()
+	mappingData,ok := mapping[urlID]
+	mappingMutex.RUnlock()
+	if ok {
+		urlID = mappingData.CalleeId
+	}
+
+	err := kvMain.Get(dbRegisteredIDs, urlID, nil)
+	if err==skv.ErrNotFound {
+		// delay brute (same as /online)
+		time.Sleep(1000 * time.Millisecond)
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+
+	// ?callerId, ?wait and ?ver are evaluated by calleeOnline()
+	result := calleeOnline(r, urlID, dialID, remoteAddr)
+	onlineResponse := ApiOnlineResponse{ID: dialID}
+	switch result.Status {
+	case onlineAvail:
+		onlineResponse.Status = "available"
+		onlineResponse.WsUrl = result.WsAddr
+	case onlineBusy:
+		onlineResponse.Status = "busy"
+	case onlineNotAvail:
+		onlineResponse.Status = "offline"
+	case onlineNotAvailTemp:
+		// callee has been offline for only a few minutes; retry with ?wait=true
+		onlineResponse.Status = "offline"
+		onlineResponse.OfflineSecs = result.OfflineSecs
+	case onlineGone:
+		// the client has given up waiting
+		return
+	default:
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	apiJson(w, http.StatusOK, onlineResponse)
+}
+
+func apiNewId(w http.ResponseWriter, r *http.Request, remoteAddr string) {
+	if !allowNewAccounts {
+		apiError(w, http.StatusForbidden, "registration_disabled", "")
+		return
+	}
+	newID := newCalleeID(r, remoteAddr)
+	if newID=="" {
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	apiJson(w, http.StatusOK, ApiID{newID})
+}
+
+func apiRegister(w http.ResponseWriter, r *http.Request, remoteAddr string, startRequestTime time.Time) {
+	if !allowNewAccounts {
+		apiError(w, http.StatusForbidden, "registration_disabled", "")
+		return
+	}
+	var req ApiRegisterRequest
+	if !apiReadJson(w, r, &req) {
+		return
+	}
+	registerID := apiID(req.ID)
+	if registerID=="" || strings.IndexAny(registerID,"&/?|")>=0 {
+		apiError(w, http.StatusBadRequest, "bad_request", "id missing or invalid")
+		return
+	}
+	if len(req.Pw)<6 {
+		apiError(w, http.StatusBadRequest, "pw_too_short", "pw must have at least 6 characters")
+		return
+	}
+	logInfo("/api/v1/register", "calleeID",registerID, "rip",remoteAddr, "ua",r.UserAgent())
+	// same as the pw posted to "/rtcsig/register"
+	pw := strings.ToLower(strings.TrimSpace(req.Pw))
+	result := registerCallee(w, r, registerID, pw, remoteAddr, startRequestTime)
+	switch result {
+	case registerOK:
+		apiJson(w, http.StatusCreated, ApiID{registerID})
+	case registerPwTooShort:
+		apiError(w, http.StatusBadRequest, "pw_too_short", "pw must have at least 6 characters")
+	case registerAlreadyRegistered:
+		apiError(w, http.StatusConflict, "already_registered", "")
+	default:
+		apiError(w, http.StatusInternalServerError, "internal", result.response())
+	}
+}
+
+// apiGetDbUser returns the dbUserKey and DbUser of calleeID
+func apiGetDbUser(calleeID string) (string,DbUser,error) {
+	var dbUser DbUser
+	var dbEntry DbEntry
+	err := kvMain.Get(dbRegisteredIDs,calleeID,&dbEntry)
+	if err!=nil {
+		return "",dbUser,err
+	}
+	dbUserKey := fmt.Sprintf("%s_%d",calleeID, dbEntry.StartTime)
+	err = kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
+	return dbUserKey,dbUser,err
+}
+
+func apiSettings(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if r.Method=="PUT" {
+		var req ApiSettings
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		newSettingsMap := make(map[string]string)
+		if req.Nickname!=nil {
+			newSettingsMap["nickname"] = *req.Nickname
+		}
+		if req.TwName!=nil {
+			newSettingsMap["twname"] = *req.TwName
+		}
+		if req.TwID!=nil {
+			newSettingsMap["twid"] = *req.TwID
+		}
+		if req.StoreContacts!=nil {
+			newSettingsMap["storeContacts"] = strconv.FormatBool(*req.StoreContacts)
+		}
+		if req.StoreMissedCalls!=nil {
+			newSettingsMap["storeMissedCalls"] = strconv.FormatBool(*req.StoreMissedCalls)
+		}
+		if req.SharePresence!=nil {
+			newSettingsMap["sharePresence"] = strconv.FormatBool(*req.SharePresence)
+		}
+		if req.Voicemail!=nil {
+			newSettingsMap["voicemail"] = strconv.FormatBool(*req.Voicemail)
+		}
+		err := setSettings(calleeID, newSettingsMap, remoteAddr)
+		if err!=nil {
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+	}
+
+	_,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil {
+		logError("/api/v1/settings get dbUser", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	dialSounds := !(dbUser.Int2&4==4) // bit4 set for mute
+	sharePresence := presenceShared(dbUser)
+	voicemail := voicemailEnabled(dbUser)
+	apiJson(w, http.StatusOK, ApiSettings{
+		Nickname: &dbUser.Name,
+		TwName: &dbUser.Email2,
+		TwID: &dbUser.Str1,
+		StoreContacts: &dbUser.StoreContacts,
+		StoreMissedCalls: &dbUser.StoreMissedCalls,
+		DialSounds: &dialSounds,
+		SharePresence: &sharePresence,
+		Voicemail: &voicemail,
+	})
+}
+
+// apiParseAltIDs parses DbUser.AltIDs (format: id,true,assign|id,false,assign|...)
+func apiParseAltIDs(altIDs string) []ApiMapping {
+	mappings := []ApiMapping{}
+	for _,tok := range strings.Split(altIDs, "|") {
+		toks2 := strings.Split(tok, ",")
+		if toks2[0]=="" {
+			continue
+		}
+		mappingEntry := ApiMapping{ID: toks2[0], Assign: "none"}
+		if len(toks2)>=2 {
+			mappingEntry.Active = toks2[1]=="true"
+		}
+		if len(toks2)>=3 && toks2[2]!="" {
+			mappingEntry.Assign = toks2[2]
+		}
+		mappings = append(mappings, mappingEntry)
+	}
+	return mappings
+}
+
+func apiFormatAltIDs(mappings []ApiMapping) string {
+	altIDs := ""
+	for idx,mappingEntry := range mappings {
+		if idx>0 {
+			altIDs += "|"
+		}
+		altIDs += mappingEntry.ID+","+strconv.FormatBool(mappingEntry.Active)+","+mappingEntry.Assign
+	}
+	return altIDs
+}
+
+func apiMappings(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	dbUserKey,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil {
+		logError("/api/v1/mapping get dbUser", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	mappings := apiParseAltIDs(dbUser.AltIDs)
+	if r.Method=="GET" {
+		apiJson(w, http.StatusOK, mappings)
+		return
+	}
+
+	// POST: create new random, free ID, register it and add it to the mapping (same as /fetchid)
+	if !allowNewAccounts {
+		apiError(w, http.StatusForbidden, "registration_disabled", "")
+		return
+	}
+	registerID,err := registerMappingID(calleeID, remoteAddr, time.Now())
+	if err!=nil {
+		logError("/api/v1/mapping register", "calleeID",calleeID, "newID",registerID, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	// unlike /fetchid (where the client stores the AltIDs via /setmapping), store the AltIDs here
+	mappingEntry := ApiMapping{ID: registerID, Active: true, Assign: "none"}
+	dbUser.AltIDs = apiFormatAltIDs(append(mappings, mappingEntry))
+	err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
+	if err!=nil {
+		logError("/api/v1/mapping store altIDs", "calleeID",calleeID, "err",err)
+		mappingMutex.Lock()
+		delete(mapping,registerID)
+		mappingMutex.Unlock()
+		kvMain.Delete(dbRegisteredIDs, registerID)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	logInfo("/api/v1/mapping new id", "calleeID",calleeID, "newID",registerID, "rip",remoteAddr)
+	apiJson(w, http.StatusCreated, mappingEntry)
+}
+
+func apiMapping(w http.ResponseWriter, r *http.Request, calleeID string, altID string, remoteAddr string) {
+	dbUserKey,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil {
+		logError("/api/v1/mapping get dbUser", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	mappings := apiParseAltIDs(dbUser.AltIDs)
+	idx := -1
+	for i := range mappings {
+		if mappings[i].ID==altID {
+			idx = i
+			break
+		}
+	}
+	if idx<0 {
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+
+	var mappingEntry ApiMapping
+	if r.Method=="DELETE" {
+		if deleteMapping(calleeID,altID,remoteAddr)==1 {
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		mappings = append(mappings[:idx], mappings[idx+1:]...)
+	} else {
+		var req ApiMappingUpdate
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		if req.Assign!=nil {
+			if *req.Assign=="" || strings.IndexAny(*req.Assign,",|")>=0 {
+				apiError(w, http.StatusBadRequest, "bad_request", "invalid assign")
+				return
+			}
+			mappings[idx].Assign = *req.Assign
+		}
+		if req.Active!=nil {
+			mappings[idx].Active = *req.Active
+		}
+		mappingEntry = mappings[idx]
+		mappingMutex.Lock()
+		if mappingEntry.Active {
+			mapping[altID] = MappingDataType{calleeID,mappingEntry.Assign}
+		} else {
+			delete(mapping,altID)
+		}
+		mappingMutex.Unlock()
+	}
+
+	dbUser.AltIDs = apiFormatAltIDs(mappings)
+	err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
+	if err!=nil {
+		logError("/api/v1/mapping store altIDs", "calleeID",calleeID, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if r.Method=="DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	apiJson(w, http.StatusOK, mappingEntry)
+}
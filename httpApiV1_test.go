@@ -0,0 +1,113 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for /api/v1 register, login and mapping
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"encoding/json"
+)
+
+// testApi sends a json request to httpApiV1Handler and decodes the json response into v
+func testApi(t *testing.T, method string, path string, body string, cookie *http.Cookie,
+		v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if cookie!=nil {
+		r.AddCookie(cookie)
+	}
+	httpApiV1Handler(w, r)
+	if v!=nil && w.Body.Len()>0 {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err!=nil {
+			t.Fatalf("%s %s response %s err=%v", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestApiRegisterLoginMapping(t *testing.T) {
+	kvMain = testMemKV(t, dbRegisteredIDs, dbUserBucket)
+	kvHashedPw = testMemKV(t, dbHashedPwBucket)
+	kvContacts = testMemKV(t, dbContactsBucket, dbContactRecordsBucket)
+	hubMap = make(map[string]*Hub)
+	wsClientMap = make(map[uint64]wsClientDataType)
+	mapping = make(map[string]MappingDataType)
+	readConfigLock.Lock()
+	maxCallees = 10
+	readConfigLock.Unlock()
+
+	var apiErr ApiError
+	w := testApi(t, "POST", "/api/v1/register", `{"id":"19990000021","pw":"short"}`, nil, &apiErr)
+	if w.Code!=http.StatusBadRequest || apiErr.Error!="pw_too_short" {
+		t.Fatalf("register short pw: %d %s", w.Code, w.Body.String())
+	}
+	var apiID ApiID
+	w = testApi(t, "POST", "/api/v1/register", `{"id":"19990000021","pw":"Secret123"}`, nil, &apiID)
+	if w.Code!=http.StatusCreated || apiID.ID!="19990000021" {
+		t.Fatalf("register: %d %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies)!=1 || cookies[0].Name!="webcallid" {
+		t.Fatalf("register cookies %v", cookies)
+	}
+	var contacts map[string]Contact
+	if kvContacts.Get(dbContactRecordsBucket, "19990000021", &contacts)!=nil || len(contacts)!=2 {
+		t.Fatalf("register contacts %v", contacts)
+	}
+	w = testApi(t, "POST", "/api/v1/register", `{"id":"19990000021","pw":"secret456"}`, nil, &apiErr)
+	if w.Code!=http.StatusConflict || apiErr.Error!="already_registered" {
+		t.Fatalf("register twice: %d %s", w.Code, w.Body.String())
+	}
+
+	// pw's are lowercased, same as in "/rtcsig/register" and "/rtcsig/login"
+	var loginResponse ApiLoginResponse
+	w = testApi(t, "POST", "/api/v1/login", `{"id":"19990000021","pw":"SECRET123"}`, nil, &loginResponse)
+	if w.Code!=http.StatusOK || !strings.HasPrefix(loginResponse.WsUrl, "ws") ||
+			strings.Index(loginResponse.WsUrl, "?wsid=")<0 {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies())!=1 {
+		t.Fatalf("login cookies %v", w.Result().Cookies())
+	}
+	w = testApi(t, "POST", "/api/v1/login", `{"id":"19990000022","pw":"secret123"}`, nil, &apiErr)
+	if w.Code!=http.StatusNotFound || apiErr.Error!="not_registered" {
+		t.Fatalf("login not registered: %d %s", w.Code, w.Body.String())
+	}
+
+	var mappingEntry ApiMapping
+	w = testApi(t, "POST", "/api/v1/mapping", "", cookies[0], &mappingEntry)
+	if w.Code!=http.StatusCreated || mappingEntry.ID=="" || !mappingEntry.Active {
+		t.Fatalf("mapping: %d %s", w.Code, w.Body.String())
+	}
+	var dbEntry DbEntry
+	if kvMain.Get(dbRegisteredIDs, mappingEntry.ID, &dbEntry)!=nil || dbEntry.Password!="nopw" {
+		t.Fatalf("mapping id %s not registered: %v", mappingEntry.ID, dbEntry)
+	}
+	mappingMutex.RLock()
+	mappingData := mapping[mappingEntry.ID]
+	mappingMutex.RUnlock()
+	if mappingData.CalleeId!="19990000021" {
+		t.Fatalf("mapping %v", mappingData)
+	}
+	var mappings []ApiMapping
+	w = testApi(t, "GET", "/api/v1/mapping", "", cookies[0], &mappings)
+	if w.Code!=http.StatusOK || len(mappings)!=1 || mappings[0]!=mappingEntry {
+		t.Fatalf("get mapping: %d %s", w.Code, w.Body.String())
+	}
+
+	// the same through "/rtcsig/fetchid"
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/rtcsig/fetchid?id=19990000021", nil)
+	httpFetchID(w, r, "19990000021", "19990000021", cookies[0], "127.0.0.1", time.Now())
+	fetchID := w.Body.String()
+	if fetchID=="" || strings.HasPrefix(fetchID, "error") || fetchID==mappingEntry.ID {
+		t.Fatalf("fetchid %s", fetchID)
+	}
+	if kvMain.Get(dbRegisteredIDs, fetchID, &dbEntry)!=nil || dbEntry.Password!="nopw" {
+		t.Fatalf("fetchid %s not registered: %v", fetchID, dbEntry)
+	}
+}
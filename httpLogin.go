@@ -9,6 +9,8 @@
 // callee client will receive a responseString in the form of 
 // "wss://(hostname):(wssPort)/ws|other|parameters|...|..."
 // with which the websocket connection can be established.
+// The login itself is done by calleeLogin(), which is also
+// used by "/api/v1/login" (see httpApiV1.go).
 
 package main
 
@@ -20,13 +22,60 @@ import (
 	"io"
 	"math/rand"
 	"sync"
+	"crypto/subtle"
 )
 
-func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *http.Cookie, pw string, remoteAddr string, remoteAddrWithPort string, nocookie bool, startRequestTime time.Time, pwIdCombo PwIdCombo, userAgent string) {
-	if logWantedFor("loginex") {
-		fmt.Printf("/login (%s) %s rt=%v\n",
-			urlID, remoteAddrWithPort, time.Since(startRequestTime)) // rt=4.393µs
+// LoginResult is the outcome of calleeLogin()
+type LoginResult struct {
+	Status int
+	Msg string // the text shown to the user for loginOutdated, loginReconnectBlocked and loginTooMany
+	WsAddr string
+	ConnectedToPeerSecs int
+	ServiceSecs int
+	Hidden bool
+	DialSoundsMuted bool
+}
+
+const (
+	loginDenied = iota    // answie/talkback not from localhost (no response)
+	loginOK
+	loginError            // no pw, wrong pw, maxCallees reached or db error
+	loginNotRegistered
+	loginAlreadyLoggedIn
+	loginNoService
+	loginOutdated
+	loginReconnectBlocked
+	loginTooMany
+)
+
+// response returns the "/rtcsig/login" text response for result
+func (result LoginResult) response() string {
+	switch result.Status {
+	case loginOK:
+		return fmt.Sprintf("%s|%d|%s|%d|%v|%v",
+			result.WsAddr,              // 0
+			result.ConnectedToPeerSecs, // 1
+			outboundIP,                 // 2
+			result.ServiceSecs,         // 3
+			result.Hidden,              // 4 isHiddenCallee
+			result.DialSoundsMuted)     // 5 dialSoundsMuted
+	case loginError:
+		return "error"
+	case loginNotRegistered:
+		return "notregistered"
+	case loginAlreadyLoggedIn:
+		return "fatal"
+	case loginNoService:
+		return "noservice"
+	case loginOutdated, loginReconnectBlocked, loginTooMany:
+		return result.Msg
 	}
+	return ""
+}
+
+func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *http.Cookie, pw string, remoteAddr string, remoteAddrWithPort string, nocookie bool, startRequestTime time.Time, pwIdCombo PwIdCombo, userAgent string) {
+	logDebug("loginex", "/login", "calleeID",urlID, "rip",remoteAddrWithPort,
+		"rt",time.Since(startRequestTime)) // rt=4.393µs
 
 	clientVersion := ""
 	url_arg_array, ok := r.URL.Query()["ver"]
@@ -34,11 +83,40 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		clientVersion = url_arg_array[0]
 	}
 
+	postPw := ""
+	postBuf := make([]byte, 128)
+	length, _ := io.ReadFull(r.Body, postBuf)
+	if length > 0 {
+		var pwData = string(postBuf[:length])
+		//fmt.Printf("/login pwData (%s)\n", pwData)
+		pwData = strings.ToLower(pwData)
+		pwData = strings.TrimSpace(pwData)
+		tokenSlice := strings.Split(pwData, "&")
+		for _, tok := range tokenSlice {
+			if strings.HasPrefix(tok, "pw=") {
+				postPw = tok[3:]
+				if postPw!="" {
+					//fmt.Printf("/login pw from httpPost (%s)\n", postPw)
+					break
+				}
+			}
+		}
+	}
+
+	result := calleeLogin(w, r, urlID, cookie, pw, postPw, clientVersion, remoteAddr, remoteAddrWithPort,
+		nocookie, startRequestTime, pwIdCombo, userAgent)
+	fmt.Fprint(w, result.response())
+}
+
+// calleeLogin checks the pw (postPw, or cookiePw taken from the cookie) of callee urlID
+// and creates the hub that the callee will connect to via websocket
+// w is only used to set the cookie (unless nocookie is set)
+func calleeLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *http.Cookie, cookiePw string, postPw string, clientVersion string, remoteAddr string, remoteAddrWithPort string, nocookie bool, startRequestTime time.Time, pwIdCombo PwIdCombo, userAgent string) LoginResult {
 	// answie and talkback can only log in from localhost
 	if strings.HasPrefix(urlID, "answie") || strings.HasPrefix(urlID, "talkback") {
 		if remoteAddr!="127.0.0.1" && remoteAddr!=outboundIP {
-			fmt.Printf("/login (%s) not from local host denied %s\n", urlID, remoteAddrWithPort)
-			return
+			logWarn("/login not from local host denied", "calleeID",urlID, "rip",remoteAddrWithPort)
+			return LoginResult{Status:loginDenied}
 		}
 	}
 
@@ -46,15 +124,14 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	if !strings.HasPrefix(urlID,"answie") && !strings.HasPrefix(urlID,"talkback") {
 		readConfigLock.RLock()
 		if clientBlockBelowVersion!="" && (clientVersion=="" || clientVersion < clientBlockBelowVersion) {
-			fmt.Printf("/login (%s) deny clientVersion (%s) < clientBlockBelowVersion (%s) %s\n",
-				urlID, clientVersion, clientBlockBelowVersion, remoteAddr)
+			logWarn("/login deny clientVersion < clientBlockBelowVersion", "calleeID",urlID, "ver",clientVersion,
+				"blockBelow",clientBlockBelowVersion, "rip",remoteAddr)
 			readConfigLock.RUnlock()
 
 			// NOTE: msg MUST NOT contain apostroph (') characters
 			msg := "The version of WebCall you are using is no longer supported."+
 					" <a href=\"/webcall/update/\">Please upgrade.</a>"
-			fmt.Fprintf(w,msg)
-			return
+			return LoginResult{Status:loginOutdated, Msg:msg}
 		}
 		readConfigLock.RUnlock()
 	}
@@ -67,21 +144,19 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		// callee with urlID was blocked due to an earlier ws-reconnect issue (likely due to battery optimization)
 		if time.Now().Sub(blockedTime) <= 10 * 60 * time.Minute {
 			// urlID was blocked in the last 10h
-			if logWantedFor("overload") {
-				fmt.Printf("/login (%s) block recon (%v) rip=%s v=%s ua=%s\n",
-					urlID, time.Now().Sub(blockedTime), remoteAddr, clientVersion, userAgent)
-			}
+			metricsLoginRateLimitTotal.Inc("reconnect")
+			logDebug("overload", "/login block recon", "calleeID",urlID, "since",time.Now().Sub(blockedTime),
+				"rip",remoteAddr, "ver",clientVersion, "ua",userAgent)
 			// this error response string is formated so that callee.js will show it via showStatus()
 			// it also makes Android service (1.0.0-RC3+) abort the reconnecter loop
 			// NOTE: msg MUST NOT contain apostroph (') characters
 			msg :=  "A Websocket reconnect has failed. Likely in device sleep mode. "+
 					"Please deactivate battery optimizations aka provide keep-awake permission. "+
 					"<a href=\"/webcall/more/#keepawake\">More info</a>"
-			fmt.Fprintf(w,msg)
 			blockMapMutex.Lock()
 			delete(blockMap,urlID)
 			blockMapMutex.Unlock()
-			return
+			return LoginResult{Status:loginReconnectBlocked, Msg:msg}
 		}
 		blockMapMutex.Lock()
 		delete(blockMap,urlID)
@@ -108,17 +183,15 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 				}
 			}
 			if len(calleeLoginSlice) >= maxLoginPer30minTmp {
-				if logWantedFor("overload") {
-					fmt.Printf("/login (%s) %d >= %d logins/30m rip=%s v=%s\n",
-						urlID, len(calleeLoginSlice), maxLoginPer30minTmp, remoteAddr, clientVersion)
-				}
-				fmt.Fprintf(w,"Too many reconnects / login attempts in short order. "+
-							  "Is your network connection stable? "+
-							  "Please take a pause.")
+				metricsLoginRateLimitTotal.Inc("logins30m")
+				logDebug("overload", "/login too many logins/30m", "calleeID",urlID, "logins",len(calleeLoginSlice),
+					"max",maxLoginPer30minTmp, "rip",remoteAddr, "ver",clientVersion)
 				calleeLoginMutex.Lock()
 				calleeLoginMap[urlID] = calleeLoginSlice
 				calleeLoginMutex.Unlock()
-				return
+				return LoginResult{Status:loginTooMany, Msg:"Too many reconnects / login attempts in short order. "+
+					"Is your network connection stable? "+
+					"Please take a pause."}
 			}
 		}
 		calleeLoginSlice = append(calleeLoginSlice,time.Now())
@@ -141,10 +214,10 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	myMultiCallees := multiCallees
 	readConfigLock.RUnlock()
 	if lenHubMap > myMaxCallees {
-		fmt.Printf("# /login lenHubMap %d > myMaxCallees %d rip=%s v=%s\n",
-			lenHubMap, myMaxCallees, remoteAddr, clientVersion)
-		fmt.Fprintf(w, "error")
-		return
+		metricsLoginRateLimitTotal.Inc("maxcallees")
+		logWarn("/login lenHubMap > myMaxCallees", "lenHubMap",lenHubMap, "maxCallees",myMaxCallees,
+			"rip",remoteAddr, "ver",clientVersion)
+		return LoginResult{Status:loginError}
 	}
 
 	if strings.Index(myMultiCallees, "|"+urlID+"|") < 0 {
@@ -157,7 +230,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		key, _, _, err := GetOnlineCallee(urlID, ejectOn1stFound, reportBusyCallee, 
 			reportHiddenCallee, remoteAddr, "/login")
 		if err != nil {
-			fmt.Printf("# /login (%s) GetOnlineCallee() err=%v v=%s\n", key, err, clientVersion)
+			logError("/login GetOnlineCallee()", "calleeID",key, "ver",clientVersion, "err",err)
 		}
 		if key != "" {
 			// found "already logged in"
@@ -167,7 +240,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 			key, _, _, err = GetOnlineCallee(urlID, ejectOn1stFound, reportBusyCallee, 
 				reportHiddenCallee, remoteAddr, "/login")
 			if err != nil {
-				fmt.Printf("# /login (%s) GetOnlineCallee() err=%v v=%s\n", key, err, clientVersion)
+				logError("/login GetOnlineCallee()", "calleeID",key, "ver",clientVersion, "err",err)
 			}
 			if key != "" {
 				// a login request for a user that is still logged in
@@ -189,10 +262,8 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 						offlineReason = 3 // CalleeClient is not online anymore
 					} else {
 						// hub.CalleeClient seems to (still) be online; let's see if this holds if we ping it
-						if logWantedFor("login") {
-							fmt.Printf("/login (%s) ping-wait %s <- %s v=%s\n",
-								key, calleeIP, remoteAddrWithPort, clientVersion)
-						}
+						logDebug("login", "/login ping-wait", "calleeID",key, "calleeIP",calleeIP, "rip",remoteAddrWithPort,
+							"ver",clientVersion)
 
 						// ping the callee client and if it doesn't respond within 2500ms, disconnect it
 						hub.CalleeClient.SendPing(2500)
@@ -204,10 +275,8 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 							if hub==nil || hub.CalleeClient==nil || !hub.CalleeClient.isOnline.Get() {
 								// CalleeClient is not online anymore (we can accept the new login)
 								offlineReason = 4
-								if logWantedFor("login") {
-								  fmt.Printf("/login (%s) logged out after wait %dms/%v %s ws=%d v=%s\n", key,
-									i*100, time.Since(startRequestTime), remoteAddr, hub.WsClientID, clientVersion)
-								}
+								logDebug("login", "/login logged out after wait", "calleeID",key, "waitedMS",i*100,
+									"rt",time.Since(startRequestTime), "rip",remoteAddr, "wsid",hub.WsClientID, "ver",clientVersion)
 								break
 							}
 						}
@@ -216,10 +285,9 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 
 				if offlineReason==0 {
 					// abort this login attempt: old/sameId callee is already/still logged in
-					fmt.Printf("/login (%s) already/still logged in %v by %s <- %s v=%s ua=%s\n",
-						key, time.Since(startRequestTime), calleeIP, remoteAddrWithPort, clientVersion, userAgent)
-					fmt.Fprintf(w,"fatal")
-					return
+					logInfo("/login already/still logged in", "calleeID",key, "rt",time.Since(startRequestTime),
+						"calleeIP",calleeIP, "rip",remoteAddrWithPort, "ver",clientVersion, "ua",userAgent)
+					return LoginResult{Status:loginAlreadyLoggedIn}
 				}
 
 				// the new login is valid (the old callee is not online anymore)
@@ -228,31 +296,22 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		}
 	}
 
-	postBuf := make([]byte, 128)
-	length, _ := io.ReadFull(r.Body, postBuf)
-	if length > 0 {
-		var pwData = string(postBuf[:length])
-		//fmt.Printf("/login pwData (%s)\n", pwData)
-		pwData = strings.ToLower(pwData)
-		pwData = strings.TrimSpace(pwData)
-		tokenSlice := strings.Split(pwData, "&")
-		for _, tok := range tokenSlice {
-			if strings.HasPrefix(tok, "pw=") {
-				pwFromPost := tok[3:]
-				if(pwFromPost!="") {
-					pw = pwFromPost
-					//fmt.Printf("/login pw from httpPost (%s)\n", pw)
-					break
-				}
-			}
-		}
+	// cookiePw may have been taken from the cookie (see httpApiHandler)
+	// in which case it holds the hashed pw, not the cleartext
+	pw := cookiePw
+	pwFromCookie := (cookie != nil && pw != "")
+	if postPw != "" {
+		pw = postPw
+		pwFromCookie = false
 	}
 
+	// a valid bearer token of urlID replaces the pw (see tokenSession)
+	pwFromToken := postPw == "" && tokenFor(r, urlID)
+
 	// pw must be available now
-	if pw == "" {
-		fmt.Printf("/login (%s) no pw %s v=%s ua=%s\n", urlID, remoteAddr, clientVersion, userAgent)
-		fmt.Fprintf(w, "error")
-		return
+	if pw == "" && !pwFromToken {
+		logInfo("/login no pw", "calleeID",urlID, "rip",remoteAddr, "ver",clientVersion, "ua",userAgent)
+		return LoginResult{Status:loginError}
 	}
 
 	//fmt.Printf("/login (%s) pw given rip=%s rt=%v\n",
@@ -265,12 +324,11 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	globalID := ""
 	dbUserKey := ""
 
-	if len(pw) < 6 {
+	if len(pw) < 6 && !pwFromToken {
 		// guessing more difficult if delayed
-		fmt.Printf("/login (%s) pw too short %s v=%s\n", urlID, remoteAddr, clientVersion)
+		logInfo("/login pw too short", "calleeID",urlID, "rip",remoteAddr, "ver",clientVersion)
 		time.Sleep(3000 * time.Millisecond)
-		fmt.Fprintf(w, "error")
-		return
+		return LoginResult{Status:loginError}
 	}
 
 	err := kvMain.Get(dbRegisteredIDs, urlID, &dbEntry)
@@ -278,18 +336,15 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		// err is most likely "skv key not found"
 		// log "skv key not found" only if "login" is wanted
 		if strings.Index(err.Error(), "skv key not found") >= 0 {
-			if logWantedFor("login") {
-				fmt.Printf("/login (%s) error db=%s bucket=%s %s get registeredID err=%v v=%s\n",
-					urlID, dbMainName, dbRegisteredIDs, remoteAddr, err, clientVersion)
-			}
+			logDebug("login", "/login get registeredID", "calleeID",urlID, "db",dbMainName, "bucket",dbRegisteredIDs,
+				"rip",remoteAddr, "ver",clientVersion, "err",err)
 		} else {
-			fmt.Printf("/login (%s) error db=%s bucket=%s %s get registeredID err=%v v=%s\n",
-				urlID, dbMainName, dbRegisteredIDs, remoteAddr, err, clientVersion)
+			logError("/login get registeredID", "calleeID",urlID, "db",dbMainName, "bucket",dbRegisteredIDs,
+				"rip",remoteAddr, "ver",clientVersion, "err",err)
 		}
 		if strings.Index(err.Error(), "disconnect") >= 0 {
 			// TODO admin email notif may be useful
-			fmt.Fprintf(w, "error")
-			return
+			return LoginResult{Status:loginError}
 		}
 		if strings.Index(err.Error(), "timeout") < 0 {
 			// pw guessing more difficult if delayed
@@ -297,25 +352,57 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		}
 		// TODO clear cookie?
 		//clearCookie(w, r, urlID, remoteAddr)
-		fmt.Fprintf(w, "notregistered")
-		return
+		return LoginResult{Status:loginNotRegistered}
 	}
-	if pw != dbEntry.Password {
-		fmt.Printf("/login (%s) fail wrong password %d %s\n", urlID, len(calleeLoginSlice), remoteAddr)
+	pwOK := false
+	if pwFromToken {
+		pwOK = true
+	} else if pwFromCookie && pwIsHashed(pw) {
+		// the cookie refers to the hashed pw that was stored on the last login
+		pwOK = subtle.ConstantTimeCompare([]byte(pw), []byte(dbEntry.Password))==1
+	} else {
+		// pw is cleartext (either posted or from a cookie created before pw hashing)
+		pwOK = pwVerify(pw, dbEntry.Password)
+	}
+	if !pwOK {
+		logInfo("/login fail wrong password", "calleeID",urlID, "logins",len(calleeLoginSlice), "rip",remoteAddr)
 		// delay to make pw guessing harder
 		time.Sleep(2000 * time.Millisecond)
-		fmt.Fprintf(w, "error")
-		return
+		return LoginResult{Status:loginError}
+	}
+
+	if !pwFromToken && !pwIsHashed(dbEntry.Password) {
+		// pw accepted, but still stored as cleartext: upgrade to a hashed pw
+		hashedPw,err := pwHash(pw)
+		if err!=nil {
+			logError("/login pwHash", "calleeID",urlID, "err",err)
+		} else {
+			dbEntry.Password = hashedPw
+			err = kvMain.Put(dbRegisteredIDs, urlID, dbEntry, false)
+			if err!=nil {
+				logError("/login put hashed pw", "calleeID",urlID, "db",dbMainName, "bucket",dbRegisteredIDs, "err",err)
+			} else {
+				logInfo("/login pw upgraded to hash", "calleeID",urlID)
+				if cookie != nil && pwIdCombo.CalleeId != "" {
+					// the old cookie holds the cleartext pw: replace it with the hash
+					pwIdCombo.Pw = hashedPw
+					err = kvHashedPw.Put(dbHashedPwBucket, cookie.Value, pwIdCombo, true)
+					if err!=nil {
+						logError("/login put cookie", "calleeID",urlID, "db",dbHashedPwName, "bucket",dbHashedPwBucket,
+							"cookie",cookie.Value, "err",err)
+					}
+				}
+			}
+		}
 	}
 
 	// pw accepted
 	dbUserKey = fmt.Sprintf("%s_%d", urlID, dbEntry.StartTime)
 	err = kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
 	if err != nil {
-		fmt.Printf("# /login (%s) error db=%s bucket=%s get %s err=%v v=%s\n",
-			dbUserKey, dbMainName, dbUserBucket, remoteAddr, err, clientVersion)
-		fmt.Fprintf(w, "error")
-		return
+		logError("/login get dbUser", "key",dbUserKey, "db",dbMainName, "bucket",dbUserBucket,
+			"rip",remoteAddr, "ver",clientVersion, "err",err)
+		return LoginResult{Status:loginError}
 	}
 	//fmt.Printf("/login dbUserKey=%v dbUser.Int=%d (hidden) rt=%v\n",
 	//	dbUserKey, dbUser.Int2, time.Since(startRequestTime)) // rt=75ms
@@ -324,10 +411,9 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	dbUser.LastLoginTime = time.Now().Unix()
 	err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
 	if err!=nil {
-		fmt.Printf("# /login (%s) error db=%s bucket=%s put %s err=%v v=%s\n",
-			urlID, dbMainName, dbUserBucket, remoteAddr, err, clientVersion)
-		fmt.Fprintf(w, "error")
-		return
+		logError("/login put dbUser", "calleeID",urlID, "db",dbMainName, "bucket",dbUserBucket,
+			"rip",remoteAddr, "ver",clientVersion, "err",err)
+		return LoginResult{Status:loginError}
 	}
 
 	// create new unique wsClientID
@@ -339,30 +425,25 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 
 	globalID,_,err = StoreCalleeInHubMap(urlID, myMultiCallees, remoteAddrWithPort, wsClientID, false)
 	if err != nil || globalID == "" {
-		fmt.Printf("# /login (%s/%s) StoreCalleeInHubMap err=%v v=%s\n",
-			urlID, globalID, err, clientVersion)
-		fmt.Fprintf(w, "noservice")
-		return
+		logError("/login StoreCalleeInHubMap", "calleeID",urlID, "globalID",globalID, "ver",clientVersion, "err",err)
+		return LoginResult{Status:loginNoService}
 	}
 	//fmt.Printf("/login (%s) urlID=(%s) rip=%s rt=%v\n",
 	//	globalID, urlID, remoteAddr, time.Since(startRequestTime))
 
 	if cookie == nil && !nocookie {
-		err,cookieValue := createCookie(w, urlID, pw, &pwIdCombo)
+		err,cookieValue := createCookie(w, urlID, dbEntry.Password, &pwIdCombo)
 		if err != nil {
 			if globalID != "" {
 				_,lenGlobalHubMap = DeleteFromHubMap(globalID)
 			}
-			fmt.Printf("# /login (%s) persist PwIdCombo error db=%s bucket=%s cookie=%s err=%v v=%s (%d)\n",
-				urlID, dbHashedPwName, dbHashedPwBucket, cookieValue, err, clientVersion, lenGlobalHubMap)
-			fmt.Fprintf(w, "noservice")
-			return
+			logError("/login persist PwIdCombo", "calleeID",urlID, "db",dbHashedPwName, "bucket",dbHashedPwBucket,
+				"cookie",cookieValue, "ver",clientVersion, "lenGlobalHubMap",lenGlobalHubMap, "err",err)
+			return LoginResult{Status:loginNoService}
 		}
 
-		if logWantedFor("cookie") {
-			fmt.Printf("/login (%s) persisted PwIdCombo db=%s bucket=%s key=%s v=%s\n",
-				urlID, dbHashedPwName, dbHashedPwBucket, cookieValue, clientVersion)
-		}
+		logDebug("cookie", "/login persisted PwIdCombo", "calleeID",urlID, "db",dbHashedPwName,
+			"bucket",dbHashedPwBucket, "key",cookieValue, "ver",clientVersion)
 		//fmt.Printf("/login (%s) pwIdCombo stored time=%v\n", urlID, time.Since(startRequestTime))
 	}
 
@@ -380,8 +461,8 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 
 		if hub == nil {
 			// connection was cut off by the device / or timeout26s
-			fmt.Printf("# exitfunc (%s) hub==nil ws=%d %s rip=%s v=%s\n",
-				globalID, wsClientID, comment, remoteAddrWithPort, clientVersion)
+			logWarn("exitfunc hub==nil", "globalID",globalID, "wsid",wsClientID, "comment",comment,
+				"rip",remoteAddrWithPort, "ver",clientVersion)
 			return;
 		}
 
@@ -390,24 +471,21 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 			// not the same (already exited, possibly by timeout26s): abort exit / deny deletion
 			// exitfunc (id) abort ws=54553222902/0 'OnClose'
 			if reqWsClientID!=0 {
-				fmt.Printf("exitfunc (%s) abort ws=%d/%d '%s' %s v=%s\n",
-					globalID, wsClientID, reqWsClientID, comment, remoteAddrWithPort, clientVersion)
+				logInfo("exitfunc abort", "globalID",globalID, "wsid",wsClientID, "reqWsid",reqWsClientID,
+					"comment",comment, "rip",remoteAddrWithPort, "ver",clientVersion)
 			}
 			return;
 		}
 
-		if logWantedFor("attach") {
-			fmt.Printf("exitfunc (%s) '%s' ws=%d %s\n",
-				globalID, comment, wsClientID, remoteAddr)
-		}
+		logDebug("attach", "exitfunc", "globalID",globalID, "comment",comment, "wsid",wsClientID, "rip",remoteAddr)
 
 		if dbUserKey!="" {
 			// feed LastLogoffTime
 			var dbUser2 DbUser
 			err := kvMain.Get(dbUserBucket, dbUserKey, &dbUser2)
 			if err != nil {
-				fmt.Printf("# exitfunc (%s) error db=%s bucket=%s get key=%v err=%v\n",
-					globalID, dbMainName, dbUserBucket, dbUserKey, err)
+				logError("exitfunc get dbUser", "globalID",globalID, "db",dbMainName, "bucket",dbUserBucket,
+					"key",dbUserKey, "err",err)
 			} else {
 				//fmt.Printf("exitfunc (%s) dbUserKey=%s isHiddenCallee=%v (%d)\n",
 				//	globalID, dbUserKey, dbUser2.Int2&1!=0, dbUser2.Int2)
@@ -416,8 +494,8 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 				dbUser2.LastLogoffTime = time.Now().Unix()
 				err = kvMain.Put(dbUserBucket, dbUserKey, dbUser2, false)
 				if err!=nil {
-					fmt.Printf("# exitfunc (%s) error db=%s bucket=%s put key=%s err=%v\n",
-						globalID, dbMainName, dbUserBucket, urlID, err)
+					logError("exitfunc put dbUser", "globalID",globalID, "db",dbMainName, "bucket",dbUserBucket,
+						"key",urlID, "err",err)
 				}
 			}
 		}
@@ -427,11 +505,11 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 			if globalID != "" {
 				_,lenGlobalHubMap = DeleteFromHubMap(globalID)
 			} else {
-				fmt.Printf("# exitfunc (%s) globalID is empty\n", urlID)
+				logWarn("exitfunc globalID is empty", "calleeID",urlID)
 			}
 			hub = nil
 		} else {
-			fmt.Printf("# exitfunc (%s) hub==nil\n", urlID)
+			logWarn("exitfunc hub==nil", "calleeID",urlID)
 		}
 		myHubMutex.Unlock()
 
@@ -441,7 +519,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		    wsClientMutex.Unlock()
 			//fmt.Printf("exitfunc (%s) done\n", urlID)
 		} else {
-			fmt.Printf("# exitfunc (%s) wsClientID==0\n", urlID)
+			logWarn("exitfunc wsClientID==0", "calleeID",urlID)
 		}
 	}
 
@@ -456,7 +534,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 
 	//fmt.Printf("/login newHub store in local hubMap with globalID=%s\n", globalID)
 	hubMapMutex.Lock()
-	hubMap[globalID] = hub
+	hubMapPut(globalID, hub)
 	hubMapMutex.Unlock()
 
 	//fmt.Printf("/login run hub id=%s durationSecs=%d/%d rt=%v\n",
@@ -481,20 +559,15 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	//	fmt.Printf("/login wsAddr=%s\n",wsAddr)
 	//}
 
-	if logWantedFor("login") {
-		fmt.Printf("/login (%s) success %d %v ws=%d %s v=%s ua=%s\n",
-			urlID, len(calleeLoginSlice), time.Since(startRequestTime), wsClientID,
-			remoteAddrWithPort, clientVersion, userAgent)
-	}
+	logDebug("login", "/login success", "calleeID",urlID, "logins",len(calleeLoginSlice),
+		"rt",time.Since(startRequestTime), "wsid",wsClientID, "rip",remoteAddrWithPort,
+		"ver",clientVersion, "ua",userAgent)
 
-	responseString := fmt.Sprintf("%s|%d|%s|%d|%v|%v",
-		wsAddr,                     // 0
-		dbUser.ConnectedToPeerSecs, // 1
-		outboundIP,                 // 2
-		serviceSecs,                // 3
-		dbUser.Int2&1 != 0,         // 4 isHiddenCallee
-		dbUser.Int2&4 != 0)         // 5 dialSoundsMuted (if bit is set, dialSounds will be muted)
-	fmt.Fprintf(w, responseString)
+	result := LoginResult{Status:loginOK, WsAddr:wsAddr,
+		ConnectedToPeerSecs: dbUser.ConnectedToPeerSecs,
+		ServiceSecs: serviceSecs,
+		Hidden: dbUser.Int2&1 != 0,
+		DialSoundsMuted: dbUser.Int2&4 != 0} // if bit is set, dialSounds will be muted
 
 	if urlID != "" && globalID != "" {
 		// start a goroutine for max X seconds to check if callee has succefully logged in via ws
@@ -556,7 +629,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 					if unregisterNeeded {
 						// this looks like a ws-(re)connect problem
 						// the next login attempt of urlID/globalID will be denied to break it's reconnecter loop
-						fmt.Printf("/login (%s) timeout26s unregisterNeeded\n", urlID)
+						logInfo("/login timeout26s unregisterNeeded", "calleeID",urlID)
 						blockMapMutex.Lock()
 						blockMap[urlID] = time.Now()
 						blockMapMutex.Unlock()
@@ -565,29 +638,28 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 						hub.closeCallee(msg) // -> exitFunc()
 					} else {
 						// callee has exited early
-						if logWantedFor("login") {
-							fmt.Printf("/login (%s/%s) timeout%ds callee gone skip hub.doUnregister\n",
-								urlID, globalID, waitedFor)
-						}
+						logDebug("login", "/login timeout callee gone skip hub.doUnregister", "calleeID",urlID,
+							"globalID",globalID, "secs",waitedFor)
 					}
 
 					if globalID != "" {
 						//_,lenGlobalHubMap =
 							DeleteFromHubMap(globalID)
 					} else {
-						fmt.Printf("# /login (%s/%s) timeout%ds no globalID skip DeleteFromHubMap()\n",
-							urlID, globalID, waitedFor)
+						logWarn("/login timeout no globalID skip DeleteFromHubMap()", "calleeID",urlID,
+							"globalID",globalID, "secs",waitedFor)
 					}
 				}
 			}
 		}()
 	} else {
-		fmt.Printf("# /login (%s/%s) not starting waitForWsConnect\n", urlID, globalID)
+		logWarn("/login not starting waitForWsConnect", "calleeID",urlID, "globalID",globalID)
 	}
-	return
+	return result
 }
 
-func createCookie(w http.ResponseWriter, urlID string, pw string, pwIdCombo *PwIdCombo) (error,string) {
+// createCookie expects hashedPw to be the hashed pw as stored in DbEntry.Password
+func createCookie(w http.ResponseWriter, urlID string, hashedPw string, pwIdCombo *PwIdCombo) (error,string) {
 	// create new cookie with name=webcallid value=urlID
 	// store only if url parameter nocookie is NOT set
 	cookieSecret := fmt.Sprintf("%d", rand.Int63n(99999999999))
@@ -606,12 +678,10 @@ func createCookie(w http.ResponseWriter, urlID string, pw string, pwIdCombo *PwI
 		Expires:  expiration}
 	cookie := &cookieObj
 	http.SetCookie(w, cookie)
-	if logWantedFor("cookie") {
-		fmt.Printf("/login cookie created (%v)\n", cookieValue)
-	}
+	logDebug("cookie", "/login cookie created", "cookie",cookieValue)
 
-	// here we could encrypt the pw
-	pwIdCombo.Pw = pw
+	// never store the cleartext pw here
+	pwIdCombo.Pw = hashedPw
 	pwIdCombo.CalleeId = urlID
 	pwIdCombo.Created = time.Now().Unix()
 	pwIdCombo.Expiration = expiration.Unix()
@@ -7,6 +7,7 @@ package main
 import (
 	"net/http"
 	"fmt"
+	"errors"
 	"io"
 	"time"
 	"strings"
@@ -136,45 +137,48 @@ func httpFetchID(w http.ResponseWriter, r *http.Request, urlID string, calleeID
 
 	if allowNewAccounts {
 		// create new random, free ID, register it and return it
-		registerID,err := GetRandomCalleeID()
+		registerID,err := registerMappingID(calleeID, remoteAddr, startRequestTime)
 		if err!=nil {
-			fmt.Printf("# /fetchid (%s) GetRandomCalleeID err=%v\n",calleeID,err)
-			return
-		}
-		if registerID=="" {
-			fmt.Printf("# /fetchid (%s) registerID is empty\n",calleeID)
+			fmt.Printf("# /fetchid (%s) newid=%s err=%v\n", calleeID, registerID, err)
+			fmt.Fprint(w,"error cannot register ID")
 			return
 		}
+		fmt.Fprint(w,registerID)
+	}
 
-		var dbEntryRegistered DbEntry
-		err = kvMain.Get(dbRegisteredIDs,registerID,&dbEntryRegistered)
-		if err==nil {
-			// registerID is already registered
-			fmt.Printf("# /fetchid (%s) newid=%s already registered db=%s bucket=%s\n",
-				calleeID, registerID, dbMainName, dbRegisteredIDs)
-			fmt.Fprintf(w, "error already registered")
-// TODO jump to GetRandomCalleeID()?
-			return
-		}
+	return
+}
 
-		unixTime := startRequestTime.Unix()
-		// "nopw": tmpID's don't have passwords
-		err = kvMain.Put(dbRegisteredIDs, registerID, DbEntry{unixTime, remoteAddr, "nopw"}, false)
-		if err!=nil {
-			fmt.Printf("# /fetchid (%s) error db=%s bucket=%s put err=%v\n",
-				registerID,dbMainName,dbRegisteredIDs,err)
-			fmt.Fprintf(w,"error cannot register ID")
-			// TODO this is bad! got to role back kvMain.Put((dbUser...) from above
-		} else {
-			// add registerID -> calleeID (assign) to mapping.map
-			mappingMutex.Lock()
-			mapping[registerID] = MappingDataType{calleeID,"none"}
-			mappingMutex.Unlock()
-			fmt.Fprintf(w,registerID)
-		}
+// registerMappingID registers a new random, free ID without a pw ("nopw")
+// and maps it to calleeID (used by /fetchid and POST /api/v1/mapping)
+func registerMappingID(calleeID string, remoteAddr string, startRequestTime time.Time) (string,error) {
+	registerID,err := GetRandomCalleeID()
+	if err!=nil {
+		return "",err
+	}
+	if registerID=="" {
+		return "",errors.New("registerID is empty")
 	}
 
-	return
+	var dbEntryRegistered DbEntry
+	err = kvMain.Get(dbRegisteredIDs,registerID,&dbEntryRegistered)
+	if err==nil {
+		// TODO jump to GetRandomCalleeID()?
+		return registerID,fmt.Errorf("already registered db=%s bucket=%s", dbMainName, dbRegisteredIDs)
+	}
+
+	unixTime := startRequestTime.Unix()
+	// "nopw": tmpID's don't have passwords
+	err = kvMain.Put(dbRegisteredIDs, registerID, DbEntry{unixTime, remoteAddr, "nopw"}, false)
+	if err!=nil {
+		return registerID,fmt.Errorf("db=%s bucket=%s put err=%v", dbMainName, dbRegisteredIDs, err)
+	}
+
+	// add registerID -> calleeID (assign) to mapping.map
+	mappingMutex.Lock()
+	mapping[registerID] = MappingDataType{calleeID,"none"}
+	mappingMutex.Unlock()
+	return registerID,nil
 }
 
 func httpSetAssign(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
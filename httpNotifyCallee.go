@@ -2,8 +2,8 @@
 //
 // WebCall server will send push notifications to callees
 // if they have specified such channels and if they are not online 
-// at the time of a call (or are hidden). Push notifications can be 
-// sent via WebPush and/or Twitter.
+// at the time of a call (or are hidden). Push notifications are sent
+// via the notifiers in notifier.go (WebPush, Twitter, webhook, email, ...).
 //
 // httpCanbenotified() is called via XHR "/rtcsig/canbenotified".
 // This method checks if the specified callee has at least one 
@@ -29,9 +29,9 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"sync"
+	"errors"
 	"github.com/mehrvarz/webcall/twitter"
 	"github.com/mrjones/oauth"
-//	webpush "github.com/SherClockHolmes/webpush-go"
 )
 
 var twitterClient *twitter.DesktopClient = nil
@@ -104,6 +104,13 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 	}
 	fmt.Printf("/notifyCallee (%s) from callerId=(%s) name=(%s) msg=(%s) %s\n",
 		urlID, callerIdLong, callerName, logTxtMsg, remoteAddr)
+	reason := callFilter(urlID, CallAttempt{CallerID:callerIdLong, CallerName:callerName, Msg:callerMsg,
+		Ip:remoteAddr, Stage:"notify"})
+	if reason!="" {
+		// JS will tell caller: could not reach urlID
+		fmt.Printf("/notifyCallee (%s) blocked (%s) callerId=(%s) %s\n", urlID, reason, callerIdLong, remoteAddr)
+		return
+	}
 	if dbUser.StoreContacts && callerIdLong!="" && callerName!="" {
 		addContact(urlID, callerIdLong, callerName, "/notifyCallee")
 	}
@@ -129,6 +136,8 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 	}
 
 	notificationSent := 0
+	notificationPending := false
+	notifyOutboxKey := ""
 	if glUrlID == "" {
 		// callee (urlID) is offline - send push notification(s)
 		msg := "Unknown caller"
@@ -145,167 +154,27 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 		if callerMsg!="" {
 			msg += " '"+callerMsg+"'"
 		}
-/*
-		if dbUser.Str2 != "" {
-			// web push device 1 subscription is specified
-			// here we use web push to send a notification
-			err, statusCode := webpushSend(dbUser.Str2, msg, urlID)
-			if err != nil {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 err=%v\n", urlID, err)
-			} else if statusCode == 201 {
-				notificationSent |= 1
-			} else if statusCode == 410 {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 delete subscr\n", urlID)
-				dbUser.Str2 = ""
-			} else {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 status=%d\n",	urlID, statusCode)
-			}
-		}
-
-		if dbUser.Str3 != "" {
-			// web push device 2 subscription is specified
-			// here we use web push to send a notification
-			err, statusCode := webpushSend(dbUser.Str3, msg, urlID)
-			if err != nil {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 err=%v\n", urlID, err)
-			} else if statusCode == 201 {
-				notificationSent |= 2
-			} else if statusCode == 410 {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 delete subscr\n", urlID)
-				dbUser.Str3 = ""
-			} else {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 status=%d\n",
-					urlID, statusCode)
+		// move legacy web push subscriptions into dbWebPushBucket
+		if webpushMigrate(urlID, &dbUser) {
+			err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
+			if err!=nil {
+				fmt.Printf("# /notifyCallee (%s) store dbUser after webpush migrate err=%v\n", urlID, err)
 			}
 		}
-*/
-		// notify urlID via twitter message
-		// here we use twitter message (or twitter direct message) to send a notification
-		if dbUser.Email2 != "" {
-			// twitter handle exists
-			twitterClientLock.Lock()
-			if twitterClient == nil {
-				twitterAuth()
-			}
-			twitterClientLock.Unlock()
-			if twitterClient == nil {
-				fmt.Printf("# /notifyCallee (%s) failed no twitterClient\n", urlID)
-				// script will tell caller: could not reach urlID
-			} else {
-				// we are authenticated to twitter, does this user have a twid?
-				var twid int64 = 0
-				if dbUser.Str1 == "" {
-					// if twitter-id (dbUser.Str1) is NOT given, get it via twitter handle (dbUser.Email2)
-					twitterClientLock.Lock()
-					userDetail, _, err := twitterClient.QueryFollowerByName(dbUser.Email2)
-					twitterClientLock.Unlock()
-					if err!=nil {
-						fmt.Printf("# /notifyCallee (%s) twhandle=(%s) err=%v (%s)\n",
-							urlID, dbUser.Email2, err, msg)
-					} else {
-						fmt.Printf("/notifyCallee (%s) twhandle=(%s) fetched id=%v\n",
-							urlID, dbUser.Email2, userDetail.ID)
-						if userDetail.ID > 0 {
-							// dbUser.Email2 is a real twitter handle
-							twid = userDetail.ID
-							dbUser.Str1 = fmt.Sprintf("%d",twid)
-							// store this modified dbUser
-							err2 := kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
-							if err2!=nil {
-								fmt.Printf("# /notifyCallee (%s) kvMain.Put fail err=%v\n", urlID, err2)
-							}
-						}
-					}
-				} else {
-					fmt.Printf("/notifyCallee (%s) twhandle=(%s) stored Str1=%s\n",
-						urlID, dbUser.Email2, dbUser.Str1)
-					// tw-id is given
-					i64, err := strconv.ParseInt(dbUser.Str1, 10, 64)
-					if err!=nil {
-						fmt.Printf("# /notifyCallee (%s) ParseInt64 Str1=(%s) err=%v\n",
-							urlID, dbUser.Str1, err)
-					} else {
-						twid = i64
-					}
-				}
-
-				// check if dbUser.Email2 is a follower
-				isFollower := false
-				if twid>0 {
-					// check if twid exist in followerIDs
-					followerIDsLock.RLock()
-					for _,id := range followerIDs.Ids {
-						if id == twid {
-							isFollower = true
-							break
-						}
-					}
-					followerIDsLock.RUnlock()
-				}
-
-				// send tweet only if user is a follower
-				if isFollower {
-					// twid is a follower
-
-					maxlen := 30
-					if len(dbUser.Email2) < 30 {
-						maxlen = len(dbUser.Email2)
-					}
-					fmt.Printf("/notifyCallee (%s) SendTweet🐦  %s msg=%s\n",
-						urlID, dbUser.Email2[:maxlen], msg)
-/*
-					if strings.HasPrefix(dbUser.Email2, "@") {
-						msg = dbUser.Email2 + " " + msg
-					} else {
-						msg = "@" + dbUser.Email2 + " " + msg
-					}
-					msg = msg + " " + operationalNow().Format("2006-01-02 15:04:05")
-					respdata, err := twitterClient.SendTweet(msg)
-*/
-					respdata, err := twitterClient.SendDirect(dbUser.Str1, msg)
-					if err != nil {
-						// failed to send tweet
-						fmt.Printf("# /notifyCallee (%s) %s SendTweet err=%v msg=%s\n",
-							urlID, dbUser.Email2[:maxlen], err, msg)
-						// something is wrong with tw-handle (dbUser.Email2) clear the twid (dbUser.Str1)
-						dbUser.Str1 = ""
-						err2 := kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
-						if err2!=nil {
-							fmt.Printf("# /notifyCallee (%s) kvMain.Put fail err=%v\n", urlID, err2)
-						}
-					} else {
-// TODO twitter.TimelineTweet is the wrong struct for direct messages 
-// therefor tweet.IdStr is empty
-						tweet := twitter.TimelineTweet{}
-						err = json.Unmarshal(respdata, &tweet)
-						if err != nil {
-							fmt.Printf("# SendTweet (%s) cannot parse respdata err=%v\n", urlID, err)
-						} else {
-							// twitter notification succesfully sent
-							notificationSent |= 4
-							maxlen := 30
-							if len(dbUser.Email2) < 30 {
-								maxlen = len(dbUser.Email2)
-							}
-							fmt.Printf("SendTweet (%s) OK twHandle=%s tweetId=%s\n",
-								urlID, dbUser.Email2[:maxlen], tweet.IdStr)
-
-//							// in 1hr we want to delete this tweet in ticker3min() via tweet.Id
-//							// so we store tweet.Id dbSentNotifTweets
-//							notifTweet := NotifTweet{time.Now().Unix(), msg}
-//							err = kvNotif.Put(dbSentNotifTweets, tweet.IdStr, notifTweet, false)
-//							if err != nil {
-//								fmt.Printf("# /notifyCallee (%s) failed to store dbSentNotifTweets (%s)\n",
-//									urlID, tweet.IdStr)
-//							}
-
-						}
-					}
-				}
-			}
+		if contactRingPolicy(urlID, callerIdLong)=="silent" {
+			// this contact does not trigger notifications
+			fmt.Printf("/notifyCallee (%s) contact (%s) ring policy silent\n", urlID, callerIdLong)
+		} else {
+			// queue the notification in the outbox; failed deliveries are retried while the caller waits
+			var outboxEntry OutboxEntry
+			notifyOutboxKey, outboxEntry, _ = outboxSubmit(&Notification{CalleeID:urlID, CallerID:callerIdLong,
+				CallerName:callerName, CallerMsg:callerMsg, Text:msg, Time:time.Now().Unix(),
+				dbUser:&dbUser, dbUserKey:dbUserKey}, remoteAddr)
+			notificationSent = outboxEntry.sent()
+			notificationPending = outboxEntry.pending()>0
 		}
 
-		if notificationSent==0 {
+		if notificationSent==0 && !notificationPending {
 			// we could not send any notifications (could be hidden online callee has just gone offline)
 			// store call as missed call
 			if(dbUser.StoreMissedCalls) {
@@ -316,6 +185,9 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 			} else {
 				fmt.Printf("# /notifyCallee (%s) could not send notification\n", urlID)
 			}
+			if notifyOutboxKey!="" {
+				outboxRelease(notifyOutboxKey, "failed")
+			}
 			return
 		}
 	}
@@ -339,7 +211,7 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 		// we can ignore this
 	}
 
-	if notificationSent>0 || calleeIsHiddenOnline {
+	if notificationSent>0 || notificationPending || calleeIsHiddenOnline {
 		// we now "freeze" the caller's xhr until callee goes online and sends a value to the caller's chan
 		// waitingCallerChanMap[urlID] <- 1 to signal it is picking up the call
 		//fmt.Printf("/notifyCallee (%s) notification sent; freeze caller\n", urlID)
@@ -366,6 +238,14 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 				} else {
 					calleeWsClient.Write([]byte("waitingCallers|" + string(json)))
 				}
+			} else if globHub != nil {
+				// callee is hosted by another cluster node
+				json, err := json.Marshal(waitingCallerSlice)
+				if err != nil {
+					fmt.Printf("# /notifyCallee (%s) json.Marshal(waitingCallerSlice) err=%v\n", urlID, err)
+				} else if err = SendToCallee(glUrlID, []byte("waitingCallers|" + string(json))); err != nil {
+					fmt.Printf("# /notifyCallee (%s) SendToCallee err=%v\n", glUrlID, err)
+				}
 			}
 		}
 
@@ -400,7 +280,9 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 						glUrlID, remoteAddr, err)
 				} else {
 					hubMapMutex.RLock()
-					calleeWsClient = hubMap[glUrlID].CalleeClient
+					if myhub := hubMap[glUrlID]; myhub!=nil {
+						calleeWsClient = myhub.CalleeClient
+					}
 					hubMapMutex.RUnlock()
 
 					// clear unHiddenForCaller after a while, say, after 3 min
@@ -448,11 +330,21 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 				fmt.Printf("/notifyCallee (%s/%s) GetOnlineCallee() is empty\n", urlID, glUrlID)
 			} else {
 				hubMapMutex.RLock()
-				calleeWsClient = hubMap[glUrlID].CalleeClient
+				if myhub := hubMap[glUrlID]; myhub!=nil {
+					calleeWsClient = myhub.CalleeClient
+				}
 				hubMapMutex.RUnlock()
 			}
 		}
 
+		if notifyOutboxKey!="" {
+			if callerGaveUp {
+				outboxRelease(notifyOutboxKey, "abandoned")
+			} else {
+				outboxRelease(notifyOutboxKey, "answered")
+			}
+		}
+
 		//fmt.Printf("/notifyCallee (%s) delete callee online-notification chan\n", urlID)
 		waitingCallerChanLock.Lock()
 		delete(waitingCallerChanMap, remoteAddrWithPort)
@@ -476,7 +368,7 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 		}
 	}
 
-	var missedCallsSlice []CallerInfo
+	var missedCallsSlice []MissedCall
 	if callerGaveUp && dbUser.StoreMissedCalls {
 		// store missed call
 		//fmt.Printf("/notifyCallee (%s) store missed call\n", urlID)
@@ -701,6 +593,14 @@ func httpCanbenotified(w http.ResponseWriter, r *http.Request, urlID string, rem
 		callerIdLong += "@"+callerHost
 	}
 
+	reason := callFilter(urlID, CallAttempt{CallerID:callerIdLong, CallerName:callerName,
+		Ip:remoteAddr, Stage:"canbenotified"})
+	if reason!="" {
+		// like a callee that can not be notified, but without a missed call
+		fmt.Printf("/canbenotified (%s) blocked (%s) <- %s (%s)\n", urlID, reason, remoteAddr, callerIdLong)
+		return
+	}
+
 	// check if callee is hidden online
 	calleeIsHiddenOnline := false
 	ejectOn1stFound := true
@@ -721,29 +621,8 @@ func httpCanbenotified(w http.ResponseWriter, r *http.Request, urlID string, rem
 
 	calleeHasPushChannel := false
 	if !calleeIsHiddenOnline {
-		// has twitter account?
-		if dbUser.Email2!="" && dbUser.Str1!="" {
-			// if a follower?
-			twid, err := strconv.ParseInt(dbUser.Str1, 10, 64)
-			if err!=nil {
-				fmt.Printf("# /notifyCallee (%s) ParseInt64 Str1=(%s) err=%v\n",
-					urlID, dbUser.Str1, err)
-			} else if twid>0 {
-				// check if twid exist in followerIDs
-				isFollower := false
-				followerIDsLock.RLock()
-				for _,id := range followerIDs.Ids {
-					if id == twid {
-						isFollower = true
-						break
-					}
-				}
-				followerIDsLock.RUnlock()
-				if isFollower {
-					calleeHasPushChannel = true
-				}
-			}
-		}
+		// any of the callee's notification channels ready?
+		calleeHasPushChannel = notifyReady(urlID, &dbUser)
 	}
 
 	if calleeIsHiddenOnline || calleeHasPushChannel {
@@ -766,39 +645,6 @@ func httpCanbenotified(w http.ResponseWriter, r *http.Request, urlID string, rem
 	return
 }
 
-func addMissedCall(urlID string, caller CallerInfo, cause string) (error, []CallerInfo) {
-	// do we need to check StoreMissedCalls here? NO, it is always checked before this is called
-	var missedCallsSlice []CallerInfo
-	err := kvCalls.Get(dbMissedCalls,urlID,&missedCallsSlice)
-	if err!=nil && strings.Index(err.Error(),"key not found")<0 {
-		fmt.Printf("# addMissedCall (%s) failed to read dbMissedCalls (%v) err=%v\n",
-			urlID, caller, err)
-	}
-	// make sure we never keep/show more than 10 missed calls
-	maxMissedCalls := 10
-	if len(missedCallsSlice) >= maxMissedCalls {
-		missedCallsSlice = missedCallsSlice[len(missedCallsSlice)-(maxMissedCalls-1):]
-	}
-	// TODO: maybe NOT save urlID == caller.CallerID (sending to self)
-	missedCallsSlice = append(missedCallsSlice, caller)
-	err = kvCalls.Put(dbMissedCalls, urlID, missedCallsSlice, true) // TODO: skipConfirm really?
-	if err!=nil {
-		fmt.Printf("# addMissedCall (%s) failed to store dbMissedCalls (%v) err=%v\n", urlID, caller, err)
-		return err,nil
-	}
-	if logWantedFor("missedcall") {
-		logTxtMsg := caller.Msg
-		if logTxtMsg!="" {
-			// do not log actual msg
-			logTxtMsg = "hidden"
-		}
-		// caller.CallerID may contain @callerHost
-		fmt.Printf("missedCall (%s) <- (%s) name=%s ip=%s msg=(%s) cause=(%s)\n",
-			urlID, caller.CallerID, caller.CallerName, caller.AddrPort, logTxtMsg, cause)
-	}
-	return err,missedCallsSlice
-}
-
 func addContact(calleeID string, callerID string, callerName string, cause string) error {
 	if strings.HasPrefix(calleeID,"answie") {
 		return nil
@@ -813,20 +659,24 @@ func addContact(calleeID string, callerID string, callerName string, cause strin
 		return nil
 	}
 
-	idNameMap := make(map[string]string) // callerID -> name
-	err := kvContacts.Get(dbContactsBucket,calleeID,&idNameMap)
-	if err!=nil {
-		//fmt.Printf("# addContact get key=%s err=%v (ignored)\n", calleeID, err)
-		//can be ignored: return err // key not found (empty)
-	}
-	oldName,ok := idNameMap[callerID]
-	if ok && oldName!="" {
-		//fmt.Printf("# addContact store key=%s callerID=%s EXISTS(%s) newname=%s cause=%s\n",
-		//	calleeID, callerID, oldName, callerName, cause)
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		oldContact,ok := contacts[callerID]
+		if ok && oldContact.Name!="" {
+			//fmt.Printf("# addContact store key=%s callerID=%s EXISTS(%s) newname=%s cause=%s\n",
+			//	calleeID, callerID, oldContact.Name, callerName, cause)
+			return errContactUnchanged
+		}
+		oldContact.ID = callerID
+		oldContact.Name = callerName
+		if oldContact.Created==0 {
+			oldContact.Created = time.Now().Unix()
+		}
+		contacts[callerID] = oldContact
+		return nil
+	})
+	if err==errContactUnchanged {
 		return nil
 	}
-	idNameMap[callerID] = callerName
-	err = kvContacts.Put(dbContactsBucket, calleeID, idNameMap, true)
 	if err!=nil {
 		fmt.Printf("# addContact store key=%s err=%v\n", calleeID, err)
 		return err
@@ -836,34 +686,164 @@ func addContact(calleeID string, callerID string, callerName string, cause strin
 	return nil
 }
 
+// twitterNotify sends n.Text as a direct message to the twitter handle of the callee (dbUser.Email2)
+// the twitter-id (dbUser.Str1) is fetched and stored if needed
+func twitterNotify(n *Notification) error {
+	urlID := n.CalleeID
+	dbUser := n.dbUser
+	msg := n.Text
+	if dbUser==nil || dbUser.Email2 == "" {
+		return NotifyPermanentError{errors.New("no twitter handle")}
+	}
+	// twitter handle exists
+	twitterClientLock.Lock()
+	if twitterClient == nil {
+		twitterAuth()
+	}
+	twitterClientLock.Unlock()
+	if twitterClient == nil {
+		// script will tell caller: could not reach urlID
+		return errors.New("no twitterClient")
+	} else {
+		// we are authenticated to twitter, does this user have a twid?
+		var twid int64 = 0
+		if dbUser.Str1 == "" {
+			// if twitter-id (dbUser.Str1) is NOT given, get it via twitter handle (dbUser.Email2)
+			twitterClientLock.Lock()
+			userDetail, _, err := twitterClient.QueryFollowerByName(dbUser.Email2)
+			twitterClientLock.Unlock()
+			if err!=nil {
+				fmt.Printf("# /notifyCallee (%s) twhandle=(%s) err=%v (%s)\n",
+					urlID, dbUser.Email2, err, msg)
+			} else {
+				fmt.Printf("/notifyCallee (%s) twhandle=(%s) fetched id=%v\n",
+					urlID, dbUser.Email2, userDetail.ID)
+				if userDetail.ID > 0 {
+					// dbUser.Email2 is a real twitter handle
+					twid = userDetail.ID
+					dbUser.Str1 = fmt.Sprintf("%d",twid)
+					// store this modified dbUser
+					err2 := kvMain.Put(dbUserBucket, n.dbUserKey, dbUser, false)
+					if err2!=nil {
+						fmt.Printf("# /notifyCallee (%s) kvMain.Put fail err=%v\n", urlID, err2)
+					}
+				}
+			}
+		} else {
+			fmt.Printf("/notifyCallee (%s) twhandle=(%s) stored Str1=%s\n",
+				urlID, dbUser.Email2, dbUser.Str1)
+			// tw-id is given
+			i64, err := strconv.ParseInt(dbUser.Str1, 10, 64)
+			if err!=nil {
+				fmt.Printf("# /notifyCallee (%s) ParseInt64 Str1=(%s) err=%v\n",
+					urlID, dbUser.Str1, err)
+			} else {
+				twid = i64
+			}
+		}
+
+		// check if dbUser.Email2 is a follower
+		isFollower := false
+		if twid>0 {
+			// check if twid exist in followerIDs
+			followerIDsLock.RLock()
+			for _,id := range followerIDs.Ids {
+				if id == twid {
+					isFollower = true
+					break
+				}
+			}
+			followerIDsLock.RUnlock()
+		}
+
+		// send tweet only if user is a follower
+		if isFollower {
+			// twid is a follower
+
+			maxlen := 30
+			if len(dbUser.Email2) < 30 {
+				maxlen = len(dbUser.Email2)
+			}
+			fmt.Printf("/notifyCallee (%s) SendTweet🐦  %s msg=%s\n",
+				urlID, dbUser.Email2[:maxlen], msg)
 /*
-func webpushSend(subscription string, msg string, urlID string) (error,int) {
-	// Decode subscription
-	s := &webpush.Subscription{}
-	json.Unmarshal([]byte(subscription), s)
-	//fmt.Printf("unmarshalled subscription (%v)\n",s)
+			if strings.HasPrefix(dbUser.Email2, "@") {
+				msg = dbUser.Email2 + " " + msg
+			} else {
+				msg = "@" + dbUser.Email2 + " " + msg
+			}
+			msg = msg + " " + operationalNow().Format("2006-01-02 15:04:05")
+			respdata, err := twitterClient.SendTweet(msg)
+*/
+			respdata, err := twitterClient.SendDirect(dbUser.Str1, msg)
+			if err != nil {
+				// failed to send tweet
+				fmt.Printf("# /notifyCallee (%s) %s SendTweet err=%v msg=%s\n",
+					urlID, dbUser.Email2[:maxlen], err, msg)
+				// something is wrong with tw-handle (dbUser.Email2) clear the twid (dbUser.Str1)
+				dbUser.Str1 = ""
+				err2 := kvMain.Put(dbUserBucket, n.dbUserKey, dbUser, false)
+				if err2!=nil {
+					fmt.Printf("# /notifyCallee (%s) kvMain.Put fail err=%v\n", urlID, err2)
+				}
+				return err
+			} else {
+// TODO twitter.TimelineTweet is the wrong struct for direct messages 
+// therefor tweet.IdStr is empty
+				tweet := twitter.TimelineTweet{}
+				err = json.Unmarshal(respdata, &tweet)
+				if err != nil {
+					fmt.Printf("# SendTweet (%s) cannot parse respdata err=%v\n", urlID, err)
+					return err
+				} else {
+					// twitter notification succesfully sent
+					maxlen := 30
+					if len(dbUser.Email2) < 30 {
+						maxlen = len(dbUser.Email2)
+					}
+					fmt.Printf("SendTweet (%s) OK twHandle=%s tweetId=%s\n",
+						urlID, dbUser.Email2[:maxlen], tweet.IdStr)
+
+//					// in 1hr we want to delete this tweet in ticker3min() via tweet.Id
+//					// so we store tweet.Id dbSentNotifTweets
+//					notifTweet := NotifTweet{time.Now().Unix(), msg}
+//					err = kvNotif.Put(dbSentNotifTweets, tweet.IdStr, notifTweet, false)
+//					if err != nil {
+//						fmt.Printf("# /notifyCallee (%s) failed to store dbSentNotifTweets (%s)\n",
+//							urlID, tweet.IdStr)
+//					}
+					return nil
+				}
+			}
+		}
+	}
+	return NotifyPermanentError{errors.New("not a follower")}
+}
 
-	// Send Notification
-	readConfigLock.RLock()
-	httpResponse, err := webpush.SendNotification([]byte(msg), s, &webpush.Options{
-		Subscriber:      adminEmail, // Do not use "mailto:"
-		VAPIDPublicKey:  vapidPublicKey,
-		VAPIDPrivateKey: vapidPrivateKey,
-		TTL:             60,
-	})
-	readConfigLock.RUnlock()
-	if err != nil {
-		maxlen:=30; if len(subscription)<30 { maxlen=len(subscription) }
-		fmt.Printf("# webpush.SendNotif err=%v (id=%s) (%s)\n",
-			urlID, err, subscription[:maxlen])
-		return err, 0
-	}
-	// httpResponse.StatusCode should be 201
-	fmt.Printf("webpush.SendNotif OK id=%s (httpRespCode=%v) (%s)\n", urlID, httpResponse.StatusCode, subscription)
-	httpResponse.Body.Close()
-	return err, httpResponse.StatusCode
+// twitterIsFollower reports if the stored twitter-id of the callee (dbUser.Str1) follows the server account
+func twitterIsFollower(urlID string, dbUser *DbUser) bool {
+	if dbUser.Email2=="" || dbUser.Str1=="" {
+		return false
+	}
+	twid, err := strconv.ParseInt(dbUser.Str1, 10, 64)
+	if err!=nil {
+		fmt.Printf("# /notifyCallee (%s) ParseInt64 Str1=(%s) err=%v\n",
+			urlID, dbUser.Str1, err)
+		return false
+	}
+	if twid<=0 {
+		return false
+	}
+	// check if twid exist in followerIDs
+	followerIDsLock.RLock()
+	defer followerIDsLock.RUnlock()
+	for _,id := range followerIDs.Ids {
+		if id == twid {
+			return true
+		}
+	}
+	return false
 }
-*/
 
 func twitterAuth() {
 	// twitterClientLock must be set outside
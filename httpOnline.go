@@ -7,6 +7,8 @@
 //
 // These methods provide the functionality for callees to 
 // register new accounts. And for callers to call callees.
+// The work is done by calleeOnline(), newCalleeID() and registerCallee(),
+// which are also used by "/api/v1/" (see httpApiV1.go).
 
 package main
 
@@ -18,7 +20,46 @@ import (
 	"io"
 )
 
+// OnlineResult is the outcome of calleeOnline()
+type OnlineResult struct {
+	Status int
+	WsAddr string // for onlineAvail
+	OfflineSecs int64 // for onlineNotAvailTemp
+}
+
+const (
+	onlineError = iota
+	onlineAvail
+	onlineBusy
+	onlineNotAvail
+	onlineNotAvailTemp // callee has been offline for only a few minutes (caller may wait)
+	onlineGone         // the caller has given up waiting (no response)
+)
+
+// response returns the "/rtcsig/online" text response for result
+func (result OnlineResult) response() string {
+	switch result.Status {
+	case onlineAvail:
+		return result.WsAddr
+	case onlineBusy:
+		return "busy"
+	case onlineNotAvail:
+		return "notavail"
+	case onlineNotAvailTemp:
+		return fmt.Sprintf("notavailtemp%d",result.OfflineSecs)
+	case onlineGone:
+		return ""
+	}
+	return "error"
+}
+
 func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID string, remoteAddr string) {
+	fmt.Fprint(w, calleeOnline(r, urlID, dialID, remoteAddr).response())
+}
+
+// calleeOnline finds out if callee urlID is online and available for the caller at remoteAddr
+// with ?wait=true it waits up to 15min for a callee that has only been offline for a few minutes
+func calleeOnline(r *http.Request, urlID string, dialID string, remoteAddr string) OnlineResult {
 	// a caller uses this to check if a callee is online and available
 	// NOTE: here the variable naming is twisted
 	// the caller (calleeID) is trying to find out if the specified callee (urlID) is online
@@ -63,8 +104,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 		// error
 		fmt.Printf("# /online GetOnlineCallee(%s/%s) %s v=%s err=%v\n",
 			urlID, glUrlID, remoteAddr, clientVersion, err)
-		fmt.Fprintf(w, "error")
-		return
+		return OnlineResult{Status:onlineError}
 	}
 
 	if glUrlID == "" {
@@ -86,8 +126,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 				// key not found: delay brute
 				time.Sleep(1000 * time.Millisecond)
 			}
-			fmt.Fprintf(w, "error")
-			return
+			return OnlineResult{Status:onlineError}
 		}
 		//fmt.Printf("/online (%s) avail wsAddr=%s (%s) %s v=%s\n",
 		//	urlID, wsAddr, callerId, remoteAddr, clientVersion)
@@ -117,8 +156,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 				// caller.js will respond to "notavailtemp" by requesting /online with &wait=true
 				// and it will wait up to (15min - secsSinceLogoff) for callee to come online
 				// this &wait= request is handeled below, waiting for the caller to come online
-				fmt.Fprintf(w, fmt.Sprintf("notavailtemp%d",secsSinceLogoff))
-				return
+				return OnlineResult{Status:onlineNotAvailTemp, OfflineSecs:secsSinceLogoff}
 			}
 
 			// loop: wait for callee
@@ -140,7 +178,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 					missedCallAllowedMutex.Lock()
 					missedCallAllowedMap[remoteAddr] = time.Now()
 					missedCallAllowedMutex.Unlock()
-					return
+					return OnlineResult{Status:onlineGone}
 				default:
 					glUrlID, locHub, globHub, err = GetOnlineCallee(urlID, ejectOn1stFound, reportBusyCallee,
 						reportHiddenCallee, remoteAddr, "/online")
@@ -152,8 +190,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 						missedCallAllowedMutex.Lock()
 						missedCallAllowedMap[remoteAddr] = time.Now()
 						missedCallAllowedMutex.Unlock()
-						fmt.Fprintf(w, "error")
-						return
+						return OnlineResult{Status:onlineError}
 					}
 					//fmt.Printf("/online (%s) offline temp: glUrlID=(%s) %v %v\n",
 					//	urlID, glUrlID, locHub!=nil, globHub!=nil)
@@ -168,8 +205,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 					missedCallAllowedMutex.Lock()
 					missedCallAllowedMap[remoteAddr] = time.Now()
 					missedCallAllowedMutex.Unlock()
-					fmt.Fprintf(w, "notavail")
-					return
+					return OnlineResult{Status:onlineNotAvail}
 				}
 			}
 
@@ -190,8 +226,17 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			missedCallAllowedMutex.Lock()
 			missedCallAllowedMap[remoteAddr] = time.Now()
 			missedCallAllowedMutex.Unlock()
-			fmt.Fprintf(w, "notavail")
-			return
+			return OnlineResult{Status:onlineNotAvail}
+		}
+	}
+
+	if locHub != nil {
+		reason := callFilter(urlID, CallAttempt{CallerID:callerId, Ip:remoteAddr, Stage:"online"})
+		if reason!="" {
+			// the callee does not want to be called by this caller
+			fmt.Printf("/online (%s) notavail (%s) %s (%s) v=%s\n",
+				urlID, reason, remoteAddr, callerId, clientVersion)
+			return OnlineResult{Status:onlineNotAvail}
 		}
 	}
 
@@ -203,8 +248,9 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 				urlID, glUrlID, locHub.ConnectedCallerIp, locHub.CallerClient!=nil, locHub.IsCalleeHidden)
 		}
 
-		if locHub.ConnectedCallerIp != "" {
+		if locHub.ConnectedCallerIp != "" && (locHub.WaitingClient!=nil || !callWaitingEnabled()) {
 			// this callee (urlID/glUrlID) is online but currently busy
+			// (with call waiting, one more caller may connect; see callwaiting.go)
 			fmt.Printf("/online (%s) busy callerIp=%s <- %s v=%s\n",
 				urlID, locHub.ConnectedCallerIp, remoteAddr, clientVersion)
 			locHub.HubMutex.RUnlock()
@@ -212,8 +258,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			missedCallAllowedMutex.Lock()
 			missedCallAllowedMap[remoteAddr] = time.Now()
 			missedCallAllowedMutex.Unlock()
-			fmt.Fprintf(w, "busy")
-			return
+			return OnlineResult{Status:onlineBusy}
 		}
 
 		if locHub.IsCalleeHidden && locHub.IsUnHiddenForCallerAddr != remoteAddr {
@@ -224,8 +269,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			missedCallAllowedMutex.Lock()
 			missedCallAllowedMap[remoteAddr] = time.Now()
 			missedCallAllowedMutex.Unlock()
-			fmt.Fprintf(w, "notavail")
-			return
+			return OnlineResult{Status:onlineNotAvail}
 		}
 
 		wsClientID := locHub.WsClientID // set by wsClient serve()
@@ -238,8 +282,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			missedCallAllowedMutex.Lock()
 			missedCallAllowedMap[remoteAddr] = time.Now()
 			missedCallAllowedMutex.Unlock()
-			fmt.Fprintf(w, "notavail")
-			return
+			return OnlineResult{Status:onlineNotAvail}
 		}
 
 		if dialID != urlID {
@@ -276,8 +319,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			}
 		}
 		locHub.HubMutex.RUnlock()
-		fmt.Fprintf(w, wsAddr)
-		return
+		return OnlineResult{Status:onlineAvail, WsAddr:wsAddr}
 	}
 
 	if globHub != nil {
@@ -286,8 +328,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			// this callee (urlID/glUrlID) is online but currently busy
 			fmt.Printf("/online (%s/%s) busy callerIp=(%s) %s v=%s ua=%s\n",
 				urlID, glUrlID, globHub.ConnectedCallerIp, remoteAddr, clientVersion, r.UserAgent())
-			fmt.Fprintf(w, "busy")
-			return
+			return OnlineResult{Status:onlineBusy}
 		}
 
 		wsClientID := globHub.WsClientID
@@ -300,8 +341,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 			if err!=nil {
 				fmt.Printf("# /online (%s/%s) rkv.StoreCallerIpInHubMap err=%v\n", urlID, glUrlID, err)
 			}
-			fmt.Fprintf(w, "error")
-			return
+			return OnlineResult{Status:onlineError}
 		}
 
 		wsAddr = globHub.WsUrl
@@ -315,8 +355,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 					glUrlID, wsAddr, callerId, remoteAddr, clientVersion, r.UserAgent())
 			}
 		}
-		fmt.Fprintf(w, wsAddr)
-		return
+		return OnlineResult{Status:onlineAvail, WsAddr:wsAddr}
 	}
 
 	// something has gone wrong - callee not found anywhere
@@ -325,21 +364,24 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, dialID str
 
 	// clear ConnectedCallerIp
 	StoreCallerIpInHubMap(glUrlID, "", false)
-	fmt.Fprintf(w, "error")
-	return
+	return OnlineResult{Status:onlineError}
 }
 
 func httpNewId(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, remoteAddr string) {
-	// get a random ID that is not yet used in hubmap
+	fmt.Fprint(w, newCalleeID(r, remoteAddr))
+}
+
+// newCalleeID returns a random ID that is not yet used in hubmap (or "" on error)
+func newCalleeID(r *http.Request, remoteAddr string) string {
 	if !allowNewAccounts {
 		fmt.Printf("# /newid !allowNewAccounts\n")
-		return
+		return ""
 	}
 
 	tmpCalleeID,err := GetRandomCalleeID()
 	if err!=nil {
 		fmt.Printf("# /newid GetRandomCalleeID err=%v\n",err)
-		return
+		return ""
 	}
 	// NOTE tmpCalleeID is currently free, but it is NOT reserved
 
@@ -357,8 +399,33 @@ func httpNewId(w http.ResponseWriter, r *http.Request, urlID string, calleeID st
 			tmpCalleeID, remoteAddr, clientVersion, r.UserAgent())
 	}
 	time.Sleep(1 * time.Second)
-	fmt.Fprintf(w, tmpCalleeID)
-	return
+	return tmpCalleeID
+}
+
+// RegisterResult is the outcome of registerCallee()
+type RegisterResult int
+
+const (
+	registerOK RegisterResult = iota
+	registerPwTooShort
+	registerAlreadyRegistered
+	registerUserFailed // the DbUser could not be stored
+	registerIDFailed   // the DbEntry could not be stored
+)
+
+// response returns the "/rtcsig/register" text response for result
+func (result RegisterResult) response() string {
+	switch result {
+	case registerOK:
+		return "OK"
+	case registerPwTooShort:
+		return "too short"
+	case registerAlreadyRegistered:
+		return "was already registered"
+	case registerUserFailed:
+		return "cannot register user"
+	}
+	return "cannot register ID"
 }
 
 func httpRegister(w http.ResponseWriter, r *http.Request, urlID string, urlPath string, remoteAddr string, startRequestTime time.Time) {
@@ -396,74 +463,7 @@ func httpRegister(w http.ResponseWriter, r *http.Request, urlID string, urlPath
 			if strings.HasPrefix(pwData,"pw=") {
 				pw = pwData[3:]
 			}
-			// deny if pw is too short or not valid
-			if len(pw)<6 {
-				fmt.Printf("/register (%s) fail pw too short\n",registerID)
-				fmt.Fprintf(w, "too short")
-				return
-			}
-			//fmt.Printf("register pw=%s(%d)\n",pw,len(pw))
-
-			// this can be a fake request
-			// we need to verify if registerID is in use
-			var dbEntryRegistered DbEntry
-			err := kvMain.Get(dbRegisteredIDs,registerID,&dbEntryRegistered)
-			if err==nil {
-				// registerID is already registered
-				fmt.Printf("/register (%s) fail db=%s bucket=%s get already registered\n",
-					registerID, dbMainName, dbRegisteredIDs)
-				fmt.Fprintf(w, "was already registered")
-				return
-			}
-
-			unixTime := startRequestTime.Unix()
-			dbUserKey := fmt.Sprintf("%s_%d",registerID, unixTime)
-			dbUser := DbUser{Ip1:remoteAddr, UserAgent:r.UserAgent()}
-			dbUser.StoreContacts = true
-			dbUser.StoreMissedCalls = true
-			err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
-			if err!=nil {
-				fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
-					registerID, dbMainName, dbUserBucket, err)
-				fmt.Fprintf(w,"cannot register user")
-			} else {
-				err = kvMain.Put(dbRegisteredIDs, registerID,
-						DbEntry{unixTime, remoteAddr, pw}, false)
-				if err!=nil {
-					fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
-						registerID,dbMainName,dbRegisteredIDs,err)
-					fmt.Fprintf(w,"cannot register ID")
-					// TODO this is bad! got to role back kvMain.Put((dbUser...) from above
-				} else {
-					//fmt.Printf("/register (%s) db=%s bucket=%s stored OK\n",
-					//	registerID, dbMainName, dbRegisteredIDs)
-					// registerID is now available for use
-					var pwIdCombo PwIdCombo
-					err,cookieValue := createCookie(w, registerID, pw, &pwIdCombo)
-					if err!=nil {
-						fmt.Printf("/register (%s) create cookie error cookie=%s err=%v\n",
-							registerID, cookieValue, err)
-						// not fatal, but user needs to enter pw again now
-					}
-
-					// preload contacts with 2 Answie accounts
-					var idNameMap map[string]string // callerID -> name
-					err = kvContacts.Get(dbContactsBucket, registerID, &idNameMap)
-					if err!=nil {
-						idNameMap = make(map[string]string)
-					}
-					idNameMap["answie"] = "Answie Spoken"
-					idNameMap["answie7"] = "Answie Jazz"
-					err = kvContacts.Put(dbContactsBucket, registerID, idNameMap, false)
-					if err!=nil {
-						fmt.Printf("# /register (%s) kvContacts.Put err=%v\n", registerID, err)
-					} else {
-						//fmt.Printf("/register (%s) kvContacts.Put OK\n", registerID)
-					}
-
-					fmt.Fprintf(w, "OK")
-				}
-			}
+			fmt.Fprint(w, registerCallee(w, r, registerID, pw, remoteAddr, startRequestTime).response())
 		}
 	} else {
 		fmt.Printf("# /register newAccounts not allowed urlPath=(%s) %s ua=%s\n",
@@ -472,3 +472,71 @@ func httpRegister(w http.ResponseWriter, r *http.Request, urlID string, urlPath
 	return
 }
 
+// registerCallee registers registerID with pw
+// w is only used to set the cookie
+func registerCallee(w http.ResponseWriter, r *http.Request, registerID string, pw string, remoteAddr string, startRequestTime time.Time) RegisterResult {
+	// deny if pw is too short or not valid
+	if len(pw)<6 {
+		fmt.Printf("/register (%s) fail pw too short\n",registerID)
+		return registerPwTooShort
+	}
+	//fmt.Printf("register pw=%s(%d)\n",pw,len(pw))
+
+	// this can be a fake request
+	// we need to verify if registerID is in use
+	var dbEntryRegistered DbEntry
+	err := kvMain.Get(dbRegisteredIDs,registerID,&dbEntryRegistered)
+	if err==nil {
+		// registerID is already registered
+		fmt.Printf("/register (%s) fail db=%s bucket=%s get already registered\n",
+			registerID, dbMainName, dbRegisteredIDs)
+		return registerAlreadyRegistered
+	}
+
+	unixTime := startRequestTime.Unix()
+	dbUserKey := fmt.Sprintf("%s_%d",registerID, unixTime)
+	dbUser := DbUser{Ip1:remoteAddr, UserAgent:r.UserAgent()}
+	dbUser.StoreContacts = true
+	dbUser.StoreMissedCalls = true
+	err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
+	if err!=nil {
+		fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
+			registerID, dbMainName, dbUserBucket, err)
+		return registerUserFailed
+	}
+	hashedPw,err := pwHash(pw)
+	if err==nil {
+		err = kvMain.Put(dbRegisteredIDs, registerID,
+			DbEntry{unixTime, remoteAddr, hashedPw}, false)
+	}
+	if err!=nil {
+		fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
+			registerID,dbMainName,dbRegisteredIDs,err)
+		// TODO this is bad! got to role back kvMain.Put((dbUser...) from above
+		return registerIDFailed
+	}
+	//fmt.Printf("/register (%s) db=%s bucket=%s stored OK\n",
+	//	registerID, dbMainName, dbRegisteredIDs)
+	// registerID is now available for use
+	var pwIdCombo PwIdCombo
+	err,cookieValue := createCookie(w, registerID, hashedPw, &pwIdCombo)
+	if err!=nil {
+		fmt.Printf("/register (%s) create cookie error cookie=%s err=%v\n",
+			registerID, cookieValue, err)
+		// not fatal, but user needs to enter pw again now
+	}
+
+	// preload contacts with 2 Answie accounts
+	err = contactsModify(registerID, func(contacts map[string]Contact) error {
+		now := time.Now().Unix()
+		contacts["answie"] = Contact{ID:"answie", Name:"Answie Spoken", Created:now}
+		contacts["answie7"] = Contact{ID:"answie7", Name:"Answie Jazz", Created:now}
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# /register (%s) kvContacts.Put err=%v\n", registerID, err)
+	} else {
+		//fmt.Printf("/register (%s) kvContacts.Put OK\n", registerID)
+	}
+	return registerOK
+}
@@ -5,6 +5,7 @@
 // client software (HTML + Javascript).
 // Once loaded by the user agent, the clients will send XHR requests
 // to the "/rtcsig/" handler, implemented by httpApiHandler().
+// Native clients use the JSON API "/api/v1/", implemented by httpApiV1Handler().
 
 package main
 
@@ -24,7 +25,6 @@ import (
 	"path/filepath"
 	"crypto/tls"
 	"embed"
-	"github.com/mehrvarz/webcall/skv"
 )
 
 // note: if we use go:embed, config keyword 'htmlPath' must be set to the default value "webroot"
@@ -35,10 +35,13 @@ var embeddedFsShouldBeUsed = false
 
 func httpServer() {
 	http.HandleFunc("/rtcsig/", httpApiHandler)
+	http.HandleFunc(apiV1Prefix+"/", httpApiV1Handler)
 
 	http.HandleFunc("/callee/", substituteUserNameHandler)
 	http.HandleFunc("/user/", substituteUserNameHandler)
 	http.HandleFunc("/button/", substituteUserNameHandler)
+	http.HandleFunc("/cluster/", httpClusterHandler)
+	http.HandleFunc("/metrics", httpMetricsHandler)
 
 	readConfigLock.RLock()
 	embeddedFsShouldBeUsed = false
@@ -358,6 +361,9 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(urlPath,"/rtcsig/") {
 		urlPath = urlPath[7:]
 	}
+	defer func() {
+		metricsHttpDuration.Observe(metricsEndpoint("/rtcsig",urlPath), time.Since(startRequestTime).Seconds())
+	}()
 	if logWantedFor("http") {
 		fmt.Printf("httpApi (%v) tls=%v rip=%s\n", urlPath, r.TLS!=nil, remoteAddrWithPort)
 	}
@@ -407,6 +413,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		clientRequestsMutex.Unlock()
 */
 		if clientRequestAdd(remoteAddr,1) {
+			metricsLoginRateLimitTotal.Inc("requests30m")
 			if logWantedFor("overload") {
 				fmt.Printf("httpApi rip=%s >=%d requests/30m (%s)\n",
 					remoteAddr, maxClientRequestsPer30minTmp, urlPath)
@@ -504,7 +511,25 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 	var pwIdCombo PwIdCombo
 	pw := ""
 	cookie, err := r.Cookie(cookieName)
-	if err != nil {
+	bearer := tokenFromRequest(r,false)
+	if bearer!="" {
+		// native clients authenticate with a bearer token instead of a cookie (see httpToken.go)
+		dbToken,err := tokenAuth(bearer)
+		if err!=nil {
+			fmt.Printf("# httpApi bearer token rejected (%s) %s err=%v\n", urlPath, remoteAddr, err)
+			tokenUnauthorized(w, err)
+			return
+		}
+		if calleeID!="" && calleeID != dbToken.CalleeID && !strings.HasPrefix(urlPath,"/logout") {
+			fmt.Printf("# httpApi calleeID=(%s) != calleeIdFromToken=(%s) (%s) %s\n",
+				calleeID, dbToken.CalleeID, urlPath, remoteAddr)
+			fmt.Fprintf(w,"wrongcookie")
+			return
+		}
+		calleeID = dbToken.CalleeID
+		// a stand-in cookie makes this look like a cookie session to the handlers
+		cookie = tokenSession(calleeID)
+	} else if err != nil {
 		// cookie not avail, not valid or disabled (which is fine for localhost requests)
 		if logWantedFor("cookie") {
 			// don't log for localhost 127.0.0.1 requests
@@ -523,7 +548,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		//fmt.Printf("httpApi cookie avail(%s) req=(%s) ref=(%s) callee=(%s)\n", 
 		//	cookie.Value[:maxlen], r.URL.Path, referer, calleeID)
 
-		// cookie.Value has format: calleeID + "&" + hashedPW
+		// cookie.Value has format: calleeID + "&" + random
 		idxAmpasent := strings.Index(cookie.Value,"&")
 		if idxAmpasent<0 {
 			fmt.Printf("# httpApi error no ampasent in cookie.Value (%s) clear cookie\n", cookie.Value)
@@ -576,7 +601,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 						pwIdCombo, calleeID)
 					cookie = nil
 				} else {
-					// here we could decrypt the pw
+					// pwIdCombo.Pw holds the hashed pw (or the cleartext pw for cookies created before pw hashing)
 					//fmt.Printf("httpApi cookie available for id=(%s) (%s)(%s) reqPath=%s ref=%s rip=%s\n",
 					//	pwIdCombo.CalleeId, calleeID, urlID, r.URL.Path, referer, remoteAddrWithPort)
 					pw = pwIdCombo.Pw
@@ -602,6 +627,15 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		httpCanbenotified(w, r, urlID, remoteAddr, remoteAddrWithPort)
 		return
 	}
+	if urlPath=="/notifystatus" {
+		httpNotifyStatus(w, r, urlID, remoteAddr)
+		return
+	}
+	if urlPath=="/voicemail" {
+		// a caller asking to leave (or leaving) a voicemail
+		httpVoicemail(w, r, urlID, remoteAddr)
+		return
+	}
 	if urlPath=="/missedCall" {
 		// must be a caller that has just failed to connect to a callee
 		// using: /online?id="+calleeID+"&wait=true
@@ -621,6 +655,18 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		httpActions(w, r, urlID, calleeID, cookie, remoteAddr)
 		return
 	}
+	if urlPath=="/cdr" {
+		httpGetCdr(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/webpushsubscribe" {
+		httpWebPushSubscribe(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/webpushunsubscribe" {
+		httpWebPushUnsubscribe(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
 	if strings.HasPrefix(urlPath,"/getcontacts") {
 		httpGetContacts(w, r, urlID, calleeID, cookie, remoteAddr)
 		return
@@ -684,7 +730,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		if cookie!=nil && pw!="" && calleeID==urlID {
+		if cookie!=nil && (pw!="" || bearer!="") && calleeID==urlID {
 			// if calleeID (from cookie) == urlID, then we do NOT need pw-entry on the client
 			//fmt.Printf("/mode normal callee avail (cookie:%s) (url:%s) rip=%s\n",
 			//	calleeID, urlID, remoteAddr)
@@ -718,6 +764,9 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if urlPath=="/logout" {
+		if bearer!="" {
+			tokenRevoke(bearer)
+		}
 		clearCookie(w, r, urlID, remoteAddr, "/logout")
 		return
 	}
@@ -851,13 +900,8 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, ok := kvMain.(skv.SKV)
-		if !ok {
-			// TODO log: httpAdmin() only works with local db
-		} else {
-			if httpAdmin(kvMain.(skv.SKV), w, r, urlPath, urlID, remoteAddr) {
-				return
-			}
+		if httpAdmin(kvMain, w, r, urlPath, urlID, remoteAddr) {
+			return
 		}
 	}
 
@@ -952,7 +996,7 @@ func clearCookie(w http.ResponseWriter, r *http.Request, urlID string, remoteAdd
 	cookie = nil
 }
 
-func waitingCallerToCallee(calleeID string, waitingCallerSlice []CallerInfo, missedCalls []CallerInfo, hubclient *WsClient) {
+func waitingCallerToCallee(calleeID string, waitingCallerSlice []CallerInfo, missedCalls []MissedCall, hubclient *WsClient) {
 	// TODO before we send the waitingCallerSlice, we should remove all elements that are older than 10min
 	if waitingCallerSlice!=nil {
 		//fmt.Printf("waitingCallerToCallee json.Marshal(waitingCallerSlice)...\n")
@@ -979,7 +1023,7 @@ func waitingCallerToCallee(calleeID string, waitingCallerSlice []CallerInfo, mis
 
 	if missedCalls!=nil {
 		//fmt.Printf("waitingCallerToCallee json.Marshal(missedCalls)...\n")
-		jsonStr, err := json.Marshal(missedCalls)
+		jsonStr, err := json.Marshal(missedCallsRecent(missedCalls))
 		if err != nil {
 			fmt.Printf("# waitingCallerToCallee (%s) failed on json.Marshal err=%v\n", calleeID,err)
 		} else if hubclient==nil {
@@ -989,7 +1033,10 @@ func waitingCallerToCallee(calleeID string, waitingCallerSlice []CallerInfo, mis
 				fmt.Printf("waitingCallerToCallee send missedCalls (callee=%s) (unHidden=%s) (%s)\n",
 					calleeID, hubclient.hub.IsUnHiddenForCallerAddr, string(jsonStr))
 			}
-			hubclient.Write([]byte("missedCalls|"+string(jsonStr)))
+			err = hubclient.Write([]byte("missedCalls|"+string(jsonStr)))
+			if err==nil {
+				err = hubclient.Write([]byte("missedCallsUnread|"+strconv.Itoa(missedCallsUnread(missedCalls))))
+			}
 			if err != nil {
 				fmt.Printf("# %s (%s) send waitingCallers %s  <- to callee err=%v\n",
 					hubclient.connType, hubclient.calleeID, hubclient.RemoteAddr, err)
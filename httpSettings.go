@@ -19,6 +19,8 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
+	"github.com/mehrvarz/webcall/skv"
 )
 
 func httpGetSettings(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
@@ -70,8 +72,10 @@ func httpGetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 //		"webPushUA1": dbUser.Str2ua,
 //		"webPushSubscription2": dbUser.Str3,
 //		"webPushUA2": dbUser.Str3ua,
-//		"vapidPublicKey": vapidPublicKey,
+		"vapidPublicKey": vapidPublicKey,
 		"dialSounds": strconv.FormatBool(!(dbUser.Int2&4==4)), // bit4 set for mute (bit4 clear = play dialsounds)
+		"sharePresence": strconv.FormatBool(presenceShared(dbUser)), // bit8 set for not sharing
+		"voicemail": strconv.FormatBool(voicemailEnabled(dbUser)), // bit16 set for voicemail
 	})
 	readConfigLock.RUnlock()
 	if err != nil {
@@ -121,12 +125,18 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 			calleeID, data, remoteAddr, err)
 		return
 	}
+	setSettings(calleeID, newSettingsMap, remoteAddr)
+	return
+}
 
+// setSettings applies newSettingsMap (same keys as returned by /getsettings) to the DbUser of calleeID
+// it is used by /setsettings and by the /api/v1/settings handler
+func setSettings(calleeID string, newSettingsMap map[string]string, remoteAddr string) error {
 	var dbEntry DbEntry
-	err = kvMain.Get(dbRegisteredIDs,calleeID,&dbEntry)
+	err := kvMain.Get(dbRegisteredIDs,calleeID,&dbEntry)
 	if err!=nil {
 		fmt.Printf("# /setsettings (%s) failed on dbRegisteredIDs %s\n", calleeID, remoteAddr)
-		return
+		return err
 	}
 
 	dbUserKey := fmt.Sprintf("%s_%d",calleeID, dbEntry.StartTime)
@@ -134,9 +144,10 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 	err = kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
 	if err!=nil {
 		fmt.Printf("# /setsettings (%s) failed on dbUserBucket %s\n", calleeID, remoteAddr)
-		return
+		return err
 	}
 
+	presenceChanged := false
 	for key,val := range newSettingsMap {
 		switch(key) {
 		case "nickname":
@@ -180,22 +191,12 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 					hub := hubMap[calleeID]
 					hubMapMutex.RUnlock()
 					if hub!=nil && hub.CalleeClient!=nil {
-						var callsWhileInAbsence []CallerInfo
-						err := kvCalls.Get(dbMissedCalls,calleeID,&callsWhileInAbsence)
+						callsWhileInAbsence,err := missedCallsLoad(calleeID)
 						if err!=nil {
-							// "key not found" is here NOT an error
-							if strings.Index(err.Error(),"key not found")<0 {
-								fmt.Printf("# /setsettings (%s) storeMissedCalls kvCalls.Get fail err=%v\n",
-									calleeID, err)
-							}
-						} else {
-							json, err := json.Marshal(callsWhileInAbsence)
-							if err != nil {
-								fmt.Printf("# /setsettings (%s) storeMissedCalls json.Marshal fail err=%v\n",
-									calleeID, err)
-							} else {
-								hub.CalleeClient.Write([]byte("missedCalls|"+string(json)))
-							}
+							fmt.Printf("# /setsettings (%s) storeMissedCalls missedCallsLoad fail err=%v\n",
+								calleeID, err)
+						} else if callsWhileInAbsence!=nil {
+							missedCallsPush(calleeID, callsWhileInAbsence)
 						}
 					}
 				}
@@ -213,6 +214,17 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 					}
 				}
 			}
+		case "sharePresence":
+			if presenceShared(dbUser) != (val=="true") {
+				fmt.Printf("/setsettings (%s) new sharePresence (%s) %s\n", calleeID, val, remoteAddr)
+				dbUser.Int2 ^= 8
+				presenceChanged = true
+			}
+		case "voicemail":
+			if voicemailEnabled(dbUser) != (val=="true") {
+				fmt.Printf("/setsettings (%s) new voicemail (%s) %s\n", calleeID, val, remoteAddr)
+				dbUser.Int2 ^= 16
+			}
 /*
 		case "webPushSubscription1":
 			newVal,err := url.QueryUnescape(val)
@@ -308,8 +320,12 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 			calleeID, dbMainName, dbUserBucket, remoteAddr, err)
 	} else {
 		//fmt.Printf("/setsettings (%s) stored db=%s bucket=%s\n", calleeID, dbMainName, dbUserBucket)
+		if presenceChanged {
+			// let the subscribers see (or not see) the current state
+			presenceRefresh(calleeID)
+		}
 	}
-	return
+	return err
 }
 
 func httpGetContacts(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
@@ -327,12 +343,18 @@ func httpGetContacts(w http.ResponseWriter, r *http.Request, urlID string, calle
 		fmt.Printf("# /getcontacts urlID=%s != calleeID=%s %s\n",urlID,calleeID, remoteAddr)
 		return
 	}
-	var idNameMap map[string]string // callerID(@host) -> name
-	err := kvContacts.Get(dbContactsBucket,calleeID,&idNameMap)
+	contactsMutex.Lock()
+	contacts,err := contactsLoad(calleeID)
+	contactsMutex.Unlock()
 	if err!=nil {
 		fmt.Printf("# /getcontacts db get calleeID=%s %s err=%v\n", calleeID, remoteAddr, err)
 		return
 	}
+	// the callee client expects callerID(@host) -> compoundName
+	idNameMap := make(map[string]string)
+	for contactID,contact := range contacts {
+		idNameMap[contactID] = contact.compoundName()
+	}
 	jsonStr, err := json.Marshal(idNameMap)
 	if err != nil {
 		fmt.Printf("# /getcontacts (%s) failed on json.Marshal %s err=%v\n", calleeID, remoteAddr, err)
@@ -378,18 +400,12 @@ func httpGetContact(w http.ResponseWriter, r *http.Request, urlID string, callee
 			return
 		}
 
-		var idNameMap map[string]string // callerID(@host) -> name
-		err := kvContacts.Get(dbContactsBucket,calleeID,&idNameMap)
-		if err!=nil {
-			fmt.Printf("# /getcontact (%s) db get %s err=%v\n", calleeID, remoteAddr, err)
-			return
-		}
-
-		compoundName := idNameMap[contactID]
-		if compoundName=="" {
+		contact,ok := contactGet(calleeID,contactID)
+		if !ok {
 			//fmt.Printf("/getcontact (%s) id=%s not found rip=%s\n", calleeID, contactID, remoteAddr)
 			return
 		}
+		compoundName := contact.compoundName()
 
 		if logWantedFor("contacts") {
 			fmt.Printf("/getcontact (%s) id=%s found=%s rip=%s\n", calleeID, contactID, compoundName, remoteAddr)
@@ -508,93 +524,57 @@ func setContact(calleeID string, contactID string, compoundName string, remoteAd
 		return false
 	}
 
-	// read the complete contacts for calleeID into idNameMap
-	var idNameMap map[string]string // calleeID -> contactName
-	err = kvContacts.Get(dbContactsBucket,calleeID,&idNameMap)
-	if err!=nil {
-		if(strings.Index(err.Error(),"key not found")<0) {
-			fmt.Printf("# setcontact db get calleeID=%s %s err=%v\n", calleeID, remoteAddr, err)
-			return false
-		}
-		// "key not found" is just an empty contacts list
-		if logWantedFor("contacts") {
-			fmt.Printf("setcontact creating new contacts map %s\n", remoteAddr)
-		}
-		idNameMap = make(map[string]string)
-	}
-
-	// check for contactID
-	oldCompoundName,ok := idNameMap[contactID]
-	if !ok || oldCompoundName=="" {
-		// try lowercase contactID
-		contactID = strings.ToLower(contactID)
-		oldCompoundName,ok = idNameMap[contactID]
-	}
-	if !ok {
-		// check for uppercase contactID
-		toUpperContactID := strings.ToUpper(contactID[0:1])+contactID[1:]
-		if logWantedFor("contacts") {
-			fmt.Printf("setcontact (%s->%s) check toUpperContactID=%s\n",
-				calleeID, contactName, toUpperContactID)
-		}
-		oldCompoundName,ok = idNameMap[toUpperContactID]
+	newCompoundName := ""
+	oldCompoundName := ""
+	err = contactsModify(calleeID, func(contacts map[string]Contact) error {
+		// check for contactID (or lowercase contactID or uppercase contactID)
+		foundID,ok := contactFind(contacts,contactID)
+		var contact Contact
 		if ok {
-			contactID = toUpperContactID
+			contactID = foundID
+			contact = contacts[contactID]
+			oldCompoundName = contact.compoundName()
+			//fmt.Printf("setcontact (%s) oldCompoundName=%s\n", calleeID, oldCompoundName)
+		} else {
+			contactID = strings.ToLower(contactID)
+			contact = Contact{ID:contactID, Created:time.Now().Unix()}
 		}
-	}
-
-	if ok {
-		oldName := ""
-		oldCallerID := "";
-		oldCallerName := "";
-		tokenSlice = strings.Split(oldCompoundName, "|")
-		for idx, tok := range tokenSlice {
-			switch idx {
-				case 0: oldName = tok
-				case 1: oldCallerID = tok
-				case 2: oldCallerName = tok
-			}
+		// empty fields keep their old value
+		if contactName!="" {
+			contact.Name = contactName
 		}
-		//fmt.Printf("setcontact (%s) oldCompoundName=%s oldName=%s\n", calleeID, oldCompoundName, oldName)
-
-		if contactName=="" && oldName!="" {
-			contactName = oldName
+		if callerID!="" {
+			contact.CallerID = callerID
 		}
-
-		if callerID=="" && oldCallerID!="" {
-			callerID = oldCallerID
+		if callerName!="" {
+			contact.CallerName = callerName
 		}
-
-		if callerName=="" && oldCallerName!="" {
-			callerName = oldCallerName
+		if contact.Name=="" {
+			contact.Name = "unknown"
 		}
-	}
-
-	if contactName=="" {
-		contactName = "unknown"
-	}
-
-	newCompoundName := contactName+"|"+callerID+"|"+callerName
-	if newCompoundName == oldCompoundName {
-		// contactName for contactID exists and is same as oldName - don't overwrite
+		newCompoundName = contact.compoundName()
+		if newCompoundName == oldCompoundName {
+			// contact exists and is unchanged - don't overwrite
+			return errContactUnchanged
+		}
+		contacts[contactID] = contact
+		return nil
+	})
+	if err==errContactUnchanged {
 		if logWantedFor("contacts") {
 			fmt.Printf("setcontact (%s) contactID=%s already exists, skip (%s) %s\n",
 				calleeID, contactID, newCompoundName, remoteAddr)
 		}
 		return true
 	}
-
-	if logWantedFor("contacts") {
-		fmt.Printf("setcontact (%s) store ID=%s from (%s) to (%s) %s %s\n",
-			calleeID, contactID, oldCompoundName, newCompoundName, remoteAddr, comment)
-	}
-	idNameMap[contactID] = newCompoundName
-	//fmt.Printf("setcontact (%s) idNameMap=%v\n", calleeID, idNameMap[contactID])
-	err = kvContacts.Put(dbContactsBucket, calleeID, idNameMap, false)
 	if err!=nil {
 		fmt.Printf("# setcontact (%s) store contactID=%s %s err=%v\n", calleeID, contactID, remoteAddr, err)
 		return false
 	}
+	if logWantedFor("contacts") {
+		fmt.Printf("setcontact (%s) store ID=%s from (%s) to (%s) %s %s\n",
+			calleeID, contactID, oldCompoundName, newCompoundName, remoteAddr, comment)
+	}
 	return true
 }
 
@@ -625,25 +605,20 @@ func httpDeleteContact(w http.ResponseWriter, r *http.Request, urlID string, cal
 	}
 
 	// delete a single contactID from calleeID's contacts
-	var idNameMap map[string]string // callerID -> name
-	err := kvContacts.Get(dbContactsBucket,calleeID,&idNameMap)
-	if err!=nil {
-		fmt.Printf("# /deletecontact db get calleeID=%s %s err=%v\n", calleeID, remoteAddr, err)
-		return
-	}
-
-	_,ok = idNameMap[contactID]
-	if !ok {
-		_,ok = idNameMap[strings.ToLower(contactID)]
+	err := contactsModify(calleeID, func(contacts map[string]Contact) error {
+		foundID,ok := contactFind(contacts,contactID)
 		if !ok {
-			fmt.Printf("# /deletecontact (%s) idNameMap[%s] does not exist %s\n",
-				calleeID, contactID, remoteAddr)
-			return
+			return skv.ErrNotFound
 		}
-		contactID = strings.ToLower(contactID)
+		contactID = foundID
+		delete(contacts,contactID)
+		return nil
+	})
+	if err==skv.ErrNotFound {
+		fmt.Printf("# /deletecontact (%s) contact[%s] does not exist %s\n",
+			calleeID, contactID, remoteAddr)
+		return
 	}
-	delete(idNameMap,contactID)
-	err = kvContacts.Put(dbContactsBucket, calleeID, idNameMap, false)
 	if err!=nil {
 		fmt.Printf("# /deletecontact store calleeID=%s %s err=%v\n", calleeID, remoteAddr, err)
 		return
@@ -0,0 +1,453 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Bearer tokens let native apps, CLIs and bots authenticate without
+// faking Referer headers and cookies.
+// POST /api/v1/token with {"id","pw"} returns an access token ("wca_...")
+// and a refresh token ("wcr_..."). The access token is sent as
+// "Authorization: Bearer <token>" to every /rtcsig/ and /api/v1/ endpoint,
+// and to the websocket upgrade (where url parameter "access_token" may be
+// used instead, since browsers cannot set headers on websocket requests).
+// Access tokens expire after accessTokenSecs, refresh tokens after
+// refreshTokenDays. POST /api/v1/token/refresh exchanges a refresh token for
+// a new token pair. Refresh tokens can be used only once: if a used refresh
+// token is presented again, all tokens issued from the same login (the
+// token family) are revoked.
+// POST /api/v1/token/revoke revokes a single token, or (with "all":true) all
+// tokens of the callee. The latter is stored in the revocation list
+// dbTokenRevokedBucket (calleeID -> time of revocation); tokens issued
+// before this time are rejected.
+// Only the sha256 hash of a token is stored (in kvHashedPw, dbTokenBucket).
+
+package main
+
+import (
+	"net/http"
+	"fmt"
+	"errors"
+	"strings"
+	"time"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbTokenBucket = "tokens"               // sha256(token) -> DbToken
+const dbTokenRevokedBucket = "tokenRevoked" // calleeID -> unix time (ns) of revocation
+
+const tokenPrefixAccess = "wca_"
+const tokenPrefixRefresh = "wcr_"
+
+var errTokenInvalid = errors.New("invalid token")
+var errTokenExpired = errors.New("token expired")
+var errTokenRevoked = errors.New("token revoked")
+
+type DbToken struct {
+	CalleeID string
+	Refresh bool
+	Family string     // all tokens issued from the same /api/v1/token request share this
+	Issued int64      // unix time in ns
+	Expiration int64  // unix time
+	Used bool         // refresh token has already been exchanged
+}
+
+type ApiTokenRequest struct {
+	ID string `json:"id"`
+	Pw string `json:"pw"`
+}
+
+type ApiTokenRefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type ApiTokenRevokeRequest struct {
+	Token string `json:"token,omitempty"`
+	All bool `json:"all,omitempty"`
+}
+
+type ApiTokenResponse struct {
+	ID string `json:"id"`
+	AccessToken string `json:"accessToken"`
+	TokenType string `json:"tokenType"`
+	ExpiresIn int64 `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+	RefreshExpiresIn int64 `json:"refreshExpiresIn"`
+}
+
+// tokenFromRequest returns the bearer token of r, or "" if there is none
+// url parameter access_token is only accepted if allowUrlArg is set (for websocket upgrades)
+func tokenFromRequest(r *http.Request, allowUrlArg bool) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth)>7 && strings.EqualFold(auth[:7],"bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if allowUrlArg {
+		url_arg_array, ok := r.URL.Query()["access_token"]
+		if ok && len(url_arg_array[0]) > 0 {
+			return url_arg_array[0]
+		}
+	}
+	return ""
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenCreate(calleeID string, refresh bool, family string) (string,DbToken,error) {
+	buf := make([]byte, 32)
+	_,err := rand.Read(buf)
+	if err!=nil {
+		return "",DbToken{},err
+	}
+	readConfigLock.RLock()
+	lifetime := time.Duration(accessTokenSecs) * time.Second
+	if refresh {
+		lifetime = time.Duration(refreshTokenDays) * 24 * time.Hour
+	}
+	readConfigLock.RUnlock()
+
+	token := tokenPrefixAccess + hex.EncodeToString(buf)
+	if refresh {
+		token = tokenPrefixRefresh + hex.EncodeToString(buf)
+	}
+	now := time.Now()
+	dbToken := DbToken{CalleeID:calleeID, Refresh:refresh, Family:family,
+		Issued:now.UnixNano(), Expiration:now.Add(lifetime).Unix()}
+	err = kvHashedPw.Put(dbTokenBucket, tokenHash(token), dbToken, false)
+	if err!=nil {
+		return "",DbToken{},err
+	}
+	return token, dbToken, nil
+}
+
+// tokenCreatePair issues an access token and a refresh token of the same family
+func tokenCreatePair(calleeID string, family string) (ApiTokenResponse,error) {
+	if family=="" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		family = hex.EncodeToString(buf)
+	}
+	accessToken,accessDbToken,err := tokenCreate(calleeID, false, family)
+	if err!=nil {
+		return ApiTokenResponse{},err
+	}
+	refreshToken,refreshDbToken,err := tokenCreate(calleeID, true, family)
+	if err!=nil {
+		kvHashedPw.Delete(dbTokenBucket, tokenHash(accessToken))
+		return ApiTokenResponse{},err
+	}
+	now := time.Now().Unix()
+	return ApiTokenResponse{ID:calleeID, AccessToken:accessToken, TokenType:"Bearer",
+		ExpiresIn:accessDbToken.Expiration-now, RefreshToken:refreshToken,
+		RefreshExpiresIn:refreshDbToken.Expiration-now}, nil
+}
+
+// tokenGetter is kvHashedPw, or a transaction of it
+type tokenGetter interface {
+	Get(bucketName string, key string, value interface{}) error
+}
+
+// tokenLookup returns the DbToken of a valid (not expired, not revoked) token
+// it does not check if a refresh token was used already
+func tokenLookup(kv tokenGetter, token string, refresh bool) (DbToken,error) {
+	var dbToken DbToken
+	if refresh && !strings.HasPrefix(token,tokenPrefixRefresh) ||
+	   !refresh && !strings.HasPrefix(token,tokenPrefixAccess) {
+		return dbToken, errTokenInvalid
+	}
+	err := kv.Get(dbTokenBucket, tokenHash(token), &dbToken)
+	if err!=nil {
+		if err!=skv.ErrNotFound {
+			logError("token get", "err",err)
+		}
+		return dbToken, errTokenInvalid
+	}
+	if dbToken.Refresh!=refresh {
+		return dbToken, errTokenInvalid
+	}
+	if time.Now().Unix() >= dbToken.Expiration {
+		return dbToken, errTokenExpired
+	}
+	var revokedTime int64
+	err = kv.Get(dbTokenRevokedBucket, dbToken.CalleeID, &revokedTime)
+	if err==nil && dbToken.Issued <= revokedTime {
+		return dbToken, errTokenRevoked
+	}
+	return dbToken, nil
+}
+
+// tokenIdValid returns errTokenRevoked if the id of dbToken was deleted
+// (and maybe registered again by someone else) after the token was issued
+func tokenIdValid(dbToken DbToken) error {
+	var dbEntry DbEntry
+	err := kvMain.Get(dbRegisteredIDs, dbToken.CalleeID, &dbEntry)
+	if err!=nil || dbEntry.StartTime > dbToken.Issued/int64(time.Second) {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// tokenAuth returns the DbToken of a valid access token
+func tokenAuth(token string) (DbToken,error) {
+	dbToken,err := tokenLookup(kvHashedPw, token, false)
+	if err==nil {
+		err = tokenIdValid(dbToken)
+	}
+	return dbToken,err
+}
+
+// tokenSession returns a stand-in for the session cookie of calleeID, so that handlers
+// which expect a cookie session accept a bearer token
+// calleeLogin does not need a pw if r carries a valid access token of the callee (see tokenFor)
+func tokenSession(calleeID string) *http.Cookie {
+	return &http.Cookie{Name:"webcallid", Value:calleeID+"&token"}
+}
+
+// tokenFor returns true if r carries a valid access token of calleeID
+func tokenFor(r *http.Request, calleeID string) bool {
+	bearer := tokenFromRequest(r,false)
+	if bearer=="" {
+		return false
+	}
+	dbToken,err := tokenAuth(bearer)
+	return err==nil && dbToken.CalleeID==calleeID
+}
+
+// tokenUnauthorized responds with 401 as per rfc6750
+func tokenUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%v"`, err))
+	http.Error(w, "invalid token", http.StatusUnauthorized)
+}
+
+// tokenRevoke deletes a single token
+func tokenRevoke(token string) error {
+	return kvHashedPw.Delete(dbTokenBucket, tokenHash(token))
+}
+
+// tokenRevokeAll rejects all tokens of calleeID issued until now
+func tokenRevokeAll(calleeID string) error {
+	return kvHashedPw.Put(dbTokenRevokedBucket, calleeID, time.Now().UnixNano(), false)
+}
+
+// tokenRevokeFamily deletes all tokens that were issued from the same login
+func tokenRevokeFamily(family string) int {
+	var keyList []string
+	err := kvHashedPw.ForEach(dbTokenBucket, func(k string, v skv.Value) error {
+		var dbToken DbToken
+		if v.Decode(&dbToken)==nil && dbToken.Family==family {
+			keyList = append(keyList,k)
+		}
+		return nil
+	})
+	if err!=nil {
+		logError("tokenRevokeFamily", "family",family, "err",err)
+	}
+	for _,key := range keyList {
+		kvHashedPw.Delete(dbTokenBucket, key)
+	}
+	return len(keyList)
+}
+
+// tokenCleanup deletes expired tokens and outdated revocation entries (called by ticker3hours)
+func tokenCleanup() {
+	timeNow := time.Now()
+	var keyList []string
+	err := kvHashedPw.ForEach(dbTokenBucket, func(k string, v skv.Value) error {
+		var dbToken DbToken
+		if v.Decode(&dbToken)!=nil || timeNow.Unix() >= dbToken.Expiration {
+			keyList = append(keyList,k)
+		}
+		return nil
+	})
+	if err!=nil {
+		logError("tokenCleanup", "err",err)
+		return
+	}
+	for _,key := range keyList {
+		kvHashedPw.Delete(dbTokenBucket, key)
+	}
+
+	// once all tokens issued before a revocation have expired, the revocation entry is not needed anymore
+	readConfigLock.RLock()
+	maxLifetime := time.Duration(refreshTokenDays) * 24 * time.Hour
+	readConfigLock.RUnlock()
+	var revokedList []string
+	err = kvHashedPw.ForEach(dbTokenRevokedBucket, func(k string, v skv.Value) error {
+		var revokedTime int64
+		if v.Decode(&revokedTime)!=nil || timeNow.Sub(time.Unix(0,revokedTime)) > maxLifetime {
+			revokedList = append(revokedList,k)
+		}
+		return nil
+	})
+	if err!=nil {
+		logError("tokenCleanup revoked", "err",err)
+	}
+	for _,key := range revokedList {
+		kvHashedPw.Delete(dbTokenRevokedBucket, key)
+	}
+	if len(keyList)>0 {
+		logInfo("tokenCleanup", "tokens",len(keyList), "revocations",len(revokedList))
+	} else {
+		logDebug("timer", "tokenCleanup", "tokens",len(keyList), "revocations",len(revokedList))
+	}
+}
+
+// apiToken handles POST /api/v1/token, /api/v1/token/refresh and /api/v1/token/revoke
+func apiToken(w http.ResponseWriter, r *http.Request, action string, remoteAddr string) {
+	switch action {
+	case "":
+		var req ApiTokenRequest
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		urlID := apiID(req.ID)
+		if urlID=="" || req.Pw=="" {
+			apiError(w, http.StatusBadRequest, "bad_request", "id or pw missing")
+			return
+		}
+		if tokenLoginLimit(urlID, remoteAddr) {
+			apiError(w, http.StatusTooManyRequests, "too_many_requests",
+				"Too many login attempts in short order. Please take a pause.")
+			return
+		}
+		var dbEntry DbEntry
+		err := kvMain.Get(dbRegisteredIDs, urlID, &dbEntry)
+		if err!=nil || !pwVerify(req.Pw, dbEntry.Password) {
+			logInfo("/api/v1/token fail wrong id or pw", "calleeID",urlID, "rip",remoteAddr)
+			// delay to make pw guessing harder
+			time.Sleep(2000 * time.Millisecond)
+			apiError(w, http.StatusUnauthorized, "invalid_credentials", "")
+			return
+		}
+		tokenResponse,err := tokenCreatePair(urlID, "")
+		if err!=nil {
+			logError("/api/v1/token create", "calleeID",urlID, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		logDebug("login", "/api/v1/token issued", "calleeID",urlID, "rip",remoteAddr)
+		w.Header().Set("Cache-Control", "no-store")
+		apiJson(w, http.StatusOK, tokenResponse)
+
+	case "refresh":
+		var req ApiTokenRefreshRequest
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		// lookup, Used check and Used=true in one transaction,
+		// so that two concurrent requests cannot both exchange the same refresh token
+		var dbToken DbToken
+		reused := false
+		err := kvHashedPw.Update(func(tx skv.Tx) error {
+			var err error
+			dbToken,err = tokenLookup(tx, req.RefreshToken, true)
+			if err!=nil {
+				return err
+			}
+			if dbToken.Used {
+				reused = true
+				return errTokenRevoked
+			}
+			// keep the used refresh token until it expires, so that its reuse can be detected
+			dbToken.Used = true
+			return tx.Put(dbTokenBucket, tokenHash(req.RefreshToken), dbToken)
+		})
+		if reused {
+			// a refresh token was used twice: it may have been stolen
+			count := tokenRevokeFamily(dbToken.Family)
+			logWarn("/api/v1/token/refresh reuse of refresh token", "calleeID",dbToken.CalleeID,
+				"revoked",count, "rip",remoteAddr)
+			apiError(w, http.StatusUnauthorized, "invalid_token", errTokenRevoked.Error())
+			return
+		}
+		if err==nil {
+			err = tokenIdValid(dbToken)
+		}
+		if err==errTokenInvalid || err==errTokenExpired || err==errTokenRevoked {
+			if err==errTokenInvalid {
+				clientRequestAdd(remoteAddr,3)
+			}
+			apiError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+		if err!=nil {
+			logError("/api/v1/token/refresh put", "calleeID",dbToken.CalleeID, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		tokenResponse,err := tokenCreatePair(dbToken.CalleeID, dbToken.Family)
+		if err!=nil {
+			logError("/api/v1/token/refresh create", "calleeID",dbToken.CalleeID, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		apiJson(w, http.StatusOK, tokenResponse)
+
+	case "revoke":
+		var req ApiTokenRevokeRequest
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		calleeID := apiAuth(r)
+		if req.All {
+			if calleeID=="" {
+				apiError(w, http.StatusUnauthorized, "unauthorized", "no valid session")
+				return
+			}
+			err := tokenRevokeAll(calleeID)
+			if err!=nil {
+				logError("/api/v1/token/revoke", "calleeID",calleeID, "err",err)
+				apiError(w, http.StatusInternalServerError, "internal", "")
+				return
+			}
+			logInfo("/api/v1/token/revoke all tokens", "calleeID",calleeID, "rip",remoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if req.Token=="" {
+			apiError(w, http.StatusBadRequest, "bad_request", "token missing")
+			return
+		}
+		// as per rfc7009 revoking an unknown or invalid token is not an error
+		var dbToken DbToken
+		if kvHashedPw.Get(dbTokenBucket, tokenHash(req.Token), &dbToken)==nil {
+			if dbToken.Refresh {
+				// revoking a refresh token ends the whole login
+				tokenRevokeFamily(dbToken.Family)
+			} else {
+				tokenRevoke(req.Token)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		apiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+	}
+}
+
+// tokenLoginLimit returns true if urlID has exceeded maxLoginPer30min (same as httpLogin)
+func tokenLoginLimit(urlID string, remoteAddr string) bool {
+	readConfigLock.RLock()
+	maxLoginPer30minTmp := maxLoginPer30min
+	readConfigLock.RUnlock()
+	if maxLoginPer30minTmp<=0 || remoteAddr==outboundIP || remoteAddr=="127.0.0.1" {
+		return false
+	}
+	calleeLoginMutex.Lock()
+	defer calleeLoginMutex.Unlock()
+	calleeLoginSlice := calleeLoginMap[urlID]
+	for len(calleeLoginSlice)>0 && time.Now().Sub(calleeLoginSlice[0]) >= 30 * time.Minute {
+		calleeLoginSlice = calleeLoginSlice[1:]
+	}
+	if len(calleeLoginSlice) >= maxLoginPer30minTmp {
+		logDebug("overload", "/api/v1/token too many logins/30m", "calleeID",urlID,
+			"logins",len(calleeLoginSlice), "max",maxLoginPer30minTmp, "rip",remoteAddr)
+		calleeLoginMap[urlID] = calleeLoginSlice
+		return true
+	}
+	calleeLoginMap[urlID] = append(calleeLoginSlice,time.Now())
+	return false
+}
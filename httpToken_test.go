@@ -0,0 +1,117 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for bearer tokens: single use refresh tokens and login with a token
+package main
+
+import (
+	"sync"
+	"strings"
+	"testing"
+	"time"
+	"net/http"
+	"net/http/httptest"
+)
+
+// testTokenRequest sends a json request with an optional bearer token to httpApiV1Handler
+func testTokenRequest(path string, body string, bearer string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	if bearer!="" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	httpApiV1Handler(w, r)
+	return w
+}
+
+func testTokenSetup(t *testing.T) ApiTokenResponse {
+	t.Helper()
+	kvMain = testMemKV(t, dbRegisteredIDs, dbUserBucket)
+	kvHashedPw = testMemKV(t, dbHashedPwBucket, dbTokenBucket, dbTokenRevokedBucket)
+	hubMap = make(map[string]*Hub)
+	wsClientMap = make(map[uint64]wsClientDataType)
+	clientRequestsMutex.Lock()
+	clientRequestsMap = make(map[string][]time.Time)
+	clientRequestsMutex.Unlock()
+	readConfigLock.Lock()
+	maxCallees = 10
+	accessTokenSecs = 600
+	refreshTokenDays = 1
+	readConfigLock.Unlock()
+	hashed,_ := pwHash("secret123")
+	testRegister(t, "19990000031", hashed)
+	testRegister(t, "19990000032", hashed)
+
+	var tokenResponse ApiTokenResponse
+	w := testApi(t, "POST", "/api/v1/token", `{"id":"19990000031","pw":"secret123"}`, nil, &tokenResponse)
+	if w.Code!=http.StatusOK || tokenResponse.AccessToken=="" || tokenResponse.RefreshToken=="" {
+		t.Fatalf("token: %d %s", w.Code, w.Body.String())
+	}
+	return tokenResponse
+}
+
+func TestTokenRefreshOnce(t *testing.T) {
+	tokenResponse := testTokenSetup(t)
+	body := `{"refreshToken":"`+tokenResponse.RefreshToken+`"}`
+	var refreshed ApiTokenResponse
+	w := testApi(t, "POST", "/api/v1/token/refresh", body, nil, &refreshed)
+	if w.Code!=http.StatusOK || refreshed.AccessToken=="" || refreshed.AccessToken==tokenResponse.AccessToken {
+		t.Fatalf("refresh: %d %s", w.Code, w.Body.String())
+	}
+	if _,err := tokenAuth(refreshed.AccessToken); err!=nil {
+		t.Fatalf("refreshed access token: %v", err)
+	}
+
+	// the reuse of a refresh token revokes the whole family
+	var apiErr ApiError
+	w = testApi(t, "POST", "/api/v1/token/refresh", body, nil, &apiErr)
+	if w.Code!=http.StatusUnauthorized || apiErr.Error!="invalid_token" {
+		t.Fatalf("refresh reuse: %d %s", w.Code, w.Body.String())
+	}
+	for _,token := range []string{tokenResponse.AccessToken, refreshed.AccessToken} {
+		if _,err := tokenAuth(token); err==nil {
+			t.Fatalf("access token %s not revoked", token)
+		}
+	}
+}
+
+func TestTokenRefreshConcurrent(t *testing.T) {
+	tokenResponse := testTokenSetup(t)
+	body := `{"refreshToken":"`+tokenResponse.RefreshToken+`"}`
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- testTokenRequest("/api/v1/token/refresh", body, "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	ok := 0
+	for code := range codes {
+		if code==http.StatusOK {
+			ok++
+		}
+	}
+	if ok!=1 {
+		t.Fatalf("refresh token exchanged %d times", ok)
+	}
+}
+
+func TestTokenLogin(t *testing.T) {
+	tokenResponse := testTokenSetup(t)
+
+	// the token of another id is no replacement for the pw
+	w := testTokenRequest("/api/v1/login", `{"id":"19990000032"}`, tokenResponse.AccessToken)
+	if w.Code!=http.StatusUnauthorized {
+		t.Fatalf("login with the token of another id: %d %s", w.Code, w.Body.String())
+	}
+
+	w = testTokenRequest("/api/v1/login", `{"id":"19990000031"}`, tokenResponse.AccessToken)
+	if w.Code!=http.StatusOK || strings.Index(w.Body.String(), `"wsUrl":"ws`)<0 {
+		t.Fatalf("login with token: %d %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies())!=0 {
+		t.Fatalf("login with token set cookies %v", w.Result().Cookies())
+	}
+}
@@ -0,0 +1,133 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// ICE servers for the clients.
+// The list is sent together with the TURN credentials of a call (see runturn.go):
+//   turnCredentials|{"username":..,"credential":..,"ttl":..,"port":..,"iceServers":[..]}
+// port (etc.) describes the embedded STUN/TURN server; it is omitted with turnPort=0.
+// iceServers lists external STUN/TURN servers (dedicated relay boxes):
+//   iceStunUrls = stun:stun1.example.com:3478, stun:stun2.example.com:3478
+//   iceTurnUrls = turn:relay1.example.com:3478, turns:relay1.example.com:5349?transport=tcp
+// External TURN servers get the credentials of the call, so they must verify them
+// with the same shared secret (coturn: use-auth-secret, static-auth-secret=turnSecret).
+// Regions: clients with an ip in one of the networks of a region get the servers of
+// this region (if a region does not define stun or turn urls, the default ones are used):
+//   iceRegions = eu, us
+//   iceRegionNets_eu = 192.0.2.0/24, 2001:db8::/32
+//   iceStunUrls_eu = stun:stun.eu.example.com:3478
+//   iceTurnUrls_eu = turn:relay.eu.example.com:3478
+// Regions are evaluated in the given order; the first match wins.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"gopkg.in/ini.v1"
+)
+
+type IceServer struct {
+	Urls []string `json:"urls"`
+	Username string `json:"username,omitempty"`
+	Credential string `json:"credential,omitempty"`
+}
+
+type IceRegion struct {
+	Name string
+	Nets string
+	StunUrls string
+	TurnUrls string
+	ipNets []*net.IPNet
+}
+
+// the regions listed in iceRegions, set by iceRegionsConfig()
+var iceRegionList []IceRegion
+
+// iceRegionsConfig reads the keywords of the regions listed in iceRegions
+// it is called by readConfig() with readConfigLock held
+func iceRegionsConfig(configIni *ini.File) {
+	oldRegions := make(map[string]IceRegion)
+	for _,region := range iceRegionList {
+		oldRegions[region.Name] = region
+	}
+	var regionList []IceRegion
+	for _,name := range iceUrlList(iceRegions) {
+		region,ok := oldRegions[name]
+		region.Name = name
+		oldNets := region.Nets
+		region.Nets = readIniString(configIni, "iceRegionNets_"+name, region.Nets, "")
+		region.StunUrls = readIniString(configIni, "iceStunUrls_"+name, region.StunUrls, "")
+		region.TurnUrls = readIniString(configIni, "iceTurnUrls_"+name, region.TurnUrls, "")
+		if ok && region.Nets==oldNets {
+			regionList = append(regionList, region)
+			continue
+		}
+		region.ipNets = nil
+		for _,cidr := range iceUrlList(region.Nets) {
+			_,ipNet,err := net.ParseCIDR(cidr)
+			if err!=nil {
+				logWarn("iceRegionNets", "region",name, "cidr",cidr, "err",err)
+				continue
+			}
+			region.ipNets = append(region.ipNets, ipNet)
+		}
+		regionList = append(regionList, region)
+	}
+	iceRegionList = regionList
+}
+
+// iceUrlList splits a comma separated config value
+func iceUrlList(value string) []string {
+	var list []string
+	for _,entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry!="" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// iceRegionOf returns the region of remoteIP ("" for the default region)
+// and its stun and turn urls
+func iceRegionOf(remoteIP string) (string, string, string) {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	stunUrls, turnUrls := iceStunUrls, iceTurnUrls
+	ip := net.ParseIP(remoteIP)
+	if ip==nil {
+		return "", stunUrls, turnUrls
+	}
+	for _,region := range iceRegionList {
+		for _,ipNet := range region.ipNets {
+			if !ipNet.Contains(ip) {
+				continue
+			}
+			if region.StunUrls!="" {
+				stunUrls = region.StunUrls
+			}
+			if region.TurnUrls!="" {
+				turnUrls = region.TurnUrls
+			}
+			return region.Name, stunUrls, turnUrls
+		}
+	}
+	return "", stunUrls, turnUrls
+}
+
+// iceServersFor returns the external ice servers for a client with remoteIP
+// the turn servers get the credentials of username
+func iceServersFor(username string, remoteIP string) []IceServer {
+	region, stunUrls, turnUrls := iceRegionOf(remoteIP)
+	var iceServers []IceServer
+	if urls := iceUrlList(stunUrls); len(urls)>0 {
+		iceServers = append(iceServers, IceServer{Urls:urls})
+	}
+	if urls := iceUrlList(turnUrls); len(urls)>0 && username!="" {
+		iceServers = append(iceServers, IceServer{Urls:urls,
+			Username:username, Credential:turnPassword(username)})
+	}
+	if region!="" {
+		logDebug("turn", "iceServers", "region",region, "rip",remoteIP)
+	}
+	return iceServers
+}
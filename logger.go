@@ -0,0 +1,208 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Leveled, structured logging.
+// Every entry has a level (debug, info, warn, error), a message and an
+// optional list of key/value fields (calleeID, rip, wsid, connType, ...).
+// A Logger can carry fields of its own (see With()), so that a WsClient
+// can attach its calleeID, remote address, wsid and connType once and
+// have them added to every entry it logs.
+// Debug entries belong to a topic and are only logged if the topic is
+// enabled via the logevents config keyword (see logWantedFor()).
+// Config keyword logLevel ("info", "warn" or "error") suppresses entries
+// of lower levels.
+// Config keyword logFormat selects the output format:
+// "text" (default): "msg key=value ..." with "# " prefixed to warn and error
+//                   entries, like the console output has always looked
+// "logfmt":         "time=... level=... topic=... msg=... key=value ..."
+// "json":           one json object per line with the same keys
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"encoding/json"
+)
+
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"debug","info","warn","error"}
+
+var logFormatCur = "text"       // protected by logeventMutex
+var logLevelCur = logLevelInfo  // protected by logeventMutex
+
+type Logger struct {
+	fields []interface{} // key/value pairs added to every entry
+}
+
+var logRoot = &Logger{}
+
+// logSetup is called by readConfig() after logFormat and logLevel have been read
+func logSetup(format string, level string) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format!="logfmt" && format!="json" {
+		format = "text"
+	}
+	levelIdx := logLevelInfo
+	for idx,name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(level),name) {
+			levelIdx = idx
+		}
+	}
+	logeventMutex.Lock()
+	logFormatCur = format
+	logLevelCur = levelIdx
+	logeventMutex.Unlock()
+}
+
+// With returns a new Logger that adds the given key/value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l==nil {
+		l = logRoot
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields:fields}
+}
+
+func (l *Logger) Debug(topic string, msg string, kv ...interface{}) {
+	if logWantedFor(topic) {
+		l.log(logLevelDebug, topic, msg, kv)
+	}
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(logLevelInfo, "", msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(logLevelWarn, "", msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(logLevelError, "", msg, kv)
+}
+
+// shortcuts for entries without Logger fields
+func logDebug(topic string, msg string, kv ...interface{}) {
+	logRoot.Debug(topic, msg, kv...)
+}
+
+func logInfo(msg string, kv ...interface{}) {
+	logRoot.Info(msg, kv...)
+}
+
+func logWarn(msg string, kv ...interface{}) {
+	logRoot.Warn(msg, kv...)
+}
+
+func logError(msg string, kv ...interface{}) {
+	logRoot.Error(msg, kv...)
+}
+
+func (l *Logger) log(level int, topic string, msg string, kv []interface{}) {
+	if l==nil {
+		l = logRoot
+	}
+	logeventMutex.RLock()
+	format := logFormatCur
+	minLevel := logLevelCur
+	logeventMutex.RUnlock()
+	if level!=logLevelDebug && level < minLevel {
+		return
+	}
+
+	var sb strings.Builder
+	switch format {
+	case "json":
+		sb.WriteString(`{"time":`)
+		sb.WriteString(logJsonValue(time.Now().Format(time.RFC3339Nano)))
+		sb.WriteString(`,"level":"`+logLevelNames[level]+`"`)
+		if topic!="" {
+			sb.WriteString(`,"topic":`+logJsonValue(topic))
+		}
+		sb.WriteString(`,"msg":`+logJsonValue(msg))
+		logFields(l.fields, kv, func(key string, value interface{}) {
+			sb.WriteString(","+logJsonValue(key)+":"+logJsonValue(value))
+		})
+		sb.WriteString("}\n")
+
+	case "logfmt":
+		sb.WriteString("time="+time.Now().Format(time.RFC3339Nano))
+		sb.WriteString(" level="+logLevelNames[level])
+		if topic!="" {
+			sb.WriteString(" topic="+logfmtValue(topic))
+		}
+		sb.WriteString(" msg="+logfmtValue(msg))
+		logFields(l.fields, kv, func(key string, value interface{}) {
+			sb.WriteString(" "+key+"="+logfmtValue(value))
+		})
+		sb.WriteString("\n")
+
+	default:
+		if level>=logLevelWarn {
+			sb.WriteString("# ")
+		}
+		sb.WriteString(msg)
+		logFields(l.fields, kv, func(key string, value interface{}) {
+			sb.WriteString(" "+key+"="+logfmtValue(value))
+		})
+		sb.WriteString("\n")
+	}
+	fmt.Print(sb.String())
+}
+
+// logFields calls fn for all key/value pairs of fields and kv
+// a missing value (odd number of arguments) is reported as "!missing"
+func logFields(fields []interface{}, kv []interface{}, fn func(string,interface{})) {
+	for _,list := range [][]interface{}{fields,kv} {
+		for i:=0; i<len(list); i+=2 {
+			key := fmt.Sprint(list[i])
+			if i+1 < len(list) {
+				fn(key, list[i+1])
+			} else {
+				fn(key, "!missing")
+			}
+		}
+	}
+}
+
+func logString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func logfmtValue(value interface{}) string {
+	str := logString(value)
+	if str=="" || strings.ContainsAny(str," =\"\t\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+func logJsonValue(value interface{}) string {
+	switch value.(type) {
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		data,err := json.Marshal(value)
+		if err==nil {
+			return string(data)
+		}
+	}
+	data,_ := json.Marshal(logString(value))
+	return string(data)
+}
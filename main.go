@@ -41,10 +41,6 @@ import (
 	"math/rand"
 	"gopkg.in/ini.v1"
 
-	"bytes"
-	"encoding/gob"
-	bolt "go.etcd.io/bbolt"
-
 	_ "net/http/pprof"
 	"github.com/mehrvarz/webcall/atombool"
 	"github.com/mehrvarz/webcall/iptools"
@@ -62,7 +58,7 @@ const dbUserBucket = "userData2"
 var	kvCalls skv.KV
 const dbCallsName = "rtccalls.db"
 const dbWaitingCaller = "waitingCallers"
-const dbMissedCalls = "missedCalls"
+const dbMissedCalls = "missedCalls" // calleeID -> []MissedCall (see missedcalls.go)
 type CallerInfo struct {
 	AddrPort string
 	CallerName string
@@ -73,7 +69,7 @@ type CallerInfo struct {
 
 var	kvContacts skv.KV
 const dbContactsName = "rtccontacts.db"
-const dbContactsBucket = "contacts" // calleeID -> map[callerID]name
+const dbContactsBucket = "contacts" // legacy: calleeID -> map[callerID]name (see contacts.go)
 
 var	kvNotif skv.KV
 const dbNotifName = "rtcnotif.db"
@@ -171,9 +167,20 @@ var insecureSkipVerify = false
 var turnIP = ""
 var turnPort = 0
 var turnRealm = ""
+var turnIP6 = ""
+var turnTcpPort = 0
+var turnTlsPort = 0
+var turnRelayPortMin = 0
+var turnRelayPortMax = 0
 var turnDebugLevel = 0
 var pprofPort = 0
 var dbPath = ""
+var dbBackend = ""
+var dbSqlDriver = ""
+var dbSqlSource = ""
+var clusterNodeID = ""
+var clusterNodeUrl = ""
+var clusterSecret = ""
 var wsUrl = ""
 var wssUrl = ""
 var twitterKey = ""
@@ -204,6 +211,49 @@ var clientBlockBelowVersion = ""
 var serverStartTime time.Time
 var adminLogPath1 = ""
 var adminLogPath2 = ""
+var accessTokenSecs = 3600
+var refreshTokenDays = 30
+var logFormat = ""
+var logLevel = ""
+var metricsAllowIPs = ""
+var cdrMaxPerCallee = 1000
+var cdrMaxDays = 90
+var roomMaxSize = 8
+var callWaiting = true
+var webPushMaxDevices = 10
+var notifyMaxChannels = 10
+var smtpHost = ""  // host:port
+var smtpUser = ""
+var smtpPassword = ""
+var smtpFrom = ""
+var telegramBotToken = ""
+var telegramApiUrl = ""
+var matrixHomeserver = ""
+var matrixAccessToken = ""
+var ntfyServer = ""
+var notifyAllowLocalhost = false
+var notifyTestPer30min = 5
+var eventWebhookUrls = ""
+var eventWebhookSecret = ""
+var eventLogMax = 200
+var eventHooksMax = 5
+var contactsMax = 1000
+var voicemailPath = "" // evaluated at startup only
+var voicemailMaxSecs = 60
+var voicemailMaxBytes = 1000000
+var voicemailMaxCount = 30
+var voicemailQuotaBytes = 20000000
+var voicemailRetentionDays = 30
+var missedCallsMax = 100
+var missedCallsMaxDays = 90
+var turnSecret = ""
+var turnCredentialSecs = 900
+var iceStunUrls = ""
+var iceTurnUrls = ""
+var iceRegions = ""
+var turnRelayMaxBytes = 0
+var turnRelayMaxKbps = 0
+var turnRelayDailyBytes = 0
 
 
 func main() {
@@ -231,9 +281,9 @@ func main() {
 	readConfig(true)
 
 	var err error
-	kvMain,err = skv.DbOpen(dbMainName,dbPath)
+	kvMain,err = dbOpen(dbMainName)
 	if err!=nil {
-		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbMainName,dbPath,err)
+		fmt.Printf("# error dbOpen %s path %s err=%v\n",dbMainName,dbPath,err)
 		return
 	}
 	err = kvMain.CreateBucket(dbRegisteredIDs)
@@ -254,9 +304,15 @@ func main() {
 		kvMain.Close()
 		return
 	}
-	kvCalls,err = skv.DbOpen(dbCallsName,dbPath)
+	err = kvMain.CreateBucket(dbRelayUsageBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbMainName,dbRelayUsageBucket,err)
+		kvMain.Close()
+		return
+	}
+	kvCalls,err = dbOpen(dbCallsName)
 	if err!=nil {
-		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbCallsName,dbPath,err)
+		fmt.Printf("# error dbOpen %s path %s err=%v\n",dbCallsName,dbPath,err)
 		return
 	}
 	err = kvCalls.CreateBucket(dbWaitingCaller)
@@ -271,9 +327,33 @@ func main() {
 		kvCalls.Close()
 		return
 	}
-	kvNotif,err = skv.DbOpen(dbNotifName,dbPath)
+	err = kvCalls.CreateBucket(dbCdrBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbCallsName,dbCdrBucket,err)
+		kvCalls.Close()
+		return
+	}
+	err = kvCalls.CreateBucket(dbEventLogBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbCallsName,dbEventLogBucket,err)
+		kvCalls.Close()
+		return
+	}
+	err = kvCalls.CreateBucket(dbBlockedCallsBucket)
 	if err!=nil {
-		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbNotifName,dbPath,err)
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbCallsName,dbBlockedCallsBucket,err)
+		kvCalls.Close()
+		return
+	}
+	err = kvCalls.CreateBucket(dbVoicemailBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbCallsName,dbVoicemailBucket,err)
+		kvCalls.Close()
+		return
+	}
+	kvNotif,err = dbOpen(dbNotifName)
+	if err!=nil {
+		fmt.Printf("# error dbOpen %s path %s err=%v\n",dbNotifName,dbPath,err)
 		return
 	}
 	err = kvNotif.CreateBucket(dbSentNotifTweets)
@@ -282,9 +362,39 @@ func main() {
 		kvNotif.Close()
 		return
 	}
-	kvHashedPw,err = skv.DbOpen(dbHashedPwName,dbPath)
+	err = kvNotif.CreateBucket(dbWebPushBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbWebPushBucket,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbNotifyChannelsBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbNotifyChannelsBucket,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbNotifyOutboxBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbNotifyOutboxBucket,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbEventHooksBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbEventHooksBucket,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbEventQueueBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbEventQueueBucket,err)
+		kvNotif.Close()
+		return
+	}
+	kvHashedPw,err = dbOpen(dbHashedPwName)
 	if err!=nil {
-		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbHashedPwName,dbPath,err)
+		fmt.Printf("# error dbOpen %s path %s err=%v\n",dbHashedPwName,dbPath,err)
 		return
 	}
 	err = kvHashedPw.CreateBucket(dbHashedPwBucket)
@@ -293,9 +403,17 @@ func main() {
 		kvHashedPw.Close()
 		return
 	}
-	kvContacts,err = skv.DbOpen(dbContactsName,dbPath)
+	for _,bucketName := range []string{dbTokenBucket,dbTokenRevokedBucket} {
+		err = kvHashedPw.CreateBucket(bucketName)
+		if err!=nil {
+			fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbHashedPwName,bucketName,err)
+			kvHashedPw.Close()
+			return
+		}
+	}
+	kvContacts,err = dbOpen(dbContactsName)
 	if err!=nil {
-		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbContactsName,dbPath,err)
+		fmt.Printf("# error dbOpen %s path %s err=%v\n",dbContactsName,dbPath,err)
 		return
 	}
 	err = kvContacts.CreateBucket(dbContactsBucket)
@@ -304,6 +422,25 @@ func main() {
 		kvContacts.Close()
 		return
 	}
+	err = kvContacts.CreateBucket(dbContactRecordsBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbContactsName,dbContactRecordsBucket,err)
+		kvContacts.Close()
+		return
+	}
+	err = kvContacts.CreateBucket(dbCallFilterBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbContactsName,dbCallFilterBucket,err)
+		kvContacts.Close()
+		return
+	}
+	contactsMigrateAll()
+
+	err = clusterInit()
+	if err!=nil {
+		fmt.Printf("# error clusterInit err=%v\n",err)
+		return
+	}
 
 	rand.Seed(time.Now().UnixNano())
 	queryFollowerIDsNeeded.Set(true)
@@ -314,49 +451,43 @@ func main() {
 	fmt.Printf("outboundIP %s\n",outboundIP)
 
 	// init mapping from dbUserBucket
-	kv := kvMain.(skv.SKV)
-	bucketName := dbUserBucket
-	db := kv.Db
-	skv.DbMutex.Lock()
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			// k = ID ("timur_1619008491")
-			// v = dbUser []byte
-
-			calleeID := string(k)
-			idxUline := strings.Index(calleeID,"_")
-			if idxUline>= 0 {
-				calleeID = calleeID[:idxUline]
-			}
+	err = kvMain.ForEach(dbUserBucket, func(k string, v skv.Value) error {
+		// k = ID ("timur_1619008491")
+		// v = dbUser (gob)
+
+		calleeID := k
+		idxUline := strings.Index(calleeID,"_")
+		if idxUline>= 0 {
+			calleeID = calleeID[:idxUline]
+		}
 
-			var dbUser DbUser // DbEntry{unixTime, remoteAddr, urlPw}
-			d := gob.NewDecoder(bytes.NewReader(v))
-			d.Decode(&dbUser)
-			if dbUser.AltIDs!="" {
-				//fmt.Printf("initloop %s (%s)->%s\n",k,calleeID,dbUser.AltIDs)
-				toks := strings.Split(dbUser.AltIDs, "|")
-				for tok := range toks {
-					toks2 := strings.Split(toks[tok], ",")
-					if toks2[0] != "" { // tmpID
-						if toks2[1] == "true" {
-							mapping[toks2[0]] = MappingDataType{calleeID,toks2[2]}
-							//fmt.Printf("initloop set %s -> %s (%s)\n",toks2[0],calleeID,toks2[2])
-						}
+		var dbUser DbUser // DbEntry{unixTime, remoteAddr, urlPw}
+		v.Decode(&dbUser)
+		if dbUser.AltIDs!="" {
+			//fmt.Printf("initloop %s (%s)->%s\n",k,calleeID,dbUser.AltIDs)
+			toks := strings.Split(dbUser.AltIDs, "|")
+			for tok := range toks {
+				toks2 := strings.Split(toks[tok], ",")
+				if toks2[0] != "" { // tmpID
+					if toks2[1] == "true" {
+						mapping[toks2[0]] = MappingDataType{calleeID,toks2[2]}
+						//fmt.Printf("initloop set %s -> %s (%s)\n",toks2[0],calleeID,toks2[2])
 					}
 				}
 			}
 		}
 		return nil
 	})
-	skv.DbMutex.Unlock()
+	if err!=nil {
+		fmt.Printf("# init mapping from db=%s bucket=%s err=%v\n",dbMainName,dbUserBucket,err)
+	}
 
 	// websocket handler
 	if wsPort > 0 {
 		wsAddr = fmt.Sprintf(":%d", wsPort)
 		mux := &http.ServeMux{}
 		mux.HandleFunc("/ws", serveWs)
+		mux.HandleFunc("/room", serveRoom)
 		svr = nbhttp.NewServer(nbhttp.Config{
 			Network: "tcp",
 			Addrs: []string{wsAddr},
@@ -404,6 +535,7 @@ func main() {
 		wssAddr = fmt.Sprintf(":%d", wssPort)
 		mux := &http.ServeMux{}
 		mux.HandleFunc("/ws", serveWss)
+		mux.HandleFunc("/room", serveRoomTls)
 		svrs = nbhttp.NewServerTLS(nbhttp.Config{
 			Network: "tcp",
 			Addrs: []string{wssAddr},
@@ -425,6 +557,9 @@ func main() {
 	go ticker20min()   // update news notifieer
 	go ticker3min()    // backupScript + delete old tw notifications
 	go ticker30sec()   // log stats
+	go outboxTicker()  // retry queued notifications
+	go eventTicker()   // retry event webhooks
+	go presenceWorker() // deliver presence updates
 	go ticker10sec()   // readConfig()
 	go ticker2sec()    // check for new day
 	if pprofPort>0 {
@@ -450,6 +585,8 @@ func main() {
 	writeStatsFile()
 	time.Sleep(2 * time.Second)
 
+	clusterShutdown()
+
 	fmt.Printf("kvContacts.Close...\n")
 	err = kvContacts.Close()
 	if err!=nil {
@@ -567,9 +704,22 @@ func readConfig(init bool) {
 		turnIP = readIniString(configIni, "turnIP", turnIP, "")
 		turnPort = readIniInt(configIni, "turnPort", turnPort, 0, 1) // 3739
 		turnRealm = readIniString(configIni, "turnRealm", turnRealm, "")
+		turnIP6 = readIniString(configIni, "turnIP6", turnIP6, "")
+		turnTcpPort = readIniInt(configIni, "turnTcpPort", turnTcpPort, 0, 1) // 3739
+		turnTlsPort = readIniInt(configIni, "turnTlsPort", turnTlsPort, 0, 1) // 5349
+		turnRelayPortMin = readIniInt(configIni, "turnRelayPortMin", turnRelayPortMin, 0, 1)
+		turnRelayPortMax = readIniInt(configIni, "turnRelayPortMax", turnRelayPortMax, 0, 1)
 		pprofPort = readIniInt(configIni, "pprofPort", pprofPort, 0, 1) // 8980
 		dbPath = readIniString(configIni, "dbPath", dbPath, "db/")
 		if dbPath!="" && !strings.HasSuffix(dbPath,"/") { dbPath = dbPath+"/" }
+		voicemailPath = readIniString(configIni, "voicemailPath", voicemailPath, "voicemail/")
+		if voicemailPath!="" && !strings.HasSuffix(voicemailPath,"/") { voicemailPath = voicemailPath+"/" }
+		dbBackend = readIniString(configIni, "dbBackend", dbBackend, "bolt") // bolt, memory or sql
+		dbSqlDriver = readIniString(configIni, "dbSqlDriver", dbSqlDriver, "sqlite")
+		dbSqlSource = readIniString(configIni, "dbSqlSource", dbSqlSource, "")
+		clusterNodeID = readIniString(configIni, "clusterNodeID", clusterNodeID, "") // empty = no cluster mode
+		clusterNodeUrl = readIniString(configIni, "clusterNodeUrl", clusterNodeUrl, "")
+		clusterSecret = readIniString(configIni, "clusterSecret", clusterSecret, "")
 		timeLocationString = readIniString(configIni, "timeLocation", timeLocationString, "")
 		wsUrl = readIniString(configIni, "wsUrl", wsUrl, "")
 		wssUrl = readIniString(configIni, "wssUrl", wssUrl, "")
@@ -595,6 +745,9 @@ func readConfig(init bool) {
 		logeventMap[strings.TrimSpace(s)] = true
 	}
 	logeventMutex.Unlock()
+	logFormat = readIniString(configIni, "logFormat", logFormat, "text")
+	logLevel = readIniString(configIni, "logLevel", logLevel, "info")
+	logSetup(logFormat, logLevel)
 
 //	disconCalleeOnPeerConnected = readIniBoolean(configIni,
 //		"disconCalleeOnPeerConnected", disconCalleeOnPeerConnected, false)
@@ -605,9 +758,48 @@ func readConfig(init bool) {
 	maxTalkSecsIfNoP2p = readIniInt(configIni, "maxTalkSecsIfNoP2p", maxTalkSecsIfNoP2p, 600, 1)
 
 	turnDebugLevel = readIniInt(configIni, "turnDebugLevel", turnDebugLevel, 3, 1)
+	turnSecret = readIniString(configIni, "turnSecret", turnSecret, "")
+	turnCredentialSecs = readIniInt(configIni, "turnCredentialSecs", turnCredentialSecs, 900, 1)
+	turnRelayMaxBytes = readIniInt(configIni, "turnRelayMaxBytes", turnRelayMaxBytes, 0, 1)
+	turnRelayMaxKbps = readIniInt(configIni, "turnRelayMaxKbps", turnRelayMaxKbps, 0, 1)
+	turnRelayDailyBytes = readIniInt(configIni, "turnRelayDailyBytes", turnRelayDailyBytes, 0, 1)
+	iceStunUrls = readIniString(configIni, "iceStunUrls", iceStunUrls, "")
+	iceTurnUrls = readIniString(configIni, "iceTurnUrls", iceTurnUrls, "")
+	iceRegions = readIniString(configIni, "iceRegions", iceRegions, "")
+	iceRegionsConfig(configIni)
 
 	adminID = readIniString(configIni, "adminID", adminID, "")
 	adminEmail = readIniString(configIni, "adminEmail", adminEmail, "")
+	metricsAllowIPs = readIniString(configIni, "metricsAllowIPs", metricsAllowIPs, "")
+	cdrMaxPerCallee = readIniInt(configIni, "cdrMaxPerCallee", cdrMaxPerCallee, 1000, 1)
+	cdrMaxDays = readIniInt(configIni, "cdrMaxDays", cdrMaxDays, 90, 1)
+	missedCallsMax = readIniInt(configIni, "missedCallsMax", missedCallsMax, 100, 1)
+	missedCallsMaxDays = readIniInt(configIni, "missedCallsMaxDays", missedCallsMaxDays, 90, 1)
+	roomMaxSize = readIniInt(configIni, "roomMaxSize", roomMaxSize, 8, 1)
+	callWaiting = readIniBoolean(configIni, "callWaiting", callWaiting, true)
+	webPushMaxDevices = readIniInt(configIni, "webPushMaxDevices", webPushMaxDevices, 10, 1)
+	notifyMaxChannels = readIniInt(configIni, "notifyMaxChannels", notifyMaxChannels, 10, 1)
+	smtpHost = readIniString(configIni, "smtpHost", smtpHost, "")
+	smtpUser = readIniString(configIni, "smtpUser", smtpUser, "")
+	smtpPassword = readIniString(configIni, "smtpPassword", smtpPassword, "")
+	smtpFrom = readIniString(configIni, "smtpFrom", smtpFrom, "")
+	telegramBotToken = readIniString(configIni, "telegramBotToken", telegramBotToken, "")
+	telegramApiUrl = readIniString(configIni, "telegramApiUrl", telegramApiUrl, "https://api.telegram.org")
+	matrixHomeserver = readIniString(configIni, "matrixHomeserver", matrixHomeserver, "")
+	matrixAccessToken = readIniString(configIni, "matrixAccessToken", matrixAccessToken, "")
+	ntfyServer = readIniString(configIni, "ntfyServer", ntfyServer, "https://ntfy.sh")
+	notifyAllowLocalhost = readIniBoolean(configIni, "notifyAllowLocalhost", notifyAllowLocalhost, false)
+	notifyTestPer30min = readIniInt(configIni, "notifyTestPer30min", notifyTestPer30min, 5, 1)
+	eventWebhookUrls = readIniString(configIni, "eventWebhookUrls", eventWebhookUrls, "")
+	eventWebhookSecret = readIniString(configIni, "eventWebhookSecret", eventWebhookSecret, "")
+	eventLogMax = readIniInt(configIni, "eventLogMax", eventLogMax, 200, 1)
+	eventHooksMax = readIniInt(configIni, "eventHooksMax", eventHooksMax, 5, 1)
+	contactsMax = readIniInt(configIni, "contactsMax", contactsMax, 1000, 1)
+	voicemailMaxSecs = readIniInt(configIni, "voicemailMaxSecs", voicemailMaxSecs, 60, 1)
+	voicemailMaxBytes = readIniInt(configIni, "voicemailMaxBytes", voicemailMaxBytes, 1000000, 1)
+	voicemailMaxCount = readIniInt(configIni, "voicemailMaxCount", voicemailMaxCount, 30, 1)
+	voicemailQuotaBytes = readIniInt(configIni, "voicemailQuotaBytes", voicemailQuotaBytes, 20000000, 1)
+	voicemailRetentionDays = readIniInt(configIni, "voicemailRetentionDays", voicemailRetentionDays, 30, 1)
 	adminLogPath1 = readIniString(configIni, "adminLog1", adminLogPath1, "")
 	adminLogPath2 = readIniString(configIni, "adminLog2", adminLogPath2, "")
 
@@ -626,6 +818,9 @@ func readConfig(init bool) {
 	maxLoginPer30min = readIniInt(configIni, "maxLoginPer30min", maxLoginPer30min, 0, 1)
 	maxClientRequestsPer30min = readIniInt(configIni, "maxRequestsPer30min", maxClientRequestsPer30min, 0, 1)
 
+	accessTokenSecs = readIniInt(configIni, "accessTokenSecs", accessTokenSecs, 3600, 1)
+	refreshTokenDays = readIniInt(configIni, "refreshTokenDays", refreshTokenDays, 30, 1)
+
 	readConfigLock.Unlock()
 }
 
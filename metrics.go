@@ -0,0 +1,316 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Prometheus metrics, served in the text exposition format via "/metrics".
+// Gauges (online callees, active calls, calls today, goroutines) are
+// computed from hubMap and the global counters at scrape time.
+// Counters and histograms (call durations, login rate-limit hits,
+// TURN auth results, websocket ping/pong, http latency) are fed by the
+// signaling code as things happen. The http latency is labeled with the
+// endpoint name (see metricsEndpoints), unknown request paths as "unknown".
+// "/metrics" is available to localhost and outboundIP; other scrapers must
+// be listed in the metricsAllowIPs config keyword (comma separated).
+// The scraper address is the address of the tcp peer. X-Real-IP is only
+// used if the peer is on localhost (a reverse proxy on the same host).
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// endpoint labels of metricsHttpDuration; other request paths are counted as "unknown"
+var metricsEndpoints = map[string]bool{}
+
+func init() {
+	for _,endpoint := range []string{"login", "online", "notifyCallee", "canbenotified", "notifystatus",
+			"voicemail", "missedCall", "getsettings", "setsettings", "action", "cdr", "webpushsubscribe",
+			"webpushunsubscribe", "getcontacts", "getcontact", "setcontact", "deletecontact", "getmapping",
+			"setmapping", "fetchid", "deletemapping", "setassign", "twid", "twfollower", "register", "newid",
+			"mode", "message", "logout", "version"} {
+		metricsEndpoints["/rtcsig/"+endpoint] = true
+	}
+	for _,resource := range []string{"openapi.json", "login", "online", "newid", "register", "token",
+			"logout", "settings", "contacts", "mapping", "missedcalls", "cdr", "webpush", "notify", "events",
+			"eventhooks", "callfilter", "blockedcalls", "voicemail"} {
+		metricsEndpoints[apiV1Prefix+"/"+resource] = true
+	}
+}
+
+// metricsEndpoint returns the endpoint label of a request path ("/rtcsig/register/id" -> "/rtcsig/register")
+func metricsEndpoint(prefix string, path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if idx := strings.IndexAny(path, "/?"); idx>=0 {
+		path = path[:idx]
+	}
+	if !metricsEndpoints[prefix+"/"+path] {
+		return "unknown"
+	}
+	return prefix+"/"+path
+}
+
+type metricsCounter struct {
+	name string
+	help string
+	label string // name of the single label, may be empty
+	mutex sync.Mutex
+	values map[string]float64
+}
+
+type metricsHistogram struct {
+	name string
+	help string
+	label string // name of the single label, may be empty
+	buckets []float64
+	mutex sync.Mutex
+	series map[string]*metricsHistogramSeries
+}
+
+type metricsHistogramSeries struct {
+	counts []uint64 // one per bucket (not cumulative)
+	count uint64
+	sum float64
+}
+
+var metricsCallsTotal = newMetricsCounter("webcall_calls_total",
+	"Number of completed calls by connection type (p2p or relay).", "connection")
+var metricsLoginRateLimitTotal = newMetricsCounter("webcall_login_ratelimit_total",
+	"Number of requests denied by a rate limit.", "reason")
+var metricsTurnAuthTotal = newMetricsCounter("webcall_turn_auth_total",
+	"Number of TURN authentication requests by result.", "result")
+var metricsTurnRelayBytesTotal = newMetricsCounter("webcall_turn_relay_bytes_total",
+	"Number of bytes between TURN clients and the TURN server by result (relayed or dropped).", "result")
+var metricsWsPingTotal = newMetricsCounter("webcall_ws_ping_total",
+	"Number of websocket pings sent to and received from clients.", "direction")
+var metricsWsPongTotal = newMetricsCounter("webcall_ws_pong_total",
+	"Number of websocket pongs sent to and received from clients.", "direction")
+
+var metricsRingDuration = newMetricsHistogram("webcall_ring_duration_seconds",
+	"Time from caller arrival to pickup.", "",
+	[]float64{1,2,5,10,15,20,30,45,60,120})
+var metricsTalkDuration = newMetricsHistogram("webcall_talk_duration_seconds",
+	"Duration of completed calls.", "",
+	[]float64{10,30,60,120,300,600,1800,3600,7200})
+var metricsHttpDuration = newMetricsHistogram("webcall_http_request_duration_seconds",
+	"Latency of http requests by endpoint.", "endpoint",
+	[]float64{0.001,0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10})
+
+func newMetricsCounter(name string, help string, label string) *metricsCounter {
+	return &metricsCounter{name:name, help:help, label:label, values:make(map[string]float64)}
+}
+
+func (m *metricsCounter) Add(labelValue string, n float64) {
+	m.mutex.Lock()
+	m.values[labelValue] += n
+	m.mutex.Unlock()
+}
+
+func (m *metricsCounter) Inc(labelValue string) {
+	m.Add(labelValue, 1)
+}
+
+func newMetricsHistogram(name string, help string, label string, buckets []float64) *metricsHistogram {
+	return &metricsHistogram{name:name, help:help, label:label, buckets:buckets,
+		series:make(map[string]*metricsHistogramSeries)}
+}
+
+func (m *metricsHistogram) Observe(labelValue string, value float64) {
+	m.mutex.Lock()
+	series,ok := m.series[labelValue]
+	if !ok {
+		series = &metricsHistogramSeries{counts:make([]uint64,len(m.buckets))}
+		m.series[labelValue] = series
+	}
+	for idx,bound := range m.buckets {
+		if value <= bound {
+			series.counts[idx]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+	m.mutex.Unlock()
+}
+
+func (m *metricsCounter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _,labelValue := range metricsSortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, metricsLabels(m.label,labelValue,"",""),
+			metricsFloat(m.values[labelValue]))
+	}
+}
+
+func (m *metricsHistogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	labelValues := make([]string, 0, len(m.series))
+	for labelValue := range m.series {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _,labelValue := range labelValues {
+		series := m.series[labelValue]
+		var cumulative uint64
+		for idx,bound := range m.buckets {
+			cumulative += series.counts[idx]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				metricsLabels(m.label,labelValue,"le",metricsFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+			metricsLabels(m.label,labelValue,"le","+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name,
+			metricsLabels(m.label,labelValue,"",""), metricsFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name,
+			metricsLabels(m.label,labelValue,"",""), series.count)
+	}
+}
+
+func metricsGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, metricsFloat(value))
+}
+
+func metricsLabels(label string, labelValue string, extraLabel string, extraValue string) string {
+	var list []string
+	if label!="" {
+		list = append(list, label+"="+strconv.Quote(labelValue))
+	}
+	if extraLabel!="" {
+		list = append(list, extraLabel+"="+strconv.Quote(extraValue))
+	}
+	if len(list)==0 {
+		return ""
+	}
+	return "{"+strings.Join(list,",")+"}"
+}
+
+func metricsFloat(value float64) string {
+	if math.IsInf(value,1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func metricsSortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsCallEnded is called by hub.processTimeValues() for every call with a talk duration
+func metricsCallEnded(durationSecs int64, p2p bool) {
+	if p2p {
+		metricsCallsTotal.Inc("p2p")
+	} else {
+		metricsCallsTotal.Inc("relay")
+	}
+	metricsTalkDuration.Observe("", float64(durationSecs))
+}
+
+// metricsRemoteAddr returns the address of the scraper
+// unlike apiRemoteAddr() it does not trust X-Real-IP from anyone but a local proxy
+func metricsRemoteAddr(r *http.Request) string {
+	remoteAddr,_,err := net.SplitHostPort(r.RemoteAddr)
+	if err!=nil {
+		remoteAddr = r.RemoteAddr
+	}
+	if remoteAddr=="::1" {
+		remoteAddr = "127.0.0.1"
+	}
+	if altIp := r.Header.Get("X-Real-IP"); altIp!="" && net.ParseIP(remoteAddr).IsLoopback() {
+		remoteAddr = altIp
+	}
+	return remoteAddr
+}
+
+func metricsAllowed(remoteAddr string) bool {
+	if remoteAddr=="127.0.0.1" || (outboundIP!="" && remoteAddr==outboundIP) {
+		return true
+	}
+	readConfigLock.RLock()
+	allowIPs := metricsAllowIPs
+	readConfigLock.RUnlock()
+	for _,ip := range strings.Split(allowIPs,",") {
+		if strings.TrimSpace(ip)==remoteAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func httpMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := metricsRemoteAddr(r)
+	if !metricsAllowed(remoteAddr) {
+		logWarn("/metrics denied", "rip",remoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var numberOfOnlineCallees, numberOfActiveCalls, numberOfActivePureP2pCalls int
+	// the hubs are read after hubMapMutex is released, so HubMutex is never taken inside it
+	hubMapMutex.RLock()
+	hubs := make([]*Hub, 0, len(hubMap))
+	for _,hub := range hubMap {
+		if hub!=nil {
+			hubs = append(hubs, hub)
+		}
+	}
+	hubMapMutex.RUnlock()
+	numberOfOnlineCallees = len(hubs)
+	for _,hub := range hubs {
+		hub.HubMutex.RLock()
+		if hub.lastCallStartTime>0 {
+			numberOfActiveCalls++
+			if hub.LocalP2p && hub.RemoteP2p {
+				numberOfActivePureP2pCalls++
+			}
+		}
+		hub.HubMutex.RUnlock()
+	}
+
+	numberOfCallsTodayMutex.RLock()
+	callsToday := numberOfCallsToday
+	callSecondsToday := numberOfCallSecondsToday
+	numberOfCallsTodayMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsGauge(w, "webcall_callees_online", "Number of callees connected to this server.",
+		float64(numberOfOnlineCallees))
+	metricsGauge(w, "webcall_calls_active", "Number of calls in progress.",
+		float64(numberOfActiveCalls))
+	metricsGauge(w, "webcall_calls_active_p2p", "Number of calls in progress that are p2p on both sides.",
+		float64(numberOfActivePureP2pCalls))
+	metricsGauge(w, "webcall_calls_today", "Number of calls completed today.",
+		float64(callsToday))
+	metricsGauge(w, "webcall_call_seconds_today", "Talk seconds of the calls completed today.",
+		float64(callSecondsToday))
+	numberOfRooms,numberOfRoomParticipants := roomStats()
+	metricsGauge(w, "webcall_rooms_open", "Number of open conference rooms.",
+		float64(numberOfRooms))
+	metricsGauge(w, "webcall_room_participants", "Number of participants in conference rooms.",
+		float64(numberOfRoomParticipants))
+	metricsGauge(w, "webcall_go_goroutines", "Number of goroutines.",
+		float64(runtime.NumGoroutine()))
+	metricsCallsTotal.write(w)
+	metricsRingDuration.write(w)
+	metricsTalkDuration.write(w)
+	metricsLoginRateLimitTotal.write(w)
+	metricsTurnAuthTotal.write(w)
+	metricsTurnRelayBytesTotal.write(w)
+	metricsWsPingTotal.write(w)
+	metricsWsPongTotal.write(w)
+	metricsHttpDuration.write(w)
+}
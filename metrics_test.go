@@ -0,0 +1,49 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for the access check of /metrics
+package main
+
+import (
+	"testing"
+	"net/http/httptest"
+)
+
+func TestMetricsAllowed(t *testing.T) {
+	readConfigLock.Lock()
+	metricsAllowIPs = "192.0.2.10, 192.0.2.11"
+	readConfigLock.Unlock()
+	defer func() {
+		readConfigLock.Lock()
+		metricsAllowIPs = ""
+		readConfigLock.Unlock()
+	}()
+
+	for _,test := range []struct {
+		remoteAddr string
+		realIp string
+		allowed bool
+	}{
+		{"127.0.0.1:5000", "", true},
+		{"[::1]:5000", "", true},
+		{"192.0.2.10:5000", "", true},
+		{"192.0.2.11:5000", "", true},
+		{"192.0.2.12:5000", "", false},
+		// X-Real-IP of a remote client is ignored
+		{"192.0.2.12:5000", "127.0.0.1", false},
+		{"192.0.2.12:5000", "192.0.2.10", false},
+		// X-Real-IP set by a local proxy
+		{"127.0.0.1:5000", "192.0.2.10", true},
+		{"127.0.0.1:5000", "192.0.2.12", false},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.realIp!="" {
+			r.Header.Set("X-Real-IP", test.realIp)
+		}
+		w := httptest.NewRecorder()
+		httpMetricsHandler(w, r)
+		if (w.Code==200)!=test.allowed {
+			t.Fatalf("rip=%s X-Real-IP=%s status=%d, want allowed=%v",
+				test.remoteAddr, test.realIp, w.Code, test.allowed)
+		}
+	}
+}
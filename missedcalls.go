@@ -0,0 +1,408 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Missed call history.
+// addMissedCall() appends a missed call to the log of the callee (if the caller
+// was not blocked by the callee's call filter). The log is stored in
+// kvCalls/dbMissedCalls (calleeID -> []MissedCall, oldest first). Every entry has
+// a unique ID and the flags Read and CalledBack. Both are set automatically when
+// the callee calls the caller back and the call is picked up.
+// Entries stored by older versions ([]CallerInfo) are read with the ID
+// "AddrPort_CallTime", which is also accepted by the websocket cmd "deleteMissedCall".
+// Config keywords: missedCallsMax per callee (default 100) and missedCallsMaxDays
+// (default 90, 0 = keep forever); outdated entries are removed by ticker3hours.
+// The callee client receives the most recent missedCallsPushMax entries as
+// "missedCalls|[..]" and the number of unread entries as "missedCallsUnread|n"
+// (on login and whenever the log is modified).
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/missedcalls?offset=&limit=&q=&unread=true&from=&to=" -> [ApiMissedCall,..]
+//     newest first; header X-Total-Count = number of matching entries
+//   GET "/api/v1/missedcalls/unread" -> {"unread":n,"total":n}
+//   PUT "/api/v1/missedcalls" {"read":bool,"calledBack":bool} (all entries)
+//   PUT "/api/v1/missedcalls/{id}" {"read":bool,"calledBack":bool}
+//   DELETE "/api/v1/missedcalls/{id}"
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/json"
+)
+
+// the number of (most recent) missed calls sent to the callee client
+const missedCallsPushMax = 10
+
+var missedCallsStore = newCalleeStore(&kvCalls, dbMissedCalls)
+
+// MissedCall uses the field names of CallerInfo, so that the callee client can
+// render both and legacy []CallerInfo values can be decoded
+type MissedCall struct {
+	ID string
+	AddrPort string
+	CallerName string
+	CallTime int64
+	CallerID string
+	Msg string
+	Cause string
+	Read bool
+	CalledBack bool
+}
+
+type ApiMissedCallUpdate struct {
+	Read *bool `json:"read,omitempty"`
+	CalledBack *bool `json:"calledBack,omitempty"`
+}
+
+func missedCallLegacyID(missedCall *MissedCall) string {
+	return missedCall.AddrPort + "_" + strconv.FormatInt(missedCall.CallTime,10)
+}
+
+func (missedCall *MissedCall) apiMissedCall() ApiMissedCall {
+	return ApiMissedCall{missedCall.ID, missedCall.CallerID, missedCall.CallerName, missedCall.AddrPort,
+		missedCall.CallTime, missedCall.Msg, missedCall.Cause, missedCall.Read, missedCall.CalledBack}
+}
+
+func missedCallsLegacyIDs(missedCalls []MissedCall) {
+	for idx := range missedCalls {
+		if missedCalls[idx].ID=="" {
+			// stored as CallerInfo
+			missedCalls[idx].ID = missedCallLegacyID(&missedCalls[idx])
+		}
+	}
+}
+
+// missedCallsLoad returns the missed call log of calleeID (nil if there is none)
+func missedCallsLoad(calleeID string) ([]MissedCall, error) {
+	var missedCalls []MissedCall
+	if _,err := missedCallsStore.load(calleeID, &missedCalls); err!=nil {
+		return nil, err
+	}
+	missedCallsLegacyIDs(missedCalls)
+	return missedCalls, nil
+}
+
+// missedCallsModify loads the log of calleeID, lets modify() change it and stores it
+// if modify() returns true; it returns the (modified) log
+func missedCallsModify(calleeID string, modify func([]MissedCall) ([]MissedCall,bool)) ([]MissedCall, error) {
+	var missedCalls []MissedCall
+	err := missedCallsStore.modify(calleeID, &missedCalls, func(bool) (bool,error) {
+		missedCallsLegacyIDs(missedCalls)
+		var modified bool
+		missedCalls,modified = modify(missedCalls)
+		return modified, nil
+	})
+	if err!=nil {
+		return nil, err
+	}
+	return missedCalls, nil
+}
+
+// missedCallsPrune removes the entries older than maxDays and the oldest entries beyond maxPerCallee
+func missedCallsPrune(missedCalls []MissedCall, maxPerCallee int, maxDays int) []MissedCall {
+	if maxDays>0 {
+		minCallTime := time.Now().Unix() - int64(maxDays)*24*60*60
+		var pruned []MissedCall
+		for _,missedCall := range missedCalls {
+			// CallTime comes from the caller client and may be out of order
+			if missedCall.CallTime >= minCallTime {
+				pruned = append(pruned, missedCall)
+			}
+		}
+		missedCalls = pruned
+	}
+	if maxPerCallee>0 && len(missedCalls) > maxPerCallee {
+		missedCalls = missedCalls[len(missedCalls)-maxPerCallee:]
+	}
+	return missedCalls
+}
+
+func addMissedCall(urlID string, caller CallerInfo, cause string) (error, []MissedCall) {
+	// do we need to check StoreMissedCalls here? NO, it is always checked before this is called
+	// a call blocked by the callee's call filter is logged as a blocked call only
+	reason := callFilter(urlID, CallAttempt{CallerID:caller.CallerID, CallerName:caller.CallerName,
+		Msg:caller.Msg, Ip:caller.AddrPort, Stage:"missedcall"})
+	if reason!="" {
+		return errCallFiltered,nil
+	}
+
+	readConfigLock.RLock()
+	maxPerCallee := missedCallsMax
+	maxDays := missedCallsMaxDays
+	readConfigLock.RUnlock()
+
+	// TODO: maybe NOT save urlID == caller.CallerID (sending to self)
+	missedCall := MissedCall{ID:strconv.FormatInt(time.Now().UnixNano(),36), AddrPort:caller.AddrPort,
+		CallerName:caller.CallerName, CallTime:caller.CallTime, CallerID:caller.CallerID, Msg:caller.Msg,
+		Cause:cause}
+	missedCalls,err := missedCallsModify(urlID, func(missedCalls []MissedCall) ([]MissedCall,bool) {
+		return missedCallsPrune(append(missedCalls, missedCall), maxPerCallee, maxDays), true
+	})
+	if err!=nil {
+		logError("addMissedCall store", "calleeID",urlID, "callerID",caller.CallerID, "err",err)
+		return err,nil
+	}
+	emitEvent(Event{Type:"missedcall", CalleeID:urlID, CallerID:caller.CallerID, CallerName:caller.CallerName,
+		Cause:cause})
+	if logWantedFor("missedcall") {
+		logTxtMsg := caller.Msg
+		if logTxtMsg!="" {
+			// do not log actual msg
+			logTxtMsg = "hidden"
+		}
+		// caller.CallerID may contain @callerHost
+		logDebug("missedcall", "missedCall", "calleeID",urlID, "callerID",caller.CallerID,
+			"callerName",caller.CallerName, "ip",caller.AddrPort, "msg",logTxtMsg, "cause",cause)
+	}
+	return nil,missedCalls
+}
+
+// missedCallsRecent returns the entries to be shown by the callee client
+func missedCallsRecent(missedCalls []MissedCall) []MissedCall {
+	if len(missedCalls) > missedCallsPushMax {
+		return missedCalls[len(missedCalls)-missedCallsPushMax:]
+	}
+	return missedCalls
+}
+
+func missedCallsUnread(missedCalls []MissedCall) int {
+	unread := 0
+	for idx := range missedCalls {
+		if !missedCalls[idx].Read {
+			unread++
+		}
+	}
+	return unread
+}
+
+// missedCallsPush sends the recent entries and the unread count to calleeID (if online)
+func missedCallsPush(calleeID string, missedCalls []MissedCall) {
+	data,err := json.Marshal(missedCallsRecent(missedCalls))
+	if err!=nil {
+		logError("missedCallsPush json.Marshal", "calleeID",calleeID, "err",err)
+		return
+	}
+	if SendToCallee(calleeID, []byte("missedCalls|"+string(data)))==nil {
+		SendToCallee(calleeID, []byte("missedCallsUnread|"+strconv.Itoa(missedCallsUnread(missedCalls))))
+	}
+}
+
+// missedCallRemove removes the entry with the given id (or legacy id) from the log of calleeID
+func missedCallRemove(calleeID string, id string) ([]MissedCall, bool, error) {
+	found := false
+	missedCalls,err := missedCallsModify(calleeID, func(missedCalls []MissedCall) ([]MissedCall,bool) {
+		for idx := range missedCalls {
+			if missedCalls[idx].ID==id || missedCallLegacyID(&missedCalls[idx])==id {
+				found = true
+				return append(missedCalls[:idx], missedCalls[idx+1:]...), true
+			}
+		}
+		return missedCalls, false
+	})
+	return missedCalls, found, err
+}
+
+// missedCallsCalledBack is called when calleeID has called callerID and the call was picked up:
+// the missed calls from callerID in the log of calleeID are marked as read and called back
+func missedCallsCalledBack(calleeID string, callerID string) {
+	calleeID = contactLocalID(calleeID)
+	if calleeID=="" || callerID=="" || strings.Index(calleeID,"@")>=0 {
+		return
+	}
+	modified := false
+	missedCalls,err := missedCallsModify(calleeID, func(missedCalls []MissedCall) ([]MissedCall,bool) {
+		for idx := range missedCalls {
+			if !missedCalls[idx].CalledBack && contactLocalID(missedCalls[idx].CallerID)==callerID {
+				missedCalls[idx].CalledBack = true
+				missedCalls[idx].Read = true
+				modified = true
+			}
+		}
+		return missedCalls, modified
+	})
+	if err!=nil {
+		logError("missedCallsCalledBack", "calleeID",calleeID, "callerID",callerID, "err",err)
+		return
+	}
+	if modified {
+		logInfo("missedcalls called back", "calleeID",calleeID, "callerID",callerID)
+		missedCallsPush(calleeID, missedCalls)
+	}
+}
+
+// missedCallsDelete removes the missed call log of a deleted callee
+func missedCallsDelete(calleeID string) {
+	err := missedCallsStore.delete(calleeID)
+	if err!=nil {
+		logError("missedCallsDelete", "calleeID",calleeID, "err",err)
+	}
+}
+
+// missedCallsCleanup is called by ticker3hours to remove outdated missed calls
+func missedCallsCleanup() {
+	readConfigLock.RLock()
+	maxPerCallee := missedCallsMax
+	maxDays := missedCallsMaxDays
+	readConfigLock.RUnlock()
+
+	pruned,err := missedCallsStore.prune(func() interface{} { return &[]MissedCall{} },
+		func(calleeID string, value interface{}) bool {
+			missedCalls := value.(*[]MissedCall)
+			count := len(*missedCalls)
+			*missedCalls = missedCallsPrune(*missedCalls, maxPerCallee, maxDays)
+			return len(*missedCalls)!=count
+		})
+	if err!=nil {
+		logError("missedCallsCleanup", "err",err)
+		return
+	}
+	logDebug("timer", "missedCallsCleanup", "pruned",pruned)
+}
+
+// apiMissedCalls serves GET and PUT "/api/v1/missedcalls"
+func apiMissedCalls(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if r.Method=="PUT" {
+		var req ApiMissedCallUpdate
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		updated := 0
+		missedCalls,err := missedCallsModify(calleeID, func(missedCalls []MissedCall) ([]MissedCall,bool) {
+			for idx := range missedCalls {
+				if missedCallUpdate(&missedCalls[idx], &req) {
+					updated++
+				}
+			}
+			return missedCalls, updated>0
+		})
+		if err!=nil {
+			logError("/api/v1/missedcalls put", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		if updated>0 {
+			missedCallsPush(calleeID, missedCalls)
+		}
+		apiJson(w, http.StatusOK, map[string]int{"updated":updated})
+		return
+	}
+
+	missedCalls,err := missedCallsLoad(calleeID)
+	if err!=nil {
+		logError("/api/v1/missedcalls get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	query := r.URL.Query()
+	offset,_ := strconv.Atoi(query.Get("offset"))
+	limit,_ := strconv.Atoi(query.Get("limit"))
+	from,_ := strconv.ParseInt(query.Get("from"), 10, 64)
+	to,_ := strconv.ParseInt(query.Get("to"), 10, 64)
+	search := strings.ToLower(query.Get("q"))
+	unreadOnly := query.Get("unread")=="true"
+
+	// newest first
+	list := []ApiMissedCall{}
+	for idx := len(missedCalls)-1; idx>=0; idx-- {
+		missedCall := &missedCalls[idx]
+		if unreadOnly && missedCall.Read {
+			continue
+		}
+		if (from>0 && missedCall.CallTime<from) || (to>0 && missedCall.CallTime>to) {
+			continue
+		}
+		if search!="" && strings.Index(strings.ToLower(missedCall.CallerID+" "+missedCall.CallerName+" "+
+				missedCall.Msg), search)<0 {
+			continue
+		}
+		list = append(list, missedCall.apiMissedCall())
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	if offset>0 {
+		if offset>=len(list) {
+			list = []ApiMissedCall{}
+		} else {
+			list = list[offset:]
+		}
+	}
+	if limit>0 && len(list)>limit {
+		list = list[:limit]
+	}
+	apiJson(w, http.StatusOK, list)
+}
+
+// apiMissedCallsUnread serves GET "/api/v1/missedcalls/unread"
+func apiMissedCallsUnread(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	missedCalls,err := missedCallsLoad(calleeID)
+	if err!=nil {
+		logError("/api/v1/missedcalls/unread", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	apiJson(w, http.StatusOK, map[string]int{"unread":missedCallsUnread(missedCalls), "total":len(missedCalls)})
+}
+
+// apiMissedCall serves PUT and DELETE "/api/v1/missedcalls/{id}"
+func apiMissedCall(w http.ResponseWriter, r *http.Request, calleeID string, id string, remoteAddr string) {
+	if r.Method=="DELETE" {
+		missedCalls,found,err := missedCallRemove(calleeID, id)
+		if err!=nil {
+			logError("/api/v1/missedcalls delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		if !found {
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		// update the callee client (if online)
+		missedCallsPush(calleeID, missedCalls)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req ApiMissedCallUpdate
+	if !apiReadJson(w, r, &req) {
+		return
+	}
+	var updated *MissedCall
+	modified := false
+	missedCalls,err := missedCallsModify(calleeID, func(missedCalls []MissedCall) ([]MissedCall,bool) {
+		for idx := range missedCalls {
+			if missedCalls[idx].ID==id {
+				updated = &missedCalls[idx]
+				modified = missedCallUpdate(updated, &req)
+				break
+			}
+		}
+		return missedCalls, modified
+	})
+	if err!=nil {
+		logError("/api/v1/missedcalls put", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if updated==nil {
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+	if modified {
+		missedCallsPush(calleeID, missedCalls)
+	}
+	apiJson(w, http.StatusOK, updated.apiMissedCall())
+}
+
+// missedCallUpdate applies req to missedCall and returns true if anything has changed
+func missedCallUpdate(missedCall *MissedCall, req *ApiMissedCallUpdate) bool {
+	modified := false
+	if req.Read!=nil && missedCall.Read!=*req.Read {
+		missedCall.Read = *req.Read
+		modified = true
+	}
+	if req.CalledBack!=nil && missedCall.CalledBack!=*req.CalledBack {
+		missedCall.CalledBack = *req.CalledBack
+		modified = true
+	}
+	return modified
+}
@@ -0,0 +1,876 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Pluggable notification backends for offline callees.
+// A Notifier delivers a Notification (an incoming call while the callee
+// is not connected) via one channel type. All notifiers are registered
+// in notifierRegistry by name:
+//   webpush  - browser push to all devices in dbWebPushBucket (see webpush.go)
+//   twitter  - direct message to dbUser.Email2 if it follows the server account
+//   webhook  - POST of the JSON notification to the target url, signed with
+//              HMAC-SHA256 over "timestamp.body" using the channel secret:
+//              X-WebCall-Timestamp: unix secs
+//              X-WebCall-Signature: sha256=<hex>
+//   email    - mail to the target address via smtpHost (smtpUser, smtpPassword, smtpFrom)
+//   telegram - bot message to the target chat_id (telegramBotToken)
+//   matrix   - m.text message to the target room id (matrixHomeserver, matrixAccessToken)
+//   ntfy     - message to the target topic on ntfyServer (or the full topic url)
+//
+// Every callee picks the channels to be woken up by (up to notifyMaxChannels),
+// stored in kvNotif/dbNotifyChannelsBucket. A callee without a stored
+// channel list is notified via webpush and twitter, as before.
+// notifyCallee() sends a Notification to all channels concurrently.
+//
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/notify" -> {"available":[..],"channels":[..]}
+//   POST "/api/v1/notify" NotifyChannel -> channel (with id and webhook secret)
+//   PUT "/api/v1/notify" [NotifyChannel,..] -> replaces all channels
+//   DELETE "/api/v1/notify/{id}"
+//   POST "/api/v1/notify/test" -> delivery result per channel (max notifyTestPer30min)
+//
+// Webhook and ntfy urls are given by the callee, so they must be https urls of
+// public hosts. notifyCheckUrl() rejects hosts that resolve to loopback, private,
+// link-local or unspecified addresses and notifyClient refuses to connect to
+// them (the address may change after the check). http://localhost targets are
+// only accepted with notifyAllowLocalhost=true (for testing).
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const dbNotifyChannelsBucket = "notifychannels" // in kvNotif: calleeID -> []NotifyChannel
+
+// notifyClient is used for the urls given by callees; it only connects to public addresses
+var notifyClient = &http.Client{Timeout: 15 * time.Second, Transport: &http.Transport{
+	DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: notifyDialControl}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout: 90 * time.Second,
+	MaxIdleConns: 20,
+}}
+
+// notifyConfigClient is used for the servers given by config (telegramApiUrl, matrixHomeserver, ntfyServer)
+var notifyConfigClient = &http.Client{Timeout: 15 * time.Second}
+
+// networks that notifyClient does not connect to
+var notifyInternalNets = notifyParseNets("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"224.0.0.0/3", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8")
+
+var notifyTestMap = make(map[string][]time.Time)
+var notifyTestMutex sync.Mutex
+
+// an empty channel list is kept: it means no notifications, while no list means notifyDefaultChannels
+var notifyChannelsStore = &CalleeStore{kv:&kvNotif, bucket:dbNotifyChannelsBucket, keepEmpty:true}
+
+type Notification struct {
+	CalleeID string `json:"calleeId"`
+	CallerID string `json:"callerId,omitempty"`
+	CallerName string `json:"callerName,omitempty"`
+	CallerMsg string `json:"callerMsg,omitempty"`
+	Text string `json:"text"`
+	Time int64 `json:"time"`
+	dbUser *DbUser
+	dbUserKey string
+}
+
+type NotifyChannel struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Target string `json:"target,omitempty"` // url, mail address, chat id, room id or topic
+	Secret string `json:"secret,omitempty"` // webhook signing key
+	Disabled bool `json:"disabled,omitempty"`
+	Created int64 `json:"created"`
+}
+
+type Notifier interface {
+	// Name is the channel type
+	Name() string
+	// Enabled reports if the server is configured for this backend
+	Enabled() bool
+	// Check validates (and normalizes) a channel before it is stored
+	Check(ch *NotifyChannel) error
+	// Ready reports if calleeID can currently be reached via ch
+	Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool
+	// Notify delivers n via ch
+	Notify(n *Notification, ch NotifyChannel) error
+}
+
+var notifierRegistry = map[string]Notifier{}
+
+func registerNotifier(notifier Notifier) {
+	notifierRegistry[notifier.Name()] = notifier
+}
+
+func init() {
+	registerNotifier(webpushNotifier{})
+	registerNotifier(twitterNotifier{})
+	registerNotifier(webhookNotifier{})
+	registerNotifier(emailNotifier{})
+	registerNotifier(telegramNotifier{})
+	registerNotifier(matrixNotifier{})
+	registerNotifier(ntfyNotifier{})
+}
+
+// notifiersAvailable returns the names of all enabled notifiers
+func notifiersAvailable() []string {
+	names := []string{}
+	for name,notifier := range notifierRegistry {
+		if notifier.Enabled() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notifyDefaultChannels are used for callees that never stored a channel list
+var notifyDefaultChannels = []NotifyChannel{{Id:"webpush", Type:"webpush"}, {Id:"twitter", Type:"twitter"}}
+
+// notifyChannels returns the stored channels of calleeID and false if there are none stored
+func notifyChannels(calleeID string) ([]NotifyChannel, bool, error) {
+	var channels []NotifyChannel
+	stored,err := notifyChannelsStore.load(calleeID, &channels)
+	return channels, stored, err
+}
+
+// notifyEffectiveChannels returns the channels calleeID is to be notified on
+func notifyEffectiveChannels(calleeID string) []NotifyChannel {
+	channels,stored,err := notifyChannels(calleeID)
+	if err!=nil {
+		logError("notify get channels", "calleeID",calleeID, "err",err)
+	}
+	if !stored {
+		return notifyDefaultChannels
+	}
+	return channels
+}
+
+// notifyCheckChannel validates ch and sets its id, creation time and (for webhooks) secret
+func notifyCheckChannel(ch *NotifyChannel) error {
+	notifier := notifierRegistry[ch.Type]
+	if notifier==nil {
+		return errors.New("unknown channel type")
+	}
+	if !notifier.Enabled() {
+		return errors.New("channel type not enabled on this server")
+	}
+	ch.Target = strings.TrimSpace(ch.Target)
+	if len(ch.Target)>500 {
+		return errors.New("target too long")
+	}
+	err := notifier.Check(ch)
+	if err!=nil {
+		return err
+	}
+	if ch.Id=="" {
+		hash := sha256.Sum256([]byte(ch.Type+"|"+ch.Target))
+		ch.Id = hex.EncodeToString(hash[:6])
+	}
+	if ch.Created==0 {
+		ch.Created = time.Now().Unix()
+	}
+	return nil
+}
+
+// notifyCheckChannels validates a channel list
+func notifyCheckChannels(channels []NotifyChannel) error {
+	readConfigLock.RLock()
+	maxChannels := notifyMaxChannels
+	readConfigLock.RUnlock()
+	if maxChannels>0 && len(channels) > maxChannels {
+		return fmt.Errorf("max %d channels", maxChannels)
+	}
+	for idx := range channels {
+		if err := notifyCheckChannel(&channels[idx]); err!=nil {
+			return fmt.Errorf("%s: %v", channels[idx].Type, err)
+		}
+		for j := 0; j<idx; j++ {
+			if channels[j].Id==channels[idx].Id {
+				return fmt.Errorf("%s: duplicate channel", channels[idx].Type)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyStoreChannels replaces the channel list of calleeID
+func notifyStoreChannels(calleeID string, channels []NotifyChannel) error {
+	if err := notifyCheckChannels(channels); err!=nil {
+		return err
+	}
+	if channels==nil {
+		// an empty list (no notifications) is different from no list (defaults)
+		channels = []NotifyChannel{}
+	}
+	var stored []NotifyChannel
+	return notifyChannelsStore.modify(calleeID, &stored, func(bool) (bool,error) {
+		stored = channels
+		return true, nil
+	})
+}
+
+// notifyModifyChannels applies modify to the channel list of calleeID and stores the result
+// a callee without a stored list starts from the defaults, so they are not silently dropped
+func notifyModifyChannels(calleeID string, modify func([]NotifyChannel) ([]NotifyChannel,bool)) (bool, error) {
+	readConfigLock.RLock()
+	maxChannels := notifyMaxChannels
+	readConfigLock.RUnlock()
+	modified := false
+	var channels []NotifyChannel
+	err := notifyChannelsStore.modify(calleeID, &channels, func(stored bool) (bool,error) {
+		if !stored {
+			for _,ch := range notifyDefaultChannels {
+				if notifierRegistry[ch.Type].Enabled() {
+					channels = append(channels, ch)
+				}
+			}
+		}
+		channels,modified = modify(channels)
+		if !modified {
+			return false, nil
+		}
+		if maxChannels>0 && len(channels) > maxChannels {
+			modified = false
+			return false, fmt.Errorf("max %d channels", maxChannels)
+		}
+		if channels==nil {
+			channels = []NotifyChannel{}
+		}
+		return true, nil
+	})
+	return modified && err==nil, err
+}
+
+// notifyAddChannel adds ch to the channels of calleeID (replacing one with the same id)
+func notifyAddChannel(calleeID string, ch NotifyChannel) (NotifyChannel, error) {
+	if err := notifyCheckChannel(&ch); err!=nil {
+		return ch, err
+	}
+	_,err := notifyModifyChannels(calleeID, func(channels []NotifyChannel) ([]NotifyChannel,bool) {
+		for idx := range channels {
+			if channels[idx].Id==ch.Id {
+				channels = append(channels[:idx], channels[idx+1:]...)
+				break
+			}
+		}
+		return append(channels, ch), true
+	})
+	return ch, err
+}
+
+// notifyRemoveChannel removes the channel with the given id; it returns false if there is no such channel
+func notifyRemoveChannel(calleeID string, id string) (bool, error) {
+	return notifyModifyChannels(calleeID, func(channels []NotifyChannel) ([]NotifyChannel,bool) {
+		for idx := range channels {
+			if channels[idx].Id==id {
+				return append(channels[:idx], channels[idx+1:]...), true
+			}
+		}
+		return channels, false
+	})
+}
+
+// notifyReady reports if calleeID can be notified on at least one channel
+func notifyReady(calleeID string, dbUser *DbUser) bool {
+	for _,ch := range notifyEffectiveChannels(calleeID) {
+		notifier := notifierRegistry[ch.Type]
+		if notifier!=nil && !ch.Disabled && notifier.Enabled() && notifier.Ready(calleeID, dbUser, ch) {
+			return true
+		}
+	}
+	return false
+}
+
+type NotifyResult struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Ok bool `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// NotifyPermanentError is returned by a Notifier if retrying the delivery is pointless
+type NotifyPermanentError struct {
+	Err error
+}
+
+func (e NotifyPermanentError) Error() string { return e.Err.Error() }
+
+func notifyIsPermanent(err error) bool {
+	var permanentErr NotifyPermanentError
+	return errors.As(err, &permanentErr)
+}
+
+// notifySend delivers n via the single channel ch
+func notifySend(n *Notification, ch NotifyChannel) error {
+	notifier := notifierRegistry[ch.Type]
+	if notifier==nil || !notifier.Enabled() {
+		return NotifyPermanentError{errors.New("not enabled")}
+	}
+	if ch.Disabled {
+		return NotifyPermanentError{errors.New("disabled")}
+	}
+	err := notifier.Notify(n, ch)
+	if err!=nil {
+		logWarn("notify fail", "calleeID",n.CalleeID, "type",ch.Type, "channel",ch.Id, "err",err)
+		return err
+	}
+	logInfo("notify sent", "calleeID",n.CalleeID, "type",ch.Type, "channel",ch.Id)
+	return nil
+}
+
+// notifyCallee sends n to all channels of n.CalleeID concurrently; it returns one result per channel
+func notifyCallee(n *Notification) []NotifyResult {
+	channels := notifyEffectiveChannels(n.CalleeID)
+	results := make([]NotifyResult, len(channels))
+	var wg sync.WaitGroup
+	for idx,ch := range channels {
+		results[idx] = NotifyResult{Id:ch.Id, Type:ch.Type}
+		wg.Add(1)
+		go func(idx int, ch NotifyChannel) {
+			defer wg.Done()
+			if err := notifySend(n, ch); err!=nil {
+				results[idx].Error = err.Error()
+				return
+			}
+			results[idx].Ok = true
+		}(idx, ch)
+	}
+	wg.Wait()
+	return results
+}
+
+// notifyLoadUser sets n.dbUser and n.dbUserKey from the database
+func notifyLoadUser(n *Notification) error {
+	var dbEntry DbEntry
+	err := kvMain.Get(dbRegisteredIDs, n.CalleeID, &dbEntry)
+	if err!=nil {
+		return err
+	}
+	var dbUser DbUser
+	dbUserKey := fmt.Sprintf("%s_%d", n.CalleeID, dbEntry.StartTime)
+	err = kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
+	if err!=nil {
+		return err
+	}
+	n.dbUser = &dbUser
+	n.dbUserKey = dbUserKey
+	return nil
+}
+
+// notifySentCount returns the number of successful deliveries in results
+func notifySentCount(results []NotifyResult) int {
+	sent := 0
+	for _,result := range results {
+		if result.Ok {
+			sent++
+		}
+	}
+	return sent
+}
+
+func notifyParseNets(cidrs ...string) []*net.IPNet {
+	var ipNets []*net.IPNet
+	for _,cidr := range cidrs {
+		_,ipNet,err := net.ParseCIDR(cidr)
+		if err!=nil {
+			panic(err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+// notifyInternalIP reports if ip is a loopback, private, link-local, multicast or unspecified address
+func notifyInternalIP(ip net.IP) bool {
+	for _,ipNet := range notifyInternalNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyIPAllowed reports if notifyClient may connect to ip
+func notifyIPAllowed(ip net.IP) bool {
+	if !notifyInternalIP(ip) {
+		return true
+	}
+	return ip.IsLoopback() && notifyConfigBool(&notifyAllowLocalhost)
+}
+
+// notifyDialControl refuses connections to internal addresses
+// it is called with the resolved address, so a dns change after notifyCheckUrl is also caught
+func notifyDialControl(network string, address string, c syscall.RawConn) error {
+	host,_,err := net.SplitHostPort(address)
+	if err!=nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip==nil || !notifyIPAllowed(ip) {
+		return errors.New("address not allowed "+host)
+	}
+	return nil
+}
+
+// notifyCheckUrl accepts https urls of public hosts
+// and http urls on this host if notifyAllowLocalhost is set (for testing)
+func notifyCheckUrl(rawurl string) (*url.URL, error) {
+	u,err := url.Parse(rawurl)
+	if err!=nil || u.Host=="" {
+		return nil, errors.New("invalid url")
+	}
+	host := u.Hostname()
+	isLocalhost := host=="localhost" || host=="127.0.0.1" || host=="::1"
+	if isLocalhost && !notifyConfigBool(&notifyAllowLocalhost) {
+		return nil, errors.New("host not allowed")
+	}
+	if u.Scheme!="https" && (u.Scheme!="http" || !isLocalhost) {
+		return nil, errors.New("url must be https")
+	}
+	ips,err := net.LookupIP(host)
+	if err!=nil || len(ips)==0 {
+		return nil, errors.New("cannot resolve host "+host)
+	}
+	for _,ip := range ips {
+		if !notifyIPAllowed(ip) {
+			return nil, errors.New("host not allowed")
+		}
+	}
+	return u, nil
+}
+
+// notifyTestLimit reports if calleeID has reached notifyTestPer30min test notifications
+func notifyTestLimit(calleeID string) bool {
+	readConfigLock.RLock()
+	maxTests := notifyTestPer30min
+	readConfigLock.RUnlock()
+	if maxTests<=0 {
+		return false
+	}
+	notifyTestMutex.Lock()
+	defer notifyTestMutex.Unlock()
+	timeNow := time.Now()
+	for key,tests := range notifyTestMap {
+		if len(tests)>0 && timeNow.Sub(tests[len(tests)-1]) >= 30*time.Minute {
+			delete(notifyTestMap, key)
+		}
+	}
+	tests := notifyTestMap[calleeID]
+	for len(tests)>0 && timeNow.Sub(tests[0]) >= 30*time.Minute {
+		tests = tests[1:]
+	}
+	if len(tests) >= maxTests {
+		notifyTestMap[calleeID] = tests
+		return true
+	}
+	notifyTestMap[calleeID] = append(tests, timeNow)
+	return false
+}
+
+// notifyPost sends a request and returns an error if it was not answered with 2xx
+func notifyPost(client *http.Client, method string, url string, contentType string, body []byte,
+		header map[string]string) error {
+	req,err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err!=nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key,value := range header {
+		req.Header.Set(key, value)
+	}
+	resp,err := client.Do(req)
+	if err!=nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode<200 || resp.StatusCode>=300 {
+		err = fmt.Errorf("status %d", resp.StatusCode)
+		if resp.StatusCode>=400 && resp.StatusCode<500 &&
+				resp.StatusCode!=http.StatusRequestTimeout && resp.StatusCode!=http.StatusTooManyRequests {
+			// rejected by the receiver (bad target or credentials)
+			return NotifyPermanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func notifyConfig(value *string) string {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return *value
+}
+
+func notifyConfigBool(value *bool) bool {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return *value
+}
+
+type webpushNotifier struct{}
+
+func (webpushNotifier) Name() string { return "webpush" }
+
+func (webpushNotifier) Enabled() bool {
+	_,_,err := webpushVapidKey()
+	return err==nil
+}
+
+func (webpushNotifier) Check(ch *NotifyChannel) error {
+	// the devices are managed via /api/v1/webpush
+	ch.Id = "webpush"
+	ch.Target = ""
+	return nil
+}
+
+func (webpushNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	if dbUser.Str2!="" || dbUser.Str3!="" {
+		return true
+	}
+	devices,err := webpushDevices(calleeID)
+	if err!=nil {
+		logError("webpush get devices", "calleeID",calleeID, "err",err)
+	}
+	return len(devices)>0
+}
+
+func (webpushNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	if webpushNotify(n.CalleeID, n.Text)==0 {
+		// expired devices have been removed by webpushNotify
+		devices,err := webpushDevices(n.CalleeID)
+		if err==nil && len(devices)==0 {
+			return NotifyPermanentError{errors.New("no devices")}
+		}
+		return errors.New("no device reached")
+	}
+	return nil
+}
+
+type twitterNotifier struct{}
+
+func (twitterNotifier) Name() string { return "twitter" }
+
+func (twitterNotifier) Enabled() bool {
+	return notifyConfig(&twitterKey)!="" && notifyConfig(&twitterSecret)!=""
+}
+
+func (twitterNotifier) Check(ch *NotifyChannel) error {
+	// the twitter handle is dbUser.Email2
+	ch.Id = "twitter"
+	ch.Target = ""
+	return nil
+}
+
+func (twitterNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return twitterIsFollower(calleeID, dbUser)
+}
+
+func (twitterNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	return twitterNotify(n)
+}
+
+type webhookNotifier struct{}
+
+func (webhookNotifier) Name() string { return "webhook" }
+
+func (webhookNotifier) Enabled() bool { return true }
+
+func (webhookNotifier) Check(ch *NotifyChannel) error {
+	if _,err := notifyCheckUrl(ch.Target); err!=nil {
+		return err
+	}
+	if ch.Secret=="" {
+		secret := make([]byte, 24)
+		if _,err := rand.Read(secret); err!=nil {
+			return err
+		}
+		ch.Secret = hex.EncodeToString(secret)
+	}
+	return nil
+}
+
+func (webhookNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return ch.Target!=""
+}
+
+func (webhookNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	body,err := json.Marshal(struct {
+		Event string `json:"event"`
+		*Notification
+	}{"notify", n})
+	if err!=nil {
+		return err
+	}
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	return notifyPost(notifyClient, "POST", ch.Target, "application/json", body, map[string]string{
+		"X-WebCall-Timestamp": timestamp,
+		"X-WebCall-Signature": "sha256="+notifySign(ch.Secret, timestamp, body),
+	})
+}
+
+// notifySign returns the hex HMAC-SHA256 of "timestamp.body"
+func notifySign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp+"."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type emailNotifier struct{}
+
+func (emailNotifier) Name() string { return "email" }
+
+func (emailNotifier) Enabled() bool {
+	return notifyConfig(&smtpHost)!="" && notifyConfig(&smtpFrom)!=""
+}
+
+func (emailNotifier) Check(ch *NotifyChannel) error {
+	addr,err := mail.ParseAddress(ch.Target)
+	if err!=nil {
+		return errors.New("invalid mail address")
+	}
+	ch.Target = addr.Address
+	return nil
+}
+
+func (emailNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return ch.Target!=""
+}
+
+func (emailNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	readConfigLock.RLock()
+	host := smtpHost
+	user := smtpUser
+	password := smtpPassword
+	from := smtpFrom
+	readConfigLock.RUnlock()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", ch.Target)
+	fmt.Fprintf(&msg, "Subject: WebCall %s: incoming call\r\n", n.CalleeID)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Unix(n.Time,0).Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", n.Text)
+
+	var auth smtp.Auth
+	if user!="" {
+		hostname,_,err := net.SplitHostPort(host)
+		if err!=nil {
+			hostname = host
+		}
+		auth = smtp.PlainAuth("", user, password, hostname)
+	}
+	fromAddr := from
+	if addr,err := mail.ParseAddress(from); err==nil {
+		fromAddr = addr.Address
+	}
+	return smtp.SendMail(host, auth, fromAddr, []string{ch.Target}, msg.Bytes())
+}
+
+type telegramNotifier struct{}
+
+func (telegramNotifier) Name() string { return "telegram" }
+
+func (telegramNotifier) Enabled() bool { return notifyConfig(&telegramBotToken)!="" }
+
+func (telegramNotifier) Check(ch *NotifyChannel) error {
+	// numeric chat id or @channelname
+	if ch.Target=="" || strings.ContainsAny(ch.Target, " /?#") {
+		return errors.New("invalid chat id")
+	}
+	return nil
+}
+
+func (telegramNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return ch.Target!=""
+}
+
+func (telegramNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	readConfigLock.RLock()
+	token := telegramBotToken
+	apiUrl := telegramApiUrl
+	readConfigLock.RUnlock()
+	body,err := json.Marshal(map[string]string{"chat_id":ch.Target, "text":n.Text})
+	if err!=nil {
+		return err
+	}
+	return notifyPost(notifyConfigClient, "POST", strings.TrimSuffix(apiUrl,"/")+"/bot"+token+"/sendMessage",
+		"application/json", body, nil)
+}
+
+type matrixNotifier struct{}
+
+func (matrixNotifier) Name() string { return "matrix" }
+
+func (matrixNotifier) Enabled() bool {
+	return notifyConfig(&matrixHomeserver)!="" && notifyConfig(&matrixAccessToken)!=""
+}
+
+func (matrixNotifier) Check(ch *NotifyChannel) error {
+	// room id "!opaque:server"
+	if !strings.HasPrefix(ch.Target,"!") || strings.Index(ch.Target,":")<2 {
+		return errors.New("invalid room id")
+	}
+	return nil
+}
+
+func (matrixNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return ch.Target!=""
+}
+
+func (matrixNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	readConfigLock.RLock()
+	homeserver := matrixHomeserver
+	token := matrixAccessToken
+	readConfigLock.RUnlock()
+	body,err := json.Marshal(map[string]string{"msgtype":"m.text", "body":n.Text})
+	if err!=nil {
+		return err
+	}
+	txnID := fmt.Sprintf("webcall%d", time.Now().UnixNano())
+	return notifyPost(notifyConfigClient, "PUT", strings.TrimSuffix(homeserver,"/")+"/_matrix/client/v3/rooms/"+
+		url.PathEscape(ch.Target)+"/send/m.room.message/"+txnID,
+		"application/json", body, map[string]string{"Authorization":"Bearer "+token})
+}
+
+type ntfyNotifier struct{}
+
+func (ntfyNotifier) Name() string { return "ntfy" }
+
+func (ntfyNotifier) Enabled() bool { return notifyConfig(&ntfyServer)!="" }
+
+func (ntfyNotifier) Check(ch *NotifyChannel) error {
+	if strings.Contains(ch.Target,"://") {
+		_,err := notifyCheckUrl(ch.Target)
+		return err
+	}
+	if ch.Target=="" || len(ch.Target)>64 || strings.ContainsAny(ch.Target, " /?#") {
+		return errors.New("invalid topic")
+	}
+	return nil
+}
+
+func (ntfyNotifier) Ready(calleeID string, dbUser *DbUser, ch NotifyChannel) bool {
+	return ch.Target!=""
+}
+
+func (ntfyNotifier) Notify(n *Notification, ch NotifyChannel) error {
+	topicUrl := ch.Target
+	client := notifyClient
+	if !strings.Contains(topicUrl,"://") {
+		topicUrl = strings.TrimSuffix(notifyConfig(&ntfyServer),"/")+"/"+topicUrl
+		client = notifyConfigClient
+	}
+	return notifyPost(client, "POST", topicUrl, "text/plain; charset=utf-8", []byte(n.Text), map[string]string{
+		"Title": "WebCall "+n.CalleeID,
+		"Priority": "high",
+		"Tags": "telephone_receiver",
+	})
+}
+
+type ApiNotify struct {
+	Available []string `json:"available"`
+	Channels []NotifyChannel `json:"channels"`
+}
+
+// apiNotify serves GET, POST and PUT "/api/v1/notify"
+func apiNotify(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	switch r.Method {
+	case "POST":
+		var ch NotifyChannel
+		if !apiReadJson(w, r, &ch) {
+			return
+		}
+		ch,err := notifyAddChannel(calleeID, ch)
+		if err!=nil {
+			logWarn("/api/v1/notify add fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusBadRequest, "invalid_channel", err.Error())
+			return
+		}
+		logInfo("/api/v1/notify add", "calleeID",calleeID, "type",ch.Type, "channel",ch.Id, "rip",remoteAddr)
+		apiJson(w, http.StatusCreated, ch)
+		return
+	case "PUT":
+		var channels []NotifyChannel
+		if !apiReadJson(w, r, &channels) {
+			return
+		}
+		err := notifyStoreChannels(calleeID, channels)
+		if err!=nil {
+			logWarn("/api/v1/notify put fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusBadRequest, "invalid_channel", err.Error())
+			return
+		}
+		logInfo("/api/v1/notify put", "calleeID",calleeID, "channels",len(channels), "rip",remoteAddr)
+	}
+	channels,stored,err := notifyChannels(calleeID)
+	if err!=nil {
+		logError("/api/v1/notify get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if !stored {
+		channels = notifyDefaultChannels
+	} else if channels==nil {
+		channels = []NotifyChannel{}
+	}
+	apiJson(w, http.StatusOK, ApiNotify{notifiersAvailable(), channels})
+}
+
+// apiNotifyTest serves POST "/api/v1/notify/test"
+func apiNotifyTest(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if notifyTestLimit(calleeID) {
+		logWarn("/api/v1/notify/test limit", "calleeID",calleeID, "rip",remoteAddr)
+		apiError(w, http.StatusTooManyRequests, "too_many_requests",
+			"Too many test notifications in short order. Please take a pause.")
+		return
+	}
+	n := &Notification{CalleeID:calleeID, Time:time.Now().Unix(),
+		Text:"This is a test notification from WebCall for "+calleeID}
+	if err := notifyLoadUser(n); err!=nil {
+		logError("/api/v1/notify/test", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	results := notifyCallee(n)
+	logInfo("/api/v1/notify/test", "calleeID",calleeID, "sent",notifySentCount(results), "rip",remoteAddr)
+	apiJson(w, http.StatusOK, results)
+}
+
+// apiDeleteNotify serves DELETE "/api/v1/notify/{id}"
+func apiDeleteNotify(w http.ResponseWriter, r *http.Request, calleeID string, id string, remoteAddr string) {
+	found,err := notifyRemoveChannel(calleeID, id)
+	if err!=nil {
+		logError("/api/v1/notify delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,383 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Durable notification outbox.
+// Every notification for an offline callee is stored in kvNotif/dbNotifyOutboxBucket
+// before it is sent. The key is "calleeID|callerIp|callerID", so a caller
+// repeating /notifyCallee while its earlier request is still waiting does not
+// wake up the callee a second time. Each channel of the callee has its own
+// delivery state (queued, sent, retrying, failed, cancelled). Failed deliveries
+// are retried by outboxTicker() after outboxBackoffSecs, for as long as the
+// caller is waiting, but no longer than outboxMaxSecs. Permanent errors
+// (NotifyPermanentError) are not retried. Closed entries are kept for
+// outboxKeepSecs.
+//
+// The caller page polls the delivery status of its notification:
+//   GET "/rtcsig/notifystatus?id=(calleeID)&callerId=&callerHost=" -> OutboxStatus
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbNotifyOutboxBucket = "notifyoutbox" // in kvNotif: outboxKey() -> OutboxEntry
+
+const outboxTickSecs = 5
+const outboxMaxSecs = 10*60    // same as the caller's xhr timeout for /notifyCallee
+const outboxKeepSecs = 24*60*60
+
+// delay before the 1st, 2nd, ... retry of a failed delivery
+var outboxBackoffSecs = []int64{10, 20, 40, 60, 120}
+
+// serializes the read-modify-write of outbox entries
+var outboxMutex sync.Mutex
+
+// keys of the entries currently being delivered
+var outboxInflight = map[string]bool{}
+
+// number of /notifyCallee requests waiting on each open entry
+var outboxWaiters = map[string]int{}
+
+type OutboxDelivery struct {
+	ChannelId string
+	Type string
+	Status string // queued, sent, retrying, failed, cancelled
+	Attempts int
+	NextTry int64
+	LastError string
+	SentTime int64
+}
+
+type OutboxEntry struct {
+	Notification Notification
+	Deliveries []OutboxDelivery
+	Created int64
+	Closed int64
+	ClosedReason string // answered, abandoned, failed, expired
+}
+
+type OutboxChannelStatus struct {
+	Type string `json:"type"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	NextTry int64 `json:"nextTry,omitempty"`
+}
+
+type OutboxStatus struct {
+	Status string `json:"status"` // none, queued, retrying, sent, failed
+	Closed string `json:"closed,omitempty"`
+	Created int64 `json:"created,omitempty"`
+	Channels []OutboxChannelStatus `json:"channels"`
+}
+
+func outboxKey(calleeID string, callerIp string, callerID string) string {
+	return calleeID+"|"+callerIp+"|"+callerID
+}
+
+func (entry *OutboxEntry) sent() int {
+	count := 0
+	for _,delivery := range entry.Deliveries {
+		if delivery.Status=="sent" {
+			count++
+		}
+	}
+	return count
+}
+
+func (entry *OutboxEntry) pending() int {
+	count := 0
+	for _,delivery := range entry.Deliveries {
+		if delivery.Status=="queued" || delivery.Status=="retrying" {
+			count++
+		}
+	}
+	return count
+}
+
+func (entry *OutboxEntry) status() OutboxStatus {
+	status := OutboxStatus{Status:"failed", Closed:entry.ClosedReason, Created:entry.Created}
+	status.Channels = make([]OutboxChannelStatus, len(entry.Deliveries))
+	queued := true
+	for idx,delivery := range entry.Deliveries {
+		status.Channels[idx] = OutboxChannelStatus{delivery.Type, delivery.Status, delivery.Attempts, delivery.NextTry}
+		if delivery.Attempts>0 {
+			queued = false
+		}
+	}
+	if entry.sent()>0 {
+		status.Status = "sent"
+	} else if entry.pending()>0 {
+		status.Status = "retrying"
+		if queued {
+			status.Status = "queued"
+		}
+	}
+	return status
+}
+
+// outboxSubmit queues n for all channels of the callee and makes the first delivery attempt
+// if an entry for the same caller is still open, it is returned instead (and nothing is sent)
+// every call must be followed by outboxRelease() once the caller stops waiting
+func outboxSubmit(n *Notification, callerIp string) (string, OutboxEntry, bool) {
+	key := outboxKey(n.CalleeID, callerIp, n.CallerID)
+	outboxMutex.Lock()
+	outboxWaiters[key]++
+	var entry OutboxEntry
+	err := kvNotif.Get(dbNotifyOutboxBucket, key, &entry)
+	if err==nil && entry.Closed==0 && time.Now().Unix()-entry.Created < outboxMaxSecs {
+		outboxMutex.Unlock()
+		logInfo("outbox duplicate notification", "key",key, "sent",entry.sent(), "pending",entry.pending())
+		return key, entry, false
+	}
+	entry = OutboxEntry{Notification:*n, Created:time.Now().Unix()}
+	for _,ch := range notifyEffectiveChannels(n.CalleeID) {
+		entry.Deliveries = append(entry.Deliveries, OutboxDelivery{ChannelId:ch.Id, Type:ch.Type, Status:"queued"})
+	}
+	err = kvNotif.Put(dbNotifyOutboxBucket, key, entry, false)
+	outboxMutex.Unlock()
+	if err!=nil {
+		logError("outbox store", "key",key, "err",err)
+	}
+	if updated,ok := outboxAttempt(key, n); ok {
+		entry = updated
+	}
+	return key, entry, true
+}
+
+// outboxAttempt sends all due deliveries of entry key concurrently and stores the results
+func outboxAttempt(key string, n *Notification) (OutboxEntry, bool) {
+	outboxMutex.Lock()
+	if outboxInflight[key] {
+		outboxMutex.Unlock()
+		return OutboxEntry{}, false
+	}
+	var entry OutboxEntry
+	err := kvNotif.Get(dbNotifyOutboxBucket, key, &entry)
+	if err!=nil || entry.Closed>0 {
+		outboxMutex.Unlock()
+		return entry, false
+	}
+	outboxInflight[key] = true
+	outboxMutex.Unlock()
+
+	channels := notifyEffectiveChannels(n.CalleeID)
+	timeNow := time.Now().Unix()
+	results := make([]error, len(entry.Deliveries))
+	attempted := make([]bool, len(entry.Deliveries))
+	var wg sync.WaitGroup
+	for idx,delivery := range entry.Deliveries {
+		if (delivery.Status!="queued" && delivery.Status!="retrying") || delivery.NextTry > timeNow {
+			continue
+		}
+		attempted[idx] = true
+		var channel *NotifyChannel
+		for i := range channels {
+			if channels[i].Id==delivery.ChannelId {
+				channel = &channels[i]
+				break
+			}
+		}
+		if channel==nil {
+			results[idx] = NotifyPermanentError{fmt.Errorf("channel removed")}
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, ch NotifyChannel) {
+			defer wg.Done()
+			if err := notifySend(n, ch); err!=nil {
+				results[idx] = err
+			}
+		}(idx, *channel)
+	}
+	wg.Wait()
+
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	delete(outboxInflight, key)
+	var stored OutboxEntry
+	err = kvNotif.Get(dbNotifyOutboxBucket, key, &stored)
+	if err!=nil || len(stored.Deliveries)!=len(entry.Deliveries) {
+		return entry, false
+	}
+	timeNow = time.Now().Unix()
+	for idx := range stored.Deliveries {
+		delivery := &stored.Deliveries[idx]
+		if !attempted[idx] || (delivery.Status!="queued" && delivery.Status!="retrying" &&
+				delivery.Status!="cancelled") {
+			// cancelled: closed while this attempt was in progress
+			continue
+		}
+		delivery.Attempts++
+		err := results[idx]
+		if err==nil {
+			delivery.Status = "sent"
+			delivery.SentTime = timeNow
+			delivery.NextTry = 0
+			delivery.LastError = ""
+			continue
+		}
+		delivery.LastError = err.Error()
+		if notifyIsPermanent(err) || delivery.Attempts > len(outboxBackoffSecs) {
+			delivery.Status = "failed"
+			delivery.NextTry = 0
+		} else {
+			delivery.Status = "retrying"
+			delivery.NextTry = timeNow + outboxBackoffSecs[delivery.Attempts-1]
+		}
+		if stored.Closed>0 && delivery.Status!="failed" {
+			delivery.Status = "cancelled"
+		}
+	}
+	err = kvNotif.Put(dbNotifyOutboxBucket, key, stored, false)
+	if err!=nil {
+		logError("outbox store", "key",key, "err",err)
+	}
+	return stored, true
+}
+
+// outboxRelease is called when a caller stops waiting for entry key
+// the entry is closed if no other request is waiting on it, or if the call was answered
+func outboxRelease(key string, reason string) {
+	outboxMutex.Lock()
+	outboxWaiters[key]--
+	waiters := outboxWaiters[key]
+	if waiters<=0 {
+		delete(outboxWaiters, key)
+	}
+	outboxMutex.Unlock()
+	if waiters<=0 || reason=="answered" {
+		outboxClose(key, reason)
+	}
+}
+
+// outboxClose ends the retries of entry key; reason is answered, abandoned, failed or expired
+func outboxClose(key string, reason string) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	var entry OutboxEntry
+	err := kvNotif.Get(dbNotifyOutboxBucket, key, &entry)
+	if err!=nil || entry.Closed>0 {
+		return
+	}
+	entry.Closed = time.Now().Unix()
+	entry.ClosedReason = reason
+	for idx := range entry.Deliveries {
+		if entry.Deliveries[idx].Status=="queued" || entry.Deliveries[idx].Status=="retrying" {
+			entry.Deliveries[idx].Status = "cancelled"
+			entry.Deliveries[idx].NextTry = 0
+		}
+	}
+	err = kvNotif.Put(dbNotifyOutboxBucket, key, entry, false)
+	if err!=nil {
+		logError("outbox close", "key",key, "err",err)
+		return
+	}
+	logInfo("outbox closed", "key",key, "reason",reason, "sent",entry.sent())
+}
+
+// outboxTicker retries due deliveries, expires entries after outboxMaxSecs
+// and deletes closed entries after outboxKeepSecs
+func outboxTicker() {
+	ticker := time.NewTicker(outboxTickSecs*time.Second)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if shutdownStarted.Get() {
+			break
+		}
+		timeNow := time.Now().Unix()
+		var due, expired, outdated []string
+		err := kvNotif.ForEach(dbNotifyOutboxBucket, func(key string, value skv.Value) error {
+			var entry OutboxEntry
+			if err := value.Decode(&entry); err!=nil {
+				outdated = append(outdated, key)
+				return nil
+			}
+			if entry.Closed>0 {
+				if timeNow-entry.Closed >= outboxKeepSecs {
+					outdated = append(outdated, key)
+				}
+				return nil
+			}
+			if timeNow-entry.Created >= outboxMaxSecs {
+				expired = append(expired, key)
+				return nil
+			}
+			for _,delivery := range entry.Deliveries {
+				if delivery.Status=="retrying" && delivery.NextTry<=timeNow {
+					due = append(due, key)
+					break
+				}
+			}
+			return nil
+		})
+		if err!=nil {
+			logError("outboxTicker", "bucket",dbNotifyOutboxBucket, "err",err)
+			continue
+		}
+		for _,key := range expired {
+			outboxClose(key, "expired")
+		}
+		for _,key := range outdated {
+			if err := kvNotif.Delete(dbNotifyOutboxBucket, key); err!=nil {
+				logError("outboxTicker delete", "key",key, "err",err)
+			}
+		}
+		for _,key := range due {
+			go outboxRetry(key)
+		}
+	}
+}
+
+func outboxRetry(key string) {
+	var entry OutboxEntry
+	if err := kvNotif.Get(dbNotifyOutboxBucket, key, &entry); err!=nil {
+		return
+	}
+	n := entry.Notification
+	if err := notifyLoadUser(&n); err!=nil {
+		logWarn("outbox retry no user", "key",key, "err",err)
+		outboxClose(key, "expired")
+		return
+	}
+	if stored,ok := outboxAttempt(key, &n); ok {
+		logInfo("outbox retry", "key",key, "sent",stored.sent(), "pending",stored.pending())
+	}
+}
+
+// outboxGetStatus returns the delivery status of entry key
+func outboxGetStatus(key string) OutboxStatus {
+	var entry OutboxEntry
+	err := kvNotif.Get(dbNotifyOutboxBucket, key, &entry)
+	if err!=nil {
+		if err!=skv.ErrNotFound {
+			logError("outbox get", "key",key, "err",err)
+		}
+		return OutboxStatus{Status:"none", Channels:[]OutboxChannelStatus{}}
+	}
+	return entry.status()
+}
+
+func httpNotifyStatus(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr string) {
+	if urlID=="" {
+		return
+	}
+	callerID := r.URL.Query().Get("callerId")
+	callerHost := strings.ToLower(r.URL.Query().Get("callerHost"))
+	if callerHost!="" && callerHost!=hostname {
+		callerID += "@"+callerHost
+	}
+	data,err := json.Marshal(outboxGetStatus(outboxKey(urlID, remoteAddr, callerID)))
+	if err!=nil {
+		logError("/notifystatus", "calleeID",urlID, "err",err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
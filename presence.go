@@ -0,0 +1,277 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Presence subscriptions.
+// A logged-in callee can subscribe to the presence of its contacts via websocket:
+//   presenceSubscribe|          subscribe to all (local) contacts
+//   presenceSubscribe|id1,id2   subscribe to the given ids only
+//   presenceUnsubscribe|
+// The server answers with a snapshot and then sends updates, both in the same format:
+//   presence|[{"id":"..","state":"..","since":unixtime},..]
+// state is one of: online, busy (in a call), hidden, offline, unknown.
+// since is the time of the last state change (for offline: the last logoff).
+// A callee's presence is only shown to subscribers who are in its contact list
+// (not rejected or blocked by its call filter) and only if it has not turned off
+// the setting sharePresence (DbUser.Int2 bit 8). Everyone else sees "unknown".
+// Subscriptions are kept in memory and end when the callee disconnects.
+// Only callees hosted on this server (node) are covered; the contact list is
+// evaluated on subscribe, so clients should subscribe again after editing it.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const presenceMaxSubs = 200
+
+type Presence struct {
+	ID string `json:"id"`
+	State string `json:"state"`
+	Since int64 `json:"since,omitempty"`
+}
+
+var presenceMutex sync.RWMutex
+
+// current state of the logged-in callees (offline callees are not stored)
+var presenceStates = map[string]Presence{}
+
+// calleeID -> subscribing callee clients -> the state last sent to this client
+var presenceSubs = map[string]map[*WsClient]string{}
+
+// subscribing callee client -> subscribed calleeIDs
+var presenceSubsOf = map[*WsClient][]string{}
+
+// state changes to be delivered by presenceWorker()
+var presenceQueue = make(chan Presence, 1000)
+
+// presenceStateOf returns the state of an idle callee
+func presenceStateOf(hidden bool) string {
+	if hidden {
+		return "hidden"
+	}
+	return "online"
+}
+
+// presenceSet changes the state of calleeID and queues an update for the subscribers
+// if ifStates are given, the state is only changed if the current state is one of them
+// it does not block; it may be called while holding HubMutex
+func presenceSet(calleeID string, state string, ifStates ...string) {
+	if calleeID=="" {
+		return
+	}
+	p := Presence{ID:calleeID, State:state, Since:time.Now().Unix()}
+	presenceMutex.Lock()
+	current,ok := presenceStates[calleeID]
+	if !ok {
+		current.State = "offline"
+	}
+	if current.State==state {
+		presenceMutex.Unlock()
+		return
+	}
+	if len(ifStates)>0 {
+		found := false
+		for _,ifState := range ifStates {
+			if ifState==current.State {
+				found = true
+				break
+			}
+		}
+		if !found {
+			presenceMutex.Unlock()
+			return
+		}
+	}
+	if state=="offline" {
+		delete(presenceStates, calleeID)
+	} else {
+		presenceStates[calleeID] = p
+	}
+	presenceMutex.Unlock()
+	presenceEnqueue(p)
+}
+
+// presenceRefresh queues the current state of calleeID (after its privacy setting has changed)
+func presenceRefresh(calleeID string) {
+	presenceMutex.RLock()
+	p,ok := presenceStates[calleeID]
+	presenceMutex.RUnlock()
+	if !ok {
+		p = Presence{ID:calleeID, State:"offline"}
+	}
+	presenceEnqueue(p)
+}
+
+func presenceEnqueue(p Presence) {
+	select {
+		case presenceQueue <- p:
+		default:
+			logWarn("presence queue full", "calleeID",p.ID, "state",p.State)
+	}
+}
+
+// presenceVisible returns the DbUser of calleeID and true if subscriberID may see its presence
+func presenceVisible(calleeID string, subscriberID string) (DbUser,bool) {
+	_,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil {
+		return dbUser, false
+	}
+	if !presenceShared(dbUser) || !presenceContact(calleeID, subscriberID) {
+		return dbUser, false
+	}
+	return dbUser, true
+}
+
+// presenceShared returns false if the user has turned off sharePresence
+func presenceShared(dbUser DbUser) bool {
+	return dbUser.Int2&8==0 // bit8 set for not sharing
+}
+
+// presenceContact returns true if subscriberID is a (not blocked) contact of calleeID
+func presenceContact(calleeID string, subscriberID string) bool {
+	if _,ok := contactGet(calleeID, subscriberID); !ok {
+		return false
+	}
+	// also checks contact ring policy "reject"
+	return callFilterCheck(calleeID, CallAttempt{CallerID:subscriberID, Stage:"online"})==""
+}
+
+// presenceOf returns the presence of calleeID as seen by subscriberID
+func presenceOf(calleeID string, subscriberID string) Presence {
+	dbUser,visible := presenceVisible(calleeID, subscriberID)
+	if !visible {
+		return Presence{ID:calleeID, State:"unknown"}
+	}
+	presenceMutex.RLock()
+	p,ok := presenceStates[calleeID]
+	presenceMutex.RUnlock()
+	if ok {
+		return p
+	}
+	return Presence{ID:calleeID, State:"offline", Since:dbUser.LastLogoffTime}
+}
+
+// presenceSubscribe handles "presenceSubscribe|" from a callee client
+func (c *WsClient) presenceSubscribe(payload string) {
+	var ids []string
+	if strings.TrimSpace(payload)=="" {
+		contactsMutex.Lock()
+		contacts,err := contactsLoad(c.calleeID)
+		contactsMutex.Unlock()
+		if err!=nil {
+			c.log.Error("presence contacts load", "err",err)
+			return
+		}
+		for contactID := range contacts {
+			ids = append(ids, contactID)
+		}
+	} else {
+		ids = strings.Split(payload, ",")
+	}
+
+	// only local ids, no duplicates
+	idMap := make(map[string]bool)
+	var subIDs []string
+	for _,id := range ids {
+		id = contactLocalID(strings.TrimSpace(id))
+		if id=="" || id==c.calleeID || strings.Index(id,"@")>=0 || idMap[id] {
+			continue
+		}
+		if len(subIDs)>=presenceMaxSubs {
+			c.log.Warn("presence too many subscriptions", "count",len(ids), "max",presenceMaxSubs)
+			break
+		}
+		idMap[id] = true
+		subIDs = append(subIDs, id)
+	}
+
+	snapshot := make([]Presence, 0, len(subIDs))
+	for _,id := range subIDs {
+		snapshot = append(snapshot, presenceOf(id, c.calleeID))
+	}
+
+	presenceUnsubscribe(c)
+	presenceMutex.Lock()
+	for _,p := range snapshot {
+		subs := presenceSubs[p.ID]
+		if subs==nil {
+			subs = make(map[*WsClient]string)
+			presenceSubs[p.ID] = subs
+		}
+		subs[c] = p.State
+	}
+	if len(subIDs)>0 {
+		presenceSubsOf[c] = subIDs
+	}
+	presenceMutex.Unlock()
+	c.log.Info("presence subscribe", "count",len(subIDs))
+
+	data,err := json.Marshal(snapshot)
+	if err!=nil {
+		c.log.Error("presence json.Marshal", "err",err)
+		return
+	}
+	c.Write([]byte("presence|"+string(data)))
+}
+
+// presenceUnsubscribe removes all subscriptions of c
+func presenceUnsubscribe(c *WsClient) {
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	for _,id := range presenceSubsOf[c] {
+		if subs := presenceSubs[id]; subs!=nil {
+			delete(subs, c)
+			if len(subs)==0 {
+				delete(presenceSubs, id)
+			}
+		}
+	}
+	delete(presenceSubsOf, c)
+}
+
+// presenceWorker delivers the queued state changes to the subscribers (in order)
+func presenceWorker() {
+	for p := range presenceQueue {
+		presenceMutex.RLock()
+		var clients []*WsClient
+		for client := range presenceSubs[p.ID] {
+			clients = append(clients, client)
+		}
+		presenceMutex.RUnlock()
+		if len(clients)<=0 {
+			continue
+		}
+
+		_,dbUser,err := apiGetDbUser(p.ID)
+		shared := err==nil && presenceShared(dbUser)
+		if p.State=="offline" && p.Since<=0 && shared {
+			// presenceRefresh()
+			p.Since = dbUser.LastLogoffTime
+		}
+		for _,client := range clients {
+			update := p
+			if !shared || !presenceContact(p.ID, client.calleeID) {
+				update = Presence{ID:p.ID, State:"unknown"}
+			}
+			presenceMutex.Lock()
+			subs := presenceSubs[p.ID]
+			lastState,ok := subs[client]
+			if ok && lastState!=update.State {
+				subs[client] = update.State
+			}
+			presenceMutex.Unlock()
+			if !ok || lastState==update.State {
+				// unsubscribed meanwhile or nothing new for this client
+				continue
+			}
+			data,err := json.Marshal([]Presence{update})
+			if err!=nil {
+				continue
+			}
+			client.Write([]byte("presence|"+string(data))) // ignore any error
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Callee passwords are stored as salted argon2id hashes in DbEntry.Password.
+// The hash is kept in PHC string format, so that the cost parameters can be
+// raised later without invalidating existing hashes:
+// "$argon2id$v=19$m=19456,t=2,p=1$(base64 salt)$(base64 key)"
+// Entries created before hashing was introduced still hold the cleartext pw.
+// They are upgraded on the next successful /login, or all at once via the
+// localhost admin command "/migratepw" (see httpAdmin.go).
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/argon2"
+)
+
+const pwHashPrefix = "$argon2id$"
+
+// argon2id cost parameters for newly created hashes (OWASP minimum recommendation)
+const pwHashMemory = 19*1024 // KiB
+const pwHashTime = 2
+const pwHashThreads = 1
+const pwHashSaltLen = 16
+const pwHashKeyLen = 32
+
+// pwHash returns a salted argon2id hash of pw in PHC string format
+func pwHash(pw string) (string,error) {
+	salt := make([]byte, pwHashSaltLen)
+	_,err := rand.Read(salt)
+	if err!=nil {
+		return "",err
+	}
+	key := argon2.IDKey([]byte(pw), salt, pwHashTime, pwHashMemory, pwHashThreads, pwHashKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		pwHashPrefix, argon2.Version, pwHashMemory, pwHashTime, pwHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// pwIsHashed returns true if storedPw was created by pwHash()
+func pwIsHashed(storedPw string) bool {
+	return strings.HasPrefix(storedPw, pwHashPrefix)
+}
+
+// pwVerify checks the cleartext pw against storedPw, which is either an argon2id hash
+// or (for entries that have not yet been upgraded) the cleartext pw itself
+func pwVerify(pw string, storedPw string) bool {
+	if !pwIsHashed(storedPw) {
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(storedPw))==1
+	}
+
+	// "$argon2id$v=19$m=19456,t=2,p=1$salt$key" -> "", "argon2id", "v=19", "m=..", salt, key
+	toks := strings.Split(storedPw, "$")
+	if len(toks)!=6 {
+		fmt.Printf("# pwVerify bad hash format (%d)\n", len(toks))
+		return false
+	}
+	var version int
+	_,err := fmt.Sscanf(toks[2], "v=%d", &version)
+	if err!=nil || version!=argon2.Version {
+		fmt.Printf("# pwVerify unsupported version (%s) err=%v\n", toks[2], err)
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	_,err = fmt.Sscanf(toks[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err!=nil {
+		fmt.Printf("# pwVerify bad params (%s) err=%v\n", toks[3], err)
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(toks[4])
+	if err!=nil {
+		fmt.Printf("# pwVerify bad salt err=%v\n", err)
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(toks[5])
+	if err!=nil {
+		fmt.Printf("# pwVerify bad key err=%v\n", err)
+		return false
+	}
+	otherKey := argon2.IDKey([]byte(pw), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, otherKey)==1
+}
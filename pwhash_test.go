@@ -0,0 +1,210 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for the argon2id pw hashes and the upgrade of cleartext passwords
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"encoding/base64"
+	"golang.org/x/crypto/argon2"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+// testMemKV returns a memory KV with the given buckets
+func testMemKV(t *testing.T, bucketNames ...string) skv.KV {
+	t.Helper()
+	kv,err := skv.MemOpen()
+	if err!=nil {
+		t.Fatal(err)
+	}
+	for _,bucketName := range bucketNames {
+		if err = kv.CreateBucket(bucketName); err!=nil {
+			t.Fatal(err)
+		}
+	}
+	return kv
+}
+
+// testRegister stores callee calleeID with the given (cleartext or hashed) pw in kvMain
+func testRegister(t *testing.T, calleeID string, pw string) {
+	t.Helper()
+	dbEntry := DbEntry{StartTime:time.Now().Unix(), Ip:"127.0.0.1", Password:pw}
+	if err := kvMain.Put(dbRegisteredIDs, calleeID, dbEntry, false); err!=nil {
+		t.Fatal(err)
+	}
+	dbUserKey := fmt.Sprintf("%s_%d", calleeID, dbEntry.StartTime)
+	if err := kvMain.Put(dbUserBucket, dbUserKey, DbUser{}, false); err!=nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPwHashVerify(t *testing.T) {
+	hash,err := pwHash("secret123")
+	if err!=nil {
+		t.Fatal(err)
+	}
+	if !pwIsHashed(hash) || strings.Index(hash, "secret123")>=0 {
+		t.Fatalf("pwHash %s", hash)
+	}
+	if !pwVerify("secret123", hash) {
+		t.Fatal("pwVerify of the right pw failed")
+	}
+	if pwVerify("secret124", hash) || pwVerify("", hash) {
+		t.Fatal("pwVerify of a wrong pw succeeded")
+	}
+	hash2,_ := pwHash("secret123")
+	if hash2==hash {
+		t.Fatal("two hashes of the same pw are equal (no salt)")
+	}
+
+	// entries that have not been upgraded yet
+	if !pwVerify("secret123", "secret123") || pwVerify("secret124", "secret123") {
+		t.Fatal("pwVerify of a cleartext pw")
+	}
+}
+
+func TestPwVerifyParams(t *testing.T) {
+	// a hash created with other cost parameters than the current defaults
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("secret123"), salt, 3, 8*1024, 2, 24)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 8*1024, 3, 2,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if !pwVerify("secret123", hash) {
+		t.Fatal("pwVerify with m=8192,t=3,p=2 failed")
+	}
+	if pwVerify("secret124", hash) {
+		t.Fatal("pwVerify of a wrong pw succeeded")
+	}
+	// the same key with the default parameters must not match
+	hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		pwHashMemory, pwHashTime, pwHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if pwVerify("secret123", hash) {
+		t.Fatal("pwVerify ignores the parameters of the hash")
+	}
+}
+
+func TestPwVerifyMalformed(t *testing.T) {
+	hash,_ := pwHash("secret123")
+	toks := strings.Split(hash, "$")
+	for _,malformed := range []string{
+		"$argon2id$",
+		strings.Join(toks[:5], "$"),
+		hash+"$",
+		strings.Replace(hash, "$v=19$", "$v=18$", 1),
+		strings.Replace(hash, "$v=19$", "$v=x$", 1),
+		strings.Replace(hash, toks[3], "m=x,t=2,p=1", 1),
+		strings.Replace(hash, toks[4], "!!", 1),
+		strings.Replace(hash, toks[5], "!!", 1),
+	} {
+		if pwVerify("secret123", malformed) {
+			t.Fatalf("pwVerify accepted the malformed hash %s", malformed)
+		}
+	}
+}
+
+func TestLoginUpgradesPw(t *testing.T) {
+	kvMain = testMemKV(t, dbRegisteredIDs, dbUserBucket)
+	kvHashedPw = testMemKV(t, dbHashedPwBucket)
+	hubMap = make(map[string]*Hub)
+	wsClientMap = make(map[uint64]wsClientDataType)
+	readConfigLock.Lock()
+	maxCallees = 10
+	readConfigLock.Unlock()
+
+	// login with a posted pw creates a cookie that holds the hash
+	testRegister(t, "19990000001", "secret123")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rtcsig/login?id=19990000001", strings.NewReader("pw=secret123"))
+	httpLogin(w, r, "19990000001", nil, "", "127.0.0.1", "127.0.0.1:5000", false, time.Now(), PwIdCombo{}, "test")
+	if !strings.HasPrefix(w.Body.String(), "ws") {
+		t.Fatalf("/login response %s", w.Body.String())
+	}
+	var dbEntry DbEntry
+	kvMain.Get(dbRegisteredIDs, "19990000001", &dbEntry)
+	if !pwIsHashed(dbEntry.Password) || !pwVerify("secret123", dbEntry.Password) {
+		t.Fatalf("pw not upgraded: %s", dbEntry.Password)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies)!=1 {
+		t.Fatalf("cookies %v", cookies)
+	}
+	var pwIdCombo PwIdCombo
+	kvHashedPw.Get(dbHashedPwBucket, cookies[0].Value, &pwIdCombo)
+	if pwIdCombo.Pw!=dbEntry.Password {
+		t.Fatalf("cookie pw %s, want the hash", pwIdCombo.Pw)
+	}
+
+	// login with a cookie created before pw hashing (it holds the cleartext pw)
+	testRegister(t, "19990000002", "secret456")
+	cookie := &http.Cookie{Name:"webcallid", Value:"19990000002&123"}
+	pwIdCombo = PwIdCombo{Pw:"secret456", CalleeId:"19990000002"}
+	kvHashedPw.Put(dbHashedPwBucket, cookie.Value, pwIdCombo, false)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/rtcsig/login?id=19990000002", strings.NewReader(""))
+	httpLogin(w, r, "19990000002", cookie, pwIdCombo.Pw, "127.0.0.1", "127.0.0.1:5000", false, time.Now(),
+		pwIdCombo, "test")
+	if !strings.HasPrefix(w.Body.String(), "ws") {
+		t.Fatalf("/login response %s", w.Body.String())
+	}
+	kvMain.Get(dbRegisteredIDs, "19990000002", &dbEntry)
+	if !pwIsHashed(dbEntry.Password) {
+		t.Fatalf("pw not upgraded: %s", dbEntry.Password)
+	}
+	kvHashedPw.Get(dbHashedPwBucket, cookie.Value, &pwIdCombo)
+	if pwIdCombo.Pw!=dbEntry.Password {
+		t.Fatalf("cookie pw %s, want the hash", pwIdCombo.Pw)
+	}
+}
+
+func TestMigratePw(t *testing.T) {
+	kvMain = testMemKV(t, dbRegisteredIDs, dbUserBucket)
+	kvHashedPw = testMemKV(t, dbHashedPwBucket)
+	hashed,_ := pwHash("secret789")
+	testRegister(t, "19990000011", "secret123")
+	testRegister(t, "19990000012", "secret456")
+	testRegister(t, "19990000013", hashed)
+	testRegister(t, "19990000014", "nopw")
+	kvHashedPw.Put(dbHashedPwBucket, "19990000011&1", PwIdCombo{Pw:"secret123", CalleeId:"19990000011"}, false)
+	// a cookie with an outdated pw is dropped
+	kvHashedPw.Put(dbHashedPwBucket, "19990000012&1", PwIdCombo{Pw:"outdated", CalleeId:"19990000012"}, false)
+	kvHashedPw.Put(dbHashedPwBucket, "19990000013&1", PwIdCombo{Pw:hashed, CalleeId:"19990000013"}, false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/migratepw", nil)
+	if !httpAdmin(kvMain, w, r, "/migratepw", "", "127.0.0.1") {
+		t.Fatal("/migratepw not handled")
+	}
+	if strings.Index(w.Body.String(), "migrated ids=2/2 cookies=1/2")<0 {
+		t.Fatalf("/migratepw response %s", w.Body.String())
+	}
+	for calleeID,pw := range map[string]string{"19990000011":"secret123", "19990000012":"secret456",
+			"19990000013":"secret789"} {
+		var dbEntry DbEntry
+		kvMain.Get(dbRegisteredIDs, calleeID, &dbEntry)
+		if !pwIsHashed(dbEntry.Password) || !pwVerify(pw, dbEntry.Password) {
+			t.Fatalf("%s pw %s", calleeID, dbEntry.Password)
+		}
+	}
+	var dbEntry DbEntry
+	kvMain.Get(dbRegisteredIDs, "19990000014", &dbEntry)
+	if dbEntry.Password!="nopw" {
+		t.Fatalf("nopw entry changed to %s", dbEntry.Password)
+	}
+
+	var pwIdCombo PwIdCombo
+	kvMain.Get(dbRegisteredIDs, "19990000011", &dbEntry)
+	if kvHashedPw.Get(dbHashedPwBucket, "19990000011&1", &pwIdCombo)!=nil || pwIdCombo.Pw!=dbEntry.Password {
+		t.Fatalf("cookie not migrated: %s", pwIdCombo.Pw)
+	}
+	if kvHashedPw.Get(dbHashedPwBucket, "19990000012&1", &pwIdCombo)!=skv.ErrNotFound {
+		t.Fatal("cookie with an outdated pw not removed")
+	}
+	if kvHashedPw.Get(dbHashedPwBucket, "19990000013&1", &pwIdCombo)!=nil || pwIdCombo.Pw!=hashed {
+		t.Fatal("hashed cookie modified")
+	}
+}
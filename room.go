@@ -0,0 +1,415 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Conference rooms.
+// In addition to the two-party Hub, a callee ID can host a room with up
+// to N participants. Clients connect via websocket to "/room?id=roomID"
+// (on wsPort/wssPort, like "/ws"). The room is opened by its host: the
+// callee with the same ID, authenticated by the webcallid cookie or a
+// bearer token (Authorization header or access_token url arg). Since
+// browsers send the cookie along with websocket requests from any site,
+// cookie sessions are only accepted from pages of this server (the Origin
+// header must match the Host header). Guests can
+// join an open room with url arg name=. When the host leaves, the room is
+// closed and all guests are disconnected.
+// The host may lower the max number of participants with url arg max=;
+// config keyword roomMaxSize (default 8) is the upper limit for all rooms.
+//
+// Signaling uses the same "cmd|payload" text messages as the Hub.
+// server -> client:
+//   roomJoined|{"pid":..,"host":..,"maxSize":..,"roster":[..]}
+//   participantJoined|{"pid":..,"name":..,"host":..}
+//   participantLeft|{"pid":..,"name":..,"host":..}
+//   roster|[{"pid":..,"name":..,"host":..},..]  (after every join and leave)
+//   signal|{"from":pid,"data":..}
+//   roomNotOpen| roomFull| roomClosed|          (followed by a disconnect)
+// client -> server:
+//   signal|{"to":pid,"data":..}  relays data (offer, answer, candidate) to pid
+//   roster|                      requests the roster
+//   leave|                       leaves the room
+//   heartbeat|                   ignored
+// By default the participants set up a full mesh of peer connections.
+// If roomSfu is set, participant join/leave and all signal messages
+// addressed to "sfu" are handed to the SFU instead.
+// Rooms are local to this server (not shared in cluster mode).
+// Rooms are API-only: there is no room page in webroot, the websocket
+// protocol above is meant for native and custom clients.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+)
+
+var roomMap map[string]*Room
+var roomMapMutex sync.RWMutex
+
+type Room struct {
+	ID string
+	maxSize int
+	host *RoomParticipant
+	participants []*RoomParticipant // in order of joining, protected by mutex
+	closed bool
+	mutex sync.RWMutex
+}
+
+type RoomParticipant struct {
+	Pid string `json:"pid"`
+	Name string `json:"name"`
+	Host bool `json:"host"`
+	wsConn roomConn
+	log *Logger
+}
+
+// roomConn is the part of *websocket.Conn used by RoomParticipant
+type roomConn interface {
+	WriteMessage(messageType websocket.MessageType, data []byte) error
+	Close() error
+}
+
+type RoomJoined struct {
+	Pid string `json:"pid"`
+	Host bool `json:"host"`
+	MaxSize int `json:"maxSize"`
+	Roster []*RoomParticipant `json:"roster"`
+}
+
+type RoomSignal struct {
+	To string `json:"to,omitempty"`
+	From string `json:"from,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// RoomSfu is the hook for a selective forwarding unit
+// Signal() receives the "signal" messages addressed to "sfu"; the SFU answers
+// via participant.Send("signal", RoomSignal{From:"sfu", Data:...})
+type RoomSfu interface {
+	Join(room *Room, p *RoomParticipant) error
+	Leave(room *Room, p *RoomParticipant)
+	Signal(room *Room, p *RoomParticipant, data json.RawMessage) error
+}
+
+var roomSfu RoomSfu // nil = mesh signaling
+
+func serveRoom(w http.ResponseWriter, r *http.Request) {
+	serveRoomConn(w, r, false)
+}
+
+func serveRoomTls(w http.ResponseWriter, r *http.Request) {
+	serveRoomConn(w, r, true)
+}
+
+func serveRoomConn(w http.ResponseWriter, r *http.Request, tls bool) {
+	remoteAddr,_ := apiRemoteAddr(r)
+	roomID := r.URL.Query().Get("id")
+	if roomID=="" {
+		logWarn("room no id", "rip",remoteAddr)
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	// the host is the callee with the ID of the room
+	calleeID := ""
+	cookieAuth := false
+	if bearer := tokenFromRequest(r,true); bearer!="" {
+		dbToken,err := tokenAuth(bearer)
+		if err!=nil {
+			logWarn("room bearer token rejected", "roomID",roomID, "rip",remoteAddr, "err",err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		calleeID = dbToken.CalleeID
+	} else {
+		calleeID = apiAuth(r)
+		cookieAuth = calleeID!=""
+	}
+	isHost := calleeID!="" && calleeID==roomID
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if len(name)>40 {
+		name = name[:40]
+	}
+	if name=="" && calleeID!="" {
+		name = calleeID
+	}
+
+	readConfigLock.RLock()
+	maxSize := roomMaxSize
+	readConfigLock.RUnlock()
+	if isHost {
+		if max,err := strconv.Atoi(r.URL.Query().Get("max")); err==nil && max>=2 && max<=maxSize {
+			maxSize = max
+		}
+	}
+
+	upgrader := websocket.NewUpgrader()
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		if cookieAuth && !roomSameOrigin(r) {
+			logWarn("room cookie session from other origin denied", "roomID",roomID,
+				"origin",r.Header.Get("Origin"), "rip",remoteAddr)
+			return false
+		}
+		return true
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logError("room upgrade", "roomID",roomID, "rip",remoteAddr, "err",err)
+		return
+	}
+	wsConn := conn.(*websocket.Conn)
+
+	p := &RoomParticipant{Pid:roomNewPid(), Name:name, Host:isHost, wsConn:wsConn}
+	p.log = logRoot.With("roomID",roomID, "pid",p.Pid, "host",isHost, "rip",remoteAddr, "tls",tls)
+
+	room,errCmd := roomJoin(roomID, p, maxSize)
+	if room==nil {
+		p.log.Info("room join denied", "cause",errCmd)
+		p.Send(errCmd, nil)
+		wsConn.Close()
+		return
+	}
+
+	upgrader.OnMessage(func(wsConn *websocket.Conn, messageType websocket.MessageType, data []byte) {
+		if messageType==websocket.TextMessage {
+			room.handleMessage(p, string(data))
+		}
+	})
+	wsConn.OnClose(func(c *websocket.Conn, err error) {
+		room.leave(p, "disconnect")
+	})
+}
+
+// roomSameOrigin returns true if the Origin header is missing (non-browser clients)
+// or refers to the host the request was sent to
+func roomSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin=="" {
+		return true
+	}
+	u,err := url.Parse(origin)
+	if err!=nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func roomNewPid() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// roomJoin adds p to the room roomID; the host opens the room
+// on failure it returns nil and the cmd to send to p
+func roomJoin(roomID string, p *RoomParticipant, maxSize int) (*Room,string) {
+	roomMapMutex.Lock()
+	if roomMap==nil {
+		roomMap = make(map[string]*Room)
+	}
+	room := roomMap[roomID]
+	if room==nil {
+		if !p.Host {
+			roomMapMutex.Unlock()
+			return nil,"roomNotOpen"
+		}
+		room = &Room{ID:roomID, maxSize:maxSize}
+		roomMap[roomID] = room
+	}
+	roomMapMutex.Unlock()
+
+	room.mutex.Lock()
+	if room.closed {
+		room.mutex.Unlock()
+		return nil,"roomNotOpen"
+	}
+	if p.Host && room.host!=nil {
+		// the host has joined a 2nd time (from another device): join as a guest
+		p.Host = false
+	}
+	if len(room.participants) >= room.maxSize {
+		room.mutex.Unlock()
+		return nil,"roomFull"
+	}
+	if p.Host {
+		room.host = p
+	}
+	room.participants = append(room.participants, p)
+	roster := room.rosterLocked()
+	others := room.othersLocked(p)
+	room.mutex.Unlock()
+
+	p.log.Info("room join", "participants",len(roster))
+	p.Send("roomJoined", RoomJoined{p.Pid, p.Host, room.maxSize, roster})
+	for _,other := range others {
+		other.Send("participantJoined", p)
+		other.Send("roster", roster)
+	}
+	if roomSfu!=nil {
+		if err := roomSfu.Join(room, p); err!=nil {
+			p.log.Error("room sfu join", "err",err)
+		}
+	}
+	return room,""
+}
+
+// leave removes p from the room; if p is the host, the room is closed
+func (room *Room) leave(p *RoomParticipant, cause string) {
+	room.mutex.Lock()
+	idx := -1
+	for i,participant := range room.participants {
+		if participant==p {
+			idx = i
+			break
+		}
+	}
+	if idx<0 {
+		room.mutex.Unlock()
+		return
+	}
+	room.participants = append(room.participants[:idx], room.participants[idx+1:]...)
+	closeRoom := room.host==p
+	if closeRoom {
+		room.closed = true
+		room.host = nil
+	}
+	roster := room.rosterLocked()
+	others := room.othersLocked(p)
+	if closeRoom {
+		room.participants = nil
+	}
+	room.mutex.Unlock()
+
+	p.log.Info("room leave", "cause",cause, "closeRoom",closeRoom, "participants",len(roster))
+	if roomSfu!=nil {
+		roomSfu.Leave(room, p)
+	}
+	if closeRoom {
+		roomMapMutex.Lock()
+		if roomMap[room.ID]==room {
+			delete(roomMap, room.ID)
+		}
+		roomMapMutex.Unlock()
+		for _,other := range others {
+			if roomSfu!=nil {
+				roomSfu.Leave(room, other)
+			}
+			other.Send("roomClosed", nil)
+			other.wsConn.Close()
+		}
+		return
+	}
+	for _,other := range others {
+		other.Send("participantLeft", p)
+		other.Send("roster", roster)
+	}
+}
+
+func (room *Room) handleMessage(p *RoomParticipant, message string) {
+	cmd := message
+	payload := ""
+	if idx := strings.Index(message,"|"); idx>=0 {
+		cmd = message[:idx]
+		payload = message[idx+1:]
+	}
+	switch cmd {
+	case "signal":
+		var signal RoomSignal
+		if err := json.Unmarshal([]byte(payload), &signal); err!=nil || signal.To=="" {
+			p.log.Warn("room signal malformed", "err",err)
+			return
+		}
+		if signal.To=="sfu" {
+			if roomSfu==nil {
+				p.log.Warn("room signal to sfu, but no sfu")
+				return
+			}
+			if err := roomSfu.Signal(room, p, signal.Data); err!=nil {
+				p.log.Error("room sfu signal", "err",err)
+			}
+			return
+		}
+		target := room.participant(signal.To)
+		if target==nil {
+			p.log.Debug("room", "room signal target not found", "to",signal.To)
+			return
+		}
+		target.Send("signal", RoomSignal{From:p.Pid, Data:signal.Data})
+	case "roster":
+		room.mutex.RLock()
+		roster := room.rosterLocked()
+		room.mutex.RUnlock()
+		p.Send("roster", roster)
+	case "leave":
+		room.leave(p, "leave")
+		p.wsConn.Close()
+	case "heartbeat":
+	default:
+		p.log.Warn("room unknown cmd", "cmd",cmd)
+	}
+}
+
+func (room *Room) participant(pid string) *RoomParticipant {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	for _,participant := range room.participants {
+		if participant.Pid==pid {
+			return participant
+		}
+	}
+	return nil
+}
+
+// rosterLocked returns a copy of the participants (with room.mutex held)
+func (room *Room) rosterLocked() []*RoomParticipant {
+	roster := make([]*RoomParticipant, len(room.participants))
+	copy(roster, room.participants)
+	return roster
+}
+
+// othersLocked returns all participants except p (with room.mutex held)
+func (room *Room) othersLocked(p *RoomParticipant) []*RoomParticipant {
+	var others []*RoomParticipant
+	for _,participant := range room.participants {
+		if participant!=p {
+			others = append(others, participant)
+		}
+	}
+	return others
+}
+
+// Send writes "cmd|json(payload)" to the participant (just "cmd|" if payload is nil)
+func (p *RoomParticipant) Send(cmd string, payload interface{}) {
+	message := cmd+"|"
+	if payload!=nil {
+		data,err := json.Marshal(payload)
+		if err!=nil {
+			p.log.Error("room send marshal", "cmd",cmd, "err",err)
+			return
+		}
+		message += string(data)
+	}
+	err := p.wsConn.WriteMessage(websocket.TextMessage, []byte(message))
+	if err!=nil {
+		p.log.Debug("room", "room send", "cmd",cmd, "err",err)
+	}
+}
+
+// roomStats returns the number of open rooms and their participants (for /metrics)
+func roomStats() (int,int) {
+	roomMapMutex.RLock()
+	defer roomMapMutex.RUnlock()
+	participants := 0
+	for _,room := range roomMap {
+		room.mutex.RLock()
+		participants += len(room.participants)
+		room.mutex.RUnlock()
+	}
+	return len(roomMap), participants
+}
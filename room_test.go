@@ -0,0 +1,144 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for joining and leaving rooms and for the origin check of cookie sessions
+package main
+
+import (
+	"sync"
+	"strings"
+	"testing"
+	"net/http/httptest"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+)
+
+// testRoomConn records the messages sent to a participant
+type testRoomConn struct {
+	mutex sync.Mutex
+	messages []string
+	closed bool
+}
+
+func (c *testRoomConn) WriteMessage(messageType websocket.MessageType, data []byte) error {
+	c.mutex.Lock()
+	c.messages = append(c.messages, string(data))
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *testRoomConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	return nil
+}
+
+// cmds returns the cmds of all messages received so far
+func (c *testRoomConn) cmds() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var cmds []string
+	for _,message := range c.messages {
+		cmds = append(cmds, message[:strings.Index(message,"|")])
+	}
+	return cmds
+}
+
+func testRoomParticipant(name string, host bool) (*RoomParticipant,*testRoomConn) {
+	conn := &testRoomConn{}
+	p := &RoomParticipant{Pid:roomNewPid(), Name:name, Host:host, wsConn:conn}
+	p.log = logRoot.With("pid",p.Pid)
+	return p,conn
+}
+
+func TestRoomJoinLeave(t *testing.T) {
+	roomMapMutex.Lock()
+	roomMap = nil
+	roomMapMutex.Unlock()
+
+	// no room is open: a guest is denied
+	guest1,guest1Conn := testRoomParticipant("guest1", false)
+	if room,errCmd := roomJoin("19990000041", guest1, 3); room!=nil || errCmd!="roomNotOpen" {
+		t.Fatalf("guest join without host: %v %s", room, errCmd)
+	}
+
+	// the host opens the room
+	host,hostConn := testRoomParticipant("host", true)
+	room,errCmd := roomJoin("19990000041", host, 3)
+	if room==nil || errCmd!="" || !host.Host || room.host!=host {
+		t.Fatalf("host join: %v %s", room, errCmd)
+	}
+	if cmds := hostConn.cmds(); len(cmds)!=1 || cmds[0]!="roomJoined" ||
+			strings.Index(hostConn.messages[0], `"host":true`)<0 {
+		t.Fatalf("host messages %v", hostConn.messages)
+	}
+	if rooms,participants := roomStats(); rooms!=1 || participants!=1 {
+		t.Fatalf("roomStats %d %d", rooms, participants)
+	}
+
+	if room2,errCmd := roomJoin("19990000041", guest1, 3); room2!=room || errCmd!="" {
+		t.Fatalf("guest join: %v %s", room2, errCmd)
+	}
+	if cmds := hostConn.cmds(); strings.Join(cmds,",")!="roomJoined,participantJoined,roster" {
+		t.Fatalf("host messages after guest join %v", cmds)
+	}
+
+	// a second connection of the host joins as a guest
+	host2,host2Conn := testRoomParticipant("host", true)
+	if room2,errCmd := roomJoin("19990000041", host2, 3); room2!=room || errCmd!="" {
+		t.Fatalf("2nd host join: %v %s", room2, errCmd)
+	}
+	if host2.Host || room.host!=host || strings.Index(host2Conn.messages[0], `"host":false`)<0 {
+		t.Fatalf("2nd host connection joined as host: %v", host2Conn.messages)
+	}
+
+	// max=3 has been reached
+	guest2,_ := testRoomParticipant("guest2", false)
+	if room2,errCmd := roomJoin("19990000041", guest2, 3); room2!=nil || errCmd!="roomFull" {
+		t.Fatalf("join of a full room: %v %s", room2, errCmd)
+	}
+
+	// a guest leaves
+	room.leave(guest1, "leave")
+	if cmds := host2Conn.cmds(); cmds[len(cmds)-2]!="participantLeft" {
+		t.Fatalf("messages after guest leave %v", cmds)
+	}
+	if room.participant(guest1.Pid)!=nil {
+		t.Fatal("guest still in the room")
+	}
+
+	// the host leaves: the room is closed
+	room.leave(host, "disconnect")
+	if cmds := host2Conn.cmds(); cmds[len(cmds)-1]!="roomClosed" || !host2Conn.closed {
+		t.Fatalf("messages after host leave %v closed=%v", cmds, host2Conn.closed)
+	}
+	if guest1Conn.closed {
+		t.Fatal("guest that left before was disconnected again")
+	}
+	if rooms,_ := roomStats(); rooms!=0 {
+		t.Fatalf("%d rooms after host leave", rooms)
+	}
+	if room2,errCmd := roomJoin("19990000041", guest2, 3); room2!=nil || errCmd!="roomNotOpen" {
+		t.Fatalf("guest join after host leave: %v %s", room2, errCmd)
+	}
+}
+
+func TestRoomSameOrigin(t *testing.T) {
+	for _,test := range []struct {
+		origin string
+		same bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"https://example.com:8443", false},
+		{"https://evil.example", false},
+		{"null", false},
+	} {
+		r := httptest.NewRequest("GET", "https://example.com/room?id=19990000041", nil)
+		if test.origin!="" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if roomSameOrigin(r)!=test.same {
+			t.Fatalf("origin=%q same=%v", test.origin, !test.same)
+		}
+	}
+}
@@ -1,13 +1,42 @@
 // WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// TURN server with ephemeral credentials (TURN REST API scheme).
+// For every call the server mints a username "expiry:calleeID:nonce" and the
+// password base64(HMAC-SHA1(turnSecret, username)). Both are sent to the caller
+// when it connects and to the callee before the callerOffer:
+//   turnCredentials|{"username":..,"credential":..,"ttl":secs}
+// AuthHandler only needs to recompute the password and check the expiry, so the
+// same credentials also work with other TURN servers using the same shared secret
+// (coturn: use-auth-secret, static-auth-secret; see iceservers.go). Credentials are
+// revoked turnEndedGraceSecs after the peer connection of their call has ended.
+// Config keywords: turnSecret (if empty, a random secret is generated on start;
+// must be the same on all cluster nodes) and turnCredentialSecs (default 900).
+//
+// Listeners: UDP on turnPort, optionally TCP on turnTcpPort and TLS (tls.pem/tls.key)
+// on turnTlsPort, for callers behind firewalls that block UDP. The relayed media is
+// always UDP. Relay ports are taken from turnRelayPortMin..turnRelayPortMax (if set).
+// With turnIP6 set, the same listeners are opened on IPv6: clients connecting over
+// IPv6 get an IPv6 relay address (turnIP6), all others an IPv4 one (turnIP).
+// Relay traffic is counted and limited per allocation and per callee (turnrelay.go).
+
 package main
 
 import (
 	"fmt"
 	"net"
+	"errors"
+	mathrand "math/rand"
+	"crypto/tls"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 
 	//"github.com/pion/turn/v2" // see: https://github.com/pion/turn/issues/206#issuecomment-907091251
 	"github.com/mehrvarz/turn/v2" // this _is_ pion/turn but with a minor patch for FF on Android
@@ -16,25 +45,149 @@ import (
 
 type TurnCallee struct {
 	CalleeID   string
-	TimeStored time.Time
+	TimeStored time.Time // time of minting
+	Expires    int64     // unix secs
+	Used       bool      // the credentials were used at least once
+	EndTime    int64     // unix secs the call has ended (0 = not ended)
+	Ended      bool      // the grace period after EndTime is over: credentials are revoked
+}
+
+// the credentials of a call stay valid for a few secs after the call has ended
+// (the clients may still be allocating or refreshing while the call is torn down)
+const turnEndedGraceSecs = 10
+
+// ended returns true if the credentials are revoked at unix time now
+func (turnCallee TurnCallee) ended(now int64) bool {
+	return turnCallee.Ended || (turnCallee.EndTime>0 && now-turnCallee.EndTime > turnEndedGraceSecs)
 }
 
 // recentTurnCalleeIps is accessed from timer.go
-// recentTurnCalleeIps provides a mapping: TurnCallee <-- [callerIP]
-var recentTurnCalleeIps map[string]TurnCallee
+// recentTurnCalleeIps provides a mapping: TurnCallee <-- [turn username]
+// (the name is historic; turn sessions used to be identified by the caller ip)
+var recentTurnCalleeIps = make(map[string]TurnCallee)
 var recentTurnCalleeIpMutex sync.RWMutex
 
-func runTurnServer() {
-	if turnPort <= 0 {
+type TurnCredentials struct {
+	Username string `json:"username"`
+	Credential string `json:"credential"`
+	Ttl int64 `json:"ttl"`
+	Port int `json:"port,omitempty"`
+	TcpPort int `json:"tcpPort,omitempty"`
+	TlsPort int `json:"tlsPort,omitempty"`
+	IceServers []IceServer `json:"iceServers,omitempty"` // external servers (see iceservers.go)
+}
+
+var turnSecretOnce sync.Once
+var turnSecretGenerated []byte
+
+func turnSecretKey() []byte {
+	readConfigLock.RLock()
+	secret := turnSecret
+	readConfigLock.RUnlock()
+	if secret!="" {
+		return []byte(secret)
+	}
+	turnSecretOnce.Do(func() {
+		turnSecretGenerated = make([]byte, 32)
+		if _,err := rand.Read(turnSecretGenerated); err!=nil {
+			logError("turn secret", "err",err)
+		}
+	})
+	return turnSecretGenerated
+}
+
+// turnPassword returns the password for username
+func turnPassword(username string) string {
+	mac := hmac.New(sha1.New, turnSecretKey())
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnCredentialsNew mints the TURN username for a new call to calleeID
+func turnCredentialsNew(calleeID string) string {
+	readConfigLock.RLock()
+	ttl := turnCredentialSecs
+	readConfigLock.RUnlock()
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	timeNow := time.Now()
+	expires := timeNow.Unix()+int64(ttl)
+	username := fmt.Sprintf("%d:%s:%s", expires, calleeID, hex.EncodeToString(nonce))
+	// NOTE: entries will be deleted by ticker30sec after they have expired
+	recentTurnCalleeIpMutex.Lock()
+	recentTurnCalleeIps[username] = TurnCallee{calleeID, timeNow, expires, false, 0, false}
+	recentTurnCalleeIpMutex.Unlock()
+	return username
+}
+
+// turnCredentialsMsg returns the "turnCredentials|" message for username
+// for a client with remoteIP (which selects the region of the external ice servers)
+func turnCredentialsMsg(username string, remoteIP string) []byte {
+	expires,_,ok := turnUsernameParse(username)
+	if !ok {
+		return nil
+	}
+	data,err := json.Marshal(TurnCredentials{Username:username, Credential:turnPassword(username),
+		Ttl:expires-time.Now().Unix(), Port:turnPort, TcpPort:turnTcpPort, TlsPort:turnTlsPort,
+		IceServers:iceServersFor(username, remoteIP)})
+	if err!=nil {
+		logError("turnCredentialsMsg json.Marshal", "err",err)
+		return nil
+	}
+	return []byte("turnCredentials|"+string(data))
+}
+
+// turnUsernameParse returns the expiry and the calleeID of a username minted by turnCredentialsNew
+func turnUsernameParse(username string) (int64, string, bool) {
+	tok := strings.SplitN(username, ":", 3)
+	if len(tok)<3 {
+		return 0, "", false
+	}
+	expires,err := strconv.ParseInt(tok[0], 10, 64)
+	if err!=nil {
+		return 0, "", false
+	}
+	return expires, tok[1], true
+}
+
+// turnCredentialsEnd revokes the credentials of a call that has ended, after turnEndedGraceSecs
+func turnCredentialsEnd(username string) {
+	if username=="" {
+		return
+	}
+	expires,calleeID,ok := turnUsernameParse(username)
+	if !ok || expires < time.Now().Unix() {
 		return
 	}
+	recentTurnCalleeIpMutex.Lock()
+	turnCallee,ok := recentTurnCalleeIps[username]
+	if !ok {
+		// minted before a restart (or by another node)
+		turnCallee = TurnCallee{calleeID, time.Now(), expires, false, 0, false}
+	}
+	if turnCallee.EndTime==0 {
+		turnCallee.EndTime = time.Now().Unix()
+	}
+	recentTurnCalleeIps[username] = turnCallee
+	recentTurnCalleeIpMutex.Unlock()
+}
 
-	recentTurnCalleeIps = make(map[string]TurnCallee)
+// turnCredentialsProlong restarts the grace period of the ended calls of calleeID
+// it is called when the caller is gone (see locStoreCallerIpInHubMap)
+func turnCredentialsProlong(calleeID string) {
+	timeNow := time.Now().Unix()
+	recentTurnCalleeIpMutex.Lock()
+	for username,turnCallee := range recentTurnCalleeIps {
+		if turnCallee.CalleeID==calleeID && turnCallee.EndTime>0 && !turnCallee.ended(timeNow) {
+			turnCallee.EndTime = timeNow
+			recentTurnCalleeIps[username] = turnCallee
+		}
+	}
+	recentTurnCalleeIpMutex.Unlock()
+}
 
-	fmt.Printf("turn server listening on '%s' port=%d\n", turnIP, turnPort)
-	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(turnPort))
-	if err != nil {
-		fmt.Printf("# Failed to create TURN server listener: %s\n", err)
+func runTurnServer() {
+	if turnPort <= 0 {
 		return
 	}
 
@@ -44,125 +197,199 @@ func runTurnServer() {
 	loggerFactory.DefaultLogLevel = logging.LogLevel(turnDebugLevel) // 3=info 4=LogLevelDebug
 	readConfigLock.RUnlock()
 
-	_, err = turn.NewServer(turn.ServerConfig{
+	var tlsConfig *tls.Config
+	if turnTlsPort>0 {
+		cer, err := tls.LoadX509KeyPair("tls.pem", "tls.key")
+		if err != nil {
+			logError("turn server tls.LoadX509KeyPair", "err",err)
+		} else {
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cer},
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+	}
+
+	minPort, maxPort := turnRelayPortMin, turnRelayPortMax
+	if minPort>0 && (maxPort<minPort || maxPort>65535) {
+		logWarn("turn relay port range invalid; using any port", "min",minPort, "max",maxPort)
+		minPort, maxPort = 0, 0
+	}
+
+	var packetConnConfigs []turn.PacketConnConfig
+	var listenerConfigs []turn.ListenerConfig
+	for _,ipVersion := range []string{"4","6"} {
+		listenIP, relayIP := "0.0.0.0", net.ParseIP(turnIP)
+		if ipVersion=="6" {
+			if turnIP6=="" {
+				break
+			}
+			listenIP, relayIP = "::", net.ParseIP(turnIP6)
+			if relayIP!=nil && relayIP.To4()!=nil {
+				relayIP = nil
+			}
+		}
+		if relayIP==nil {
+			logError("turn server relay ip invalid", "ipVersion",ipVersion, "turnIP",turnIP, "turnIP6",turnIP6)
+			return
+		}
+		relayGenerator := &turnRelayGenerator{network:"udp"+ipVersion, relayIP:relayIP, listenIP:listenIP,
+			minPort:minPort, maxPort:maxPort}
+
+		udpListener, err := net.ListenPacket("udp"+ipVersion, net.JoinHostPort(listenIP, strconv.Itoa(turnPort)))
+		if err != nil {
+			logError("failed to create TURN server listener", "network","udp"+ipVersion, "err",err)
+			return
+		}
+		packetConnConfigs = append(packetConnConfigs,
+			turn.PacketConnConfig{PacketConn: &turnRelayPacketConn{udpListener}, RelayAddressGenerator: relayGenerator})
+		logInfo("turn server listening", "network","udp"+ipVersion, "ip",relayIP, "port",turnPort)
+
+		if turnTcpPort>0 {
+			tcpListener, err := net.Listen("tcp"+ipVersion, net.JoinHostPort(listenIP, strconv.Itoa(turnTcpPort)))
+			if err != nil {
+				logError("failed to create TURN server listener", "network","tcp"+ipVersion, "err",err)
+			} else {
+				listenerConfigs = append(listenerConfigs,
+					turn.ListenerConfig{Listener: &turnRelayListener{tcpListener}, RelayAddressGenerator: relayGenerator})
+				logInfo("turn server listening", "network","tcp"+ipVersion, "ip",relayIP, "port",turnTcpPort)
+			}
+		}
+		if tlsConfig!=nil {
+			tlsListener, err := tls.Listen("tcp"+ipVersion, net.JoinHostPort(listenIP, strconv.Itoa(turnTlsPort)), tlsConfig)
+			if err != nil {
+				logError("failed to create TURN server listener", "network","tls"+ipVersion, "err",err)
+			} else {
+				listenerConfigs = append(listenerConfigs,
+					turn.ListenerConfig{Listener: &turnRelayListener{tlsListener}, RelayAddressGenerator: relayGenerator})
+				logInfo("turn server listening", "network","tls"+ipVersion, "ip",relayIP, "port",turnTlsPort)
+			}
+		}
+	}
+
+	_, err := turn.NewServer(turn.ServerConfig{
 		Realm: ourRealm,
 		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-			// AuthHandler callback is called everytime a caller tries to authenticate with the TURN server
-			// - username is the "iceServers" username from Javascript
-			// - srcAddr is ip:port of caller (we receive 2 calls: same caller ip, but two different ports)
+			// AuthHandler callback is called everytime a client tries to authenticate with the TURN server
+			// - username is the "iceServers" username from Javascript (see turnCredentialsNew())
+			// - srcAddr is ip:port of the client (we receive several calls per allocation)
 			// note that for a relay connection to become available for both sides,
 			// only ONE side needs to successfully authenticate
-			// we will:
-			// - return authKey,true if we find a ConnectedCallerIp in the global hub == srcAddr (without port)
-			// - otherwise we return nil,false
-			//if logWantedFor("turn") {
-			//	fmt.Printf("turnauth username=(%s) srcAddr=(%v)\n", username, srcAddr)
-			//}
-			timeNow := time.Now()
-			foundIp := false
-			foundByMap := false
-			foundCalleeId := ""
-			// search for ipAddr without the port number
-			// bc srcAddr is from the turn client and IpInHubMap is from the websocket client (different ports)
-			// TODO this could create issues; srcAddr should be same as IpInHubMap
-			// so we don't need to cut the port
-
-			// ipAddr is the caller ip without :port
 			ipAddr := srcAddr.String()
-			if portIdx := strings.Index(ipAddr, ":"); portIdx >= 0 {
+			if portIdx := strings.LastIndex(ipAddr, ":"); portIdx >= 0 {
 				ipAddr = ipAddr[:portIdx]
 			}
+			timeNow := time.Now()
+			expires,calleeID,ok := turnUsernameParse(username)
+			if !ok {
+				logDebug("turn", "turnauth denied", "rip",ipAddr, "username",username)
+				metricsTurnAuthTotal.Inc("denied")
+				return nil, false
+			}
+			if expires < timeNow.Unix() {
+				logDebug("turn", "turnauth expired", "calleeID",calleeID, "rip",ipAddr)
+				metricsTurnAuthTotal.Inc("denied")
+				return nil, false
+			}
 
-			recentTurnCalleeIpMutex.RLock()
-			turnCallee, ok := recentTurnCalleeIps[ipAddr]
-			recentTurnCalleeIpMutex.RUnlock()
-			if ok {
-				timeSinceFirstFound := timeNow.Sub(turnCallee.TimeStored)
-
-				readConfigLock.RLock()
-				maxTalkSecsIfNoP2pTmp := maxTalkSecsIfNoP2p
-				readConfigLock.RUnlock()
-
-				if timeSinceFirstFound.Seconds() <= float64(maxTalkSecsIfNoP2pTmp) {
-					foundIp = true
-					foundCalleeId = turnCallee.CalleeID
-					foundByMap = true
-					//fmt.Printf("turnauth session foundIp foundByMap %v\n", foundCalleeId)
-				} else {
-					// turn session is outdated, will not anymore be authenticated
-					// check if callee is offline or not connected, in which case we will not log session outdated
-					_, locHub, _, err := GetOnlineCallee(turnCallee.CalleeID, true, true, true, "", "turn")
-					if err==nil && locHub==nil {
-						// turnCallee.CalleeID is offline: don't log
-					} else if err==nil && locHub.ConnectedCallerIp == "" {
-						// turnCallee.CalleeID is online but not connected: don't log
-					} else {
-						fmt.Printf("turnauth (%s) session outdated %s %v %d\n",
-							turnCallee.CalleeID, ipAddr, timeSinceFirstFound.Seconds(), maxTalkSecsIfNoP2pTmp)
-					}
-				}
-			} else {
-				// here I check if ipAddr is listed anywhere in hubMap as a callerIp
-				// in other words: the connection will be authenticated to use turn
-				// by the caller (!), not by the callee
-				// we do this bc only one of the two sides needs to authenticate
-
-				// SearchCallerIpInHubMap() returns the callee ip and ID for the given caller ipAddr
-				foundIp, foundCalleeId, err = SearchCallerIpInHubMap(ipAddr)
-				if err != nil {
-					fmt.Printf("# turnauth for %s err=%v\n", ipAddr, err)
-					return nil, false
-				}
-				if foundIp {
-					//fmt.Printf("turn service approved for (%s) %v\n", foundCalleeId, ipAddr)
-					if !foundByMap {
-						recentTurnCalleeIpMutex.Lock()
-						recentTurnCalleeIps[ipAddr] = TurnCallee{foundCalleeId, timeNow}
-						//if logWantedFor("turn") {
-						//	fmt.Printf("turn auth added (%s) to recentTurnCalleeIps len=%d\n",
-						//		ipAddr, len(recentTurnCalleeIps))
-						//}
-						recentTurnCalleeIpMutex.Unlock()
-
-						// NOTE: recentTurnCalleeIps[ipAddr] will be deleted
-						//       in wsClient.go peerConHasEnded() on 'peer callee discon'
-					}
-				} else {
-					//fmt.Printf("turn service not approved for %v\n", ipAddr)
+			recentTurnCalleeIpMutex.Lock()
+			turnCallee,found := recentTurnCalleeIps[username]
+			if found && turnCallee.ended(timeNow.Unix()) {
+				if !turnCallee.Ended {
+					turnCallee.Ended = true
+					recentTurnCalleeIps[username] = turnCallee
 				}
+				recentTurnCalleeIpMutex.Unlock()
+				logDebug("turn", "turnauth call has ended", "calleeID",calleeID, "rip",ipAddr)
+				metricsTurnAuthTotal.Inc("denied")
+				return nil, false
 			}
-			if foundIp {
-				if !foundByMap /*&& logWantedFor("turn") */ {
-					recentTurnCalleeIpMutex.RLock()
-					fmt.Printf("turnauth (%s) for caller %v %d\n",
-						foundCalleeId, ipAddr, len(recentTurnCalleeIps))
-					recentTurnCalleeIpMutex.RUnlock()
-				}
-				// NOTE: the same key strings are used in caller.js and callee.js
-				// it doesn't matter what they are, but they must be the same
-				authKey := turn.GenerateAuthKey("c807ec29df3c9ff", realm, "736518fb4232d44")
-				return authKey, true
+			firstUse := found && !turnCallee.Used
+			if firstUse {
+				turnCallee.Used = true
+				recentTurnCalleeIps[username] = turnCallee
 			}
+			recentCount := len(recentTurnCalleeIps)
+			recentTurnCalleeIpMutex.Unlock()
 
-			if logWantedFor("turn") {
-				fmt.Printf("turnauth denied for %v\n", ipAddr)
+			// usernames not minted by this node are accepted as well (cluster, restart)
+			// for a forged username the client cannot know the password:
+			// the MESSAGE-INTEGRITY check of its request will fail
+			if !turnRelayAuth(srcAddr.String(), username, calleeID) {
+				// the daily relay quota of calleeID is exhausted (see turnrelay.go)
+				metricsTurnAuthTotal.Inc("quota")
+				return nil, false
 			}
-			return nil, false
+			authKey := turn.GenerateAuthKey(username, realm, turnPassword(username))
+			if firstUse {
+				logInfo("turnauth", "calleeID",calleeID, "rip",ipAddr, "recent",recentCount)
+			} else {
+				logDebug("turn", "turnauth", "calleeID",calleeID, "rip",ipAddr, "known",found)
+			}
+			metricsTurnAuthTotal.Inc("success")
+			return authKey, true
 		},
 		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{
-				PacketConn: udpListener,
-				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
-					RelayAddress: net.ParseIP(turnIP),
-					Address:      "0.0.0.0",
-				},
-			},
-		},
+		PacketConnConfigs: packetConnConfigs,
+		// ListenerConfigs is a list of TCP and TLS Listeners
+		ListenerConfigs: listenerConfigs,
 		LoggerFactory: loggerFactory,
 	})
 	if err != nil {
-		fmt.Printf("turn err %v ===========================\n", err)
+		logError("turn server", "err",err)
 		return
 	}
 }
+
+// turnRelayGenerator allocates the relay ports of the TURN server
+// pion/turn always asks for "udp4"; we allocate on the network of the listener instead
+// (so that IPv6 clients get IPv6 relays) and, if configured, within minPort..maxPort
+type turnRelayGenerator struct {
+	network  string // "udp4" or "udp6"
+	relayIP  net.IP // the (public) ip returned to the client
+	listenIP string
+	minPort  int
+	maxPort  int
+}
+
+func (r *turnRelayGenerator) Validate() error {
+	if r.relayIP==nil {
+		return errors.New("turn relay ip not set for "+r.network)
+	}
+	return nil
+}
+
+func (r *turnRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if requestedPort!=0 || r.minPort<=0 {
+		return r.listenPacket(requestedPort)
+	}
+	// start at a random port and try every port of the range once
+	count := r.maxPort - r.minPort + 1
+	start := mathrand.Intn(count)
+	var err error
+	for i:=0; i<count; i++ {
+		conn, relayAddr, err2 := r.listenPacket(r.minPort + (start+i)%count)
+		if err2==nil {
+			return conn, relayAddr, nil
+		}
+		err = err2
+	}
+	logWarn("turn relay port range exhausted", "network",r.network, "min",r.minPort, "max",r.maxPort)
+	return nil, nil, err
+}
+
+func (r *turnRelayGenerator) listenPacket(port int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket(r.network, net.JoinHostPort(r.listenIP, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	// replace the listening ip with the public relay ip
+	relayAddr := *conn.LocalAddr().(*net.UDPAddr)
+	relayAddr.IP = r.relayIP
+	return conn, &relayAddr, nil
+}
+
+func (r *turnRelayGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	// TCP relays (RFC 6062) are not supported by pion/turn
+	return nil, nil, errors.New("turn tcp relay not supported")
+}
@@ -0,0 +1,64 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests for the grace period of TURN credentials after the end of a call
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testTurnCallee(t *testing.T, username string) TurnCallee {
+	t.Helper()
+	recentTurnCalleeIpMutex.RLock()
+	defer recentTurnCalleeIpMutex.RUnlock()
+	turnCallee,ok := recentTurnCalleeIps[username]
+	if !ok {
+		t.Fatalf("%s not in recentTurnCalleeIps", username)
+	}
+	return turnCallee
+}
+
+func TestTurnCredentialsGrace(t *testing.T) {
+	readConfigLock.Lock()
+	turnCredentialSecs = 900
+	readConfigLock.Unlock()
+	username := turnCredentialsNew("19990000051")
+	other := turnCredentialsNew("19990000052")
+	now := time.Now().Unix()
+	if testTurnCallee(t, username).ended(now) {
+		t.Fatal("new credentials ended")
+	}
+
+	// within the grace period after the end of the call the credentials stay valid
+	turnCredentialsEnd(username)
+	turnCallee := testTurnCallee(t, username)
+	if turnCallee.EndTime==0 || turnCallee.ended(now) || turnCallee.ended(now+turnEndedGraceSecs) {
+		t.Fatalf("credentials ended within the grace period %+v", turnCallee)
+	}
+	if !turnCallee.ended(now+turnEndedGraceSecs+2) {
+		t.Fatalf("credentials not ended after the grace period %+v", turnCallee)
+	}
+
+	// the caller is gone: the grace period starts again
+	recentTurnCalleeIpMutex.Lock()
+	turnCallee.EndTime = now-turnEndedGraceSecs+2
+	recentTurnCalleeIps[username] = turnCallee
+	recentTurnCalleeIpMutex.Unlock()
+	turnCredentialsProlong("19990000051")
+	if turnCallee = testTurnCallee(t, username); turnCallee.EndTime < now {
+		t.Fatalf("grace period not prolonged %+v", turnCallee)
+	}
+	if testTurnCallee(t, other).EndTime!=0 {
+		t.Fatal("credentials of another callee were ended")
+	}
+
+	// credentials past their grace period are not prolonged
+	recentTurnCalleeIpMutex.Lock()
+	turnCallee.EndTime = now-turnEndedGraceSecs-2
+	recentTurnCalleeIps[username] = turnCallee
+	recentTurnCalleeIpMutex.Unlock()
+	turnCredentialsProlong("19990000051")
+	if !testTurnCallee(t, username).ended(time.Now().Unix()) {
+		t.Fatal("revoked credentials were prolonged")
+	}
+}
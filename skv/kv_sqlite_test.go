@@ -0,0 +1,24 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// runs the KV contract tests against SqlKV with the pure-Go sqlite driver
+// (go test -tags sqlite, after "go get modernc.org/sqlite")
+
+//go:build sqlite
+// +build sqlite
+
+package skv
+
+import (
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	testBackends["sql"] = func(t *testing.T) KV {
+		kv, err := SqlOpen("test", "sqlite", t.TempDir()+"/test.sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kv
+	}
+}
@@ -0,0 +1,256 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests of the KV contract, run against every backend
+// (SqlKV only when built with a sql driver: go test -tags sqlite)
+
+package skv
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testBackends opens an empty KV with the buckets "b1" and "b2"
+var testBackends = map[string]func(t *testing.T) KV{
+	"bolt": func(t *testing.T) KV {
+		kv, err := DbOpen("test.db", t.TempDir()+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kv
+	},
+	"memory": func(t *testing.T) KV {
+		kv, _ := MemOpen()
+		return kv
+	},
+}
+
+type testEntry struct {
+	Name  string
+	Count int
+}
+
+// testKeys returns the keys that ForEach (or Tx.ForEach with tx!=nil) passes to fn
+func testKeys(t *testing.T, kv KV, tx Tx, bucketName string) []string {
+	t.Helper()
+	var keys []string
+	fn := func(key string, value Value) error {
+		keys = append(keys, key)
+		return nil
+	}
+	var err error
+	if tx != nil {
+		err = tx.ForEach(bucketName, fn)
+	} else {
+		err = kv.ForEach(bucketName, fn)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+var testCases = []struct {
+	name string
+	fn   func(t *testing.T, kv KV)
+}{
+	{"GetPutDelete", func(t *testing.T, kv KV) {
+		var entry testEntry
+		if err := kv.Get("b1", "k1", &entry); err != ErrNotFound {
+			t.Fatalf("Get of a missing key: %v", err)
+		}
+		if err := kv.Put("b1", "k1", testEntry{"one", 1}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Put("b1", "k1", testEntry{"two", 2}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Get("b1", "k1", &entry); err != nil || entry != (testEntry{"two", 2}) {
+			t.Fatalf("Get %v %v", entry, err)
+		}
+		if err := kv.Get("b2", "k1", &entry); err != ErrNotFound {
+			t.Fatalf("Get from the other bucket: %v", err)
+		}
+		if err := kv.Delete("b1", "k1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Delete("b1", "k1"); err != ErrNotFound {
+			t.Fatalf("Delete of a missing key: %v", err)
+		}
+		if err := kv.Get("b1", "k1", &entry); err != ErrNotFound {
+			t.Fatalf("Get of a deleted key: %v", err)
+		}
+	}},
+	{"ForEachOrder", func(t *testing.T, kv KV) {
+		for _, key := range []string{"c", "a|2", "b", "a|1", "a_1", "a%"} {
+			kv.Put("b1", key, testEntry{key, 0}, false)
+		}
+		kv.Put("b2", "a|3", testEntry{}, false)
+		if keys := testKeys(t, kv, nil, "b1"); !reflect.DeepEqual(keys,
+			[]string{"a%", "a_1", "a|1", "a|2", "b", "c"}) {
+			t.Fatalf("ForEach keys %v", keys)
+		}
+		var keys []string
+		var names []string
+		err := kv.ForEachPrefix("b1", "a|", func(key string, value Value) error {
+			var entry testEntry
+			if err := value.Decode(&entry); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			names = append(names, entry.Name)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(keys, []string{"a|1", "a|2"}) || !reflect.DeepEqual(keys, names) {
+			t.Fatalf("ForEachPrefix keys %v names %v err %v", keys, names, err)
+		}
+		// no wildcards in the prefix
+		keys = nil
+		kv.ForEachPrefix("b1", "a_", func(key string, value Value) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if !reflect.DeepEqual(keys, []string{"a_1"}) {
+			t.Fatalf("ForEachPrefix(a_) keys %v", keys)
+		}
+		errStop := errors.New("stop")
+		count := 0
+		err = kv.ForEach("b1", func(key string, value Value) error {
+			count++
+			return errStop
+		})
+		if err != errStop || count != 1 {
+			t.Fatalf("ForEach did not stop: %v %d", err, count)
+		}
+	}},
+	{"UpdateCommit", func(t *testing.T, kv KV) {
+		kv.Put("b1", "k1", testEntry{"one", 1}, false)
+		err := kv.Update(func(tx Tx) error {
+			var entry testEntry
+			if err := tx.Get("b1", "k1", &entry); err != nil || entry.Count != 1 {
+				t.Fatalf("tx.Get %v %v", entry, err)
+			}
+			entry.Count++
+			if err := tx.Put("b1", "k1", entry); err != nil {
+				return err
+			}
+			if err := tx.Get("b1", "k1", &entry); err != nil || entry.Count != 2 {
+				t.Fatalf("tx.Get after tx.Put %v %v", entry, err)
+			}
+			if err := tx.Put("b2", "k2", testEntry{"two", 2}); err != nil {
+				return err
+			}
+			if err := tx.Delete("b1", "k3"); err != ErrNotFound {
+				t.Fatalf("tx.Delete of a missing key: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry testEntry
+		if kv.Get("b1", "k1", &entry); entry.Count != 2 {
+			t.Fatalf("k1 %v", entry)
+		}
+		if err = kv.Get("b2", "k2", &entry); err != nil || entry.Count != 2 {
+			t.Fatalf("k2 %v %v", entry, err)
+		}
+	}},
+	{"UpdateRollback", func(t *testing.T, kv KV) {
+		kv.Put("b1", "k1", testEntry{"one", 1}, false)
+		errAbort := errors.New("abort")
+		err := kv.Update(func(tx Tx) error {
+			tx.Put("b1", "k1", testEntry{"two", 2})
+			tx.Put("b1", "k2", testEntry{"two", 2})
+			tx.Delete("b1", "k1")
+			return errAbort
+		})
+		if err != errAbort {
+			t.Fatalf("Update %v", err)
+		}
+		var entry testEntry
+		if err = kv.Get("b1", "k1", &entry); err != nil || entry.Count != 1 {
+			t.Fatalf("k1 %v %v", entry, err)
+		}
+		if err = kv.Get("b1", "k2", &entry); err != ErrNotFound {
+			t.Fatalf("k2 %v", err)
+		}
+	}},
+	{"TxForEachSnapshot", func(t *testing.T, kv KV) {
+		for _, key := range []string{"a", "b", "c"} {
+			kv.Put("b1", key, testEntry{key, 0}, false)
+		}
+		var keys []string
+		err := kv.Update(func(tx Tx) error {
+			tx.Delete("b1", "c")
+			return tx.ForEach("b1", func(key string, value Value) error {
+				keys = append(keys, key)
+				if key == "a" {
+					// b is still passed to fn, d is not
+					if err := tx.Delete("b1", "b"); err != nil {
+						return err
+					}
+					return tx.Put("b1", "d", testEntry{"d", 0})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+			t.Fatalf("tx.ForEach keys %v", keys)
+		}
+		if keys = testKeys(t, kv, nil, "b1"); !reflect.DeepEqual(keys, []string{"a", "d"}) {
+			t.Fatalf("keys after Update %v", keys)
+		}
+	}},
+	{"ConcurrentPut", func(t *testing.T, kv KV) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- kv.Put("b1", "k1", testEntry{"k1", i}, false)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if keys := testKeys(t, kv, nil, "b1"); !reflect.DeepEqual(keys, []string{"k1"}) {
+			t.Fatalf("keys %v", keys)
+		}
+	}},
+	{"Buckets", func(t *testing.T, kv KV) {
+		if err := kv.CreateBucket("b1"); err != nil {
+			t.Fatalf("CreateBucket of an existing bucket: %v", err)
+		}
+		names, err := kv.Buckets()
+		if err != nil || !reflect.DeepEqual(names, []string{"b1", "b2"}) {
+			t.Fatalf("Buckets %v %v", names, err)
+		}
+	}},
+}
+
+func TestKV(t *testing.T) {
+	for backend, open := range testBackends {
+		for _, tc := range testCases {
+			t.Run(backend+"/"+tc.name, func(t *testing.T) {
+				kv := open(t)
+				defer kv.Close()
+				for _, bucketName := range []string{"b1", "b2"} {
+					if err := kv.CreateBucket(bucketName); err != nil {
+						t.Fatal(err)
+					}
+				}
+				tc.fn(t, kv)
+			})
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// MemKV is a non-persistent KV backend that keeps all entries in memory.
+// It is meant for tests and for throw-away instances; all data is lost on Close().
+// Values are gob-encoded just like with the bolt backend, so that callers see
+// the same (deep-copy) semantics regardless of the backend in use.
+
+package skv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MemKV struct {
+	mutex   *sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func MemOpen() (MemKV, error) {
+	return MemKV{mutex: &sync.RWMutex{}, buckets: make(map[string]map[string][]byte)}, nil
+}
+
+func (kvm MemKV) CreateBucket(bucketName string) error {
+	kvm.mutex.Lock()
+	defer kvm.mutex.Unlock()
+	if _, ok := kvm.buckets[bucketName]; !ok {
+		kvm.buckets[bucketName] = make(map[string][]byte)
+	}
+	return nil
+}
+
+func (kvm MemKV) Get(bucketName string, key string, value interface{}) error {
+	kvm.mutex.RLock()
+	defer kvm.mutex.RUnlock()
+	return memTx{buckets: kvm.buckets}.Get(bucketName, key, value)
+}
+
+func (kvm MemKV) Put(bucketName string, key string, value interface{}, waitConfirm bool) error {
+	kvm.mutex.Lock()
+	defer kvm.mutex.Unlock()
+	return memTx{buckets: kvm.buckets}.Put(bucketName, key, value)
+}
+
+func (kvm MemKV) Delete(bucketName string, key string) error {
+	kvm.mutex.Lock()
+	defer kvm.mutex.Unlock()
+	return memTx{buckets: kvm.buckets}.Delete(bucketName, key)
+}
+
+func (kvm MemKV) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	kvm.mutex.RLock()
+	defer kvm.mutex.RUnlock()
+	b, ok := kvm.buckets[bucketName]
+	if !ok {
+		return ErrNoBucket
+	}
+	for _, key := range sortedKeys(b) {
+		if err := fn(key, Value(b[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kvm MemKV) ForEachPrefix(bucketName string, prefix string, fn func(key string, value Value) error) error {
+	kvm.mutex.RLock()
+	defer kvm.mutex.RUnlock()
+	b, ok := kvm.buckets[bucketName]
+	if !ok {
+		return ErrNoBucket
+	}
+	for _, key := range sortedKeys(b) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(key, Value(b[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update collects the changes made by fn, which are applied to the live
+// buckets only if fn returns no error.
+func (kvm MemKV) Update(fn func(tx Tx) error) error {
+	kvm.mutex.Lock()
+	defer kvm.mutex.Unlock()
+	tx := memTx{buckets: kvm.buckets, changes: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for name, changes := range tx.changes {
+		b := kvm.buckets[name]
+		for key, v := range changes {
+			if v == nil {
+				delete(b, key)
+			} else {
+				b[key] = v
+			}
+		}
+	}
+	return nil
+}
+
+func (kvm MemKV) Buckets() ([]string, error) {
+	kvm.mutex.RLock()
+	defer kvm.mutex.RUnlock()
+	var names []string
+	for name := range kvm.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (kvm MemKV) Sync() error {
+	return nil
+}
+
+func (kvm MemKV) Close() error {
+	kvm.mutex.Lock()
+	defer kvm.mutex.Unlock()
+	for name := range kvm.buckets {
+		delete(kvm.buckets, name)
+	}
+	return nil
+}
+
+// memTx works directly on buckets, or (inside Update) records its changes
+type memTx struct {
+	buckets map[string]map[string][]byte
+	changes map[string]map[string][]byte // bucket -> key -> value (nil = deleted)
+}
+
+// get returns the current value of key (including the changes of the transaction)
+func (t memTx) get(bucketName string, key string) ([]byte, error) {
+	b, ok := t.buckets[bucketName]
+	if !ok {
+		return nil, ErrNoBucket
+	}
+	if v, ok := t.changes[bucketName][key]; ok {
+		if v == nil {
+			return nil, ErrNotFound
+		}
+		return v, nil
+	}
+	v, ok := b[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+// set stores v (nil = delete) in the bucket or, inside Update, in the changes
+func (t memTx) set(bucketName string, key string, v []byte) {
+	if t.changes == nil {
+		if v == nil {
+			delete(t.buckets[bucketName], key)
+		} else {
+			t.buckets[bucketName][key] = v
+		}
+		return
+	}
+	changes, ok := t.changes[bucketName]
+	if !ok {
+		changes = make(map[string][]byte)
+		t.changes[bucketName] = changes
+	}
+	changes[key] = v
+}
+
+func (t memTx) Get(bucketName string, key string, value interface{}) error {
+	v, err := t.get(bucketName, key)
+	if err != nil {
+		return err
+	} else if value == nil {
+		return nil
+	}
+	return Value(v).Decode(value)
+}
+
+func (t memTx) Put(bucketName string, key string, value interface{}) error {
+	if _, ok := t.buckets[bucketName]; !ok {
+		return ErrNoBucket
+	}
+	buf, err := encode(value)
+	if err != nil {
+		return err
+	}
+	t.set(bucketName, key, buf)
+	return nil
+}
+
+func (t memTx) Delete(bucketName string, key string) error {
+	if _, err := t.get(bucketName, key); err != nil {
+		return err
+	}
+	t.set(bucketName, key, nil)
+	return nil
+}
+
+// ForEach takes a snapshot of the bucket before calling fn (see Tx for the rules)
+func (t memTx) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	b, ok := t.buckets[bucketName]
+	if !ok {
+		return ErrNoBucket
+	}
+	snapshot := make(map[string][]byte, len(b))
+	for key, v := range b {
+		snapshot[key] = v
+	}
+	for key, v := range t.changes[bucketName] {
+		if v == nil {
+			delete(snapshot, key)
+		} else {
+			snapshot[key] = v
+		}
+	}
+	for _, key := range sortedKeys(snapshot) {
+		if err := fn(key, Value(snapshot[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(b map[string][]byte) []string {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
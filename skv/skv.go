@@ -27,14 +27,60 @@ import (
 	"github.com/mehrvarz/webcall/iptools"
 )
 
+// KV is implemented by all storage backends (bolt: SKV, in-memory: MemKV, sql: SqlKV).
+// All values are gob-encoded, so entries can be moved between backends unchanged.
 type KV interface {
 	CreateBucket(bucketName string) error
 	Get(bucketName string, key string, value interface{}) error
 	Put(bucketName string, key string, value interface{}, waitConfirm bool) error
 	Delete(bucketName string, key string) error
+	// ForEach calls fn for every entry of the bucket in key order (read-only)
+	ForEach(bucketName string, fn func(key string, value Value) error) error
+	// ForEachPrefix calls fn for the entries with a key starting with prefix in key order (read-only)
+	ForEachPrefix(bucketName string, prefix string, fn func(key string, value Value) error) error
+	// Update runs fn inside a single read-write transaction
+	// if fn returns an error, all changes made via tx are rolled back
+	Update(fn func(tx Tx) error) error
+	// Buckets returns the names of all buckets
+	Buckets() ([]string, error)
+	// Sync flushes all pending writes to persistent storage
+	Sync() error
 	Close() error
 }
 
+// Tx gives access to the buckets of a KV inside Update().
+// Unlike with bolt cursors, fn given to ForEach() may Put() or Delete()
+// entries of the bucket that is being iterated.
+type Tx interface {
+	Get(bucketName string, key string, value interface{}) error
+	Put(bucketName string, key string, value interface{}) error
+	Delete(bucketName string, key string) error
+	// ForEach calls fn for the entries of the bucket as they were when ForEach was
+	// called (in key order): changes made by fn do not affect the iteration, so fn
+	// is also called for entries it has deleted and not for entries it has added
+	ForEach(bucketName string, fn func(key string, value Value) error) error
+}
+
+// Value is a gob-encoded value as handed out by ForEach()
+type Value []byte
+
+// Decode gob-decodes the value into "value", which must be pointer-typed
+func (v Value) Decode(value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(v)).Decode(value)
+}
+
+// encode gob-encodes a value for storage
+func encode(value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, ErrBadValue
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 type SKV struct {
 	Db *bolt.DB
     Name string
@@ -47,6 +93,7 @@ var (
 	MyOutBoundIpAddr string
 	ErrNotFound = errors.New("skv key not found")
 	ErrBadValue = errors.New("skv bad value")
+	ErrNoBucket = errors.New("skv bucket not found")
 )
 
 // Open a key-value store. "path" is the full path to the database file, any
@@ -100,17 +147,14 @@ func (kvs SKV) CreateBucket(bucketName string) error {
 //	}
 //	err := store.Put("key43", m)
 func (kvs SKV) Put(bucketName string, key string, value interface{}, waitConfirm bool) error {
-	if value == nil {
-		return ErrBadValue
-	}
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+	buf, err := encode(value)
+	if err != nil {
 		return err
 	}
 	DbMutex.Lock()
 	defer DbMutex.Unlock()
 	return kvs.Db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte(bucketName)).Put([]byte(key), buf.Bytes())
+		return tx.Bucket([]byte(bucketName)).Put([]byte(key), buf)
 	})
 }
 
@@ -164,11 +208,146 @@ func (kvs SKV) Delete(bucketName string, key string) error {
 	})
 }
 
+// ForEach calls fn for every entry of the bucket in key order. The value
+// handed to fn is only valid until fn returns. If fn returns an error, the
+// iteration stops and the error is returned.
+func (kvs SKV) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	return kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := fn(string(k), Value(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachPrefix is like ForEach, but only visits the keys starting with prefix.
+func (kvs SKV) ForEachPrefix(bucketName string, prefix string, fn func(key string, value Value) error) error {
+	return kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		p := []byte(prefix)
+		c := b.Cursor()
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if err := fn(string(k), Value(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update runs fn inside a single bolt read-write transaction.
+func (kvs SKV) Update(fn func(tx Tx) error) error {
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	return kvs.Db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Buckets returns the names of all buckets in the store.
+func (kvs SKV) Buckets() ([]string, error) {
+	var names []string
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Sync forces an fdatasync of the database file.
+func (kvs SKV) Sync() error {
+	return kvs.Db.Sync()
+}
+
 // Close closes the key-value store file.
 func (kvs SKV) Close() error {
 	return kvs.Db.Close()
 }
 
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) bucket(bucketName string) (*bolt.Bucket, error) {
+	b := t.tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil, ErrNoBucket
+	}
+	return b, nil
+}
+
+func (t boltTx) Get(bucketName string, key string, value interface{}) error {
+	b, err := t.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	v := b.Get([]byte(key))
+	if v == nil {
+		return ErrNotFound
+	} else if value == nil {
+		return nil
+	}
+	return Value(v).Decode(value)
+}
+
+func (t boltTx) Put(bucketName string, key string, value interface{}) error {
+	b, err := t.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	buf, err := encode(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), buf)
+}
+
+func (t boltTx) Delete(bucketName string, key string) error {
+	b, err := t.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if b.Get([]byte(key)) == nil {
+		return ErrNotFound
+	}
+	return b.Delete([]byte(key))
+}
+
+// ForEach takes a snapshot of the bucket before calling fn, so that fn may
+// modify the bucket (bolt does not allow this while a cursor is in use).
+// See Tx for the rules.
+func (t boltTx) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	b, err := t.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var values []Value
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		keys = append(keys, string(k))
+		values = append(values, append(Value(nil), v...))
+	}
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Exit() error {
 	return nil
 }
@@ -0,0 +1,258 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// SqlKV is a KV backend on top of database/sql. All KV stores (rtcsig.db,
+// rtccalls.db, ...) can share one sql database; each store keeps its entries
+// in the table "skv" under its own name, next to the table "skv_buckets".
+// Values are stored gob-encoded, the same as with the bolt backend.
+// The sql driver must be registered by the main package (see sqldriver.go)
+// and is selected by its name, e.g. "sqlite", "postgres" or "mysql".
+
+package skv
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type SqlKV struct {
+	db         *sql.DB
+	Name       string
+	numberedPh bool   // "$1" placeholders (postgres) instead of "?"
+	upsert     string // insert or replace of one entry in the dialect of the driver
+}
+
+// SqlOpen opens (and, if needed, initializes) a KV store by the given name
+// inside the sql database given by driverName and dataSource.
+func SqlOpen(name string, driverName string, dataSource string) (SqlKV, error) {
+	fmt.Printf("SqlOpen %s %s\n", driverName, name)
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		return SqlKV{}, err
+	}
+	if driverName == "sqlite" || driverName == "sqlite3" {
+		// sqlite allows only one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	kvq := SqlKV{db: db, Name: name,
+		numberedPh: driverName == "postgres" || driverName == "pgx"}
+	// sqlite (3.24+) and postgres share the ON CONFLICT syntax
+	kvq.upsert = "INSERT INTO skv (store, bucket, k, v) VALUES (?, ?, ?, ?) " +
+		"ON CONFLICT (store, bucket, k) DO UPDATE SET v=excluded.v"
+	if driverName == "mysql" {
+		kvq.upsert = "REPLACE INTO skv (store, bucket, k, v) VALUES (?, ?, ?, ?)"
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS skv_buckets (store VARCHAR(64) NOT NULL, bucket VARCHAR(64) NOT NULL, " +
+			"PRIMARY KEY (store, bucket))",
+		"CREATE TABLE IF NOT EXISTS skv (store VARCHAR(64) NOT NULL, bucket VARCHAR(64) NOT NULL, " +
+			"k VARCHAR(255) NOT NULL, v BLOB NOT NULL, PRIMARY KEY (store, bucket, k))",
+	} {
+		if kvq.numberedPh {
+			stmt = strings.Replace(stmt, "BLOB", "BYTEA", 1)
+		}
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return SqlKV{}, err
+		}
+	}
+	return kvq, nil
+}
+
+// q rewrites "?" placeholders for drivers that need numbered placeholders
+func (kvq SqlKV) q(query string) string {
+	if !kvq.numberedPh {
+		return query
+	}
+	n := 0
+	var sb strings.Builder
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+		} else {
+			sb.WriteRune(ch)
+		}
+	}
+	return sb.String()
+}
+
+func (kvq SqlKV) CreateBucket(bucketName string) error {
+	return kvq.Update(func(tx Tx) error {
+		t := tx.(sqlTx)
+		var count int
+		err := t.tx.QueryRow(kvq.q("SELECT COUNT(*) FROM skv_buckets WHERE store=? AND bucket=?"),
+			kvq.Name, bucketName).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+		_, err = t.tx.Exec(kvq.q("INSERT INTO skv_buckets (store, bucket) VALUES (?, ?)"),
+			kvq.Name, bucketName)
+		return err
+	})
+}
+
+func (kvq SqlKV) Get(bucketName string, key string, value interface{}) error {
+	var v []byte
+	err := kvq.db.QueryRow(kvq.q("SELECT v FROM skv WHERE store=? AND bucket=? AND k=?"),
+		kvq.Name, bucketName, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if value == nil {
+		return nil
+	}
+	return Value(v).Decode(value)
+}
+
+func (kvq SqlKV) Put(bucketName string, key string, value interface{}, waitConfirm bool) error {
+	return kvq.Update(func(tx Tx) error {
+		return tx.Put(bucketName, key, value)
+	})
+}
+
+func (kvq SqlKV) Delete(bucketName string, key string) error {
+	return kvq.Update(func(tx Tx) error {
+		return tx.Delete(bucketName, key)
+	})
+}
+
+func (kvq SqlKV) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	return forEachRow(kvq.db, kvq, bucketName, "", fn)
+}
+
+func (kvq SqlKV) ForEachPrefix(bucketName string, prefix string, fn func(key string, value Value) error) error {
+	return forEachRow(kvq.db, kvq, bucketName, prefix, fn)
+}
+
+func (kvq SqlKV) Update(fn func(tx Tx) error) error {
+	tx, err := kvq.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(sqlTx{tx, kvq}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (kvq SqlKV) Buckets() ([]string, error) {
+	rows, err := kvq.db.Query(kvq.q("SELECT bucket FROM skv_buckets WHERE store=? ORDER BY bucket"), kvq.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Sync is a no-op: committed sql transactions are already persisted
+func (kvq SqlKV) Sync() error {
+	return nil
+}
+
+func (kvq SqlKV) Close() error {
+	return kvq.db.Close()
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// forEachRow reads all rows of the bucket (with a key starting with prefix) before
+// calling fn, so that fn may modify the bucket and so that no rows are held open
+// while fn is running
+func forEachRow(querier sqlQuerier, kvq SqlKV, bucketName string, prefix string,
+	fn func(key string, value Value) error) error {
+	var rows *sql.Rows
+	var err error
+	if prefix == "" {
+		rows, err = querier.Query(kvq.q("SELECT k, v FROM skv WHERE store=? AND bucket=? ORDER BY k"),
+			kvq.Name, bucketName)
+	} else {
+		// unlike LIKE, SUBSTR has no wildcards and is case sensitive on all dialects
+		rows, err = querier.Query(kvq.q("SELECT k, v FROM skv WHERE store=? AND bucket=? AND "+
+			"SUBSTR(k, 1, ?)=? ORDER BY k"), kvq.Name, bucketName, len([]rune(prefix)), prefix)
+	}
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var values []Value
+	for rows.Next() {
+		var key string
+		var v []byte
+		if err = rows.Scan(&key, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, Value(v))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err = fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqlTx struct {
+	tx  *sql.Tx
+	kvq SqlKV
+}
+
+func (t sqlTx) Get(bucketName string, key string, value interface{}) error {
+	var v []byte
+	err := t.tx.QueryRow(t.kvq.q("SELECT v FROM skv WHERE store=? AND bucket=? AND k=?"),
+		t.kvq.Name, bucketName, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if value == nil {
+		return nil
+	}
+	return Value(v).Decode(value)
+}
+
+// Put is a single upsert statement, so that concurrent Puts of the same key
+// do not run into a unique key violation
+func (t sqlTx) Put(bucketName string, key string, value interface{}) error {
+	buf, err := encode(value)
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.Exec(t.kvq.q(t.kvq.upsert), t.kvq.Name, bucketName, key, buf)
+	return err
+}
+
+func (t sqlTx) Delete(bucketName string, key string) error {
+	res, err := t.tx.Exec(t.kvq.q("DELETE FROM skv WHERE store=? AND bucket=? AND k=?"),
+		t.kvq.Name, bucketName, key)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (t sqlTx) ForEach(bucketName string, fn func(key string, value Value) error) error {
+	return forEachRow(t.tx, t.kvq, bucketName, "", fn)
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"net"
 	"strings"
 	"strconv"
 	"fmt"
@@ -11,6 +12,79 @@ import (
 	"github.com/mehrvarz/webcall/skv"
 )
 
+// secondary indexes of hubMap, guarded by hubMapMutex
+// hubMapByCallee: calleeID -> the keys of its hubs (calleeID, or "calleeID!ext" for multiCallees)
+// hubMapByCallerIp: caller ip (without port) -> the keys of the hubs connected to a caller from this ip
+// they must be maintained by hubMapPut(), hubMapSetCallerIp() and hubMapDelete()
+var hubMapByCallee = make(map[string]map[string]bool)
+var hubMapByCallerIp = make(map[string]map[string]bool)
+
+// hubMapCalleeID returns the calleeID of a hubMap key
+func hubMapCalleeID(key string) string {
+	if idx := strings.Index(key,"!"); idx>=0 {
+		return key[:idx]
+	}
+	return key
+}
+
+// ipNoPort returns the ip of an address that may contain a port ("1.2.3.4:5", "[::1]:5")
+func ipNoPort(addr string) string {
+	if host,_,err := net.SplitHostPort(addr); err==nil {
+		return host
+	}
+	return addr
+}
+
+func hubMapIndexAdd(index map[string]map[string]bool, indexKey string, key string) {
+	keys := index[indexKey]
+	if keys==nil {
+		keys = make(map[string]bool)
+		index[indexKey] = keys
+	}
+	keys[key] = true
+}
+
+func hubMapIndexRemove(index map[string]map[string]bool, indexKey string, key string) {
+	if keys := index[indexKey]; keys!=nil {
+		delete(keys, key)
+		if len(keys)==0 {
+			delete(index, indexKey)
+		}
+	}
+}
+
+// hubMapPut stores hub under key (caller must hold hubMapMutex.Lock)
+func hubMapPut(key string, hub *Hub) {
+	if oldHub := hubMap[key]; oldHub!=nil && oldHub!=hub && oldHub.ConnectedCallerIp!="" {
+		hubMapIndexRemove(hubMapByCallerIp, ipNoPort(oldHub.ConnectedCallerIp), key)
+	}
+	hubMap[key] = hub
+	hubMapIndexAdd(hubMapByCallee, hubMapCalleeID(key), key)
+	if hub!=nil && hub.ConnectedCallerIp!="" {
+		hubMapIndexAdd(hubMapByCallerIp, ipNoPort(hub.ConnectedCallerIp), key)
+	}
+}
+
+// hubMapSetCallerIp sets hub.ConnectedCallerIp (caller must hold hubMapMutex.Lock)
+func hubMapSetCallerIp(key string, hub *Hub, callerIp string) {
+	if hub.ConnectedCallerIp!="" {
+		hubMapIndexRemove(hubMapByCallerIp, ipNoPort(hub.ConnectedCallerIp), key)
+	}
+	hub.ConnectedCallerIp = callerIp
+	if callerIp!="" {
+		hubMapIndexAdd(hubMapByCallerIp, ipNoPort(callerIp), key)
+	}
+}
+
+// hubMapDelete removes key from hubMap (caller must hold hubMapMutex.Lock)
+func hubMapDelete(key string) {
+	if hub := hubMap[key]; hub!=nil && hub.ConnectedCallerIp!="" {
+		hubMapIndexRemove(hubMapByCallerIp, ipNoPort(hub.ConnectedCallerIp), key)
+	}
+	delete(hubMap, key)
+	hubMapIndexRemove(hubMapByCallee, hubMapCalleeID(key), key)
+}
+
 // GetOnlineCallee(ID) can tell us (with optional ejectOn1stFound yes/no):
 // "is calleeID online?", "is calleeID hidden online?", "is calleeID hidden online for my callerIpAddr?"
 func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,error) { // actual calleeID, hostingServerIp
@@ -21,16 +95,16 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 		fmt.Printf("GetOnlineCallee %s (%s) ejectOn1stFound=%v reportBusy=%v reportHidden=%v callerIpAddr=%s\n",
 			calleeID,comment,ejectOn1stFound,reportBusyCallee, reportHiddenCallee,callerIpAddr)
 	}
-	calleeIdPlusExcl := calleeID+"!"
 	count:=0
-	for key := range hubMap {
+	// only the keys of calleeID: calleeID itself and "calleeID!ext" (multiCallees)
+	for key := range hubMapByCallee[calleeID] {
 		count++
-		// wenn nicht=calleeID && fängt auch nicht mit calleeID! an, dann weitersuchen
-		if key!=calleeID && !strings.HasPrefix(key,calleeIdPlusExcl) {
-			continue
-		}
 		// found a fitting calleeID
 		hub := hubMap[key]
+		if hub==nil {
+			// stored by StoreCalleeInHubMap(), but /login has not set the hub yet
+			continue
+		}
 		if logWantedFor("searchhub") {
 			fmt.Printf("GetOnlineCallee found id=%s key=%s callerIP=%s hidden=%v\n", 
 				calleeID, key, hub.ConnectedCallerIp, hub.IsCalleeHidden)
@@ -99,17 +173,9 @@ func locStoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool
 		err = skv.ErrNotFound
 	} else {
 		if hub.ConnectedCallerIp != callerIp {
-
-			if callerIp == "" && recentTurnCalleeIps!=nil {
+			if callerIp=="" && hub.ConnectedCallerIp!="" {
 				// client is gone, but we prolong turn session by a few secs, to avoid turn-errors
-				ipAddr := hub.ConnectedCallerIp
-				if portIdx := strings.Index(ipAddr, ":"); portIdx >= 0 {
-					ipAddr = ipAddr[:portIdx]
-				}
-				//fmt.Printf("StoreCallerIpInHubMap prolong turn for callerIp=%s\n", ipAddr)
-				recentTurnCalleeIpMutex.Lock()
-				recentTurnCalleeIps[ipAddr] = TurnCallee{calleeId,time.Now()}
-				recentTurnCalleeIpMutex.Unlock()
+				turnCredentialsProlong(hubMapCalleeID(calleeId))
 			}
 
 			if logWantedFor("searchhub") {
@@ -117,8 +183,7 @@ func locStoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool
 					calleeId, callerIp, hub.ConnectedCallerIp)
 			}
 
-			hub.ConnectedCallerIp = callerIp
-			hubMap[calleeId] = hub
+			hubMapSetCallerIp(calleeId, hub, callerIp)
 		} else {
 			if logWantedFor("searchhub") {
 				fmt.Printf("StoreCallerIpInHubMap calleeId=%s set callerIp=%s was already set\n",
@@ -132,9 +197,10 @@ func locStoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool
 func locSearchCallerIpInHubMap(ip string) (bool,string,error) {
 	hubMapMutex.RLock()
 	defer hubMapMutex.RUnlock()
-	for id := range hubMap {
+	// ip may be given with or without port
+	for id := range hubMapByCallerIp[ipNoPort(ip)] {
 		hub := hubMap[id]
-		if strings.HasPrefix(hub.ConnectedCallerIp,ip) {
+		if hub!=nil && strings.HasPrefix(hub.ConnectedCallerIp,ip) {
 			if logWantedFor("ipinhub") {
 				fmt.Printf("SearchCallerIpInHubMap ip=%s found\n",ip)
 			}
@@ -154,7 +220,7 @@ func locSearchCallerIpInHubMap(ip string) (bool,string,error) {
 func locDeleteFromHubMap(id string) (int64,error) {
 	hubMapMutex.Lock()
 	defer hubMapMutex.Unlock()
-	delete(hubMap,id)
+	hubMapDelete(id)
 	//fmt.Printf("exitFunc delete(globalHubMap,%s) done %d\n",releasedCalleeID,len(globalHubMap))
 	return int64(len(hubMap)),nil
 }
@@ -186,7 +252,7 @@ func locStoreCalleeInHubMap(key string, hub *Hub, multiCallees string, remoteAdd
 		key = newKey
 	}
 	//fmt.Printf("StoreCalleeInHubMap final key=%s\n",key)
-	hubMap[key] = hub
+	hubMapPut(key, hub)
 	return key, int64(len(hubMap)), nil
 }
 
@@ -252,6 +318,32 @@ func locSetUnHiddenForCaller(calleeId string, callerIp string) (error) {
 	return nil
 }
 
+func locSendToCallee(calleeId string, message []byte) error {
+	hubMapMutex.RLock()
+	hub := hubMap[calleeId]
+	hubMapMutex.RUnlock()
+	if hub==nil || hub.CalleeClient==nil {
+		return skv.ErrNotFound
+	}
+	return hub.CalleeClient.Write(message)
+}
+
+func locPickupWaitingCaller(callerAddrPort string) bool {
+	waitingCallerChanLock.RLock()
+	c,ok := waitingCallerChanMap[callerAddrPort]
+	waitingCallerChanLock.RUnlock()
+	if !ok {
+		return false
+	}
+	// this will end the frozen xhr call by the caller in httpNotifyCallee.go (see: case <-c)
+	select {
+	case c <- 1:
+	case <-time.After(3 * time.Second):
+		return false
+	}
+	return true
+}
+
 /*
 // return the number of callees (and callers) currently online
 func GetOnlineCalleeCount(countCallers bool) (int64,int64,error) {
@@ -0,0 +1,127 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// tests and benchmarks for the hubMap indexes
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// hubMapFill replaces hubMap with n hubs; every 10th hub is connected to a caller
+func hubMapFill(n int) {
+	hubMapMutex.Lock()
+	defer hubMapMutex.Unlock()
+	hubMap = make(map[string]*Hub)
+	hubMapByCallee = make(map[string]map[string]bool)
+	hubMapByCallerIp = make(map[string]map[string]bool)
+	for i:=0; i<n; i++ {
+		key := strconv.Itoa(10000000000+i)
+		hub := &Hub{}
+		hubMapPut(key, hub)
+		if i%10==0 {
+			hubMapSetCallerIp(key, hub, "10.0."+strconv.Itoa(i/256%256)+"."+strconv.Itoa(i%256)+":5000")
+		}
+	}
+}
+
+// hubMapCheckIndexes compares both indexes with indexes rebuilt from hubMap
+func hubMapCheckIndexes(t *testing.T) {
+	t.Helper()
+	hubMapMutex.RLock()
+	defer hubMapMutex.RUnlock()
+	byCallee := make(map[string]map[string]bool)
+	byCallerIp := make(map[string]map[string]bool)
+	for key,hub := range hubMap {
+		hubMapIndexAdd(byCallee, hubMapCalleeID(key), key)
+		if hub!=nil && hub.ConnectedCallerIp!="" {
+			hubMapIndexAdd(byCallerIp, ipNoPort(hub.ConnectedCallerIp), key)
+		}
+	}
+	if !reflect.DeepEqual(byCallee, hubMapByCallee) {
+		t.Fatalf("hubMapByCallee %v, want %v", hubMapByCallee, byCallee)
+	}
+	if !reflect.DeepEqual(byCallerIp, hubMapByCallerIp) {
+		t.Fatalf("hubMapByCallerIp %v, want %v", hubMapByCallerIp, byCallerIp)
+	}
+}
+
+func TestHubMapIndexes(t *testing.T) {
+	hubMapFill(1000)
+	hubMapCheckIndexes(t)
+
+	key,hub,_ := locGetOnlineCallee("10000000501", false, false, false, "", "test")
+	if hub==nil || key!="10000000501" {
+		t.Fatalf("locGetOnlineCallee key=%s hub=%v", key, hub)
+	}
+	// hub 500 is connected to 10.0.1.244:5000
+	for _,ip := range []string{"10.0.1.244", "10.0.1.244:5000"} {
+		if found,_,_ := locSearchCallerIpInHubMap(ip); !found {
+			t.Fatalf("locSearchCallerIpInHubMap(%s) not found", ip)
+		}
+	}
+
+	// caller ip changes and is cleared
+	hubMapMutex.Lock()
+	hubMapSetCallerIp("10000000500", hubMap["10000000500"], "[2001:db8::1]:6000")
+	hubMapMutex.Unlock()
+	hubMapCheckIndexes(t)
+	if found,_,_ := locSearchCallerIpInHubMap("10.0.1.244"); found {
+		t.Fatal("old caller ip still found")
+	}
+	if found,_,_ := locSearchCallerIpInHubMap("[2001:db8::1]:6000"); !found {
+		t.Fatal("new caller ip not found")
+	}
+	hubMapMutex.Lock()
+	hubMapSetCallerIp("10000000500", hubMap["10000000500"], "")
+	hubMapMutex.Unlock()
+	hubMapCheckIndexes(t)
+
+	// a hub replaced by a new one under the same key
+	hubMapMutex.Lock()
+	hubMapPut("10000000510", &Hub{ConnectedCallerIp:"192.0.2.1:7000"})
+	hubMapMutex.Unlock()
+	hubMapCheckIndexes(t)
+
+	// multiCallees: two hubs of one callee
+	key1,_,_ := locStoreCalleeInHubMap("multi", &Hub{}, "|multi|", "", 0, false)
+	key2,_,_ := locStoreCalleeInHubMap("multi", &Hub{}, "|multi|", "", 0, false)
+	hubMapCheckIndexes(t)
+	if len(hubMapByCallee["multi"])!=2 {
+		t.Fatalf("hubMapByCallee[multi] %v", hubMapByCallee["multi"])
+	}
+	locDeleteFromHubMap(key1)
+	hubMapCheckIndexes(t)
+	if key,_,_ := locGetOnlineCallee("multi", false, false, false, "", "test"); key!=key2 {
+		t.Fatalf("locGetOnlineCallee(multi) key=%s, want %s", key, key2)
+	}
+	locDeleteFromHubMap(key2)
+	locDeleteFromHubMap("10000000510")
+	hubMapCheckIndexes(t)
+	if _,ok := hubMapByCallee["multi"]; ok {
+		t.Fatal("empty index entry not removed")
+	}
+}
+
+func BenchmarkLocGetOnlineCallee(b *testing.B) {
+	hubMapFill(100000)
+	b.ResetTimer()
+	for i:=0; i<b.N; i++ {
+		locGetOnlineCallee("10000050001", false, false, false, "", "bench")
+	}
+}
+
+func BenchmarkLocSearchCallerIpInHubMap(b *testing.B) {
+	hubMapFill(100000)
+	// hub 50000 is connected to 10.0.195.80:5000
+	for _,ip := range []string{"10.0.195.80", "192.0.2.1"} {
+		found := ip=="10.0.195.80"
+		b.Run(ip, func(b *testing.B) {
+			for i:=0; i<b.N; i++ {
+				if hit,_,_ := locSearchCallerIpInHubMap(ip); hit!=found {
+					b.Fatalf("locSearchCallerIpInHubMap(%s) %v", ip, hit)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// The sql storage backend (config.ini: dbBackend=sql) needs a database/sql
+// driver. Build with "go build -tags sqlite" to link the pure-Go sqlite driver
+// (after "go get modernc.org/sqlite"), then set dbSqlDriver=sqlite and
+// dbSqlSource=db/webcall.sqlite. Other drivers can be added the same way.
+
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	_ "modernc.org/sqlite"
+)
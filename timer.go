@@ -6,9 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"strconv"
-	"bytes"
 	"unicode"
-	"encoding/gob"
 	"sort"
 	"io"
 	"os"
@@ -18,18 +16,14 @@ import (
 	"github.com/mehrvarz/webcall/skv"
 	"github.com/mehrvarz/webcall/twitter"
 	"gopkg.in/ini.v1"
-	bolt "go.etcd.io/bbolt"
 )
 
 var followerIDs twitter.FollowerIDs
 var followerIDsLock sync.RWMutex
 
 func ticker3hours() {
-	if logWantedFor("timer") {
-		fmt.Printf("ticker3hours start\n")
-	}
-	kv := kvMain.(skv.SKV)
-	db := kv.Db
+	logDebug("timer", "ticker3hours start")
+	kv := kvMain
 
 	// put ticker3hours out of step with other tickers
 	time.Sleep(37 * time.Second)
@@ -40,32 +34,26 @@ func ticker3hours() {
 		timeNowUnix := time.Now().Unix()
 
 		// loop all dbRegisteredIDs to delete outdated dbUserBucket entries (not online for 180+ days)
-		if logWantedFor("timer") {
-			fmt.Printf("ticker3hours start looking for outdated IDs...\n")
-		}
+		logDebug("timer", "ticker3hours start looking for outdated IDs...")
 		var maxDaysOffline int64 = 180
 		var deleteKeyArray []string  // for deleting
-		skv.DbMutex.Lock()
 		counterDeleted := 0
 		counter := 0
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(dbRegisteredIDs))
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				userID := string(k)
+		err := kv.Update(func(tx skv.Tx) error {
+			return tx.ForEach(dbRegisteredIDs, func(k string, v skv.Value) error {
+				userID := k
 				if strings.HasPrefix(userID,"answie") || strings.HasPrefix(userID,"talkback") {
-					continue
+					return nil
 				}
 				if !isOnlyNumericString(userID) {
-					continue
+					return nil
 				}
 				var dbEntry DbEntry // DbEntry{unixTime, remoteAddr, urlPw}
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
+				v.Decode(&dbEntry)
 				// we now must find out when this user was using the account the last time
 				dbUserKey := fmt.Sprintf("%s_%d", userID, dbEntry.StartTime)
 				var dbUser DbUser
-				err2 := kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
+				err2 := tx.Get(dbUserBucket, dbUserKey, &dbUser)
 				if err2 != nil {
 					// this occurs with mapping tmpID's - is not an error
 					//fmt.Printf("# ticker3hours %d error read db=%s bucket=%s get key=%v err=%v\n",
@@ -77,22 +65,18 @@ func ticker3hours() {
 						lastLoginTime = dbEntry.StartTime // created by httpRegister()
 					}
 					if(lastLoginTime==0) {
-						if logWantedFor("timer") {
-							fmt.Printf("ticker3hours %d id=%s sinceLastLogin=0 StartTime=0\n", counter, k)
-						}
+						logDebug("timer", "ticker3hours sinceLastLogin=0 StartTime=0", "counter",counter, "id",k)
 					} else {
 						sinceLastLoginSecs := timeNowUnix - lastLoginTime
 						sinceLastLoginDays := sinceLastLoginSecs/(24*60*60)
 						if sinceLastLoginDays > maxDaysOffline {
 							// account is outdated, delete this entry
-							if logWantedFor("timer") {
-								fmt.Printf("ticker3hours %d id=%s regist delete sinceLastLogin=%ds days=%d\n",
-									counter, k, sinceLastLoginSecs, sinceLastLoginDays)
-							}
-							err2 = c.Delete()
+							logDebug("timer", "ticker3hours regist delete", "counter",counter, "id",k,
+								"sinceLastLoginSecs",sinceLastLoginSecs, "days",sinceLastLoginDays)
+							err2 = tx.Delete(dbRegisteredIDs, k)
 							if err2!=nil {
 								// this is bad
-								fmt.Printf("# ticker3hours %d id=%s regist delete err=%v\n", counter, k, err2)
+								logError("ticker3hours regist delete", "counter",counter, "id",k, "err",err2)
 							} else {
 								counterDeleted++
 								//if logWantedFor("timer") {
@@ -105,23 +89,20 @@ func ticker3hours() {
 						}
 					}
 				}
-			}
-			return nil
+				return nil
+			})
 		})
-		skv.DbMutex.Unlock()
 		if err!=nil {
 			// this is bad
-			fmt.Printf("# ticker3hours delete=%d offline for %d days err=%v\n", counterDeleted,maxDaysOffline,err)
+			logError("ticker3hours delete offline", "deleted",counterDeleted, "days",maxDaysOffline, "err",err)
 		} else /*if counterDeleted>0*/ {
-			if logWantedFor("timer") {
-				fmt.Printf("ticker3hours delete=%d/%d offline for %d days (no err)\n",
-					counterDeleted, counter, maxDaysOffline)
-			}
+			logDebug("timer", "ticker3hours delete offline", "deleted",counterDeleted, "counter",counter,
+				"days",maxDaysOffline)
 		}
 		for _,key := range deleteKeyArray {
 			idxUnderline := strings.LastIndex(key,"_")
 			if idxUnderline<0 {
-				fmt.Printf("# ticker3hours error key=%s no underline\n", key)
+				logError("ticker3hours key has no underline", "key",key)
 				continue
 			}
 			userID := key[:idxUnderline]
@@ -132,8 +113,7 @@ func ticker3hours() {
 				starttimeStr := key[idxUnderline+1:]
 				starttime64, err := strconv.ParseInt(starttimeStr, 10, 64)
 				if err!=nil {
-					fmt.Printf("# ticker3hours error bucket=%s key=%s conv timestr err=%v\n",
-						dbBlockedIDs, key, err)
+					logError("ticker3hours conv timestr", "bucket",dbBlockedIDs, "key",key, "err",err)
 				} else {
 					sinceDeletedInSecs := timeNowUnix - starttime64
 */
@@ -148,15 +128,19 @@ func ticker3hours() {
 			}
 
 			// also delete userID's contacts
-			err = kvContacts.Delete(dbContactsBucket, userID)
+			err = contactsDelete(userID)
 			if err!=nil {
-				fmt.Printf("# ticker3hours delete contacts of id=%s err=%v\n", userID, err)
+				logError("ticker3hours delete contacts", "id",userID, "err",err)
 			}
+			callFilterDelete(userID)
+			voicemailDelete(userID)
+			missedCallsDelete(userID)
+			turnRelayUsageDelete(userID)
 
 			err = kv.Delete(dbUserBucket, key)
 			if err!=nil {
 				// this is bad
-				fmt.Printf("# ticker3hours delete user-id=%s err=%v\n", key, err)
+				logError("ticker3hours delete user-id", "id",key, "err",err)
 			} else {
 				// all is well: create a dbBlockedIDs entry (will be deleted after 60 days)
 				//fmt.Printf("ticker3hours key=%s user deleted\n", key)
@@ -164,112 +148,100 @@ func ticker3hours() {
 				err = kvMain.Put(dbBlockedIDs, dbUserKey, DbUser{}, false)
 				if err!=nil {
 					// this is bad
-					fmt.Printf("# ticker3hours error db=%s bucket=%s put key=%s err=%v\n",
-						dbMainName,dbBlockedIDs,dbUserKey,err)
+					logError("ticker3hours put", "db",dbMainName, "bucket",dbBlockedIDs, "key",dbUserKey, "err",err)
 				}
 			}
 		}
 
 		// loop all dbBlockedIDs to delete blocked entries
 		var deleteKeyArray2 []string  // for deleting
-		if logWantedFor("timer") {
-			fmt.Printf("ticker3hours start looking for outdated blocked entries...\n")
-		}
+		logDebug("timer", "ticker3hours start looking for outdated blocked entries...")
 		var blockedForDays int64 = 60
 		counterDeleted2 := 0
 		counter2 := 0
-		skv.DbMutex.Lock()
-		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(dbBlockedIDs))
-			c := b.Cursor()
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		err = kv.ForEach(dbBlockedIDs, func(k string, _ skv.Value) error {
 /*
-				userID := string(k) // key_timeNowUnix
+			userID := string(k) // key_timeNowUnix
+			if strings.HasPrefix(userID,"answie") || strings.HasPrefix(userID,"talkback") {
+				return nil
+			}
+			if !isOnlyNumericString(userID) {
+				return nil
+			}
+
+			var dbEntry DbEntry // DbEntry{unixTime, remoteAddr, urlPw}
+			d := gob.NewDecoder(bytes.NewReader(v))
+			d.Decode(&dbEntry)
+
+			sinceDeletedInSecs := timeNowUnix - dbEntry.StartTime
+			if sinceDeletedInSecs > blockedForDays * 24*60*60 {
+				deleteKeyArray2 = append(deleteKeyArray2,userID)
+				counterDeleted2++
+			}
+*/
+			dbUserKey := k
+			// dbUserKey format: 'calleeID_unixtime'
+			counter2++
+			idxUnderline := strings.LastIndex(dbUserKey,"_")
+			if idxUnderline<0 {
+				logError("ticker3hours key has no underline", "bucket",dbBlockedIDs, "key",dbUserKey)
+			} else {
+				userID := dbUserKey[:idxUnderline]
 				if strings.HasPrefix(userID,"answie") || strings.HasPrefix(userID,"talkback") {
-					continue
+					return nil
 				}
 				if !isOnlyNumericString(userID) {
-					continue
+					logInfo("ticker3hours !isOnlyNumericString", "key",userID)
+					return nil
 				}
 
-				var dbEntry DbEntry // DbEntry{unixTime, remoteAddr, urlPw}
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
-
-				sinceDeletedInSecs := timeNowUnix - dbEntry.StartTime
-				if sinceDeletedInSecs > blockedForDays * 24*60*60 {
-					deleteKeyArray2 = append(deleteKeyArray2,userID)
-					counterDeleted2++
-				}
-*/
-				dbUserKey := string(k)
-				// dbUserKey format: 'calleeID_unixtime'
-				counter2++
-				idxUnderline := strings.LastIndex(dbUserKey,"_")
-				if idxUnderline<0 {
-					fmt.Printf("# ticker3hours error bucket=%s key=%s no underline\n", dbBlockedIDs, dbUserKey)
+				starttimeStr := dbUserKey[idxUnderline+1:]
+				starttime64, err := strconv.ParseInt(starttimeStr, 10, 64)
+				if err!=nil {
+					logError("ticker3hours conv timestr", "bucket",dbBlockedIDs, "key",dbUserKey, "err",err)
 				} else {
-					userID := dbUserKey[:idxUnderline]
-					if strings.HasPrefix(userID,"answie") || strings.HasPrefix(userID,"talkback") {
-						continue
-					}
-					if !isOnlyNumericString(userID) {
-						fmt.Printf("_ticker3hours !isOnlyNumericString key=%s\n", userID)
-						continue
-					}
-
-					starttimeStr := dbUserKey[idxUnderline+1:]
-					starttime64, err := strconv.ParseInt(starttimeStr, 10, 64)
-					if err!=nil {
-						fmt.Printf("# ticker3hours error bucket=%s key=%s conv timestr err=%v\n",
-							dbBlockedIDs, dbUserKey, err)
+					sinceDeletedInSecs := timeNowUnix - starttime64
+					if sinceDeletedInSecs > blockedForDays * 24*60*60 {
+						deleteKeyArray2 = append(deleteKeyArray2,dbUserKey)
+						counterDeleted2++
 					} else {
-						sinceDeletedInSecs := timeNowUnix - starttime64
-						if sinceDeletedInSecs > blockedForDays * 24*60*60 {
-							deleteKeyArray2 = append(deleteKeyArray2,dbUserKey)
-							counterDeleted2++
-						} else {
-							if logWantedFor("timer") {
-								secsToLive := blockedForDays * 24*60*60 - sinceDeletedInSecs
-								if logWantedFor("blocked") {
-									fmt.Printf("ticker3hours blocked but not outdated key=%s (wait %ds %ddays)\n",
-										dbUserKey, secsToLive, secsToLive/(24*60*60))
-								}
-							}
+						if logWantedFor("timer") {
+							secsToLive := blockedForDays * 24*60*60 - sinceDeletedInSecs
+							logDebug("blocked", "ticker3hours blocked but not outdated", "key",dbUserKey,
+								"waitSecs",secsToLive, "waitDays",secsToLive/(24*60*60))
 						}
 					}
 				}
 			}
 			return nil
 		})
-		skv.DbMutex.Unlock()
 		if err!=nil {
 			// this is bad
-			fmt.Printf("# ticker3hours delete=%d blocked for %d days err=%v\n",counterDeleted2,blockedForDays,err)
+			logError("ticker3hours delete blocked", "deleted",counterDeleted2, "days",blockedForDays, "err",err)
 		} else /*if counterDeleted2>0*/ {
-			if logWantedFor("timer") {
-				fmt.Printf("ticker3hours delete=%d/%d id's blocked for %d days (no err)\n",
-					counterDeleted2, counter2, blockedForDays)
-			}
+			logDebug("timer", "ticker3hours delete blocked", "deleted",counterDeleted2, "counter",counter2,
+				"days",blockedForDays)
 		}
 		for _,key := range deleteKeyArray2 {
-			if logWantedFor("timer") {
-				fmt.Printf("ticker3hours delete blocked user-id=%s\n", key)
-			}
+			logDebug("timer", "ticker3hours delete blocked user-id", "id",key)
 			err = kv.Delete(dbBlockedIDs, key)
 			if err!=nil {
 				// this is bad
-				fmt.Printf("# ticker3hours delete blocked user-id=%s err=%v\n", key, err)
+				logError("ticker3hours delete blocked user-id", "id",key, "err",err)
 			} else {
 				// all is well
 				//fmt.Printf("ticker3hours key=%s user deleted\n", key)
 			}
 		}
 
+		// delete expired bearer tokens
+		tokenCleanup()
+		cdrCleanup()
+		voicemailExpire()
+		missedCallsCleanup()
+
 		if counterDeleted>0 || counterDeleted2>0 {
-			if logWantedFor("timer") {
-				fmt.Printf("ticker3hours done\n")
-			}
+			logDebug("timer", "ticker3hours done")
 		}
 
 		<-threeHoursTicker.C
@@ -308,24 +280,22 @@ func ticker20min() {
 				twitterAuth()
 			}
 			if twitterClient==nil {
-				fmt.Printf("# ticker20min no twitterClient\n")
+				logWarn("ticker20min no twitterClient")
 			} else {
-				if logWantedFor("timer") {
-					fmt.Printf("ticker20min fetch list of twitter followers...\n")
-				}
+				logDebug("timer", "ticker20min fetch list of twitter followers...")
 				// TODO we must later support more than 5000 followers
 				var err error
 				followerIDsLock.Lock()
 				var data []byte
 				followerIDs, data, err = twitterClient.QueryFollowerIDs(5000)
 				if err!=nil {
-					fmt.Printf("# ticker20min QueryFollowerIDs err=%v [%v]\n", err, data)
+					logError("ticker20min QueryFollowerIDs", "data",data, "err",err)
 				} else {
 					if logWantedFor("timer") {
-						fmt.Printf("ticker20min QueryFollowerIDs count=%d\n", len(followerIDs.Ids))
+						logDebug("timer", "ticker20min QueryFollowerIDs", "count",len(followerIDs.Ids))
 						if logWantedFor("twitter") {
 							for idx,id := range followerIDs.Ids {
-								fmt.Printf("ticker20min %d followerIDs.Id=%v\n", idx+1, int64(id))
+								logDebug("twitter", "ticker20min followerID", "idx",idx+1, "id",int64(id))
 							}
 						}
 					}
@@ -503,7 +473,7 @@ func broadcastNewsLink(date string, url string) {
 			hub.HubMutex.RLock()
 			// we make sure to send each news with a particular date string only once
 			if hub.CalleeClient==nil {
-				fmt.Printf("# newsLink hub.CalleeClient==nil to=%s sendData=%s\n",calleeID,sendData)
+				logWarn("newsLink hub.CalleeClient==nil", "to",calleeID, "sendData",sendData)
 			} else {
 				// the callee in this hub is online
 				// we don't need newsDateMutex bc no one else is using newsDateMap
@@ -519,7 +489,7 @@ func broadcastNewsLink(date string, url string) {
 					countSent++
 
 					if err!=nil {
-						fmt.Printf("# newsLink write to=%s err=%v\n",calleeID,err)
+						logError("newsLink write", "to",calleeID, "err",err)
 					} else {
 						//newsDateMutex.Lock()
 						newsDateMap[calleeID] = date
@@ -530,15 +500,13 @@ func broadcastNewsLink(date string, url string) {
 			}
 			hub.HubMutex.RUnlock()
 		} else {
-			fmt.Printf("# newsLink hub==nil to=%s sendData=%s\n",calleeID,sendData)
+			logWarn("newsLink hub==nil", "to",calleeID, "sendData",sendData)
 		}
 	}
 	if countSent>0 {
 		newsLinkDeliveredCounter += countSentNoErr
-		if logWantedFor("timer") {
-			fmt.Printf("newsLink sent=%d/%d total=%d sendData=%s\n",
-				countSentNoErr, countSent, newsLinkDeliveredCounter, sendData)
-		}
+		logDebug("timer", "newsLink sent", "sent",countSentNoErr, "count",countSent,
+			"total",newsLinkDeliveredCounter, "sendData",sendData)
 	}
 	return
 }
@@ -560,66 +528,53 @@ func ticker3min() {
 			mytwitterSecret := twitterSecret
 			readConfigLock.RUnlock()
 			if mytwitterKey!="" && mytwitterSecret!="" {
-				kv := kvNotif.(skv.SKV)
-
-				skv.DbMutex.Lock()
-				kv.Db.Update(func(tx *bolt.Tx) error {
-					unixNow := time.Now().Unix()
-					//fmt.Printf("ticker3min release outdated entries from db=%s bucket=%s\n",
-					//	dbNotifName, dbSentNotifTweets)
-					b := tx.Bucket([]byte(dbSentNotifTweets))
-					if b==nil {
-						fmt.Printf("# ticker3min bucket=(%s) no tx\n",dbSentNotifTweets)
-						return nil
-					}
-					c := b.Cursor()
-					deleteCount := 0
-					for k, v := c.First(); k != nil; k, v = c.Next() {
-						idStr := string(k)
-						d := gob.NewDecoder(bytes.NewReader(v))
+				unixNow := time.Now().Unix()
+				deleteCount := 0
+				//fmt.Printf("ticker3min release outdated entries from db=%s bucket=%s\n",
+				//	dbNotifName, dbSentNotifTweets)
+				err := kvNotif.Update(func(tx skv.Tx) error {
+					return tx.ForEach(dbSentNotifTweets, func(idStr string, v skv.Value) error {
 						var notifTweet NotifTweet
-						d.Decode(&notifTweet)
+						v.Decode(&notifTweet)
 						ageSecs := unixNow - notifTweet.TweetTime
 						if ageSecs >= 60*60 {
-							if logWantedFor("timer") {
-								fmt.Printf("ticker3min outdated ID=%s ageSecs=%d > 1h (%s) deleting\n",
-									idStr, ageSecs, notifTweet.Comment)
-							}
+							logDebug("timer", "ticker3min outdated ID > 1h deleting", "id",idStr, "ageSecs",ageSecs,
+								"comment",notifTweet.Comment)
 /* kvNotif is currently not fed from httpNotifyCallee.go
 							twitterClientLock.Lock()
 							if twitterClient==nil {
 								twitterAuth()
 							}
 							if twitterClient==nil {
-								fmt.Printf("# ticker3min failed on no twitterClient\n")
+								logWarn("ticker3min failed on no twitterClient")
 								twitterClientLock.Unlock()
 								break
 							}
 							respdata,err := twitterClient.DeleteTweet(idStr)
 							twitterClientLock.Unlock()
 							if err!=nil {
-								fmt.Printf("# ticker3min DeleteTweet %s err=%v (%s)\n", idStr, err, respdata)
+								logError("ticker3min DeleteTweet", "id",idStr, "resp",string(respdata), "err",err)
 							} else 
 */
 							{
 								//fmt.Printf("ticker3min DeleteTweet %s OK\n", idStr)
-								err := c.Delete()
+								err := tx.Delete(dbSentNotifTweets, idStr)
 								if err!=nil {
-									fmt.Printf("# ticker3min error db=%s bucket=%s delete id=%s err=%v\n",
-										dbMainName, dbSentNotifTweets, idStr, err)
+									logError("ticker3min delete", "db",dbMainName, "bucket",dbSentNotifTweets, "id",idStr, "err",err)
 								} else {
 									deleteCount++
 								}
 							}
 						}
-					}
-					if deleteCount>0 {
-						//fmt.Printf("ticker3min db=%s bucket=%s deleted %d entries\n",
-						//	dbNotifName, dbSentNotifTweets, deleteCount)
-					}
-					return nil
+						return nil
+					})
 				})
-				skv.DbMutex.Unlock()
+				if err!=nil {
+					logError("ticker3min", "db",dbNotifName, "bucket",dbSentNotifTweets, "err",err)
+				} else if deleteCount>0 {
+					//fmt.Printf("ticker3min db=%s bucket=%s deleted %d entries\n",
+					//	dbNotifName, dbSentNotifTweets, deleteCount)
+				}
 			}
 
 			// call backupScript
@@ -636,7 +591,7 @@ func ticker3min() {
 				} else {
 					_,err := os.Stat(mybackupScript)
 					if err!=nil {
-						fmt.Printf("# ticker3min file %s err=%v\n",mybackupScript,err)
+						logError("ticker3min backup script", "file",mybackupScript, "err",err)
 					} else {
 						if callBackupScript(mybackupScript) == nil {
 							lastBackupTime = timeNow
@@ -684,39 +639,35 @@ func ticker3min() {
 }
 
 func callBackupScript(scriptName string) error {
-	skv.DbMutex.Lock()
-	defer skv.DbMutex.Unlock()
+	logInfo("callBackupScript sync db's", "script",scriptName)
 
-	fmt.Printf("callBackupScript sync db's (%s)\n",scriptName)
-
-	kv := kvMain.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvMain sync error: %s\n", err)
+	if err := kvMain.Sync(); err != nil {
+		logError("callBackupScript kvMain sync", "err",err)
 	}
-	kv = kvCalls.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvCalls sync error: %s\n", err)
+	if err := kvCalls.Sync(); err != nil {
+		logError("callBackupScript kvCalls sync", "err",err)
 	}
-	kv = kvContacts.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvContacts sync error: %s\n", err)
+	if err := kvContacts.Sync(); err != nil {
+		logError("callBackupScript kvContacts sync", "err",err)
 	}
-	kv = kvNotif.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvNotif sync error: %s\n", err)
+	if err := kvNotif.Sync(); err != nil {
+		logError("callBackupScript kvNotif sync", "err",err)
 	}
-	kv = kvHashedPw.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvHashedPw sync error: %s\n", err)
+	if err := kvHashedPw.Sync(); err != nil {
+		logError("callBackupScript kvHashedPw sync", "err",err)
 	}
 
-	fmt.Printf("callBackupScript exec (%s)...\n",scriptName)
+	// no db writes while the backup script is running
+	skv.DbMutex.Lock()
+	defer skv.DbMutex.Unlock()
+
+	logInfo("callBackupScript exec...", "script",scriptName)
 	cmd, err := exec.Command("/bin/sh", scriptName).Output()
 	if err != nil {
-		fmt.Printf("# callBackupScript %s err=%s log=(%s)", scriptName, err, string(cmd))
+		logError("callBackupScript", "script",scriptName, "log",string(cmd), "err",err)
 		return err
 	}
-	fmt.Printf("callBackupScript %s done log=(%s)\n",scriptName,string(cmd))
+	logInfo("callBackupScript done", "script",scriptName, "log",string(cmd))
 	return nil
 }
 
@@ -735,7 +686,7 @@ func ticker30sec() {
 		mythirtySecStats := thirtySecStats
 		readConfigLock.RUnlock()
 		if mythirtySecStats {
-			fmt.Printf("%s\n",getStats())
+			logInfo(getStats())
 		}
 
 		// cleanup recentTurnCalleeIps
@@ -743,12 +694,11 @@ func ticker30sec() {
 		deleted := 0
 		recentTurnCalleeIpMutex.Lock()
 		//fmt.Printf("ticker30sec recentTurnCalleeIps cleanup elementCount=%d\n",len(recentTurnCalleeIps))
-		for ipAddr := range recentTurnCalleeIps {
-			turnCallee, ok := recentTurnCalleeIps[ipAddr]
+		for username := range recentTurnCalleeIps {
+			turnCallee, ok := recentTurnCalleeIps[username]
 			if ok {
-				timeSinceLastFound := timeNow.Sub(turnCallee.TimeStored)
-				if timeSinceLastFound.Seconds() > 610 { // 10min
-					delete(recentTurnCalleeIps,ipAddr)
+				if turnCallee.Expires < timeNow.Unix() {
+					delete(recentTurnCalleeIps,username)
 					deleted++
 				}
 			}
@@ -756,26 +706,28 @@ func ticker30sec() {
 		if deleted>0 {
 			if logWantedFor("timer") {
 				if logWantedFor("turn") {
-					fmt.Printf("ticker30sec deleted %d entries from recentTurnCalleeIps (remain=%d)\n",
-						deleted, len(recentTurnCalleeIps))
+					logDebug("turn", "ticker30sec deleted entries from recentTurnCalleeIps", "deleted",deleted,
+						"remain",len(recentTurnCalleeIps))
 				}
 			}
 		}
 		recentTurnCalleeIpMutex.Unlock()
 
+		// store relay usage (turnrelay.go)
+		turnRelayFlush()
 
 		// every 10 min
 		ticker30secCounter++
 /*
 		if(ticker30secCounter%20==0) {
 			// loop through all hubs
-			fmt.Printf("ticker10min %d\n",ticker30secCounter/20)
+			logDebug("timer", "ticker10min", "counter",ticker30secCounter/20)
 			hubMapMutex.RLock()
 			for _,hub := range hubMap {
 				if hub!=nil {
 					err := hub.CalleeClient.Write([]byte("dummy|"+timeNow.String()))
 					if err != nil {
-						fmt.Printf("ticker10min send dummy id=%s err=%v\n",hub.CalleeClient.calleeID,err)
+						logWarn("ticker10min send dummy", "id",hub.CalleeClient.calleeID, "err",err)
 					} else {
 						//fmt.Printf("ticker10min send dummy id=%s noerr\n",hub.CalleeClient.calleeID)
 					}
@@ -785,9 +737,7 @@ func ticker30sec() {
 		}
 */
 	}
-	if logWantedFor("timer") {
-		fmt.Printf("ticker30sec ending\n")
-	}
+	logDebug("timer", "ticker30sec ending")
 }
 
 // 10s-ticker: periodically call readConfig()
@@ -813,7 +763,7 @@ func ticker2sec() {
 		// detect new day
 		timeNow := time.Now()
 		if timeNow.Day() != lastCurrentDayOfMonth {
-			fmt.Printf("we have a new day\n")
+			logInfo("we have a new day")
 			lastCurrentDayOfMonth = timeNow.Day()
 			numberOfCallsTodayMutex.Lock()
 			numberOfCallsToday = 0
@@ -0,0 +1,384 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// TURN relay accounting and limits (embedded TURN server, see runturn.go).
+// The listener sockets of the TURN server are wrapped, so that all traffic between
+// a TURN client and the server (the relayed media plus TURN framing) is counted.
+// AuthHandler maps the client address to the credentials of its call and so to
+// the callee. Traffic of clients that have not authenticated (STUN) is not counted.
+// Config keywords (0 = unlimited):
+//   turnRelayMaxBytes    per allocation (client address)
+//   turnRelayMaxKbps     per allocation, measured per second
+//   turnRelayDailyBytes  per callee and day (default quota)
+// Admins can set an individual daily quota per callee (-1 = unlimited).
+// UDP packets exceeding a limit are dropped. TCP/TLS connections are throttled when
+// exceeding turnRelayMaxKbps and closed when exceeding the other limits. A callee
+// over its daily quota does not pass AuthHandler anymore.
+// The daily usage is stored in kvMain/dbRelayUsageBucket (calleeID -> RelayUsage)
+// every 30s, adding to the stored value (so cluster nodes can share the db).
+// The relay bytes of a call are stored in its CDR (relayBytes).
+// Admins (localhost): "/rtcsig/dumprelay" (sessions and daily usage) and
+// "/rtcsig/relayquota?id=calleeID&quota=bytes" (quota=0 for the default).
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbRelayUsageBucket = "relayusage" // in kvMain: calleeID -> RelayUsage
+
+// sessions without traffic are removed after this time (the allocation lifetime)
+const turnRelaySessionIdleSecs = 600
+
+type RelayUsage struct {
+	Day string   // operationalNow() "2006-01-02"
+	Bytes int64  // relayed on Day
+	Quota int64  // 0 = turnRelayDailyBytes, -1 = unlimited
+}
+
+// TurnRelaySession is the relay traffic of one TURN client address
+type TurnRelaySession struct {
+	Username string
+	CalleeID string
+	Bytes int64
+	Dropped int64
+	LastActive int64 // unix secs
+	maxBytes int64
+	maxBytesPerSec int64
+	secStart int64   // unix secs of the current bitrate window
+	secBytes int64
+}
+
+// turnRelayUsage is the cached daily usage of a callee
+type turnRelayUsage struct {
+	RelayUsage
+	stored int64 // part of Bytes that is already stored in the db
+	limit int64  // resolved Quota (0 = unlimited)
+}
+
+const (
+	turnRelayPass = iota
+	turnRelayThrottle
+	turnRelayDrop
+)
+
+var turnRelayMutex sync.Mutex
+var turnRelaySessions = make(map[string]*TurnRelaySession) // client addr -> session
+var turnRelayUsages = make(map[string]*turnRelayUsage)     // calleeID -> today's usage
+var turnRelayBytesPassed int64   // since the last turnRelayFlush() (for metrics)
+var turnRelayBytesDropped int64
+
+func turnRelayDay() string {
+	return operationalNow().Format("2006-01-02")
+}
+
+// turnRelayLimit resolves the daily quota of a callee
+func turnRelayLimit(quota int64, dailyBytes int) int64 {
+	if quota<0 {
+		return 0
+	}
+	if quota>0 {
+		return quota
+	}
+	return int64(dailyBytes)
+}
+
+// turnRelayAuth is called by AuthHandler after the credentials of addr have been verified
+// it returns false if the callee has exceeded its daily quota
+func turnRelayAuth(addr string, username string, calleeID string) bool {
+	readConfigLock.RLock()
+	maxBytes := int64(turnRelayMaxBytes)
+	maxBytesPerSec := int64(turnRelayMaxKbps)*1000/8
+	dailyBytes := turnRelayDailyBytes
+	readConfigLock.RUnlock()
+
+	turnRelayMutex.Lock()
+	usage := turnRelayUsages[calleeID]
+	turnRelayMutex.Unlock()
+	if usage==nil {
+		// not cached yet: load today's usage and the quota of calleeID
+		day := turnRelayDay()
+		var relayUsage RelayUsage
+		err := kvMain.Get(dbRelayUsageBucket, calleeID, &relayUsage)
+		if err!=nil && !errors.Is(err, skv.ErrNotFound) {
+			logWarn("turn relay usage load", "calleeID",calleeID, "err",err)
+		}
+		if relayUsage.Day!=day {
+			relayUsage.Day = day
+			relayUsage.Bytes = 0
+		}
+		usage = &turnRelayUsage{RelayUsage:relayUsage, stored:relayUsage.Bytes,
+			limit:turnRelayLimit(relayUsage.Quota, dailyBytes)}
+	}
+
+	turnRelayMutex.Lock()
+	defer turnRelayMutex.Unlock()
+	if cached := turnRelayUsages[calleeID]; cached!=nil {
+		usage = cached
+	} else {
+		turnRelayUsages[calleeID] = usage
+	}
+	if usage.limit>0 && usage.Bytes>=usage.limit {
+		logInfo("turn relay daily quota exceeded", "calleeID",calleeID, "bytes",usage.Bytes, "quota",usage.limit)
+		// no session, so the error response will not be dropped
+		return false
+	}
+	session := turnRelaySessions[addr]
+	if session==nil || session.Username!=username {
+		session = &TurnRelaySession{Username:username, CalleeID:calleeID}
+		turnRelaySessions[addr] = session
+	}
+	session.LastActive = time.Now().Unix()
+	session.maxBytes = maxBytes
+	session.maxBytesPerSec = maxBytesPerSec
+	return true
+}
+
+// turnRelayCount accounts n bytes of client addr
+// it returns turnRelayPass, turnRelayThrottle (bitrate exceeded) or turnRelayDrop
+// stream: throttled bytes will be retried, they are not counted as dropped
+func turnRelayCount(addr string, n int, stream bool) int {
+	turnRelayMutex.Lock()
+	defer turnRelayMutex.Unlock()
+	session := turnRelaySessions[addr]
+	if session==nil {
+		// not authenticated
+		return turnRelayPass
+	}
+	count := int64(n)
+	now := time.Now().Unix()
+	session.LastActive = now
+	usage := turnRelayUsages[session.CalleeID]
+	if (session.maxBytes>0 && session.Bytes+count>session.maxBytes) ||
+			(usage!=nil && usage.limit>0 && usage.Bytes+count>usage.limit) {
+		session.Dropped += count
+		turnRelayBytesDropped += count
+		return turnRelayDrop
+	}
+	if session.maxBytesPerSec>0 {
+		if session.secStart!=now {
+			session.secStart = now
+			session.secBytes = 0
+		}
+		if session.secBytes>0 && session.secBytes+count>session.maxBytesPerSec {
+			if !stream {
+				session.Dropped += count
+				turnRelayBytesDropped += count
+			}
+			return turnRelayThrottle
+		}
+		session.secBytes += count
+	}
+	session.Bytes += count
+	if usage!=nil {
+		usage.Bytes += count
+	}
+	turnRelayBytesPassed += count
+	return turnRelayPass
+}
+
+// turnRelayBytes returns the relay bytes of the call with the given TURN username
+func turnRelayBytes(username string) int64 {
+	if username=="" {
+		return 0
+	}
+	var bytes int64
+	turnRelayMutex.Lock()
+	for _,session := range turnRelaySessions {
+		if session.Username==username {
+			bytes += session.Bytes
+		}
+	}
+	turnRelayMutex.Unlock()
+	return bytes
+}
+
+// turnRelayFlush is called by ticker30sec
+// it stores the new relay bytes of all callees and removes idle sessions
+func turnRelayFlush() {
+	readConfigLock.RLock()
+	dailyBytes := turnRelayDailyBytes
+	readConfigLock.RUnlock()
+
+	day := turnRelayDay()
+	timeNowUnix := time.Now().Unix()
+	deltas := make(map[string]RelayUsage) // calleeID -> the new bytes of Day
+	turnRelayMutex.Lock()
+	for addr,session := range turnRelaySessions {
+		if timeNowUnix - session.LastActive > turnRelaySessionIdleSecs {
+			delete(turnRelaySessions, addr)
+		}
+	}
+	activeCallees := make(map[string]bool)
+	for _,session := range turnRelaySessions {
+		activeCallees[session.CalleeID] = true
+	}
+	for calleeID,usage := range turnRelayUsages {
+		if usage.Bytes > usage.stored {
+			deltas[calleeID] = RelayUsage{Day:usage.Day, Bytes:usage.Bytes - usage.stored}
+			usage.stored = usage.Bytes
+		}
+		if !activeCallees[calleeID] {
+			delete(turnRelayUsages, calleeID)
+		} else if usage.Day!=day {
+			// new day: the sessions of calleeID continue to count into a new usage
+			turnRelayUsages[calleeID] = &turnRelayUsage{RelayUsage:RelayUsage{Day:day, Quota:usage.Quota},
+				limit:turnRelayLimit(usage.Quota, dailyBytes)}
+		} else {
+			usage.limit = turnRelayLimit(usage.Quota, dailyBytes)
+		}
+	}
+	bytesPassed, bytesDropped := turnRelayBytesPassed, turnRelayBytesDropped
+	turnRelayBytesPassed, turnRelayBytesDropped = 0, 0
+	turnRelayMutex.Unlock()
+
+	if bytesPassed>0 {
+		metricsTurnRelayBytesTotal.Add("relayed", float64(bytesPassed))
+	}
+	if bytesDropped>0 {
+		metricsTurnRelayBytesTotal.Add("dropped", float64(bytesDropped))
+	}
+
+	for calleeID,delta := range deltas {
+		turnRelayUsageModify(calleeID, func(relayUsage *RelayUsage) {
+			if relayUsage.Day!=delta.Day {
+				if relayUsage.Day > delta.Day {
+					// the db already holds a newer day
+					return
+				}
+				relayUsage.Day = delta.Day
+				relayUsage.Bytes = 0
+			}
+			relayUsage.Bytes += delta.Bytes
+		})
+	}
+}
+
+var turnRelayUsageMutex sync.Mutex
+
+// turnRelayUsageModify does a read-modify-write of the stored RelayUsage of calleeID
+func turnRelayUsageModify(calleeID string, modify func(*RelayUsage)) (RelayUsage,error) {
+	turnRelayUsageMutex.Lock()
+	defer turnRelayUsageMutex.Unlock()
+	var relayUsage RelayUsage
+	err := kvMain.Get(dbRelayUsageBucket, calleeID, &relayUsage)
+	if err!=nil && !errors.Is(err, skv.ErrNotFound) {
+		logWarn("turn relay usage load", "calleeID",calleeID, "err",err)
+		return relayUsage, err
+	}
+	modify(&relayUsage)
+	err = kvMain.Put(dbRelayUsageBucket, calleeID, relayUsage, false)
+	if err!=nil {
+		logWarn("turn relay usage store", "calleeID",calleeID, "err",err)
+	}
+	return relayUsage, err
+}
+
+// turnRelayQuotaSet sets the daily quota of calleeID (0 = default, -1 = unlimited)
+func turnRelayQuotaSet(calleeID string, quota int64) (RelayUsage,error) {
+	relayUsage,err := turnRelayUsageModify(calleeID, func(relayUsage *RelayUsage) {
+		relayUsage.Quota = quota
+	})
+	if err!=nil {
+		return relayUsage, err
+	}
+	readConfigLock.RLock()
+	dailyBytes := turnRelayDailyBytes
+	readConfigLock.RUnlock()
+	turnRelayMutex.Lock()
+	if usage := turnRelayUsages[calleeID]; usage!=nil {
+		usage.Quota = quota
+		usage.limit = turnRelayLimit(quota, dailyBytes)
+	}
+	turnRelayMutex.Unlock()
+	return relayUsage, nil
+}
+
+// turnRelayUsageDelete is called when a user is deleted
+func turnRelayUsageDelete(calleeID string) {
+	turnRelayUsageMutex.Lock()
+	defer turnRelayUsageMutex.Unlock()
+	err := kvMain.Delete(dbRelayUsageBucket, calleeID)
+	if err!=nil && !errors.Is(err, skv.ErrNotFound) {
+		logWarn("turn relay usage delete", "calleeID",calleeID, "err",err)
+	}
+}
+
+// turnRelayPacketConn wraps the UDP listener of the TURN server
+type turnRelayPacketConn struct {
+	net.PacketConn
+}
+
+func (c *turnRelayPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err!=nil || addr==nil || turnRelayCount(addr.String(), n, false)==turnRelayPass {
+			return n, addr, err
+		}
+		// over limit: drop
+	}
+}
+
+func (c *turnRelayPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if turnRelayCount(addr.String(), len(p), false)!=turnRelayPass {
+		// over limit: drop
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// turnRelayListener wraps the TCP and TLS listeners of the TURN server
+type turnRelayListener struct {
+	net.Listener
+}
+
+func (l *turnRelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err!=nil {
+		return conn, err
+	}
+	return &turnRelayConn{Conn:conn, addr:conn.RemoteAddr().String()}, nil
+}
+
+type turnRelayConn struct {
+	net.Conn
+	addr string
+}
+
+var errTurnRelayLimit = errors.New("turn relay limit exceeded")
+
+// count accounts n bytes; a stream cannot drop data, so it is throttled or closed
+func (c *turnRelayConn) count(n int) error {
+	for {
+		switch turnRelayCount(c.addr, n, true) {
+		case turnRelayPass:
+			return nil
+		case turnRelayThrottle:
+			time.Sleep(100 * time.Millisecond)
+		default:
+			c.Conn.Close()
+			return errTurnRelayLimit
+		}
+	}
+}
+
+func (c *turnRelayConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n>0 {
+		if err2 := c.count(n); err2!=nil {
+			return 0, err2
+		}
+	}
+	return n, err
+}
+
+func (c *turnRelayConn) Write(p []byte) (int, error) {
+	if err := c.count(len(p)); err!=nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
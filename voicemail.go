@@ -0,0 +1,455 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Voicemail.
+// If a callee has enabled voicemail (setting "voicemail", DbUser.Int2 bit16), a caller
+// can record an audio message after the ring timeout, after the call was denied,
+// or while the callee is offline. The caller page asks first:
+//   GET "/rtcsig/voicemail?id=calleeID&callerId=" -> "ok|maxSecs", "full" or "no"
+// and then uploads the recording (Content-Type audio/...):
+//   POST "/rtcsig/voicemail?id=calleeID&callerId=&callerName=&callerHost=&msg=&duration="
+//     -> "ok", "full", "toolarge" or "no"
+// Audio files are stored in voicemailPath (named calleeID_voicemailID), the list of
+// voicemails in kvCalls/dbVoicemailBucket. Limits (config keywords): voicemailMaxSecs
+// per message (0 disables voicemail), voicemailMaxBytes per message, voicemailMaxCount
+// and voicemailQuotaBytes per callee. Voicemails older than voicemailRetentionDays
+// are deleted by ticker3hours. A new voicemail is sent to the callee as
+// "voicemail|unreadCount" (if online) and emitted as event "voicemail".
+// Endpoints (cookie or bearer token auth):
+//   GET "/api/v1/voicemail" -> [Voicemail,..] (newest first)
+//   GET "/api/v1/voicemail/{id}" -> audio
+//   PUT "/api/v1/voicemail/{id}" {"read":true}
+//   DELETE "/api/v1/voicemail/{id}"
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dbVoicemailBucket = "voicemail" // in kvCalls: calleeID -> []Voicemail
+
+const voicemailMsgMaxLen = 137 // same as msgBoxMaxLen in caller.js
+
+var voicemailStore = newCalleeStore(&kvCalls, dbVoicemailBucket)
+
+var errVoicemailFull = errors.New("voicemail full")
+
+type Voicemail struct {
+	ID string `json:"id"`
+	Time int64 `json:"time"`
+	CallerID string `json:"callerId,omitempty"`
+	CallerName string `json:"callerName,omitempty"`
+	CallerHost string `json:"callerHost,omitempty"`
+	Msg string `json:"msg,omitempty"`
+	Duration int `json:"duration"` // secs (as reported by the caller)
+	Size int `json:"size"`         // bytes
+	Mime string `json:"mime"`
+	Read bool `json:"read"`
+}
+
+type ApiVoicemailUpdate struct {
+	Read *bool `json:"read,omitempty"`
+}
+
+// voicemailEnabled returns true if the user has turned on voicemail
+func voicemailEnabled(dbUser DbUser) bool {
+	return dbUser.Int2&16==16 // bit16 set for voicemail
+}
+
+// voicemailAudioMime returns true if mime is a plain audio/subtype without parameters
+func voicemailAudioMime(mime string) bool {
+	if !strings.HasPrefix(mime,"audio/") || len(mime)<=len("audio/") || len(mime)>64 {
+		return false
+	}
+	for _,c := range mime[len("audio/"):] {
+		if !(c>='a' && c<='z' || c>='0' && c<='9' || c=='-' || c=='.' || c=='+') {
+			return false
+		}
+	}
+	return true
+}
+
+func voicemailFile(calleeID string, id string) string {
+	return voicemailPath+calleeID+"_"+id
+}
+
+func voicemailLoad(calleeID string) ([]Voicemail, error) {
+	var voicemails []Voicemail
+	_,err := voicemailStore.load(calleeID, &voicemails)
+	return voicemails, err
+}
+
+// voicemailRemoveFiles removes the files of the voicemails of calleeID for which remove returns true
+// and returns the remaining voicemails
+func voicemailRemoveFiles(calleeID string, voicemails []Voicemail, remove func(voicemail Voicemail) bool) []Voicemail {
+	var keep []Voicemail
+	for _,voicemail := range voicemails {
+		if !remove(voicemail) {
+			keep = append(keep, voicemail)
+			continue
+		}
+		err := os.Remove(voicemailFile(calleeID, voicemail.ID))
+		if err!=nil && !os.IsNotExist(err) {
+			logError("voicemail remove file", "calleeID",calleeID, "id",voicemail.ID, "err",err)
+		}
+	}
+	return keep
+}
+
+// voicemailCheck returns "ok|maxSecs", "full" or "no" for a caller of calleeID
+// with size>0 it also checks if a recording of this size still fits
+func voicemailCheck(calleeID string, attempt CallAttempt, size int) string {
+	readConfigLock.RLock()
+	maxSecs := voicemailMaxSecs
+	maxCount := voicemailMaxCount
+	quotaBytes := voicemailQuotaBytes
+	readConfigLock.RUnlock()
+	if maxSecs<=0 || calleeID=="" || strings.HasPrefix(calleeID,"answie") || strings.HasPrefix(calleeID,"talkback") {
+		return "no"
+	}
+	_,dbUser,err := apiGetDbUser(calleeID)
+	if err!=nil || !voicemailEnabled(dbUser) {
+		return "no"
+	}
+	if callFilterCheck(calleeID, attempt)!="" {
+		return "no"
+	}
+	voicemails,err := voicemailLoad(calleeID)
+	if err!=nil {
+		logError("voicemail load", "calleeID",calleeID, "err",err)
+		return "no"
+	}
+	totalBytes := 0
+	for _,voicemail := range voicemails {
+		totalBytes += voicemail.Size
+	}
+	if len(voicemails)>=maxCount || totalBytes+size>quotaBytes {
+		return "full"
+	}
+	return "ok|"+strconv.Itoa(maxSecs)
+}
+
+// httpVoicemail serves GET and POST "/rtcsig/voicemail" for the caller
+func httpVoicemail(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr string) {
+	query := r.URL.Query()
+	attempt := CallAttempt{
+		CallerID: strings.TrimSpace(query.Get("callerId")),
+		CallerName: strings.TrimSpace(query.Get("callerName")),
+		Msg: strings.TrimSpace(query.Get("msg")),
+		Ip: remoteAddr,
+		Stage: "voicemail",
+	}
+	callerHost := strings.TrimSpace(query.Get("callerHost"))
+	if attempt.CallerID!="" && callerHost!="" && callerHost!=hostname &&
+			strings.Index(attempt.CallerID,"@")<0 {
+		attempt.CallerID += "@"+callerHost
+	}
+	if len(attempt.CallerName)>40 {
+		attempt.CallerName = attempt.CallerName[:40]
+	}
+	if len(attempt.Msg)>voicemailMsgMaxLen {
+		attempt.Msg = attempt.Msg[:voicemailMsgMaxLen]
+	}
+
+	if r.Method!="POST" {
+		fmt.Fprint(w, voicemailCheck(urlID, attempt, 0))
+		return
+	}
+
+	readConfigLock.RLock()
+	maxSecs := voicemailMaxSecs
+	maxBytes := voicemailMaxBytes
+	readConfigLock.RUnlock()
+	mime := r.Header.Get("Content-Type")
+	if idx := strings.Index(mime,";"); idx>=0 {
+		mime = mime[:idx]
+	}
+	mime = strings.TrimSpace(strings.ToLower(mime))
+	if !voicemailAudioMime(mime) {
+		logWarn("/voicemail no audio", "calleeID",urlID, "rip",remoteAddr, "mime",mime)
+		fmt.Fprintf(w,"no")
+		return
+	}
+	duration,_ := strconv.Atoi(query.Get("duration"))
+	if duration<0 || duration>maxSecs+2 {
+		logWarn("/voicemail duration", "calleeID",urlID, "rip",remoteAddr, "duration",duration)
+		fmt.Fprintf(w,"toolarge")
+		return
+	}
+	data,err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err!=nil {
+		logWarn("/voicemail read", "calleeID",urlID, "rip",remoteAddr, "err",err)
+		fmt.Fprintf(w,"no")
+		return
+	}
+	if len(data)>maxBytes {
+		logWarn("/voicemail too large", "calleeID",urlID, "rip",remoteAddr, "max",maxBytes)
+		fmt.Fprintf(w,"toolarge")
+		return
+	}
+	if len(data)==0 {
+		fmt.Fprintf(w,"no")
+		return
+	}
+
+	check := voicemailCheck(urlID, attempt, len(data))
+	if !strings.HasPrefix(check,"ok") {
+		if check=="no" {
+			callFilter(urlID, attempt) // log the attempt if it is blocked by the call filter
+		}
+		logInfo("/voicemail denied", "calleeID",urlID, "rip",remoteAddr, "result",check)
+		fmt.Fprint(w,check)
+		return
+	}
+
+	voicemail := Voicemail{
+		ID: strconv.FormatInt(time.Now().UnixNano(),36),
+		Time: time.Now().Unix(),
+		CallerID: attempt.CallerID,
+		CallerName: attempt.CallerName,
+		CallerHost: callerHost,
+		Msg: attempt.Msg,
+		Duration: duration,
+		Size: len(data),
+		Mime: mime,
+	}
+	err = os.MkdirAll(strings.TrimSuffix(voicemailPath,"/"), 0700)
+	if err==nil {
+		err = os.WriteFile(voicemailFile(urlID, voicemail.ID), data, 0600)
+	}
+	if err!=nil {
+		logError("/voicemail write", "calleeID",urlID, "err",err)
+		fmt.Fprintf(w,"no")
+		return
+	}
+
+	unread := 0
+	err = voicemailAdd(urlID, voicemail, &unread)
+	if err!=nil {
+		os.Remove(voicemailFile(urlID, voicemail.ID))
+		if err==errVoicemailFull {
+			fmt.Fprintf(w,"full")
+			return
+		}
+		logError("/voicemail store", "calleeID",urlID, "err",err)
+		fmt.Fprintf(w,"no")
+		return
+	}
+	logInfo("/voicemail stored", "calleeID",urlID, "callerID",voicemail.CallerID, "rip",remoteAddr,
+		"secs",duration, "size",len(data), "mime",mime)
+	emitEvent(Event{Type:"voicemail", CalleeID:urlID, CallerID:voicemail.CallerID,
+		CallerName:voicemail.CallerName, Duration:int64(duration)})
+
+	// let the callee client know (if online)
+	hubMapMutex.RLock()
+	hub := hubMap[urlID]
+	hubMapMutex.RUnlock()
+	if hub!=nil {
+		hub.HubMutex.RLock()
+		if hub.CalleeClient!=nil {
+			hub.CalleeClient.Write([]byte("voicemail|"+strconv.Itoa(unread)))
+		}
+		hub.HubMutex.RUnlock()
+	}
+	fmt.Fprintf(w,"ok")
+}
+
+// voicemailAdd appends voicemail to the list of calleeID (if the quota allows) and returns the unread count
+func voicemailAdd(calleeID string, voicemail Voicemail, unread *int) error {
+	readConfigLock.RLock()
+	maxCount := voicemailMaxCount
+	quotaBytes := voicemailQuotaBytes
+	readConfigLock.RUnlock()
+	var voicemails []Voicemail
+	return voicemailStore.modify(calleeID, &voicemails, func(bool) (bool,error) {
+		totalBytes := voicemail.Size
+		for _,entry := range voicemails {
+			totalBytes += entry.Size
+			if !entry.Read {
+				*unread++
+			}
+		}
+		if len(voicemails)>=maxCount || totalBytes>quotaBytes {
+			return false, errVoicemailFull
+		}
+		*unread++
+		voicemails = append(voicemails, voicemail)
+		return true, nil
+	})
+}
+
+// voicemailUnread returns the number of unread voicemails of calleeID
+func voicemailUnread(calleeID string) int {
+	voicemails,err := voicemailLoad(calleeID)
+	if err!=nil {
+		logError("voicemail load", "calleeID",calleeID, "err",err)
+		return 0
+	}
+	unread := 0
+	for _,voicemail := range voicemails {
+		if !voicemail.Read {
+			unread++
+		}
+	}
+	return unread
+}
+
+// voicemailRemove removes the voicemails of calleeID for which remove returns true (incl. their files)
+func voicemailRemove(calleeID string, remove func(voicemail Voicemail) bool) (int, error) {
+	removed := 0
+	var voicemails []Voicemail
+	err := voicemailStore.modify(calleeID, &voicemails, func(bool) (bool,error) {
+		keep := voicemailRemoveFiles(calleeID, voicemails, remove)
+		removed = len(voicemails)-len(keep)
+		voicemails = keep
+		return removed>0, nil
+	})
+	if err!=nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// voicemailDelete removes all voicemails of calleeID
+func voicemailDelete(calleeID string) {
+	_,err := voicemailRemove(calleeID, func(voicemail Voicemail) bool { return true })
+	if err!=nil {
+		logError("voicemail delete", "calleeID",calleeID, "err",err)
+	}
+}
+
+// voicemailExpire removes voicemails older than voicemailRetentionDays (called by ticker3hours)
+func voicemailExpire() {
+	readConfigLock.RLock()
+	retentionDays := voicemailRetentionDays
+	readConfigLock.RUnlock()
+	if retentionDays<=0 {
+		return
+	}
+	expireTime := time.Now().Unix() - int64(retentionDays)*24*60*60
+	countRemoved := 0
+	_,err := voicemailStore.prune(func() interface{} { return &[]Voicemail{} },
+		func(calleeID string, value interface{}) bool {
+			voicemails := value.(*[]Voicemail)
+			keep := voicemailRemoveFiles(calleeID, *voicemails, func(voicemail Voicemail) bool {
+				return voicemail.Time < expireTime
+			})
+			removed := len(*voicemails)-len(keep)
+			*voicemails = keep
+			countRemoved += removed
+			return removed>0
+		})
+	if err!=nil {
+		logError("voicemail expire", "err",err)
+	}
+	if countRemoved>0 {
+		logInfo("voicemail expired", "count",countRemoved, "days",retentionDays)
+	}
+}
+
+// apiVoicemails serves GET "/api/v1/voicemail"
+func apiVoicemails(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	voicemails,err := voicemailLoad(calleeID)
+	if err!=nil {
+		logError("/api/v1/voicemail get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	list := make([]Voicemail, 0, len(voicemails))
+	for i := len(voicemails)-1; i>=0; i-- {
+		list = append(list, voicemails[i])
+	}
+	apiJson(w, http.StatusOK, list)
+}
+
+// apiVoicemail serves GET (audio), PUT and DELETE "/api/v1/voicemail/{id}"
+func apiVoicemail(w http.ResponseWriter, r *http.Request, calleeID string, id string, remoteAddr string) {
+	if r.Method=="DELETE" {
+		removed,err := voicemailRemove(calleeID, func(voicemail Voicemail) bool {
+			return voicemail.ID==id
+		})
+		if err!=nil {
+			logError("/api/v1/voicemail delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		if removed==0 {
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		logInfo("/api/v1/voicemail delete", "calleeID",calleeID, "id",id, "rip",remoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method=="PUT" {
+		var req ApiVoicemailUpdate
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		var updated *Voicemail
+		var voicemails []Voicemail
+		err := voicemailStore.modify(calleeID, &voicemails, func(bool) (bool,error) {
+			for idx := range voicemails {
+				if voicemails[idx].ID==id {
+					if req.Read!=nil {
+						voicemails[idx].Read = *req.Read
+					}
+					updated = &voicemails[idx]
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+		if err!=nil {
+			logError("/api/v1/voicemail put", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, http.StatusInternalServerError, "internal", "")
+			return
+		}
+		if updated==nil {
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		apiJson(w, http.StatusOK, *updated)
+		return
+	}
+
+	// GET: the audio
+	voicemails,err := voicemailLoad(calleeID)
+	if err!=nil {
+		logError("/api/v1/voicemail get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	for _,voicemail := range voicemails {
+		if voicemail.ID!=id {
+			continue
+		}
+		file,err := os.Open(voicemailFile(calleeID, id))
+		if err!=nil {
+			logError("/api/v1/voicemail open", "calleeID",calleeID, "id",id, "err",err)
+			apiError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+		defer file.Close()
+		mime := voicemail.Mime
+		if !voicemailAudioMime(mime) {
+			// stored before uploads were checked this strictly
+			mime = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", mime)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-store")
+		// ServeContent supports range requests (needed by audio elements for seeking)
+		http.ServeContent(w, r, "", time.Unix(voicemail.Time,0), file)
+		return
+	}
+	apiError(w, http.StatusNotFound, "not_found", "")
+}
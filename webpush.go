@@ -0,0 +1,583 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Web Push notifications for offline callees.
+// webpushSend() delivers a message to a push service endpoint: the request
+// is authorized with a VAPID JWT (RFC 8292, ES256) and the payload is
+// encrypted with aes128gcm (RFC 8291, RFC 8188). Config keywords
+// vapidPublicKey and vapidPrivateKey hold the server's P-256 key pair
+// (base64url, as generated by "/rtcsig/genvapidkeys" from localhost).
+//
+// Every callee can register up to webPushMaxDevices (default 10) push
+// subscriptions (the JSON of a browser PushSubscription), stored in
+// kvNotif/dbWebPushBucket. The oldest device is removed when a new one
+// exceeds the limit. Subscriptions that the push service reports as
+// expired (404, 410) are removed automatically. The two legacy device
+// subscriptions in DbUser.Str2 and Str3 are moved into the bucket on use.
+// Push service endpoints must be https urls of public hosts (see notifyCheckUrl);
+// webpushClient does not connect to internal addresses.
+//
+// Endpoints (cookie or bearer token auth):
+//   POST "/rtcsig/webpushsubscribe?ua=" body = subscription JSON -> device id
+//   POST "/rtcsig/webpushunsubscribe?device=" (or body = subscription JSON)
+//   GET "/api/v1/webpush" -> {"vapidPublicKey":..,"devices":[..]}
+//   POST "/api/v1/webpush" {"subscription":{..},"ua":..} -> device
+//   DELETE "/api/v1/webpush/{id}"
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/crypto/hkdf"
+)
+
+const dbWebPushBucket = "webpush" // in kvNotif: calleeID -> []WebPushDevice
+
+const webpushTTL = 60 // secs the push service may hold back an undelivered message
+const webpushRecordSize = 4096
+const webpushMaxPayload = webpushRecordSize - 16 - 1 - 100 // minus tag, delimiter, safety margin
+
+var webpushWelcomeMsg = "You will from now on receive a WebPush notification for every call"+
+	" you receive while not being connected to the WebCall server."
+
+// push services are public hosts, so the requests go through the restricted notifyClient
+var webpushClient = notifyClient
+
+var webpushStore = newCalleeStore(&kvNotif, dbWebPushBucket)
+
+// parsed vapidPrivateKey, see webpushVapidKey()
+var webpushVapidCache struct {
+	sync.Mutex
+	config string
+	key *ecdsa.PrivateKey
+	publicKey string
+}
+
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys struct {
+		P256dh string `json:"p256dh"`
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+type WebPushDevice struct {
+	Id string `json:"id"`
+	Subscription WebPushSubscription `json:"subscription"`
+	UA string `json:"ua"`
+	Created int64 `json:"created"`    // unix secs
+	LastUsed int64 `json:"lastUsed"`  // unix secs of the last successful delivery
+}
+
+// webpushDecode decodes base64url (as used by browsers) and standard base64, with or without padding
+func webpushDecode(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+","-", "/","_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func webpushEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// webpushParseSubscription decodes and validates the JSON of a PushSubscription
+func webpushParseSubscription(data []byte) (WebPushSubscription, error) {
+	var sub WebPushSubscription
+	err := json.Unmarshal(data, &sub)
+	if err!=nil {
+		return sub, err
+	}
+	u,err := notifyCheckUrl(sub.Endpoint)
+	if err==nil && u.Scheme!="https" {
+		err = errors.New("url must be https")
+	}
+	if err!=nil {
+		return sub, errors.New("invalid endpoint: "+err.Error())
+	}
+	uaPublic,err := webpushDecode(sub.Keys.P256dh)
+	if err!=nil || len(uaPublic)!=65 || uaPublic[0]!=4 {
+		return sub, errors.New("invalid p256dh key")
+	}
+	authSecret,err := webpushDecode(sub.Keys.Auth)
+	if err!=nil || len(authSecret)!=16 {
+		return sub, errors.New("invalid auth secret")
+	}
+	return sub, nil
+}
+
+func webpushDeviceID(endpoint string) string {
+	hash := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(hash[:8])
+}
+
+// webpushVapidKey returns the parsed vapidPrivateKey and the matching public key (base64url)
+func webpushVapidKey() (*ecdsa.PrivateKey, string, error) {
+	readConfigLock.RLock()
+	privateKey := vapidPrivateKey
+	publicKey := vapidPublicKey
+	readConfigLock.RUnlock()
+	if privateKey=="" {
+		return nil, "", errors.New("no vapidPrivateKey")
+	}
+
+	webpushVapidCache.Lock()
+	defer webpushVapidCache.Unlock()
+	if webpushVapidCache.key!=nil && webpushVapidCache.config==privateKey {
+		return webpushVapidCache.key, webpushVapidCache.publicKey, nil
+	}
+	d,err := webpushDecode(privateKey)
+	if err!=nil || len(d)!=32 {
+		return nil, "", errors.New("invalid vapidPrivateKey")
+	}
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+	derivedPublicKey := webpushEncode(elliptic.Marshal(curve, key.PublicKey.X, key.PublicKey.Y))
+	if publicKey!="" && strings.TrimRight(publicKey,"=")!=derivedPublicKey {
+		logWarn("webpush vapidPublicKey does not match vapidPrivateKey; using the derived public key")
+	}
+	webpushVapidCache.config = privateKey
+	webpushVapidCache.key = key
+	webpushVapidCache.publicKey = derivedPublicKey
+	return key, derivedPublicKey, nil
+}
+
+// webpushGenerateVapidKeys returns a new vapidPublicKey and vapidPrivateKey (base64url)
+func webpushGenerateVapidKeys() (string, string, error) {
+	curve := elliptic.P256()
+	d,x,y,err := elliptic.GenerateKey(curve, rand.Reader)
+	if err!=nil {
+		return "", "", err
+	}
+	return webpushEncode(elliptic.Marshal(curve, x, y)), webpushEncode(d), nil
+}
+
+// webpushVapidAuth returns the Authorization header value for a request to endpoint
+func webpushVapidAuth(endpoint string) (string, error) {
+	key,publicKey,err := webpushVapidKey()
+	if err!=nil {
+		return "", err
+	}
+	u,err := url.Parse(endpoint)
+	if err!=nil {
+		return "", err
+	}
+	readConfigLock.RLock()
+	subject := "mailto:"+adminEmail
+	if adminEmail=="" {
+		subject = "https://"+hostname
+	}
+	readConfigLock.RUnlock()
+	claims,err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme+"://"+u.Host,
+		"exp": time.Now().Add(12*time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err!=nil {
+		return "", err
+	}
+	signingInput := webpushEncode([]byte(`{"typ":"JWT","alg":"ES256"}`))+"."+webpushEncode(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	r,s,err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err!=nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return "vapid t="+signingInput+"."+webpushEncode(signature)+", k="+publicKey, nil
+}
+
+// webpushEncrypt encrypts plaintext for the subscription as a single aes128gcm record (RFC 8291)
+func webpushEncrypt(sub WebPushSubscription, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > webpushMaxPayload {
+		return nil, errors.New("payload too large")
+	}
+	uaPublic,err := webpushDecode(sub.Keys.P256dh)
+	if err!=nil {
+		return nil, err
+	}
+	authSecret,err := webpushDecode(sub.Keys.Auth)
+	if err!=nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	uaX,uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX==nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+
+	// ephemeral application server key pair and ECDH shared secret
+	asPrivate,asX,asY,err := elliptic.GenerateKey(curve, rand.Reader)
+	if err!=nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sharedX,_ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := make([]byte, 32)
+	if _,err = io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err!=nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _,err = rand.Read(salt); err!=nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _,err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err!=nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _,err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err!=nil {
+		return nil, err
+	}
+
+	block,err := aes.NewCipher(cek)
+	if err!=nil {
+		return nil, err
+	}
+	gcm,err := cipher.NewGCM(block)
+	if err!=nil {
+		return nil, err
+	}
+	// header: salt (16) | record size (4) | key id length (1) | key id = as_public (65)
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(plaintext)+1+gcm.Overhead())
+	body = append(body, salt...)
+	body = append(body, 0,0,0,0)
+	binary.BigEndian.PutUint32(body[16:20], webpushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	// 0x02 is the padding delimiter of the last (and only) record
+	record := append(append([]byte{}, plaintext...), 2)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// webpushSend delivers msg to the push service of the subscription
+// it returns the http status code of the push service (201 = created)
+func webpushSend(sub WebPushSubscription, msg string, urlID string) (error,int) {
+	body,err := webpushEncrypt(sub, []byte(msg))
+	if err!=nil {
+		return err, 0
+	}
+	auth,err := webpushVapidAuth(sub.Endpoint)
+	if err!=nil {
+		return err, 0
+	}
+	req,err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err!=nil {
+		return err, 0
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprintf("%d",webpushTTL))
+	req.Header.Set("Urgency", "high")
+	resp,err := webpushClient.Do(req)
+	if err!=nil {
+		return err, 0
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	logDebug("webpush", "webpushSend", "calleeID",urlID, "status",resp.StatusCode,
+		"endpoint",webpushDeviceID(sub.Endpoint))
+	return nil, resp.StatusCode
+}
+
+// webpushDevices returns the push subscriptions of calleeID
+func webpushDevices(calleeID string) ([]WebPushDevice, error) {
+	var devices []WebPushDevice
+	_,err := webpushStore.load(calleeID, &devices)
+	return devices, err
+}
+
+// webpushAddDevice stores a subscription for calleeID (replacing one with the same endpoint)
+func webpushAddDevice(calleeID string, sub WebPushSubscription, ua string) (WebPushDevice, error) {
+	readConfigLock.RLock()
+	maxDevices := webPushMaxDevices
+	readConfigLock.RUnlock()
+	if len(ua)>200 {
+		ua = ua[:200]
+	}
+	device := WebPushDevice{Id:webpushDeviceID(sub.Endpoint), Subscription:sub, UA:ua, Created:time.Now().Unix()}
+
+	var devices []WebPushDevice
+	err := webpushStore.modify(calleeID, &devices, func(bool) (bool,error) {
+		for idx := range devices {
+			if devices[idx].Id==device.Id {
+				devices = append(devices[:idx], devices[idx+1:]...)
+				break
+			}
+		}
+		devices = append(devices, device)
+		if maxDevices>0 && len(devices) > maxDevices {
+			// remove the oldest devices
+			devices = devices[len(devices)-maxDevices:]
+		}
+		return true, nil
+	})
+	return device, err
+}
+
+// webpushRemoveDevices removes the devices with the given ids; it returns the number of removed devices
+func webpushRemoveDevices(calleeID string, ids ...string) (int, error) {
+	removed := 0
+	var devices []WebPushDevice
+	err := webpushStore.modify(calleeID, &devices, func(bool) (bool,error) {
+		var kept []WebPushDevice
+		for _,device := range devices {
+			remove := false
+			for _,id := range ids {
+				if device.Id==id {
+					remove = true
+					break
+				}
+			}
+			if !remove {
+				kept = append(kept, device)
+			}
+		}
+		removed = len(devices)-len(kept)
+		devices = kept
+		return removed>0, nil
+	})
+	return removed, err
+}
+
+// webpushMigrate moves the legacy subscriptions from dbUser.Str2/Str3 into dbWebPushBucket
+// it returns true if dbUser was modified (and needs to be stored by the caller)
+func webpushMigrate(calleeID string, dbUser *DbUser) bool {
+	modified := false
+	for _,legacy := range []struct{ subscription *string; ua *string }{
+			{&dbUser.Str2,&dbUser.Str2ua}, {&dbUser.Str3,&dbUser.Str3ua}} {
+		if *legacy.subscription=="" {
+			continue
+		}
+		sub,err := webpushParseSubscription([]byte(*legacy.subscription))
+		if err!=nil {
+			logWarn("webpush drop invalid legacy subscription", "calleeID",calleeID, "err",err)
+		} else if _,err = webpushAddDevice(calleeID, sub, *legacy.ua); err!=nil {
+			logError("webpush migrate legacy subscription", "calleeID",calleeID, "err",err)
+			continue
+		}
+		*legacy.subscription = ""
+		*legacy.ua = ""
+		modified = true
+	}
+	return modified
+}
+
+// webpushNotify sends msg to all push devices of calleeID
+// subscriptions reported as expired are removed; it returns the number of successful deliveries
+func webpushNotify(calleeID string, msg string) int {
+	devices,err := webpushDevices(calleeID)
+	if err!=nil {
+		logError("webpush get devices", "calleeID",calleeID, "err",err)
+		return 0
+	}
+	sent := 0
+	var expired []string
+	var delivered []string
+	for _,device := range devices {
+		err,statusCode := webpushSend(device.Subscription, msg, calleeID)
+		if err!=nil {
+			logWarn("webpush send fail", "calleeID",calleeID, "device",device.Id, "err",err)
+		} else if statusCode>=200 && statusCode<300 {
+			sent++
+			delivered = append(delivered, device.Id)
+		} else if statusCode==404 || statusCode==410 {
+			logInfo("webpush subscription expired, delete", "calleeID",calleeID, "device",device.Id,
+				"status",statusCode)
+			expired = append(expired, device.Id)
+		} else {
+			logWarn("webpush send fail", "calleeID",calleeID, "device",device.Id, "status",statusCode)
+		}
+	}
+	if len(expired)>0 {
+		if _,err = webpushRemoveDevices(calleeID, expired...); err!=nil {
+			logError("webpush remove expired devices", "calleeID",calleeID, "err",err)
+		}
+	}
+	if len(delivered)>0 {
+		webpushTouchDevices(calleeID, delivered)
+	}
+	return sent
+}
+
+// webpushTouchDevices sets LastUsed of the given devices
+func webpushTouchDevices(calleeID string, ids []string) {
+	timeNow := time.Now().Unix()
+	var devices []WebPushDevice
+	err := webpushStore.modify(calleeID, &devices, func(bool) (bool,error) {
+		touched := false
+		for idx := range devices {
+			for _,id := range ids {
+				if devices[idx].Id==id {
+					devices[idx].LastUsed = timeNow
+					touched = true
+				}
+			}
+		}
+		return touched, nil
+	})
+	if err!=nil {
+		logError("webpush touch devices", "calleeID",calleeID, "err",err)
+	}
+}
+
+// webpushSubscribe registers a subscription and sends a welcome message to it
+func webpushSubscribe(calleeID string, data []byte, ua string) (WebPushDevice, int, error) {
+	sub,err := webpushParseSubscription(data)
+	if err!=nil {
+		return WebPushDevice{}, http.StatusBadRequest, err
+	}
+	if _,_,err = webpushVapidKey(); err!=nil {
+		return WebPushDevice{}, http.StatusServiceUnavailable, err
+	}
+	err,statusCode := webpushSend(sub, webpushWelcomeMsg, calleeID)
+	if err!=nil {
+		return WebPushDevice{}, http.StatusBadGateway, err
+	}
+	if statusCode<200 || statusCode>=300 {
+		return WebPushDevice{}, http.StatusBadGateway, fmt.Errorf("push service status %d",statusCode)
+	}
+	device,err := webpushAddDevice(calleeID, sub, ua)
+	if err!=nil {
+		return device, http.StatusInternalServerError, err
+	}
+	device.LastUsed = time.Now().Unix()
+	return device, http.StatusOK, nil
+}
+
+func httpWebPushSubscribe(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if calleeID=="" || cookie==nil || (urlID!="" && urlID!=calleeID) {
+		logWarn("/webpushsubscribe no auth", "urlID",urlID, "calleeID",calleeID, "rip",remoteAddr)
+		return
+	}
+	data,err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err!=nil {
+		logWarn("/webpushsubscribe read body", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		return
+	}
+	ua := r.URL.Query().Get("ua")
+	if ua=="" {
+		ua = r.UserAgent()
+	}
+	device,_,err := webpushSubscribe(calleeID, data, ua)
+	if err!=nil {
+		logWarn("/webpushsubscribe fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	logInfo("/webpushsubscribe", "calleeID",calleeID, "device",device.Id, "rip",remoteAddr)
+	fmt.Fprintf(w,device.Id)
+}
+
+func httpWebPushUnsubscribe(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if calleeID=="" || cookie==nil || (urlID!="" && urlID!=calleeID) {
+		logWarn("/webpushunsubscribe no auth", "urlID",urlID, "calleeID",calleeID, "rip",remoteAddr)
+		return
+	}
+	id := r.URL.Query().Get("device")
+	if id=="" {
+		data,err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+		if err==nil {
+			var sub WebPushSubscription
+			if json.Unmarshal(data, &sub)==nil && sub.Endpoint!="" {
+				id = webpushDeviceID(sub.Endpoint)
+			}
+		}
+	}
+	removed,err := webpushRemoveDevices(calleeID, id)
+	if err!=nil {
+		logError("/webpushunsubscribe", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	if removed==0 {
+		fmt.Fprintf(w,"notfound")
+		return
+	}
+	logInfo("/webpushunsubscribe", "calleeID",calleeID, "device",id, "rip",remoteAddr)
+	fmt.Fprintf(w,"ok")
+}
+
+type ApiWebPush struct {
+	VapidPublicKey string `json:"vapidPublicKey"`
+	Devices []WebPushDevice `json:"devices"`
+}
+
+type ApiWebPushSubscribe struct {
+	Subscription json.RawMessage `json:"subscription"`
+	UA string `json:"ua"`
+}
+
+// apiWebPush serves GET and POST "/api/v1/webpush"
+func apiWebPush(w http.ResponseWriter, r *http.Request, calleeID string, remoteAddr string) {
+	if r.Method=="POST" {
+		var req ApiWebPushSubscribe
+		if !apiReadJson(w, r, &req) {
+			return
+		}
+		device,status,err := webpushSubscribe(calleeID, req.Subscription, req.UA)
+		if err!=nil {
+			logWarn("/api/v1/webpush subscribe fail", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+			apiError(w, status, "webpush_failed", err.Error())
+			return
+		}
+		logInfo("/api/v1/webpush subscribe", "calleeID",calleeID, "device",device.Id, "rip",remoteAddr)
+		apiJson(w, http.StatusCreated, device)
+		return
+	}
+	devices,err := webpushDevices(calleeID)
+	if err!=nil {
+		logError("/api/v1/webpush get", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if devices==nil {
+		devices = []WebPushDevice{}
+	}
+	_,publicKey,_ := webpushVapidKey()
+	apiJson(w, http.StatusOK, ApiWebPush{publicKey, devices})
+}
+
+// apiDeleteWebPush serves DELETE "/api/v1/webpush/{id}"
+func apiDeleteWebPush(w http.ResponseWriter, r *http.Request, calleeID string, id string, remoteAddr string) {
+	removed,err := webpushRemoveDevices(calleeID, id)
+	if err!=nil {
+		logError("/api/v1/webpush delete", "calleeID",calleeID, "rip",remoteAddr, "err",err)
+		apiError(w, http.StatusInternalServerError, "internal", "")
+		return
+	}
+	if removed==0 {
+		apiError(w, http.StatusNotFound, "not_found", "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
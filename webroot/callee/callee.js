@@ -26,8 +26,10 @@ const menuClearCacheElement = document.getElementById('menuClearCache');
 const menuExitElement = document.getElementById('menuExit');
 const iconContactsElement = document.getElementById('iconContacts');
 const idMappingElement = document.getElementById('idMapping');
+const menuVoicemailElement = document.getElementById('menuVoicemail');
 const exclamationElement = document.getElementById('exclamation');
 const ownlinkElement = document.getElementById('ownlink');
+const callControlsElement = document.getElementById('callControls');
 const autoReconnectDelay = 15;
 const singlebutton = false;
 const calleeMode = true;
@@ -72,6 +74,7 @@ var onGotStreamGoOnline = false;
 var autoPlaybackFile = "";
 var waitingCallerSlice = null;
 var missedCallsSlice = null;
+var missedCallsUnread = 0;
 var pushRegistration=null;
 var otherUA="";
 var fileReceiveBuffer = [];
@@ -84,6 +87,9 @@ var fileSendAbort=false;
 var fileReceiveAbort=false;
 //var loginResponse=false;
 var minNewsDate=0;
+var waitingCaller = null; // a 2nd caller while we are in a call (see callwaiting.go)
+var heldCall = null; // the call on hold, see parkCall()
+var consultTargetID = ""; // attended transfer: the held call will be transferred to this id
 
 window.onload = function() {
 	console.log("callee.js onload...");
@@ -980,6 +986,7 @@ console.log("callee beforeunload: enable goonline");
 	autoanswerlabel.style.display = "block";
 	dialsoundslabel.style.display = "block";
 	menuSettingsElement.style.display = "block";
+	menuVoicemailElement.style.display = "block";
 	iconContactsElement.style.display = "block";
 
 //	if(typeof Android !== "undefined" && Android !== null) {
@@ -1313,6 +1320,33 @@ function signalingCommand(message, comment) {
 			missedCallsSlice = JSON.parse(payload);
 		}
 		showMissedCalls();
+	} else if(cmd=="missedCallsUnread") {
+		// number of unread missed calls (see missedcalls.go)
+		missedCallsUnread = parseInt(payload,10);
+		if(missedCallsTitleElement) {
+			if(missedCallsUnread>0) {
+				missedCallsTitleElement.innerHTML = "Missed Calls ("+missedCallsUnread+" unread)";
+			} else {
+				missedCallsTitleElement.innerHTML = "Missed Calls";
+			}
+		}
+	} else if(cmd=="voicemail") {
+		// number of unread voicemails (see voicemail.go)
+		let unread = parseInt(payload,10);
+		if(unread>0) {
+			let text = unread+" new voice message";
+			if(unread>1) {
+				text += "s";
+			}
+			showStatus("<a onclick='openVoicemail()'>"+text+"</a>",-1);
+			if(notificationSound) {
+				notificationSound.play().catch(function(error) { });
+			}
+		}
+	} else if(cmd=="turnCredentials") {
+		// the TURN credentials of the incoming call (sent before callerOffer)
+		turnCredentialsReceived(payload);
+
 	} else if(cmd=="ua") {
 		otherUA = payload;
 		gLog("otherUA",otherUA);
@@ -1334,6 +1368,88 @@ function signalingCommand(message, comment) {
 		gLog("stopCamDelivery");
 		connectLocalVideo(true);
 
+	} else if(cmd=="callWaiting") {
+		// a 2nd caller is waiting for us to end, hold or reject the active call
+		let idxSeparator = payload.indexOf("\t");
+		waitingCaller = {id:payload, name:""};
+		if(idxSeparator>=0) {
+			waitingCaller = {id:payload.substring(0,idxSeparator), name:payload.substring(idxSeparator+1)};
+		}
+		console.log("callWaiting ("+waitingCaller.id+") ("+waitingCaller.name+")");
+		if(notificationSound) {
+			notificationSound.play().catch(function(error) { });
+		}
+		showCallControls();
+
+	} else if(cmd=="waitingGone") {
+		console.log("waitingGone");
+		if(waitingCaller) {
+			showStatus("Waiting caller has hung up",4000);
+		}
+		waitingCaller = null;
+		showCallControls();
+
+	} else if(cmd=="heldGone") {
+		// the caller on hold has hung up
+		console.log("heldGone");
+		if(heldCall) {
+			closeCall(heldCall,false);
+			heldCall = null;
+			consultTargetID = "";
+			showStatus("Caller on hold has hung up",4000);
+		}
+		showCallControls();
+
+	} else if(cmd=="consult") {
+		// the server has put the active call on hold: now we call the transfer target
+		console.log("consult "+payload);
+		if(rtcConnect) {
+			heldCall = parkCall();
+			newPeerCon();
+		}
+		consultTargetID = payload;
+		showCallControls();
+		openDialId(payload);
+
+	} else if(cmd=="transferred" || cmd=="transferRelay") {
+		// transferRelay: the caller is not ws-connected anymore, we tell it via data channel
+		console.log(cmd+" "+payload);
+		if(consultTargetID!="" && heldCall) {
+			// attended transfer of the held call
+			let call = heldCall;
+			heldCall = null;
+			consultTargetID = "";
+			if(cmd=="transferRelay" && call.dataChannel && call.dataChannel.readyState=="open") {
+				call.dataChannel.send("cmd|transfer|"+payload);
+			}
+			// give the transfer msg some time to get out
+			setTimeout(function() { closeCall(call,false); },500);
+		} else {
+			// blind transfer of the active call
+			if(cmd=="transferRelay" && isDataChlOpen()) {
+				dataChannel.send("cmd|transfer|"+payload);
+			}
+			let transferredDataChannel = dataChannel;
+			setTimeout(function() {
+				if(dataChannel==transferredDataChannel) {
+					stopAllAudioEffects();
+					// transferRelay: the server has not ended the call yet
+					endWebRtcSession(cmd=="transferRelay",true,"transferred");
+				}
+			},500);
+		}
+		showStatus("Call transferred to "+escapeHtml(payload),4000);
+		showCallControls();
+
+	} else if(cmd=="transferFailed") {
+		let tok2 = payload.split("\t");
+		let reason = "";
+		if(tok2.length>=2) {
+			reason = ": "+tok2[1];
+		}
+		console.log("transferFailed "+payload);
+		showStatus("Transfer to "+escapeHtml(tok2[0])+" failed"+escapeHtml(reason),4000);
+
 	} else if(cmd=="news") {
 		let newsDate = payload;
 		let newsUrl = tok[2];
@@ -1592,11 +1708,14 @@ function showMissedCalls() {
 					}
 				}
 
+				if(missedCallsSlice[i].ID && !missedCallsSlice[i].Read) {
+					// unread (older servers do not send ID and Read)
+					callerNameMarkup = "<b>"+callerNameMarkup+"</b>";
+				}
 				str += "<td>" + callerNameMarkup + "</td>"+
 					"<td>"+	callerLink + "</td>"+
 					"<td align='right'>"+
-					"<a onclick='deleteMissedCall(\""+
-						missedCallsSlice[i].AddrPort+"_"+missedCallsSlice[i].CallTime+"\","+
+					"<a onclick='deleteMissedCall(\""+missedCallId(missedCallsSlice[i])+"\","+
 						"\""+callerName+"\","+
 						"\""+callerID+"\")'>"+
 					waitingTimeString + "</a></td>";
@@ -1636,10 +1755,18 @@ function halfShowIpAddr(ipAddr) {
 	return ipAddr
 }
 
-var myCallerAddrPortPlusCallTime = 0;
-function deleteMissedCall(callerAddrPortPlusCallTime,name,id) {
-	gLog("deleteMissedCall "+callerAddrPortPlusCallTime+" "+name+" "+id);
-	myCallerAddrPortPlusCallTime = callerAddrPortPlusCallTime;
+function missedCallId(missedCall) {
+	if(missedCall.ID) {
+		return missedCall.ID;
+	}
+	// sent by an older server
+	return missedCall.AddrPort+"_"+missedCall.CallTime;
+}
+
+var myMissedCallId = "";
+function deleteMissedCall(missedCallId,name,id) {
+	gLog("deleteMissedCall "+missedCallId+" "+name+" "+id);
+	myMissedCallId = missedCallId;
 
 	let yesNoInner = "<div style='position:absolute; z-index:110; background:#45dd; color:#fff; padding:20px 20px; line-height:1.6em; border-radius:3px; cursor:pointer;'><div style='font-weight:600'>Delete missed call?</div><br>"+
 	"Name:&nbsp;"+name+"<br>ID:&nbsp;"+id+"<br><br>"+
@@ -1649,8 +1776,8 @@ function deleteMissedCall(callerAddrPortPlusCallTime,name,id) {
 
 function deleteMissedCallDo() {
 	// will be called by deleteMissedCall()
-	gLog('deleteMissedCallDo '+myCallerAddrPortPlusCallTime);
-	wsSend("deleteMissedCall|"+myCallerAddrPortPlusCallTime);
+	gLog('deleteMissedCallDo '+myMissedCallId);
+	wsSend("deleteMissedCall|"+myMissedCallId);
 }
 
 function wsSend(message) {
@@ -1746,6 +1873,7 @@ function pickup2() {
 		if(typeof Android !== "undefined" && Android !== null) {
 			Android.peerConnect();
 		}
+		showCallControls();
 
 		if(!isDataChlOpen()) {
 			gLog('do not enable fileselectLabel: !isDataChlOpen');
@@ -1948,6 +2076,11 @@ function newPeerCon() {
 		console.log("peerCon oniceconnectionstatechange", peerCon.iceConnectionState);
 	}
 	peerCon.onconnectionstatechange = event => {
+		if(event.target!==peerCon) {
+			// a parked call (see parkCall())
+			heldCallStateChange(event.target);
+			return;
+		}
 		connectionstatechangeCounter++;
 		console.log("peerCon connectionstatechange "+peerCon.connectionState);
 		if(!peerCon || peerCon.iceConnectionState=="closed") {
@@ -2159,9 +2292,23 @@ function createDataChannel() {
 		dataChannel.onopen = event => {
 			gLog("dataChannel.onopen");
 		};
-		dataChannel.onclose = event => dataChannelOnclose(event);
-		dataChannel.onerror = event => dataChannelOnerror(event);
-		dataChannel.onmessage = event => dataChannelOnmessage(event);
+		dataChannel.onclose = event => {
+			// ignore the data channel of a parked call (see parkCall())
+			if(event.target===dataChannel) dataChannelOnclose(event);
+		};
+		dataChannel.onerror = event => {
+			if(event.target===dataChannel) dataChannelOnerror(event);
+		};
+		dataChannel.onmessage = event => {
+			if(event.target===dataChannel) {
+				dataChannelOnmessage(event);
+			} else if(heldCall && heldCall.dataChannel===event.target &&
+					typeof event.data === "string" && event.data.startsWith("disconnect")) {
+				console.log("heldCall disconnect via dataChannel");
+				showStatus("Caller on hold has hung up",4000);
+				endHeld();
+			}
+		};
 	};
 }
 
@@ -2404,7 +2551,8 @@ function endWebRtcSession(disconnectCaller,goOnlineAfter,comment) {
 		}
 	}
 
-	if(localStream && !videoEnabled) {
+	if(localStream && !videoEnabled && !heldCall) {
+		// the mic is still needed if a call is on hold
 		gLog('endWebRtcSession clear localStream');
 		const audioTracks = localStream.getAudioTracks();
 		audioTracks[0].enabled = false; // mute mic
@@ -2438,6 +2586,7 @@ function endWebRtcSession(disconnectCaller,goOnlineAfter,comment) {
 	fileselectLabel.style.display = "none";
 	progressSendElement.style.display = "none";
 	progressRcvElement.style.display = "none";
+	showCallControls();
 
 	if(goOnlineAfter && !goOnlinePending) {
 		// "goOnline()" is not the best fkt-name in this context
@@ -2463,6 +2612,245 @@ function endWebRtcSession(disconnectCaller,goOnlineAfter,comment) {
 	}
 }
 
+function escapeHtml(str) {
+	return str.replace(/&/g,"&amp;").replace(/</g,"&lt;").replace(/>/g,"&gt;")
+		.replace(/"/g,"&quot;").replace(/'/g,"&#39;");
+}
+
+function showCallControls() {
+	// links for the waiting caller, the call on hold and transfer (see callwaiting.go)
+	if(!callControlsElement) {
+		return;
+	}
+	let html = "";
+	if(waitingCaller) {
+		let name = waitingCaller.name;
+		if(name=="") {
+			name = waitingCaller.id;
+		}
+		html += "Call waiting: "+escapeHtml(name)+"<br>";
+		if(!rtcConnect) {
+			html += "<a onclick='acceptWaiting(\"end\")'>Answer</a> &nbsp; ";
+		} else {
+			if(!heldCall) {
+				html += "<a onclick='acceptWaiting(\"hold\")'>Hold and answer</a> &nbsp; ";
+			}
+			html += "<a onclick='acceptWaiting(\"end\")'>End and answer</a> &nbsp; ";
+		}
+		html += "<a onclick='rejectWaiting()'>Reject</a><br>";
+	}
+	if(heldCall) {
+		let name = heldCall.callerName;
+		if(name=="") {
+			name = heldCall.callerID;
+		}
+		html += "On hold: "+escapeHtml(name)+" &nbsp; ";
+		if(rtcConnect) {
+			html += "<a onclick='switchHeld()'>Switch</a> &nbsp; ";
+		} else {
+			html += "<a onclick='switchHeld()'>Resume</a> &nbsp; ";
+		}
+		if(consultTargetID!="") {
+			html += "<a onclick='transferComplete()'>Transfer to "+escapeHtml(consultTargetID)+"</a> &nbsp; ";
+		}
+		html += "<a onclick='endHeld()'>Hang up</a><br>";
+	}
+	if(mediaConnect && consultTargetID=="") {
+		html += "<a onclick='transferCall()'>Transfer</a>";
+	}
+	callControlsElement.innerHTML = html;
+	if(html!="") {
+		callControlsElement.style.display = "block";
+	} else {
+		callControlsElement.style.display = "none";
+	}
+}
+
+function parkCall() {
+	// detach the active call from peerCon & co, so that another call can be taken
+	// the parked peerCon stays connected, but our mic is removed and the remote stream is not played
+	let call = {peerCon:peerCon, dataChannel:dataChannel, remoteStream:remoteStream,
+		addedAudioTrack:addedAudioTrack, addedVideoTrack:addedVideoTrack,
+		callerID:callerID, callerName:callerName, listOfClientIps:listOfClientIps,
+		mediaConnect:mediaConnect, mediaConnectStartDate:mediaConnectStartDate};
+	console.log("parkCall ("+callerID+")");
+	if(peerCon && peerCon.iceConnectionState!="closed") {
+		peerCon.getSenders().forEach((sender) => {
+			sender.replaceTrack(null).catch(err => console.log("# parkCall replaceTrack "+err.message));
+		});
+	}
+	stopTimer();
+	if(remoteVideoFrame) {
+		remoteVideoFrame.srcObject = null;
+		remoteVideoHide();
+	}
+	peerCon = null;
+	dataChannel = null;
+	remoteStream = null;
+	addedAudioTrack = null;
+	addedVideoTrack = null;
+	callerID = "";
+	callerName = "";
+	listOfClientIps = "";
+	rtcConnect = false;
+	mediaConnect = false;
+	if(vsendButton) {
+		vsendButton.style.display = "none";
+	}
+	fileselectLabel.style.display = "none";
+	return call;
+}
+
+function restoreCall(call) {
+	// make a parked call the active call again
+	console.log("restoreCall ("+call.callerID+")");
+	peerCon = call.peerCon;
+	dataChannel = call.dataChannel;
+	remoteStream = call.remoteStream;
+	addedAudioTrack = call.addedAudioTrack;
+	addedVideoTrack = call.addedVideoTrack;
+	callerID = call.callerID;
+	callerName = call.callerName;
+	listOfClientIps = call.listOfClientIps;
+	mediaConnectStartDate = call.mediaConnectStartDate;
+	rtcConnect = true;
+	mediaConnect = call.mediaConnect;
+	if(!localStream) {
+		console.log("# restoreCall no localStream");
+	} else {
+		if(addedAudioTrack) {
+			addedAudioTrack.replaceTrack(localStream.getAudioTracks()[0])
+				.catch(err => console.log("# restoreCall replaceTrack "+err.message));
+		}
+		if(addedVideoTrack && localStream.getVideoTracks().length>0) {
+			addedVideoTrack.replaceTrack(localStream.getVideoTracks()[0])
+				.catch(err => console.log("# restoreCall replaceTrack vid "+err.message));
+		}
+	}
+	if(remoteVideoFrame && remoteStream) {
+		remoteVideoFrame.srcObject = remoteStream;
+		remoteVideoFrame.play().catch(function(error) {	});
+	}
+	if(mediaConnect) {
+		onlineIndicator.src="red-gradient.svg";
+		if(vsendButton) {
+			vsendButton.style.display = "inline-block";
+		}
+	}
+	answerButton.style.display = "none";
+	rejectButton.style.display = "inline-block";
+	goOfflineButton.disabled = true;
+}
+
+function closeCall(call,disconnectCaller) {
+	// close a parked call
+	console.log("closeCall ("+call.callerID+") discCaller="+disconnectCaller);
+	if(call.dataChannel) {
+		if(disconnectCaller && call.dataChannel.readyState=="open") {
+			call.dataChannel.send("disconnect");
+		}
+		call.dataChannel.close();
+	}
+	if(call.peerCon && call.peerCon.iceConnectionState!="closed") {
+		call.peerCon.close();
+	}
+}
+
+function heldCallStateChange(con) {
+	// connectionstatechange of a parked peerCon
+	if(!heldCall || heldCall.peerCon!==con) {
+		return;
+	}
+	console.log("heldCall connectionstatechange "+con.connectionState);
+	if(con.connectionState=="disconnected" || con.connectionState=="failed") {
+		showStatus("Call on hold has ended",4000);
+		endHeld();
+	}
+}
+
+function acceptWaiting(mode) {
+	// mode "hold": put the active call on hold; mode "end": end the active call
+	if(!waitingCaller) {
+		return;
+	}
+	console.log("acceptWaiting "+mode);
+	waitingCaller = null;
+	if(rtcConnect) {
+		let call = parkCall();
+		if(mode=="hold") {
+			heldCall = call;
+		} else {
+			closeCall(call,true);
+		}
+	}
+	if(!peerCon || peerCon.iceConnectionState=="closed") {
+		// the server will forward the callerOffer of the waiting caller right away
+		newPeerCon();
+	}
+	wsSend("acceptWaiting|"+mode);
+	showCallControls();
+}
+
+function rejectWaiting() {
+	console.log("rejectWaiting");
+	waitingCaller = null;
+	wsSend("rejectWaiting|");
+	showCallControls();
+}
+
+function switchHeld() {
+	// swap the active call and the call on hold, or resume the call on hold
+	if(!heldCall) {
+		return;
+	}
+	let held = heldCall;
+	heldCall = null;
+	consultTargetID = "";
+	if(rtcConnect) {
+		heldCall = parkCall();
+	} else if(peerCon && peerCon.iceConnectionState!="closed") {
+		// the idle peerCon is not needed for the resumed call
+		peerCon.close();
+	}
+	restoreCall(held);
+	wsSend("switchHeld|");
+	showCallControls();
+}
+
+function endHeld() {
+	if(!heldCall) {
+		return;
+	}
+	closeCall(heldCall,true);
+	heldCall = null;
+	consultTargetID = "";
+	wsSend("endHeld|");
+	showCallControls();
+}
+
+function transferCall() {
+	let targetID = prompt("Transfer the call to ID");
+	if(!targetID) {
+		return;
+	}
+	targetID = cleanStringParameter(targetID,true);
+	if(targetID=="") {
+		return;
+	}
+	if(confirm("Talk to "+targetID+" before the call is transferred?")) {
+		// attended transfer: the server answers with "consult|"
+		wsSend("consult|"+targetID);
+	} else {
+		// blind transfer: the server answers with "transferred|" or "transferRelay|"
+		wsSend("transfer|"+targetID);
+	}
+}
+
+function transferComplete() {
+	console.log("transferComplete "+consultTargetID);
+	wsSend("transferComplete|");
+}
+
 function goOffline() {
 	wsAutoReconnecting = false;
 	offlineAction();
@@ -2471,6 +2859,14 @@ function goOffline() {
 	ownlinkElement.innerHTML = "";
 	stopAllAudioEffects("goOffline");
 	waitingCallerSlice = null;
+	// the server ends the call on hold and drops the waiting caller when we go offline
+	if(heldCall) {
+		closeCall(heldCall,true);
+		heldCall = null;
+	}
+	waitingCaller = null;
+	consultTargetID = "";
+	showCallControls();
 
 	isHiddenlabel.style.display = "none";
 	autoanswerlabel.style.display = "none";
@@ -2581,6 +2977,12 @@ function openDialUrl(url) {
 	iframeWindowOpen(url,false);
 }
 
+function openVoicemail() {
+	let url = "/callee/voicemail/";
+	gLog('openVoicemail',url);
+	iframeWindowOpen(url,false,"height:95vh;",true);
+}
+
 function openIdMapping() {
 	let url = "/callee/mapping/"; //?ds="+playDialSounds;
 	gLog('openIdMapping',url);
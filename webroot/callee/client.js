@@ -47,14 +47,55 @@ var pickupAfterLocalStream = false; // not used in caller
 var ICE_config = {
 	"iceServers": [
 		{	'urls': 'stun:'+window.location.hostname+':3739' },
-		{	'urls': 'turn:'+window.location.hostname+':3739',
-			'username': 'c807ec29df3c9ff',
-			'credential': '736518fb4232d44'
-		}
+		// replaced by turnCredentialsReceived()
 	]
 	,"iceTransportPolicy": "all" // "all" / "relay"
 };
 
+var turnCredentials = null;
+function turnCredentialsReceived(payload) {
+	// the server sends time-limited TURN credentials for every call (see runturn.go)
+	try {
+		turnCredentials = JSON.parse(payload);
+	} catch(ex) {
+		console.warn("turnCredentials "+ex.message);
+		return;
+	}
+	let iceServers = [];
+	if(turnCredentials.port) {
+		// the embedded stun/turn server: udp plus, if the server offers them,
+		// tcp and tls (for callers behind firewalls blocking udp)
+		let hostname = window.location.hostname;
+		iceServers.push({'urls': 'stun:'+hostname+':'+turnCredentials.port});
+		let turnUrls = ['turn:'+hostname+':'+turnCredentials.port];
+		if(turnCredentials.tcpPort) {
+			turnUrls.push('turn:'+hostname+':'+turnCredentials.tcpPort+'?transport=tcp');
+		}
+		if(turnCredentials.tlsPort) {
+			turnUrls.push('turns:'+hostname+':'+turnCredentials.tlsPort+'?transport=tcp');
+		}
+		iceServers.push({
+			'urls': turnUrls,
+			'username': turnCredentials.username,
+			'credential': turnCredentials.credential
+		});
+	}
+	if(turnCredentials.iceServers) {
+		// external stun/turn servers (see iceservers.go)
+		iceServers = iceServers.concat(turnCredentials.iceServers);
+	}
+	ICE_config.iceServers = iceServers;
+	gLog("turnCredentials ttl="+turnCredentials.ttl);
+	if(peerCon && peerCon.signalingState!="closed") {
+		// peerCon may have been created before the credentials arrived
+		try {
+			peerCon.setConfiguration(ICE_config);
+		} catch(ex) {
+			console.warn("turnCredentials setConfiguration "+ex.message);
+		}
+	}
+}
+
 var defaultConstraintString = '"width": {"min":320,"ideal":1920, "max":4096 },"height": {"min":240, "ideal":1080, "max":2160 },"frameRate": { "min":10, "max":30 }';
 
 var constraintString = defaultConstraintString;
@@ -636,15 +677,21 @@ function menuDialogOpen(menuDialog,atMousePos,inner) {
 	containerElement.style.filter = "blur(0.8px) brightness(60%)";
 	if(calleeMode) {
 		if(wsConn && navigator.cookieEnabled && getCookieSupport()) {
-			// cookies avail: "Settings" visible
+			// cookies avail: "Settings" and "Voicemail" visible
 			if(menuSettingsElement) {
 				menuSettingsElement.style.display = "block";
 			}
+			if(menuVoicemailElement) {
+				menuVoicemailElement.style.display = "block";
+			}
 		} else {
-			// "Settings" hidden
+			// "Settings" and "Voicemail" hidden
 			if(menuSettingsElement) {
 				menuSettingsElement.style.display = "none";
 			}
+			if(menuVoicemailElement) {
+				menuVoicemailElement.style.display = "none";
+			}
 		}
 	}
 
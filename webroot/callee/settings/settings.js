@@ -105,6 +105,14 @@ function prepareSettings(xhrresponse) {
 			document.getElementById("storeMissedCalls").checked = false;
 		}
 	}
+	if(typeof serverSettings.voicemail!=="undefined") {
+		if(!gentle) console.log('serverSettings.voicemail',serverSettings.voicemail);
+		if(serverSettings.voicemail=="true") {
+			document.getElementById("voicemail").checked = true;
+		} else {
+			document.getElementById("voicemail").checked = false;
+		}
+	}
 /*
 	if(typeof serverSettings.webPushSubscription1!=="undefined") {
 		//if(!gentle) console.log('serverSettings.webPushSubscription1',serverSettings.webPushSubscription1);
@@ -416,6 +424,7 @@ function submitForm(autoclose) {
 			'"twid":"'+valueTwID+'",'+
 			'"storeContacts":"'+document.getElementById("storeContacts").checked+'",'+
 			'"storeMissedCalls":"'+document.getElementById("storeMissedCalls").checked+'",'+
+			'"voicemail":"'+document.getElementById("voicemail").checked+'",'+
 			'"webPushSubscription1":"'+encodeURI(serverSettings.webPushSubscription1)+'",'+
 			'"webPushUA1":"'+encodeURI(serverSettings.webPushUA1)+'",'+
 			'"webPushSubscription2":"'+encodeURI(serverSettings.webPushSubscription2)+'",'+
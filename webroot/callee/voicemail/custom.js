@@ -0,0 +1,3 @@
+const apiPath = "/rtcsig";
+const gentle = true;
+
@@ -0,0 +1,196 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+'use strict';
+const databoxElement = document.getElementById('databox');
+const apiV1Path = "/api/v1/voicemail";
+const calleeMode = false;
+
+var calleeID = "";
+var voicemails = [];
+
+window.onload = function() {
+	if(document.cookie!="" && document.cookie.startsWith("webcallid=")) {
+		// cookie webcallid exists
+		let cookieName = document.cookie.substring(10);
+		let idxAmpasent = cookieName.indexOf("&");
+		if(idxAmpasent>0) {
+			cookieName = cookieName.substring(0,idxAmpasent);
+		}
+		if(cookieName!="") {
+			calleeID = cookieName
+		}
+	}
+	if(calleeID=="") {
+		// no access without cookie
+		databoxElement.innerHTML = "no cookie";
+		return;
+	}
+	gLog('voicemail onload calleeID='+calleeID);
+
+	hashcounter = 1;
+	window.onhashchange = hashchange;
+
+	document.onkeydown = function(evt) {
+		evt = evt || window.event;
+		var isEscape = false;
+		if("key" in evt) {
+			isEscape = (evt.key === "Escape" || evt.key === "Esc");
+		} else {
+			isEscape = (evt.keyCode === 27);
+		}
+		if(isEscape) {
+			exitPage();
+		}
+	};
+
+	// XHR for the list of voicemails; server will use the cookie to authenticate us
+	requestData();
+}
+
+function requestData() {
+	ajaxFetch(new XMLHttpRequest(), "GET", apiV1Path, function(xhr) {
+		voicemails = JSON.parse(xhr.responseText);
+		showVoicemails();
+	}, errorAction);
+}
+
+function escapeHtml(str) {
+	return str.replace(/&/g,"&amp;").replace(/</g,"&lt;").replace(/>/g,"&gt;")
+		.replace(/"/g,"&quot;").replace(/'/g,"&#39;");
+}
+
+function showVoicemails() {
+	if(voicemails.length<=0) {
+		databoxElement.innerHTML = "No voice messages.";
+		return;
+	}
+	let mainLink = window.location.href;
+	let idx = mainLink.indexOf("/callee/");
+	if(idx>0) {
+		mainLink = mainLink.substring(0,idx) + "/user/";
+	}
+
+	var dataBoxContent = "<table style='width:100%; border-collapse:separate; line-height:1.7em;'>";
+	for(let voicemail of voicemails) {
+		let date = new Date(voicemail.time*1000);
+		let dateStr = date.toLocaleDateString()+" "+
+			date.toLocaleTimeString([],{hour:'2-digit', minute:'2-digit'});
+		let caller = "unknown";
+		if(voicemail.callerName) {
+			caller = escapeHtml(voicemail.callerName);
+		}
+		if(voicemail.callerId) {
+			let callerId = voicemail.callerId;
+			let idxAt = callerId.indexOf("@");
+			if(idxAt>=0 && callerId.substring(idxAt+1)!=location.host) {
+				// remote caller: show id@host, but don't offer a call link
+				caller += " ("+escapeHtml(callerId)+")";
+			} else {
+				if(idxAt>=0) {
+					callerId = callerId.substring(0,idxAt);
+				}
+				caller += " (<a href='"+mainLink+escapeHtml(callerId)+"'>"+escapeHtml(callerId)+"</a>)";
+			}
+		}
+		let style = "";
+		if(!voicemail.read) {
+			style = " style='color:#7c0; font-weight:600;'";
+		}
+		dataBoxContent += "<tr id='vm"+voicemail.id+"'><td"+style+">"+dateStr+" &nbsp;"+caller+
+			" &nbsp;"+voicemail.duration+"s";
+		if(voicemail.msg) {
+			dataBoxContent += "<br>"+escapeHtml(voicemail.msg);
+		}
+		dataBoxContent += "<br><audio controls preload='none' style='width:100%;' "+
+			"onplay='markRead(\""+voicemail.id+"\",true)' "+
+			"src='"+apiV1Path+"/"+voicemail.id+"'></audio></td>"+
+			"<td style='vertical-align:top; text-align:right;'>";
+		if(voicemail.read) {
+			dataBoxContent += "<a onclick='markRead(\""+voicemail.id+"\",false)'>unread</a><br>";
+		}
+		dataBoxContent += "<a onclick='remove(\""+voicemail.id+"\")'>del</a></td></tr>";
+	}
+	dataBoxContent += "</table>";
+	databoxElement.innerHTML = dataBoxContent;
+}
+
+function markRead(id,read) {
+	let voicemail = voicemails.find(entry => entry.id==id);
+	if(!voicemail || voicemail.read==read) {
+		return;
+	}
+	ajaxFetch(new XMLHttpRequest(), "PUT", apiV1Path+"/"+id, function(xhr) {
+		voicemail.read = read;
+		if(!read) {
+			showVoicemails();
+			return;
+		}
+		// don't redraw while the audio element is playing; just remove the unread style
+		let trElement = document.getElementById("vm"+id);
+		if(trElement) {
+			trElement.firstChild.style = "";
+		}
+	}, errorAction, JSON.stringify({"read":read}));
+}
+
+var removeId = "";
+function remove(id) {
+	gLog("remove "+id);
+	removeId = id;
+	let yesNoInner = "<div style='position:absolute; z-index:110; background:#45dd; color:#fff; padding:20px 20px; line-height:1.6em; border-radius:3px; cursor:pointer; min-width:280px;'><div style='font-weight:600'>Delete voice message?</div><br>"+
+	"<a onclick='removeDo();history.back();'>Delete!</a> &nbsp; &nbsp; <a onclick='history.back();'>Cancel</a></div>";
+	menuDialogOpen(dynDialog,true,yesNoInner);
+}
+
+function removeDo() {
+	ajaxFetch(new XMLHttpRequest(), "DELETE", apiV1Path+"/"+removeId, function(xhr) {
+		gLog('xhr delete voicemail OK');
+		voicemails = voicemails.filter(entry => entry.id!=removeId);
+		showVoicemails();
+	}, errorAction);
+}
+
+function errorAction(errString,err) {
+	gLog('xhr error',errString);
+	// let user know via alert
+	alert("xhr error "+errString+" "+err);
+}
+
+var xhrTimeout = 5000;
+function ajaxFetch(xhr, type, api, processData, errorFkt, postData) {
+	xhr.onreadystatechange = function() {
+		if(xhr.readyState==4 && xhr.status>=200 && xhr.status<300) {
+			processData(xhr);
+		} else if(xhr.readyState==4) {
+			errorFkt("fetch error",xhr.status);
+		}
+	}
+	xhr.timeout = xhrTimeout;
+	xhr.ontimeout = function () {
+		errorFkt("timeout",0);
+	}
+	xhr.onerror= function(e) {
+		errorFkt("fetching",xhr.status);
+	};
+	// cross-browser compatible approach to bypassing the cache
+	if(api.indexOf("?")>=0) {
+		api += "&_="+new Date().getTime();
+	} else {
+		api += "?_="+new Date().getTime();
+	}
+	gLog('xhr send',api);
+	xhr.open(type, api, true);
+	if(postData) {
+		xhr.setRequestHeader("Content-type", "application/json");
+		xhr.send(postData);
+	} else {
+		xhr.send();
+	}
+}
+
+function exitPage() {
+	gLog('exitPage');
+	if(parent!=null && parent.iframeWindowClose) {
+		gLog('parent.iframeWindowClose()');
+		history.back();
+	}
+}
@@ -1454,7 +1454,7 @@ function calleeOfflineAction(onlineStatus,waitForCallee) {
 					}
 					if(!goodbyDone) {
 						gLog('online: callee could not be reached (%s)',xhr.responseText);
-						showStatus("Unable to reach "+calleeID+".<br>Please try again later.",-1);
+						voicemailOffer("Unable to reach "+calleeID+".<br>Please try again later.");
 						//wsSend("missedcall|"+goodbyMissedCall); // this is not possible here
 
 						let api = apiPath+"/missedCall?id="+goodbyMissedCall;
@@ -1473,7 +1473,7 @@ function calleeOfflineAction(onlineStatus,waitForCallee) {
 					// errcode 504 = timeout
 					gLog('online: callee could not be reached. xhr err',errString,errcode);
 					// TODO if xhr /online failed, does it make sense to try xhr /missedCall ?
-					showStatus("Unable to reach "+calleeID+".<br>Please try again later.",-1);
+					voicemailOffer("Unable to reach "+calleeID+".<br>Please try again later.");
 					//wsSend("missedcall|"+goodbyMissedCall); // this is not possible here
 					if(goodbyMissedCall!="") {
 						let api = apiPath+"/missedCall?id="+goodbyMissedCall;
@@ -1512,7 +1512,7 @@ function calleeOfflineAction(onlineStatus,waitForCallee) {
 						msg += "<br><br><a onclick='history.back();'>No, I have to go</a>";
 					}
 
-					showStatus(msg,-1);
+					voicemailOffer(msg);
 					goodbyMissedCall = calleeID+"|"+callerName+"|"+callerId+
 						"|"+Math.floor(Date.now()/1000)+
 						"|"+cleanStringParameter(msgbox.value,false).substring(0,msgBoxMaxLen)+
@@ -1522,7 +1522,7 @@ function calleeOfflineAction(onlineStatus,waitForCallee) {
 					return;
 				}
 				// calleeID can NOT be notified
-				showStatus(calleeID+" is not available at this time. Please try again a little later.",-1);
+				voicemailOffer(calleeID+" is not available at this time. Please try again a little later.");
 			}, // xhr error
 				errorAction
 				// TODO errorAction will switch back
@@ -1577,6 +1577,133 @@ function goodby() {
 	}
 }
 
+// voicemail (see voicemail.go)
+var voicemailRecorder = null;
+var voicemailStream = null;
+var voicemailChunks = [];
+var voicemailStartTime = 0;
+var voicemailTimer = null;
+var voicemailSend = false;
+var voicemailStatusMsg = "";
+
+function voicemailOffer(msg) {
+	// show msg and, if the callee accepts voicemail, a link to record one
+	showStatus(msg,-1);
+	voicemailStatusMsg = msg;
+	if(singlebutton || typeof MediaRecorder==="undefined" || !navigator.mediaDevices) {
+		return;
+	}
+	let api = apiPath+"/voicemail?id="+calleeID+"&callerId="+callerId+
+		"&callerName="+encodeURIComponent(callerName)+"&callerHost="+callerHost;
+	xhrTimeout = 10*1000;
+	ajaxFetch(new XMLHttpRequest(), "GET", api, function(xhr) {
+		if(!xhr.responseText.startsWith("ok|")) {
+			gLog("voicemail not available "+xhr.responseText);
+			return;
+		}
+		let maxSecs = parseInt(xhr.responseText.substring(3),10);
+		showStatus(msg+"<br><br><a onclick='voicemailRecord("+maxSecs+")'>Leave a voice message</a>",-1);
+	}, function(errString,err) {
+		console.log('# /voicemail xhr error: '+errString+' '+err);
+	});
+}
+
+function voicemailRecord(maxSecs) {
+	if(voicemailRecorder) {
+		return;
+	}
+	navigator.mediaDevices.getUserMedia({audio:true}).then(function(stream) {
+		voicemailStream = stream;
+		voicemailChunks = [];
+		voicemailRecorder = new MediaRecorder(stream);
+		voicemailRecorder.ondataavailable = function(ev) {
+			if(ev.data && ev.data.size>0) {
+				voicemailChunks.push(ev.data);
+			}
+		};
+		voicemailRecorder.onstop = voicemailStopped;
+		voicemailRecorder.start(1000);
+		voicemailStartTime = Date.now();
+		// stop a little early, so that the server does not reject the recording
+		voicemailTimer = setTimeout(voicemailStop,maxSecs*1000-500);
+		showStatus("Recording your voice message (max "+maxSecs+"s)...<br><br>"+
+			"<a onclick='voicemailStop()'>Stop and send</a> &nbsp; &nbsp; "+
+			"<a onclick='voicemailCancel()'>Cancel</a>",-1);
+	}).catch(function(err) {
+		console.log("# voicemail getUserMedia err="+err);
+		showStatus("Unable to access the microphone.",-1);
+	});
+}
+
+function voicemailStop() {
+	voicemailEnd(true);
+}
+
+function voicemailCancel() {
+	voicemailEnd(false);
+}
+
+function voicemailEnd(send) {
+	if(!voicemailRecorder) {
+		return;
+	}
+	if(voicemailTimer) {
+		clearTimeout(voicemailTimer);
+		voicemailTimer = null;
+	}
+	voicemailSend = send;
+	voicemailRecorder.stop(); // -> voicemailStopped()
+}
+
+function voicemailStopped() {
+	let duration = Math.round((Date.now()-voicemailStartTime)/1000);
+	// mimeType may be something like "audio/webm;codecs=opus"
+	let mimeType = voicemailRecorder.mimeType;
+	if(!mimeType || !mimeType.startsWith("audio/")) {
+		mimeType = "audio/webm";
+	}
+	voicemailRecorder = null;
+	voicemailStream.getTracks().forEach(track => { track.stop(); });
+	voicemailStream = null;
+	let blob = new Blob(voicemailChunks, {type:mimeType});
+	voicemailChunks = [];
+	if(!voicemailSend) {
+		voicemailOffer(voicemailStatusMsg);
+		return;
+	}
+
+	let msgboxText = "";
+	if(msgbox) {
+		msgboxText = cleanStringParameter(msgbox.value,false).substring(0,msgBoxMaxLen);
+	}
+	let api = apiPath+"/voicemail?id="+calleeID+"&callerId="+callerId+
+		"&callerName="+encodeURIComponent(callerName)+"&callerHost="+callerHost+
+		"&msg="+encodeURIComponent(msgboxText)+"&duration="+duration;
+	gLog("voicemail send "+blob.size+" "+mimeType+" "+duration+"s");
+	showStatus("Sending your voice message...",-1);
+	let xhr = new XMLHttpRequest();
+	xhr.onreadystatechange = function() {
+		if(xhr.readyState!=4) {
+			return;
+		}
+		if(xhr.status==200 && xhr.responseText=="ok") {
+			showStatus("Your voice message has been delivered.",-1);
+			// the voice message replaces the missed call entry
+			goodbyMissedCall = "";
+		} else if(xhr.responseText=="full") {
+			showStatus("The voicemail of "+calleeID+" is full.",-1);
+		} else if(xhr.responseText=="toolarge") {
+			showStatus("Your voice message is too long.",-1);
+		} else {
+			console.log("# voicemail send status="+xhr.status+" "+xhr.responseText);
+			showStatus("Your voice message could not be delivered.",-1);
+		}
+	};
+	xhr.open("POST", api, true);
+	xhr.setRequestHeader("Content-type", mimeType);
+	xhr.send(blob);
+}
+
 function confirmNotifyConnect() {
 	gLog("callerName="+callerName+" callerId="+callerId+" callerHost="+callerHost);
 	notifyConnect(callerName,callerId,location.host);
@@ -1668,7 +1795,31 @@ function notifyConnect(callerName,callerId,callerHost) {
 		"&msg="+cleanStringParameter(msgbox.value,false).substring(0,msgBoxMaxLen);
 	xhrTimeout = 600*1000; // 10 min extended xhr timeout
 	gLog("notifyCallee api="+api+" timeout="+xhrTimeout);
+	// while we wait, poll the delivery status of the notification
+	let notifyStatusApi = apiPath+"/notifystatus?id="+calleeID +
+		"&callerId="+callerId + "&callerHost="+callerHost;
+	let notifyStatusTimer = setInterval(function() {
+		ajaxFetch(new XMLHttpRequest(), "GET", notifyStatusApi, function(xhr) {
+			let notifyStatus = null;
+			try {
+				notifyStatus = JSON.parse(xhr.responseText);
+			} catch(ex) {
+				return;
+			}
+			if(notifyStatus.closed) {
+				return;
+			}
+			if(notifyStatus.status=="sent") {
+				showStatus(calleeID+" has been notified. Please wait...",-1);
+			} else if(notifyStatus.status=="retrying") {
+				showStatus("Trying to notify "+calleeID+". Please wait...",-1);
+			}
+		}, function(errString,errcode) {
+			gLog('notifystatus xhr err',errString,errcode);
+		});
+	},5000);
 	ajaxFetch(new XMLHttpRequest(), "GET", api, function(xhr) {
+		clearInterval(notifyStatusTimer);
 		if(divspinnerframe) {
 			divspinnerframe.style.display = "none";
 		}
@@ -1682,14 +1833,15 @@ function notifyConnect(callerName,callerId,callerHost) {
 			return;
 		}
 		gLog('notify: callee could not be reached (%s)',xhr.responseText);
-		showStatus("Sorry! Unable to reach "+calleeID+".<br>Please try again a little later.",-1);
+		voicemailOffer("Sorry! Unable to reach "+calleeID+".<br>Please try again a little later.");
 	}, function(errString,errcode) {
+		clearInterval(notifyStatusTimer);
 		if(divspinnerframe) {
 			divspinnerframe.style.display = "none";
 		}
 		//errorAction(errString)
 		gLog('notify: callee could not be reached. xhr err',errString,errcode);
-		showStatus("Sorry! Unable to reach "+calleeID+".<br>Please try again a little later.",-1);
+		voicemailOffer("Sorry! Unable to reach "+calleeID+".<br>Please try again a little later.");
 	});
 }
 
@@ -1792,6 +1944,7 @@ function connectSignaling(message,openedFunc) {
 	}
 
 	gLog('connectSignaling: wsUrl='+wsUrl);
+	turnCredentials = null; // will be sent by the server
 	wsConn = new WebSocket(wsUrl);
 	wsConn.onopen = function () {
 		gLog('ws connection open '+calleeID);
@@ -2150,6 +2303,8 @@ function signalingCommand(message) {
 		if(payload!="c") {
 			//console.log("peer disconnect");
 			//showStatus("peer disconnect",8000);
+			// not picked up (ring timeout or denied by callee): offer voicemail
+			let noAnswer = !mediaConnect;
 			setTimeout(function() {
 				if(wsConn) {
 					if(!mediaConnect) {
@@ -2166,11 +2321,26 @@ function signalingCommand(message) {
 					wsConn=null;
 				}
 				hangupWithBusySound(false,"Peer hang up");
+				if(payload=="busy") {
+					// we were waiting while the callee was in another call (see callwaiting.go)
+					voicemailOffer("Busy.");
+				} else if(noAnswer) {
+					voicemailOffer("No answer.");
+				}
 			},250);
 		} else {
 			console.log("ignore cancel "+payload);
 		}
 
+	} else if(cmd=="rejected") {
+		// the call was rejected by the call filter of the callee, payload is the reason to show
+		// the server closes the connection; wsConn=null prevents hangup() from sending cancel
+		if(wsConn) {
+			wsConn.close();
+			wsConn=null;
+		}
+		hangupWithBusySound(false,payload);
+
 	} else if(cmd=="sessionDuration") {
 		// longest possible call duration
 		sessionDuration = parseInt(payload);
@@ -2192,6 +2362,16 @@ function signalingCommand(message) {
 			//console.log('cmd calleeInfo payload=('+payload+')');
 		}
 
+	} else if(cmd=="turnCredentials") {
+		// the TURN credentials of this call (sent right after ws connect)
+		turnCredentialsReceived(payload);
+		if(dial2Pending) {
+			dial2Pending = false;
+			if(!doneHangup) {
+				dial2();
+			}
+		}
+
 	} else if(cmd=="ua") {
 		otherUA = payload;
 		gLog("otherUA "+otherUA);
@@ -2205,6 +2385,48 @@ function signalingCommand(message) {
 		gLog("stopCamDelivery");
 		connectLocalVideo(true);
 
+	} else if(cmd=="waiting") {
+		// the callee is in another call and is notified of our call (see callwaiting.go)
+		showStatus("Callee is in another call. Please wait...",-1);
+
+	} else if(cmd=="hold") {
+		// mute mic while on hold
+		console.log("call on hold");
+		if(localStream) {
+			const audioTracks = localStream.getAudioTracks();
+			audioTracks[0].enabled = false;
+		}
+		showStatus("On hold...",-1);
+
+	} else if(cmd=="resume") {
+		console.log("call resumed");
+		if(localStream && microphoneIsNeeded) {
+			const audioTracks = localStream.getAudioTracks();
+			audioTracks[0].enabled = true;
+		}
+		showStatus("Call resumed",3000);
+
+	} else if(cmd=="transfer") {
+		// the callee has transferred our call: hang up and go to the dial page of the new target
+		// this arrives via wsConn or, if we are not ws-connected anymore, via dataChannel
+		let targetID = cleanStringParameter(payload,true);
+		if(!/^[A-Za-z0-9._-]+$/.test(targetID)) {
+			console.log("# transfer bad targetID "+payload);
+			return;
+		}
+		console.log("transfer to "+targetID);
+		hangup(false,false,"transfer to "+targetID);
+		showStatus("Your call is being transferred to "+targetID+"...",-1);
+		let params = new URLSearchParams(window.location.search);
+		params.delete("id");
+		let url = "/user/"+targetID;
+		if(params.toString()!="") {
+			url += "?"+params.toString();
+		}
+		setTimeout(function() {
+			window.location.replace(url);
+		},1500);
+
 	} else {
 		console.log('# ignore incom cmd',cmd);
 	}
@@ -2220,6 +2442,7 @@ function wsSend(message) {
 }
 
 let dialDate;
+var dial2Pending = false;
 function dial() {
 	if(!localStream) {
 		console.warn('dial abort no localStream');
@@ -2270,6 +2493,19 @@ function dial() {
 		}
 		playDialSound();
 
+	} else if(turnCredentials==null) {
+		// wait for the TURN credentials of this call (max 1s)
+		dial2Pending = true;
+		setTimeout(function() {
+			if(dial2Pending) {
+				dial2Pending = false;
+				if(doneHangup) {
+					gLog('abort post turnCredentials dial2()');
+				} else {
+					dial2();
+				}
+			}
+		},1000);
 	} else {
 		dial2();
 	}
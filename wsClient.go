@@ -10,10 +10,8 @@ import (
 	"bytes"
 	"time"
 	"strings"
-	"fmt"
 	"strconv"
 	"errors"
-	"encoding/json"
 	"net/http"
 	"sync/atomic"
 	"sync"
@@ -59,6 +57,7 @@ type WsClient struct {
 	callerOfferForwarded atombool.AtomBool
 	calleeAnswerReceived chan struct{}
 	reached14s atombool.AtomBool
+	isDetached atombool.AtomBool // waiting, on hold or dropped: OnClose must not end the active call
 	RemoteAddr string // with port
 	RemoteAddrNoPort string // no port
 	userAgent string // ws UA
@@ -76,8 +75,10 @@ type WsClient struct {
 	pongSent uint64
 	pingReceived uint64
 	authenticationShown bool // whether to show "pion auth for client (%v) SUCCESS"
+	turnUsername string // caller only: the TURN credentials of its call (see runturn.go)
 	isCallee bool
 	autologin bool
+	log *Logger // adds connType, calleeID, rip, wsid (and callerID) to every entry
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
@@ -89,9 +90,7 @@ func serveWss(w http.ResponseWriter, r *http.Request) {
 }
 
 func serve(w http.ResponseWriter, r *http.Request, tls bool) {
-	if logWantedFor("wsverbose") {
-		fmt.Printf("wsClient url=%s tls=%v\n", r.URL.String(), tls)
-	}
+	logDebug("wsverbose", "wsClient", "url",r.URL.String(), "tls",tls)
 
 	if keepAliveMgr==nil {
 		keepAliveMgr = NewKeepAliveMgr()
@@ -120,8 +119,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	wsClientID64, _ = strconv.ParseUint(wsClientIDstr, 10, 64)
 	if wsClientID64<=0 {
 		// not valid
-		fmt.Printf("# wsClient invalid wsClientIDstr=%s %s url=%s\n",
-			wsClientIDstr, remoteAddr, r.URL.String())
+		logWarn("wsClient invalid wsid", "wsid",wsClientIDstr, "rip",remoteAddr, "url",r.URL.String())
 		return
 	}
 	//fmt.Printf("wsClient wsClientIDstr=%s wsClientID64=%d\n",wsClientIDstr,wsClientID64)
@@ -146,6 +144,27 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		callerID = strings.ToLower(url_arg_array[0])
 	}
 
+	// native clients may authenticate with a bearer token (see httpToken.go)
+	// the token must belong to the callee (if this is the callee connecting)
+	// or to the caller (in which case it's callerID is taken from the token)
+	if bearer := tokenFromRequest(r,true); bearer!="" {
+		dbToken,err := tokenAuth(bearer)
+		if err!=nil {
+			logWarn("wsClient bearer token rejected",
+				"calleeID",wsClientData.calleeID, "rip",remoteAddr, "err",err)
+			tokenUnauthorized(w, err)
+			return
+		}
+		if callerID=="" && dbToken.CalleeID!=wsClientData.calleeID {
+			callerID = dbToken.CalleeID
+		} else if callerID!="" && callerID!=dbToken.CalleeID {
+			logWarn("wsClient callerID does not match token",
+				"calleeID",wsClientData.calleeID, "callerID",callerID, "tokenID",dbToken.CalleeID, "rip",remoteAddr)
+			http.Error(w, "callerId does not match token", http.StatusForbidden)
+			return
+		}
+	}
+
 	callerHost := ""
 	url_arg_array, ok = r.URL.Query()["callerHost"]
 	if ok && len(url_arg_array[0]) > 0 {
@@ -180,25 +199,14 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 			// try to fetch callerName by searching for callerID in contacts of calleeID
 			//fmt.Printf("wsClient try to get callerName for callerID=%s via calleeID=%s\n",
 			//	callerID, wsClientData.calleeID)
-			var idNameMap map[string]string // callerID -> compoundName
-			err := kvContacts.Get(dbContactsBucket,wsClientData.calleeID,&idNameMap)
-			if err!=nil {
-				fmt.Printf("# wsClient db get calleeID=%s (ignore) err=%v\n", wsClientData.calleeID, err)
-			} else {
-				compoundName := idNameMap[callerIdLong]
-				tokenSlice := strings.Split(compoundName, "|")
-				for idx, tok := range tokenSlice {
-					switch idx {
-						case 0: if tok!="unknown" { callerName = tok }
-						//case 1:  = tok
-						//case 2:  = tok
-					}
+			contact,ok := contactGet(wsClientData.calleeID,callerIdLong)
+			if ok {
+				if contact.Name!="unknown" {
+					callerName = contact.Name
 				}
 				if callerName!="" {
-					if logWantedFor("contacts") {
-						fmt.Printf("wsClient got callerName=%s for callerID=%s from contacts of calleeID=%s\n",
-							callerName, callerIdLong, wsClientData.calleeID)
-					}
+					logDebug("contacts", "wsClient got callerName from contacts",
+						"callerName",callerName, "callerID",callerIdLong, "calleeID",wsClientData.calleeID)
 				}
 			}
 		}
@@ -227,8 +235,8 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 						callerName += " ("+assignedName+")"
 					}
 				}
-				fmt.Printf("wsClient assignedName=%s for dialID=%s isMappedTo=%s (shouldBeSame=%s)\n",
-					assignedName, dialID, mappingData.CalleeId, wsClientData.calleeID)
+				logInfo("wsClient assignedName for dialID", "assignedName",assignedName, "dialID",dialID,
+					"mappedTo",mappingData.CalleeId, "calleeID",wsClientData.calleeID)
 			} else {
 				// dialID is not mapped
 				//fmt.Printf("wsClient dialID=%s notMapped (shouldBeSame=%s)\n",
@@ -257,7 +265,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Printf("# Upgrade err=%v\n", err)
+		logError("wsClient upgrade", "rip",remoteAddr, "err",err)
 		return
 	}
 	wsConn := conn.(*websocket.Conn)
@@ -290,8 +298,8 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 					callerName += " ("+assignedName+")"
 				}
 			}
-			fmt.Printf("wsClient assignedName=%s for dialID=%s isMappedTo=%s(=%s)\n",
-				assignedName, dialID, mappingData.CalleeId, wsClientData.calleeID)
+			logInfo("wsClient assignedName for dialID", "assignedName",assignedName, "dialID",dialID,
+				"mappedTo",mappingData.CalleeId, "calleeID",wsClientData.calleeID)
 		}
 	}
 	//fmt.Printf("serve (%s) callerID=%s callerName=%s auto=%s ver=%s\n",
@@ -312,6 +320,11 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	} else {
 		client.connType = "serveWs"
 	}
+	client.log = logRoot.With("connType",client.connType, "calleeID",client.calleeID,
+		"rip",remoteAddr, "wsid",wsClientID64)
+	if callerIdLong!="" {
+		client.log = client.log.With("callerID",callerIdLong)
+	}
 
 /*
 	keepAliveMgr.Add(wsConn)
@@ -344,21 +357,18 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 			if n>0 {
 				if logWantedFor("wsreceive") {
 					max := n; if max>20 { max = 20 }
-					fmt.Printf("%s (%s) received n=%d isCallee=%v (%s)\n",
-						client.connType, client.calleeID, n, client.isCallee, data[:max])
+					client.log.Debug("wsreceive", "received", "n",n, "isCallee",client.isCallee, "data",string(data[:max]))
 				}
 				client.handleClientMessage(data, wsConn)
 			}
 		case websocket.BinaryMessage:
-			fmt.Printf("# %s binary dataLen=%d\n", client.connType, len(data))
+			client.log.Warn("binary message", "len",len(data))
 		}
 	})
 
 	upgrader.SetPongHandler(func(wsConn *websocket.Conn, s string) {
 		// we received a pong from the client
-		if logWantedFor("gotpong") {
-			fmt.Printf("gotPong (%s) %s\n",client.calleeID, wsConn.RemoteAddr().String())
-		}
+		client.log.Debug("gotpong", "gotPong", "addr",wsConn.RemoteAddr().String())
 		// clear read deadline; don't expect data from this cli for now; set it again when we send the next ping
 		wsConn.SetReadDeadline(time.Time{})
 
@@ -367,20 +377,20 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 			keepAliveMgr.SetPingDeadline(wsConn, pingPeriod, client) // now + pingPeriod secs
 		}
 		client.pongReceived++
+		metricsWsPongTotal.Inc("received")
 	})
 
 	upgrader.SetPingHandler(func(wsConn *websocket.Conn, s string) {
 		// received a ping from the client (this only happens in rare cases; usually we send pings to client)
-		if logWantedFor("gotping") {
-			fmt.Printf("gotPing (%s)\n",client.calleeID)
-		}
+		client.log.Debug("gotping", "gotPing")
 		client.pingReceived++
+		metricsWsPingTotal.Inc("received")
 		// clear read deadline; don't expect data from this cli for now; set it again when we send the next ping
 		wsConn.SetReadDeadline(time.Time{})
 		// send the pong
 		err := wsConn.WriteMessage(websocket.PongMessage, nil)
 		if err != nil {
-			fmt.Printf("# sendPong (%s) %s err=%v\n",client.calleeID, client.wsConn.RemoteAddr().String(), err)
+			client.log.Error("sendPong", "addr",client.wsConn.RemoteAddr().String(), "err",err)
 			if(client.isCallee) {
 				// callee is gone
 				client.hub.closeCallee("sendPong: "+err.Error())
@@ -398,6 +408,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		}
 		atomic.AddInt64(&pongSentCounter, 1)
 		client.pongSent++
+		metricsWsPongTotal.Inc("sent")
 	})
 
 	wsConn.OnClose(func(c *websocket.Conn, err error) {
@@ -408,15 +419,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 			// clear read deadline; we don't expect data from this cli
 			c.SetReadDeadline(time.Time{})
 
-			if logWantedFor("wsclose") {
-				if err!=nil {
-					fmt.Printf("%s (%s) OnClose callee err=%v %s v=%s\n",
-						client.connType, client.calleeID, err, client.RemoteAddr, client.clientVersion)
-				} else {
-					fmt.Printf("%s (%s) OnClose callee noerr %s v=%s\n",
-						client.connType, client.calleeID, client.RemoteAddr, client.clientVersion)
-				}
-			}
+			client.log.Debug("wsclose", "OnClose callee", "ver",client.clientVersion, "err",err)
 			// stop watchdog timer
 			if client.hub!=nil {
 				client.hub.HubMutex.RLock()
@@ -434,16 +437,12 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 
 		} else {
 			// caller has closed ws-con to server
-			if logWantedFor("wsclose") {
-				if err!=nil {
-					fmt.Printf("%s (%s) OnClose caller err=%v %s v=%s\n",
-						client.connType, client.calleeID, err, client.RemoteAddr, client.clientVersion)
-				} else {
-					fmt.Printf("%s (%s) OnClose caller noerr %s v=%s\n",
-						client.connType, client.calleeID, client.RemoteAddr, client.clientVersion)
-				}
-			}
+			client.log.Debug("wsclose", "OnClose caller", "ver",client.clientVersion, "err",err)
 
+			if client.hub!=nil && client.hub.callWaitingClosed(client) {
+				// this was the waiting caller or the caller on hold
+				return
+			}
 			if client.hub!=nil {
 				client.hub.HubMutex.RLock()
 				if client.hub.CallerClient!=nil {
@@ -477,10 +476,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	hub.HubMutex.Lock()
 	if hub.CalleeClient==nil {
 		// callee client (1st client)
-		if logWantedFor("wsclient") {
-			fmt.Printf("%s (%s) callee conn ws=%d %s\n", client.connType,
-				client.calleeID, wsClientID64, client.RemoteAddr)
-		}
+		client.log.Debug("wsclient", "callee conn")
 		client.isCallee = true
 		client.calleeInitReceived.Set(false)
 		hub.IsCalleeHidden = wsClientData.dbUser.Int2&1!=0
@@ -508,12 +504,24 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		return
 	}
 
+	if hub.ConnectedCallerIp!="" && hub.WaitingClient==nil && callWaitingEnabled() {
+		// callee is busy: this caller will be waiting (see callwaiting.go)
+		client.log.Debug("attach", "waiting caller conn", "callerID",callerIdLong)
+		client.isCallee = false
+		client.callerOfferForwarded.Set(false)
+		client.reached14s.Set(false)
+		client.calleeAnswerReceived = make(chan struct{}, 8)
+		client.turnUsername = turnCredentialsNew(client.calleeID)
+		hub.WaitingClient = client
+		hub.waitingMsgs = nil
+		hub.HubMutex.Unlock()
+		client.Write(turnCredentialsMsg(client.turnUsername, client.RemoteAddrNoPort))
+		return
+	}
+
 	if hub.CallerClient==nil {
 		// caller client (2nd client)
-		if logWantedFor("attach") {
-			fmt.Printf("%s (%s) caller conn ws=%d (%s) %s\n", client.connType, client.calleeID,
-				wsClientID64, callerIdLong, client.RemoteAddr)
-		}
+		client.log.Debug("attach", "caller conn", "callerID",callerIdLong)
 
 		client.isCallee = false
 		client.callerOfferForwarded.Set(false)
@@ -522,8 +530,11 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		hub.CallerClient = client
 		hub.CallerIpNoPort = client.RemoteAddrNoPort
 		hub.CallerID = callerIdLong
+		client.turnUsername = turnCredentialsNew(client.calleeID)
+		hub.TurnUsername = client.turnUsername
 		hub.lastCallerContactTime = time.Now().Unix()
 		hub.HubMutex.Unlock()
+		client.Write(turnCredentialsMsg(client.turnUsername, client.RemoteAddrNoPort))
 
 /* tmtmtm
 // TODO when callee is making a call, it will NOT be in busy state for another caller
@@ -532,13 +543,9 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 			tmpRemoteIP := "aaa"
 			err := StoreCallerIpInHubMap(calleeID, tmpRemoteIP, false)
 			if err!=nil {
-				fmt.Printf("# %s (%s) StoreCallerIp %s (%s) err=%v\n",
-					client.connType, calleeID, tmpRemoteIP, callerID, err)
+				client.log.Error("StoreCallerIp", "callerIp",tmpRemoteIP, "callerID",callerID, "err",err)
 			} else {
-				if logWantedFor("wscall") {
-					fmt.Printf("%s (%s) callerOffer StoreCallerIp %s\n",
-						client.connType, callerID, tmpRemoteIP)
-				}
+				client.log.Debug("wscall", "callerOffer StoreCallerIp", "callerIp",tmpRemoteIP)
 			}
 		}
 */
@@ -546,196 +553,181 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		// connection watchdog now has two timeouts
 		// 1. from when caller connects (now) to when callee sends calleeAnswer (max 60s)
 		// 2. from when callee sends calleeAnswer to when p2p-connect should occur (max 14s)
-		go func() {
-			// NOTE: client is same as hub.CallerClient
-			client.calleeAnswerReceived = make(chan struct{}, 8)
-			secs := 60
-			timer := time.NewTimer(time.Duration(secs) * time.Second)
-			if logWantedFor("wsclose") {
-				fmt.Printf("%s (%s) %ds timer start ws=%d\n",
-					client.connType, client.calleeID, secs, wsClientID64)
-			}
-			select {
-			case <-timer.C:
-				// no calleeAnswer in response to callerOffer within 60s
-				// we want to send cancel to both clients,
-				// then disconnect the caller, reset the callee, and do peerConHasEnded
-				if logWantedFor("wsclose") {
-					fmt.Printf("%s (%s) %ds timer: time is up ws=%d\n",
-						client.connType, client.calleeID, secs, wsClientID64)
-				}
-				hub.HubMutex.RLock()
-				if hub.CallerClient!=nil {
-					// disconnect caller's ws-connection (client is caller)
-					client.Write([]byte("cancel|disconnect")) // ignore any errors
-				}
-				if hub.CalleeClient!=nil {
-					// callee is here, disconnect caller's ws-connection
-					err = hub.CalleeClient.Write([]byte("cancel|c"))
-					if err != nil {
-						// callee is gone
-						fmt.Printf("# %s (%s) %ds timer: time is up, cancel msg to callee failed %v\n",
-							hub.CalleeClient.connType, hub.CalleeClient.calleeID, secs, err)
-						hub.HubMutex.RUnlock()
-						hub.closeCallee("disconCallerAfter60s: cancel to callee: "+err.Error())
-						return
-					}
-				}
-				hub.HubMutex.RUnlock()
+		go client.callerWatchdog()
+		return
+	}
+	hub.HubMutex.Unlock()
 
-				// closePeerCon() will close the caller
-				hub.closePeerCon("disconCallAfter60s")
+	// can be ignored
+	//fmt.Printf("# %s (%s/%s) CallerClient already set [%s] %s ws=%d\n",
+	//	client.connType, client.calleeID, client.globalCalleeID, hub.CallerClient.RemoteAddr,
+	//	client.RemoteAddr, wsClientID64)
+}
+
+// callerWatchdog disconnects the caller (client) if the callee does not answer the callerOffer
+// within 60s or if there is no peer connection 14s after calleeAnswer
+func (client *WsClient) callerWatchdog() {
+	hub := client.hub
+	// NOTE: client is same as hub.CallerClient
+	client.calleeAnswerReceived = make(chan struct{}, 8)
+	secs := 60
+	timer := time.NewTimer(time.Duration(secs) * time.Second)
+	client.log.Debug("wsclose", "timer start", "secs",secs)
+	select {
+	case <-timer.C:
+		// no calleeAnswer in response to callerOffer within 60s
+		// we want to send cancel to both clients,
+		// then disconnect the caller, reset the callee, and do peerConHasEnded
+		client.log.Debug("wsclose", "timer: time is up", "secs",secs)
+		hub.HubMutex.RLock()
+		if hub.CallerClient!=nil {
+			// disconnect caller's ws-connection (client is caller)
+			client.Write([]byte("cancel|disconnect")) // ignore any errors
+		}
+		if hub.CalleeClient!=nil {
+			// callee is here, disconnect caller's ws-connection
+			err := hub.CalleeClient.Write([]byte("cancel|c"))
+			if err != nil {
+				// callee is gone
+				hub.CalleeClient.log.Error("timer: time is up, cancel msg to callee failed", "secs",secs, "err",err)
+				hub.HubMutex.RUnlock()
+				hub.closeCallee("disconCallerAfter60s: cancel to callee: "+err.Error())
 				return
-			case <-client.calleeAnswerReceived:
-				// event coming from cmd=="calleeAnswer"
-				// this is also used to signal "caller gone", but with CallerClient.isOnline=false
-				if logWantedFor("wsclose") {
-					fmt.Printf("%s (%s) %ds timer: calleeAnswerReceived ws=%d\n",
-						client.connType, client.calleeID, secs, wsClientID64)
-				}
-				timer.Stop()
-				// fall through, start 14s timer
 			}
+		}
+		hub.HubMutex.RUnlock()
 
-			delaySecs := 14
-			// incoming caller will get removed if there is no peerConnect after 14s
-			// (it can take up to 14 seconds in some cases for a devices to get fully out of deep sleep)
-			myCallerContactTime := hub.lastCallerContactTime
+		// closePeerCon() will close the caller
+		hub.closePeerCon("disconCallAfter60s")
+		return
+	case <-client.calleeAnswerReceived:
+		// event coming from cmd=="calleeAnswer"
+		// this is also used to signal "caller gone", but with CallerClient.isOnline=false
+		client.log.Debug("wsclose", "timer: calleeAnswerReceived", "secs",secs)
+		timer.Stop()
+		// fall through, start 14s timer
+	}
 
-			//fmt.Printf("%s (%s) caller conn 14s delay start\n", client.connType, client.calleeID)
-			time.Sleep(time.Duration(delaySecs) * time.Second)
-			//fmt.Printf("%s (%s) caller conn 14s delay end\n", client.connType, client.calleeID)
+	delaySecs := 14
+	// incoming caller will get removed if there is no peerConnect after 14s
+	// (it can take up to 14 seconds in some cases for a devices to get fully out of deep sleep)
+	myCallerContactTime := hub.lastCallerContactTime
 
-			hub.HubMutex.RLock()
-			if hub.CalleeClient==nil {
-				//fmt.Printf("%s (%s) no peercon check: callee gone (hub.CalleeClient==nil)\n",
-				//	client.connType, client.calleeID)
-				hub.HubMutex.RUnlock()
-				return
-			}
-			if hub.CallerClient==nil {
-				//fmt.Printf("%s (%s) no peercon check: caller gone (hub.CallerClient==nil)\n",
-				//	client.connType, client.calleeID)
-				hub.HubMutex.RUnlock()
-				return
-			}
-			if !hub.CallerClient.isOnline.Get() {
-				// this helps us to NOT throw a false NO PEERCON when the caller hanged up early
-				// we don't ws-disconnect the caller on peercon, so we can detect a hangup shortly after
-				//fmt.Printf("%s (%s) no peercon check: !CallerClient.isOnline\n",
-				//	client.connType, client.calleeID)
-				hub.HubMutex.RUnlock()
-				return
-			}
-			if !hub.CallerClient.callerOfferForwarded.Get() {
-				// caller has not sent a calleroffer yet -> it has hanged up early
-				//fmt.Printf("%s (%s) no peercon check: !CallerClient.callerOfferForwarded\n",
-				//	client.connType, client.calleeID)
-				hub.HubMutex.RUnlock()
-				return
-			}
+	//fmt.Printf("%s (%s) caller conn 14s delay start\n", client.connType, client.calleeID)
+	time.Sleep(time.Duration(delaySecs) * time.Second)
+	//fmt.Printf("%s (%s) caller conn 14s delay end\n", client.connType, client.calleeID)
 
-			client.reached14s.Set(true)
-			// if isConnectedToPeer and disconCallerOnPeerConnected -> force discon caller (but not peercon) now!
-			// caller onClose will from now on not anymore disconnect peercon on caller gone
-
-			if hub.CalleeClient.isConnectedToPeer.Get() {
-				// peercon steht; no peercon meldung nicht nötig; force caller ws-disconnect
-				// we know this is the caller, shall it be ws-disconnected?
-				readConfigLock.RLock()
-				myDisconCallerOnPeerConnected := disconCallerOnPeerConnected
-				readConfigLock.RUnlock()
-				if myDisconCallerOnPeerConnected {
-					// force-disconnect the caller WITHOUT disconnecting peerCon
-					hub.HubMutex.RUnlock()
-					if logWantedFor("wsclose") {
-						fmt.Printf("%s (%s) reached14s -> force disconnect caller\n",
-							client.connType, client.calleeID)
-					}
-					hub.closeCaller("disconCallerAfter14s") // this will clear .CallerClient
-					return
-				}
-				if logWantedFor("wsclose") {
-					fmt.Printf("%s (%s) reached14s -> do not force disconnect caller\n",
-						client.connType, client.calleeID)
-				}
-				hub.HubMutex.RUnlock()
-				return
-			}
+	hub.HubMutex.RLock()
+	if hub.CalleeClient==nil {
+		//fmt.Printf("%s (%s) no peercon check: callee gone (hub.CalleeClient==nil)\n",
+		//	client.connType, client.calleeID)
+		hub.HubMutex.RUnlock()
+		return
+	}
+	if hub.CallerClient==nil {
+		//fmt.Printf("%s (%s) no peercon check: caller gone (hub.CallerClient==nil)\n",
+		//	client.connType, client.calleeID)
+		hub.HubMutex.RUnlock()
+		return
+	}
+	if !hub.CallerClient.isOnline.Get() {
+		// this helps us to NOT throw a false NO PEERCON when the caller hanged up early
+		// we don't ws-disconnect the caller on peercon, so we can detect a hangup shortly after
+		//fmt.Printf("%s (%s) no peercon check: !CallerClient.isOnline\n",
+		//	client.connType, client.calleeID)
+		hub.HubMutex.RUnlock()
+		return
+	}
+	if !hub.CallerClient.callerOfferForwarded.Get() {
+		// caller has not sent a calleroffer yet -> it has hanged up early
+		//fmt.Printf("%s (%s) no peercon check: !CallerClient.callerOfferForwarded\n",
+		//	client.connType, client.calleeID)
+		hub.HubMutex.RUnlock()
+		return
+	}
+
+	client.reached14s.Set(true)
+	// if isConnectedToPeer and disconCallerOnPeerConnected -> force discon caller (but not peercon) now!
+	// caller onClose will from now on not anymore disconnect peercon on caller gone
+
+	if hub.CalleeClient.isConnectedToPeer.Get() {
+		// peercon steht; no peercon meldung nicht nötig; force caller ws-disconnect
+		// we know this is the caller, shall it be ws-disconnected?
+		readConfigLock.RLock()
+		myDisconCallerOnPeerConnected := disconCallerOnPeerConnected
+		readConfigLock.RUnlock()
+		if myDisconCallerOnPeerConnected {
+			// force-disconnect the caller WITHOUT disconnecting peerCon
+			hub.HubMutex.RUnlock()
+			client.log.Debug("wsclose", "reached14s -> force disconnect caller")
+			hub.closeCaller("disconCallerAfter14s") // this will clear .CallerClient
+			return
+		}
+		client.log.Debug("wsclose", "reached14s -> do not force disconnect caller")
+		hub.HubMutex.RUnlock()
+		return
+	}
 
-			if hub!=nil && myCallerContactTime != hub.lastCallerContactTime {
-				// this callee is engaged with a new caller session already (myCallerContactTime is outdated)
+	if hub!=nil && myCallerContactTime != hub.lastCallerContactTime {
+		// this callee is engaged with a new caller session already (myCallerContactTime is outdated)
 // TODO must investigate this
-				hub.HubMutex.RUnlock()
-				fmt.Printf("%s (%s) reached14s and no peerCon, but outdated %d != %d\n",
-					client.connType, client.calleeID, myCallerContactTime, hub.lastCallerContactTime)
-				return
-			}
+		hub.HubMutex.RUnlock()
+		client.log.Info("reached14s and no peerCon, but outdated",
+			"callerContactTime",myCallerContactTime, "lastCallerContactTime",hub.lastCallerContactTime)
+		return
+	}
 
-			// NO PEERCON: calleroffer received, but after 14s still no peer-connect: this is a webrtc issue
-			// let's assume both sides are still ws-connected. let's send a status msg to both
-			fmt.Printf("%s (%s) reached14s NO PEERCON📵 %ds %s <- %s (%s) %v ua=%s\n",
-				client.connType, client.calleeID, delaySecs, hub.CalleeClient.RemoteAddr,
-				client.RemoteAddr, client.callerID, client.isOnline.Get(), client.userAgent)
+	// NO PEERCON: calleroffer received, but after 14s still no peer-connect: this is a webrtc issue
+	// let's assume both sides are still ws-connected. let's send a status msg to both
+	client.log.Info("reached14s NO PEERCON📵", "secs",delaySecs, "calleeAddr",hub.CalleeClient.RemoteAddr,
+		"online",client.isOnline.Get(), "ua",client.userAgent)
 
 /* this is done by closePeerCon() below
-			// add missed call if dbUser.StoreMissedCalls is set
-			userKey := client.calleeID + "_" + strconv.FormatInt(int64(client.hub.registrationStartTime),10)
-			var dbUser DbUser
-			err = kvMain.Get(dbUserBucket, userKey, &dbUser)
-			if err!=nil {
-				fmt.Printf("# %s (%s) reached14s, failed to get dbUser for addMissedCall\n",
-					client.connType, client.calleeID)
-			} else if dbUser.StoreMissedCalls {
-				addMissedCall(hub.CalleeClient.calleeID,
-					CallerInfo{client.RemoteAddr, client.callerName, time.Now().Unix(),
-					client.callerID, client.callerTextMsg }, "NO PEERCON")
-			}
+	// add missed call if dbUser.StoreMissedCalls is set
+	userKey := client.calleeID + "_" + strconv.FormatInt(int64(client.hub.registrationStartTime),10)
+	var dbUser DbUser
+	err = kvMain.Get(dbUserBucket, userKey, &dbUser)
+	if err!=nil {
+		client.log.Error("reached14s, failed to get dbUser for addMissedCall", "err",err)
+	} else if dbUser.StoreMissedCalls {
+		addMissedCall(hub.CalleeClient.calleeID,
+			CallerInfo{client.RemoteAddr, client.callerName, time.Now().Unix(),
+			client.callerID, client.callerTextMsg }, "NO PEERCON")
+	}
 */
-			// NOTE: msg MUST NOT contain apostroph (') characters
-			msg := "Unable to establish a direct P2P connection. "+
-			  "This might be a WebRTC related issue with your browser/WebView. "+
-			  "Or with the browser/WebView on the other side. "+
-			  "It could also be a firewall issue. "+
-			  "On Android, run <a href=\"/webcall/android/#webview\">WebRTC-Check</a> "+
-			  "to test your System WebView."
-			err := client.Write([]byte("status|"+msg))
-			if err != nil {
-				// caller is gone
-				fmt.Printf("%s (%s) failed to send NO PEERCON msg to caller %s err=%v\n",
-					client.connType, client.calleeID, remoteAddr, err)
-				// ignore err bc below we disconnect the caller anyway
-			}
+	// NOTE: msg MUST NOT contain apostroph (') characters
+	msg := "Unable to establish a direct P2P connection. "+
+	  "This might be a WebRTC related issue with your browser/WebView. "+
+	  "Or with the browser/WebView on the other side. "+
+	  "It could also be a firewall issue. "+
+	  "On Android, run <a href=\"/webcall/android/#webview\">WebRTC-Check</a> "+
+	  "to test your System WebView."
+	err := client.Write([]byte("status|"+msg))
+	if err != nil {
+		// caller is gone
+		client.log.Info("failed to send NO PEERCON msg to caller", "err",err)
+		// ignore err bc below we disconnect the caller anyway
+	}
 
-			if strings.HasPrefix(hub.CalleeClient.calleeID,"answie") ||
-				strings.HasPrefix(hub.CalleeClient.calleeID,"talkback") {
-				// if callee is answie or talkback, the problem must be with the caller side
-				// don't send msg to callee
-			} else {
-				// this is a real callee-user
-				err = hub.CalleeClient.Write([]byte("status|"+msg))
-				if err != nil {
-					// callee is gone
-					fmt.Printf("%s (%s) failed to send NO PEERCON msg to callee %s err=%v\n",
-						client.connType, client.calleeID, hub.CalleeClient.RemoteAddr, err)
-					hub.HubMutex.RUnlock()
-					hub.closeCallee("failed to send NO PEERCON msg to callee: "+err.Error())
-					return
-				}
-			}
+	if strings.HasPrefix(hub.CalleeClient.calleeID,"answie") ||
+		strings.HasPrefix(hub.CalleeClient.calleeID,"talkback") {
+		// if callee is answie or talkback, the problem must be with the caller side
+		// don't send msg to callee
+	} else {
+		// this is a real callee-user
+		err = hub.CalleeClient.Write([]byte("status|"+msg))
+		if err != nil {
+			// callee is gone
+			client.log.Info("failed to send NO PEERCON msg to callee", "calleeAddr",hub.CalleeClient.RemoteAddr, "err",err)
 			hub.HubMutex.RUnlock()
-
-			// let callee alive but close caller + clear CallerIpInHubMap
-			hub.closePeerCon("NO PEERCON")
-		}()
-		return
+			hub.closeCallee("failed to send NO PEERCON msg to callee: "+err.Error())
+			return
+		}
 	}
-	hub.HubMutex.Unlock()
+	hub.HubMutex.RUnlock()
 
-	// can be ignored
-	//fmt.Printf("# %s (%s/%s) CallerClient already set [%s] %s ws=%d\n",
-	//	client.connType, client.calleeID, client.globalCalleeID, hub.CallerClient.RemoteAddr,
-	//	client.RemoteAddr, wsClientID64)
+	// let callee alive but close caller + clear CallerIpInHubMap
+	hub.closePeerCon("NO PEERCON")
 }
 
 func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn) {
@@ -754,8 +746,8 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 	tok := strings.Split(string(message),"|")
 	if len(tok)!=2 {
 		// invalid -> ignore
-		fmt.Printf("# serveWs receive len(tok)=%d is !=2; abort; checkLen=%d idxPipe=%d (%s)\n",
-			len(tok), checkLen, idxPipe, string(message[:checkLen]))
+		c.log.Warn("receive len(tok)!=2; abort",
+			"len",len(tok), "checkLen",checkLen, "idxPipe",idxPipe, "data",string(message[:checkLen]))
 		return
 	}
 
@@ -764,16 +756,21 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 
 	cmd := tok[0]
 	payload := tok[1]
+	if !c.isCallee && c.hub!=nil && c.hub.callWaitingMessage(c, cmd, message) {
+		// message from the waiting caller or from the caller on hold
+		return
+	}
+
 	if cmd=="init" {
 		// note: c == c.hub.CalleeClient
 		if !c.isCallee {
 			// only the callee can send "init|"
-			fmt.Printf("# %s (%s) deny init is not Callee %s\n", c.connType, c.calleeID, c.RemoteAddr)
+			c.log.Warn("deny init is not Callee")
 			return
 		}
 
 		if c.hub==nil {
-			fmt.Printf("# %s (%s) deny init c.hub==nil %s\n", c.connType, c.calleeID, c.RemoteAddr)
+			c.log.Warn("deny init c.hub==nil")
 			return
 		}
 
@@ -785,8 +782,17 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			c.hub.HubMutex.Unlock()
 
 			c.calleeInitReceived.Set(true)
+			if !c.hub.CalleeLogin.Get() {
+				// "init|" is sent again after every call
+				emitEvent(Event{Type:"login", CalleeID:c.calleeID})
+				c.hub.HubMutex.RLock()
+				presenceSet(c.calleeID, presenceStateOf(c.hub.IsCalleeHidden))
+				c.hub.HubMutex.RUnlock()
+			}
 			c.hub.CalleeLogin.Set(true)
 			c.pickupSent.Set(false)
+			// make this callee visible to the other cluster nodes
+			PublishCalleeInHubMap(c.globalCalleeID)
 
 			// closeCallee() will call setDeadline(0) and processTimeValues() if this is false; then set it true
 			c.callerTextMsg = ""
@@ -799,8 +805,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 				if ok {
 					loginCount = len(calleeLoginSlice)
 				}
-				fmt.Printf("%s (%s) callee init %d ws=%d %s v=%s\n",
-					c.connType, c.calleeID, loginCount, c.hub.WsClientID, c.RemoteAddr, c.clientVersion)
+				c.log.Debug("attach", "callee init", "logins",loginCount, "ver",c.clientVersion)
 			}
 
 // TODO clear blockMap[c.calleeID] ?
@@ -812,8 +817,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		// deliver the webcall codetag version string to callee
 		err := c.Write([]byte("sessionId|"+codetag))
 		if err != nil {
-			fmt.Printf("# %s (%s) send sessionId %s  <- to callee err=%v\n",
-				c.connType, c.calleeID, c.RemoteAddr, err)
+			c.log.Error("send sessionId to callee", "err",err)
 			c.hub.closeCallee("init, send sessionId to callee: "+err.Error())
 			return
 		}
@@ -826,14 +830,10 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 					// NOTE: msg MUST NOT contain apostroph (') characters
 					msg := "Please upgrade WebCall client to "+
 						   "<a href=\"/webcall/update/\">v"+clientUpdateBelowVersion+"&nbsp;or&nbsp;higher</a>"
-					if logWantedFor("attach") {
-						fmt.Printf("%s (%s) %s %s send status %s\n",
-							c.connType, c.calleeID, c.RemoteAddr, c.clientVersion, msg)
-					}
+					c.log.Debug("attach", "send status", "ver",c.clientVersion, "status",msg)
 					err = c.Write([]byte("status|"+msg))
 					if err != nil {
-						fmt.Printf("# %s (%s) send status (%s) %s <- to callee err=%v\n",
-							c.connType, c.calleeID, c.RemoteAddr, err)
+						c.log.Error("send status to callee", "err",err)
 						//c.hub.doUnregister(c, "init, send status to callee: "+err.Error())
 						//return
 					}
@@ -861,40 +861,41 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			}
 			var err error
 			if countOutdated>0 {
-				fmt.Printf("%s (%s) deleted %d outdated from waitingCallerSlice\n",
-					c.connType, c.calleeID, countOutdated)
+				c.log.Info("deleted outdated from waitingCallerSlice", "count",countOutdated)
 				err = kvCalls.Put(dbWaitingCaller, c.calleeID, waitingCallerSlice, true) // skipConfirm
 				if err!=nil {
-					fmt.Printf("# %s (%s) failed to store dbWaitingCaller\n",c.connType,c.calleeID)
+					c.log.Error("failed to store dbWaitingCaller", "err",err)
 				}
 			}
 
 			// send list of missedCalls to callee client
-			var missedCallsSlice []CallerInfo
-			// err can be ignored
-			kvCalls.Get(dbMissedCalls,c.calleeID,&missedCallsSlice)
+			missedCallsSlice,err := missedCallsLoad(c.calleeID)
+			if err!=nil {
+				c.log.Error("failed to load missedCalls", "err",err)
+			}
 // TODO must check if .DialID is still a valid ID for this callee
 // if a DialID is outdated, replace it with the calleeID - or with ""
 
 			if len(waitingCallerSlice)>0 || len(missedCallsSlice)>0 {
-				if logWantedFor("waitingCaller") {
-					fmt.Printf("%s (%s) waitingCaller=%d missedCalls=%d\n",c.connType,c.calleeID,
-						len(waitingCallerSlice),len(missedCallsSlice))
-				}
+				c.log.Debug("waitingCaller", "waitingCaller",
+					"waitingCallers",len(waitingCallerSlice), "missedCalls",len(missedCallsSlice))
 				// -> httpServer c.Write()
 				waitingCallerToCallee(c.calleeID, waitingCallerSlice, missedCallsSlice, c)
 			}
+
+			// let the callee client know about unread voicemails
+			if unread := voicemailUnread(c.calleeID); unread>0 {
+				c.Write([]byte("voicemail|"+strconv.Itoa(unread)))
+			}
 		}
 		return
 	}
 
 	if cmd=="dummy" {
-		fmt.Printf("%s (%s) dummy %s ip=%s ua=%s\n",
-			c.connType, c.calleeID, payload, c.RemoteAddr, c.userAgent)
+		c.log.Info("dummy", "payload",payload, "ua",c.userAgent)
 		err := c.Write([]byte(payload))
 		if err != nil {
-			fmt.Printf("# %s (%s) send dummy reply (isCallee=%v) error\n",
-				c.connType, c.isCallee, c.calleeID)
+			c.log.Error("send dummy reply", "isCallee",c.isCallee, "err",err)
 			c.hub.closeCallee("send dummy: "+err.Error())
 		}
 		return
@@ -914,19 +915,16 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		logTxtMsg := "(hidden)"
 		if c.hub==nil {
 			// don't log actual cleanMsg
-			fmt.Printf("# %s (%s) msg='%s' c.hub==nil callee=%v ip=%s ua=%s\n",
-				c.connType, c.calleeID, logTxtMsg, c.isCallee, c.RemoteAddr, c.userAgent)
+			c.log.Warn("msg but c.hub==nil", "text",logTxtMsg, "isCallee",c.isCallee, "ua",c.userAgent)
 			return
 		}
 		c.hub.HubMutex.Lock()
 		if c.hub.CalleeClient==nil {
 			// don't log actual cleanMsg
-			fmt.Printf("# %s (%s) msg='%s' c.hub.CalleeClient==nil callee=%v ip=%s ua=%s\n",
-				c.connType, c.calleeID, logTxtMsg, c.isCallee, c.RemoteAddr, c.userAgent)
+			c.log.Warn("msg but c.hub.CalleeClient==nil", "text",logTxtMsg, "isCallee",c.isCallee, "ua",c.userAgent)
 		} else {
 			// don't log actual cleanMsg
-			fmt.Printf("%s (%s) msg='%s' callee=%v ip=%s ua=%s\n",
-				c.connType, c.calleeID, logTxtMsg, c.isCallee, c.RemoteAddr, c.userAgent)
+			c.log.Info("msg", "text",logTxtMsg, "isCallee",c.isCallee, "ua",c.userAgent)
 
 			c.hub.CalleeClient.callerTextMsg = cleanMsg;
 		}
@@ -936,8 +934,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 
 	if cmd=="missedcall" {
 		// sent by caller on hangup without mediaconnect
-		fmt.Printf("%s (%s) missedcall='%s' callee=%v ip=%s ua=%s\n",
-			c.connType, c.calleeID, payload, c.isCallee, c.RemoteAddr, c.userAgent)
+		c.log.Info("missedcall", "payload",payload, "isCallee",c.isCallee, "ua",c.userAgent)
 		//c.hub.CalleeClient.callerTextMsg = payload;
 		missedCall(payload, c.RemoteAddr, "cmd=missedcall")
 		return
@@ -957,46 +954,59 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 
 		c.hub.HubMutex.RLock()
 		if c.hub.CalleeClient==nil {
-			fmt.Printf("# %s (%s) CALL🔔 from (%s) %s but hub.CalleeClient==nil\n",
-				c.connType, c.calleeID, c.callerID, c.RemoteAddr)
+			c.log.Warn("CALL🔔 but hub.CalleeClient==nil")
 			c.hub.HubMutex.RUnlock()
 			return
 		}
 		// prevent this callee from receiving a call, when already in a call
 		if c.hub.ConnectedCallerIp!="" {
 			// ConnectedCallerIp is set below by StoreCallerIpInHubMap()
-			fmt.Printf("# %s (%s) CALL🔔 but hub.ConnectedCallerIp not empty (%s) <- (%s) %s\n",
-				c.connType, c.calleeID, c.hub.ConnectedCallerIp, c.callerID, c.RemoteAddr)
+			c.log.Warn("CALL🔔 but callee is busy", "connectedCallerIp",c.hub.ConnectedCallerIp)
 
 			// add missed call if dbUser.StoreMissedCalls is set
 			userKey := c.calleeID + "_" + strconv.FormatInt(int64(c.hub.registrationStartTime),10)
 			var dbUser DbUser
 			err := kvMain.Get(dbUserBucket, userKey, &dbUser)
 			if err!=nil {
-				fmt.Printf("# %s (%s) failed to get dbUser\n",c.connType,c.calleeID)
+				c.log.Error("failed to get dbUser", "err",err)
 			} else if dbUser.StoreMissedCalls {
 				addMissedCall(c.calleeID, CallerInfo{c.RemoteAddr, c.callerName,
 					time.Now().Unix(), c.callerID, c.callerTextMsg }, "callee busy")
 			}
+			cdrRejected(c.calleeID, c, "callee busy")
+			c.hub.HubMutex.RUnlock()
+			return
+		}
+
+		// the text msg (if any) was sent by the caller before callerOffer
+		reason := callFilter(c.calleeID, CallAttempt{CallerID:c.callerID, CallerName:c.callerName,
+			Msg:c.hub.CalleeClient.callerTextMsg, Ip:c.RemoteAddr, Stage:"offer"})
+		if reason!="" {
+			c.log.Info("CALL🔔 blocked by call filter", "reason",reason)
 			c.hub.HubMutex.RUnlock()
+			c.callFilterReject(reason)
 			return
 		}
 
-		fmt.Printf("%s (%s) CALL🔔 %s <- %s (%s) v=%s ua=%s\n",
-			c.connType, c.calleeID, c.hub.CalleeClient.RemoteAddr,
-				c.RemoteAddr, c.callerID, c.clientVersion, c.userAgent)
+		c.log.Info("CALL🔔", "calleeAddr",c.hub.CalleeClient.RemoteAddr, "ver",c.clientVersion, "ua",c.userAgent)
+
+		// the callee gets the TURN credentials of this call before the callerOffer
+		if turnMsg := turnCredentialsMsg(c.turnUsername, c.hub.CalleeClient.RemoteAddrNoPort); turnMsg!=nil {
+			c.hub.CalleeClient.Write(turnMsg)
+		}
 
 		// forward the callerOffer message to the callee client
 		err := c.hub.CalleeClient.Write(message)
 		if err != nil {
 			// callee is gone
-			fmt.Printf("# %s (%s) CALL CalleeClient.Write(calleroffer) fail %v\n",
-				c.connType, c.calleeID, err)
+			c.log.Error("CALL CalleeClient.Write(calleroffer) fail", "err",err)
 			c.hub.HubMutex.RUnlock()
 			c.hub.closeCallee("send callerOffer to callee: "+err.Error())
 			return
 		}
 		c.callerOfferForwarded.Set(true)
+		c.hub.cdrStart(c)
+		emitEvent(Event{Type:"ring", CalleeID:c.calleeID, CallerID:c.callerID, CallerName:c.callerName})
 
 		// send callerInfo to callee (see callee.js if(cmd=="callerInfo"))
 		if c.callerID!="" || c.callerName!="" {
@@ -1010,8 +1020,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			err = c.hub.CalleeClient.Write([]byte(sendCmd))
 			if err != nil {
 				// callee is gone
-				fmt.Printf("# %s (%s) CALL CalleeClient.Write(callerInfo) fail %v\n",
-					c.connType, c.calleeID, err)
+				c.log.Error("CALL CalleeClient.Write(callerInfo) fail", "err",err)
 				c.hub.HubMutex.RUnlock()
 				c.hub.closeCallee("send callerInfo to callee: "+err.Error())
 				return
@@ -1029,15 +1038,14 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			var dbUser DbUser
 			err := kvMain.Get(dbUserBucket, userKey, &dbUser)
 			if err!=nil {
-				fmt.Printf("# %s (%s) fail get dbUser.Name\n", c.connType, c.hub.CalleeClient.calleeID)
+				c.log.Error("fail get dbUser.Name", "err",err)
 			} else {
 				if dbUser.Name!="" {
 					sendCmd := "calleeInfo|"+c.hub.CalleeClient.calleeID+"\t"+dbUser.Name
 					err = c.Write([]byte(sendCmd))
 					if err != nil {
 						// caller is gone
-						fmt.Printf("# %s (%s) fail sending calleeInfo to caller %v\n",
-							c.connType, c.hub.CalleeClient.calleeID, err)
+						c.log.Error("fail sending calleeInfo to caller", "err",err)
 						c.hub.HubMutex.RUnlock()
 						c.hub.closePeerCon("send calleeInfo to caller: "+err.Error())
 						return
@@ -1055,8 +1063,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		err = c.hub.CalleeClient.Write([]byte("ua|"+c.userAgent))
 		if err != nil {
 			// callee is gone
-			fmt.Printf("# %s (%s) send caller ua to callee fail (early callee ws-disconnect?) %v\n",
-				c.connType, c.calleeID, err)
+			c.log.Error("send caller ua to callee fail (early callee ws-disconnect?)", "err",err)
 			c.hub.HubMutex.RUnlock()
 			c.hub.closeCallee("send caller ua to callee: "+err.Error())
 			return
@@ -1067,8 +1074,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		c.hub.HubMutex.RUnlock()
 		if err != nil {
 			// caller hang up already?
-			fmt.Printf("# %s (%s) send callee-ua to caller fail (early caller ws-disconnect?) %v\n",
-				c.connType, c.calleeID, err)
+			c.log.Error("send callee ua to caller fail (early caller ws-disconnect?)", "err",err)
 			c.hub.closePeerCon("send callee ua to caller "+err.Error())
 			return
 		}
@@ -1081,27 +1087,19 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		// this is also needed for turn AuthHandler: store caller RemoteAddr
 		err = StoreCallerIpInHubMap(c.globalCalleeID, c.RemoteAddr, false)
 		if err!=nil {
-			fmt.Printf("# %s (%s) callerOffer StoreCallerIp %s err=%v\n",
-				c.connType, c.globalCalleeID, c.RemoteAddr, err)
+			c.log.Error("callerOffer StoreCallerIp", "globalCalleeID",c.globalCalleeID, "err",err)
 		} else {
-			if logWantedFor("wscall") {
-				fmt.Printf("%s (%s) callerOffer StoreCallerIp %s\n",
-					c.connType, c.globalCalleeID, c.RemoteAddr)
-			}
+			c.log.Debug("wscall", "callerOffer StoreCallerIp", "globalCalleeID",c.globalCalleeID)
 		}
 		return
 	}
 
 	if cmd=="calleeAnswer" {
 		if c.hub!=nil && c.hub.CallerClient!=nil {
-			if logWantedFor("wsclose") {
-				fmt.Printf("%s (%s) calleeAnswer forward to caller %s\n", c.connType, c.calleeID, c.RemoteAddr)
-			}
+			c.log.Debug("wsclose", "calleeAnswer forward to caller")
 			c.hub.CallerClient.calleeAnswerReceived <- struct{}{}
 		} else {
-			if logWantedFor("wsclose") {
-			  fmt.Printf("%s (%s) calleeAnswer no c.hub.CallerClient %s\n", c.connType, c.calleeID, c.RemoteAddr)
-			}
+			c.log.Debug("wsclose", "calleeAnswer no c.hub.CallerClient")
 		}
 		// must still forward calleeAnswer to caller (see below: cmd/payload to other client)
 	}
@@ -1111,19 +1109,16 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 	}
 
 	if cmd=="cancel" {
-		if logWantedFor("wsclose") {
-			fmt.Printf("%s (%s) cmd=cancel callee=%v payload=%s %s\n",
-				c.connType, c.calleeID, c.isCallee, payload, c.RemoteAddr)
-		}
+		c.log.Debug("wsclose", "cmd=cancel", "isCallee",c.isCallee, "payload",payload)
 		if c.hub==nil {
-			fmt.Printf("# %s cmd=cancel but c.hub==nil %s (%s)\n",c.connType,c.RemoteAddr,payload)
+			c.log.Warn("cmd=cancel but c.hub==nil", "payload",payload)
 			return
 		}
 		c.hub.HubMutex.RLock()
 		if c.hub.CalleeClient==nil {
 			c.hub.HubMutex.RUnlock()
 			// we receive a "cmd=cancel|" (from the caller?) but the callee is logged out
-			fmt.Printf("# %s cmd=cancel but c.hub.CalleeClient==nil %s (%s)\n",c.connType,c.RemoteAddr,payload)
+			c.log.Warn("cmd=cancel but c.hub.CalleeClient==nil", "payload",payload)
 			c.hub.closeCallee("callee already gone")
 			return
 		}
@@ -1134,16 +1129,14 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			if c.isCallee && payload!="disconnectByCaller" {
 				// NOTE: the actual discon request may also come from the caller
 				// but the caller is likely ws-disconnected, so it comes via the callee client
-				fmt.Printf("%s (%s) REQ PEER DISCON %s by callee cancel='%s'\n",
-					c.connType, c.calleeID, c.RemoteAddr, payload)
+				c.log.Info("REQ PEER DISCON by callee", "cancel",payload)
 				// end the peer-connection
 				c.hub.HubMutex.RUnlock()
 				c.hub.closePeerCon("callee "+payload)
 				return
 			}
 			// c.RemoteAddr is callee-ip (c.hub.CallerClient may be nil already)
-			fmt.Printf("%s (%s) REQ PEER DISCON %s <- by caller cancel='%s'\n",
-				c.connType, c.calleeID, c.RemoteAddr, payload)
+			c.log.Info("REQ PEER DISCON by caller", "cancel",payload)
 			// end the peer-connection
 			c.hub.HubMutex.RUnlock()
 			c.hub.closePeerCon("caller "+payload)
@@ -1155,8 +1148,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			if c.isCallee {
 				// callee fw disconnect to caller
 				if c.hub.CallerClient!=nil {
-					fmt.Printf("%s (%s) FW PEER DISCON from callee %s cancel='%s'\n",
-						c.connType, c.calleeID, c.RemoteAddr, payload)
+					c.log.Info("FW PEER DISCON from callee", "cancel",payload)
 					// callee wants the caller gone
 					c.hub.CallerClient.Write([]byte(message)) // ignore any error
 
@@ -1172,8 +1164,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			} else {
 				// caller fw disconnect to callee
 				if c.hub.CalleeClient!=nil {
-					fmt.Printf("%s (%s) FW PEER DISCON from caller %s cancel='%s'\n",
-						c.connType, c.calleeID, c.RemoteAddr, payload)
+					c.log.Info("FW PEER DISCON from caller", "cancel",payload)
 					if c.hub.CallerClient!=nil {
 						// timer.Stop()
 						c.isOnline.Set(false)	// ???
@@ -1182,8 +1173,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 					err := c.hub.CalleeClient.Write([]byte(message))
 					c.hub.HubMutex.RUnlock()
 					if err != nil {
-						fmt.Printf("# %s (%s) fw caller-cancel to callee fail %v\n",
-							c.connType, c.calleeID, err)
+						c.log.Error("fw caller-cancel to callee fail", "err",err)
 						c.hub.closeCallee("fw caller-cancel to callee: "+err.Error())
 						return
 					}
@@ -1210,6 +1200,8 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		c.hub.IsUnHiddenForCallerAddr = ""
 		calleeHidden := c.hub.IsCalleeHidden
 		c.hub.HubMutex.Unlock()
+		// a busy callee stays busy; the hangup will set the new state
+		presenceSet(c.calleeID, presenceStateOf(calleeHidden), "online", "hidden")
 
 		/* only need to do this if a global hub is being used (c.hub.IsCalleeHidden already set above)
 		// forward state of c.isHiddenCallee to globalHubMap
@@ -1217,7 +1209,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		if err != nil {
 			// via dbLayer.go: return locSetCalleeHiddenState(calleeId, hidden)
 			// hubMap[c.calleeID] == nil (in skvLayer.go)
-			fmt.Printf("# serveWs (%s) SetCalleeHiddenState %v err=%v\n", c.calleeID, calleeHidden, err)
+			c.log.Error("serveWs SetCalleeHiddenState", "hidden",calleeHidden, "err",err)
 		}
 		*/
 
@@ -1227,20 +1219,17 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		var dbUser DbUser
 		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
 		if err!=nil {
-			fmt.Printf("# serveWs (%s) cmd=calleeHidden db=%s bucket=%s getX key=%v err=%v\n",
-				c.calleeID, dbMainName, dbUserBucket, userKey, err)
+			c.log.Error("cmd=calleeHidden get dbUser", "key",userKey, "err",err)
 		} else {
 			if calleeHidden {
 				dbUser.Int2 |= 1
 			} else {
 				dbUser.Int2 &= ^1
 			}
-			fmt.Printf("%s (%s) set hidden=%v %d %s\n", c.connType, c.calleeID,
-				calleeHidden, dbUser.Int2, c.RemoteAddr)
+			c.log.Info("set hidden", "hidden",calleeHidden, "int2",dbUser.Int2)
 			err := kvMain.Put(dbUserBucket, userKey, dbUser, true) // skipConfirm
 			if err!=nil {
-				fmt.Printf("# serveWs (%s) calleeHidden db=%s bucket=%s put key=%v %s err=%v\n",
-					c.calleeID, dbMainName, dbUserBucket, userKey, c.RemoteAddr, err)
+				c.log.Error("cmd=calleeHidden put dbUser", "key",userKey, "err",err)
 			} else {
 				//fmt.Printf("%s calleeHidden db=%s bucket=%s put key=%v OK\n",
 				//	c.connType, dbMainName, dbUserBucket, userKey)
@@ -1249,11 +1238,11 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 				var dbUser2 DbUser
 				err := kvMain.Get(dbUserBucket, userKey, &dbUser2)
 				if err!=nil {
-					fmt.Printf("# serveWs calleeHidden verify db=%s bucket=%s getX key=%v err=%v\n",
-						dbMainName, dbUserBucket, userKey, err)
+					c.log.Error("serveWs calleeHidden verify", "db",dbMainName, "bucket",dbUserBucket,
+						"key",userKey, "err",err)
 				} else {
-					fmt.Printf("serveWs calleeHidden verify userKey=%v isHiddenCallee=%v (%d)\n",
-						userKey, dbUser2.Int2&1!=0, dbUser2.Int2)
+					c.log.Info("serveWs calleeHidden verify", "userKey",userKey,
+						"isHiddenCallee",dbUser2.Int2&1!=0, "int2",dbUser2.Int2)
 				}
 				*/
 			}
@@ -1272,8 +1261,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		var dbUser DbUser
 		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
 		if err!=nil {
-			fmt.Printf("# serveWs (%s) cmd=dialsounds db=%s bucket=%s getX key=%v err=%v\n",
-				c.calleeID, dbMainName, dbUserBucket, userKey, err)
+			c.log.Error("cmd=dialsoundsmuted get dbUser", "key",userKey, "err",err)
 		} else {
 			// store dbUser after set/clear dialSoundsMuted in dbUser.Int2&4
 			if dialSoundsMuted {
@@ -1281,86 +1269,49 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 			} else {
 				dbUser.Int2 &= ^4
 			}
-			fmt.Printf("%s (%s) set dialSoundsMuted=%v %d %s %s\n", c.connType, c.calleeID,
-				dialSoundsMuted, dbUser.Int2, userKey, c.RemoteAddr)
+			c.log.Info("set dialSoundsMuted", "muted",dialSoundsMuted, "int2",dbUser.Int2, "key",userKey)
 			err := kvMain.Put(dbUserBucket, userKey, dbUser, true) // skipConfirm
 			if err!=nil {
-				fmt.Printf("# serveWs (%s) dialSoundsMuted db=%s bucket=%s put key=%v %s err=%v\n",
-					c.calleeID, dbMainName, dbUserBucket, userKey, c.RemoteAddr, err)
+				c.log.Error("cmd=dialsoundsmuted put dbUser", "key",userKey, "err",err)
 			}
 		}
 		return
 	}
 
+	if cmd=="presenceSubscribe" || cmd=="presenceUnsubscribe" {
+		if !c.isCallee || !c.calleeInitReceived.Get() {
+			c.log.Warn("deny "+cmd+" not a logged in callee")
+			return
+		}
+		if cmd=="presenceSubscribe" {
+			c.presenceSubscribe(payload)
+		} else {
+			presenceUnsubscribe(c)
+		}
+		return
+	}
+
 	if cmd=="pickupWaitingCaller" {
 		// for callee only
 		// payload = ip:port
 		callerAddrPort := payload
-		fmt.Printf("%s pickupWaitingCaller from %s (%s)\n", c.connType, c.RemoteAddr, callerAddrPort)
+		c.log.Info("pickupWaitingCaller", "callerAddrPort",callerAddrPort)
 		// this will end the frozen xhr call by the caller in httpNotifyCallee.go (see: case <-c)
-		waitingCallerChanMap[callerAddrPort] <- 1
+		// in cluster mode the caller may be waiting on another node
+		PickupWaitingCaller(callerAddrPort)
 		return
 	}
 
 	if cmd=="deleteMissedCall" {
-		// for callee only: payload = ip:port:callTime
-		callerAddrPortPlusCallTime := payload
-		//fmt.Printf("%s deleteMissedCall from %s callee=%s (payload=%s)\n",
-		//	c.connType, c.RemoteAddr, c.calleeID, callerAddrPortPlusCallTime)
-
-		// remove this call from dbMissedCalls for c.calleeID
-		// first: load dbMissedCalls for c.calleeID
-		var missedCallsSlice []CallerInfo
-		userKey := c.calleeID + "_" + strconv.FormatInt(int64(c.hub.registrationStartTime),10)
-		var dbUser DbUser
-		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+		// for callee only: payload = id of the missed call (or legacy ip:port_callTime)
+		missedCallsSlice,found,err := missedCallRemove(c.calleeID, payload)
 		if err!=nil {
-			fmt.Printf("# %s (%s) failed to get dbUser\n",c.connType,c.calleeID)
-		} else if dbUser.StoreMissedCalls {
-			err = kvCalls.Get(dbMissedCalls,c.calleeID,&missedCallsSlice)
-			if err!=nil {
-				fmt.Printf("# serveWs deleteMissedCall (%s) failed to read dbMissedCalls\n",c.calleeID)
-			}
+			c.log.Error("deleteMissedCall fail store dbMissedCalls", "err",err)
+			return
 		}
-		if len(missedCallsSlice)>0 {
-			//fmt.Printf("serveWs deleteMissedCall (%s) found %d entries\n",
-			//	c.calleeID, len(missedCallsSlice))
-			// search for callerIP:port + CallTime == callerAddrPortPlusCallTime
-			for idx := range missedCallsSlice {
-				//id := fmt.Sprintf("%s_%d",missedCallsSlice[idx].AddrPort,missedCallsSlice[idx].CallTime)
-				id := missedCallsSlice[idx].AddrPort + "_" +
-					 strconv.FormatInt(int64(missedCallsSlice[idx].CallTime),10)
-				//fmt.Printf("deleteMissedCall %s compare (%s==%s)\n", callerAddrPortPlusCallTime, id)
-				if id == callerAddrPortPlusCallTime {
-					//fmt.Printf("serveWs deleteMissedCall idx=%d\n",idx)
-					missedCallsSlice = append(missedCallsSlice[:idx], missedCallsSlice[idx+1:]...)
-					// store modified dbMissedCalls for c.calleeID
-					err := kvCalls.Put(dbMissedCalls, c.calleeID, missedCallsSlice, false)
-					if err!=nil {
-						fmt.Printf("# serveWs deleteMissedCall (%s) fail store dbMissedCalls\n", c.calleeID)
-					}
-					// send modified missedCallsSlice to callee
-					json, err := json.Marshal(missedCallsSlice)
-					if err != nil {
-						fmt.Printf("# serveWs deleteMissedCall (%s) failed json.Marshal\n", c.calleeID)
-					} else {
-						//fmt.Printf("deleteMissedCall send missedCallsSlice %s\n", c.calleeID)
-						c.hub.HubMutex.RLock()
-						if c.hub.CalleeClient!=nil {
-							err = c.Write([]byte("missedCalls|"+string(json)))
-							if err != nil {
-								fmt.Printf("# %s (%s) send missedCalls fail %v\n",
-									c.connType, c.calleeID, err)
-								c.hub.HubMutex.RUnlock()
-								c.hub.closeCallee("send missedCalls to callee: "+err.Error())
-								return
-							}
-						}
-						c.hub.HubMutex.RUnlock()
-					}
-					break
-				}
-			}
+		if found {
+			// send modified missedCallsSlice to callee
+			missedCallsPush(c.calleeID, missedCallsSlice)
 		}
 		return
 	}
@@ -1368,10 +1319,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 	if cmd=="pickup" {
 		// this is sent by the callee client
 		if !c.isConnectedToPeer.Get() {
-			if logWantedFor("login") {
-				fmt.Printf("# %s (%s) pickup ignored no peerConnect %s\n",
-					c.connType, c.calleeID, c.RemoteAddr)
-			}
+			c.log.Debug("login", "pickup ignored no peerConnect")
 			return
 		}
 		if c.pickupSent.Get() {
@@ -1383,21 +1331,28 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 
 		c.hub.HubMutex.Lock()
 		c.hub.lastCallStartTime = time.Now().Unix()
-		c.hub.HubMutex.Unlock()
-		if logWantedFor("hub") {
-			fmt.Printf("%s (%s) pickup online=%v peerCon=%v starttime=%d\n",
-				c.connType, c.calleeID, c.isOnline.Get(), c.isConnectedToPeer.Get(), c.hub.lastCallStartTime)
+		if c.hub.lastCallerContactTime>0 {
+			metricsRingDuration.Observe("", float64(c.hub.lastCallStartTime - c.hub.lastCallerContactTime))
 		}
+		c.hub.HubMutex.Unlock()
+		c.hub.cdrPickup()
+		c.log.Debug("hub", "pickup", "online",c.isOnline.Get(), "peerCon",c.isConnectedToPeer.Get(),
+			"starttime",c.hub.lastCallStartTime)
 		c.hub.HubMutex.RLock()
+		pickupEvent := Event{Type:"pickup", CalleeID:c.calleeID, CallerID:c.hub.CallerID}
+		if c.hub.CallerClient!=nil {
+			pickupEvent.CallerName = c.hub.CallerClient.callerName
+		}
+		emitEvent(pickupEvent)
+		presenceSet(c.calleeID, "busy")
+		// the caller may be calling back a missed call
+		go missedCallsCalledBack(c.hub.CallerID, c.calleeID)
 		if c.hub.CallerClient!=nil {
 			// deliver "pickup" to the caller
-			if logWantedFor("wscall") {
-				fmt.Printf("%s (%s) forward pickup to caller (%s)\n", c.connType, c.calleeID, message)
-			}
+			c.log.Debug("wscall", "forward pickup to caller", "message",string(message))
 			err := c.hub.CallerClient.Write(message)
 			if err != nil {
-				fmt.Printf("# %s (%s) send cancel msg to caller fail %v\n",
-					c.connType, c.calleeID, err)
+				c.log.Error("send pickup msg to caller fail", "err",err)
 				c.hub.HubMutex.RUnlock()
 				c.hub.closePeerCon("forward pickup to caller "+err.Error())
 				return
@@ -1409,6 +1364,32 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		return
 	}
 
+	if cmd=="acceptWaiting" || cmd=="rejectWaiting" || cmd=="switchHeld" || cmd=="endHeld" ||
+			cmd=="transfer" || cmd=="consult" || cmd=="transferComplete" {
+		// call waiting and call transfer, for callee only (see callwaiting.go)
+		if !c.isCallee || c.hub==nil {
+			c.log.Warn("deny "+cmd+" not callee")
+			return
+		}
+		switch cmd {
+		case "acceptWaiting":
+			c.hub.acceptWaiting(payload)
+		case "rejectWaiting":
+			c.hub.rejectWaiting()
+		case "switchHeld":
+			c.hub.switchHeld()
+		case "endHeld":
+			c.hub.endHeld()
+		case "transfer":
+			c.hub.transfer(c, strings.TrimSpace(payload))
+		case "consult":
+			c.hub.consult(c, strings.TrimSpace(payload))
+		case "transferComplete":
+			c.hub.transferComplete(c)
+		}
+		return
+	}
+
 	if cmd=="heartbeat" {
 		// ignore: clients may send this to check the connection to the server
 		return
@@ -1420,8 +1401,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 		err := c.Write([]byte("confirm|"+payload))
 		if err != nil {
 			// client is gone
-			fmt.Printf("# %s (%s) send confirm for check (callee=%v) fail %v\n",
-				c.connType, c.calleeID, c.isCallee, err)
+			c.log.Error("send confirm for check fail", "isCallee",c.isCallee, "err",err)
 			if c.isCallee {
 				c.hub.closeCallee("send confirm for check: "+err.Error())
 				return
@@ -1434,19 +1414,18 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 	if cmd=="log" {
 		// TODO make extra sure payload is not malformed
 		if c==nil {
-			fmt.Printf("# peer c==nil\n")
+			logError("peer c==nil")
 			return
 		}
 		if c.hub==nil {
-			fmt.Printf("# %s (%s) peer c.hub==nil v=%s\n", c.connType, c.calleeID, c.clientVersion)
+			c.log.Error("peer c.hub==nil", "ver",c.clientVersion)
 			return
 		}
 
 		c.hub.HubMutex.RLock()
 		if c.hub.CalleeClient==nil {
 			c.hub.HubMutex.RUnlock()
-			fmt.Printf("# %s (%s) peer %s c.hub.CalleeClient==nil v=%s\n",
-				c.connType, c.calleeID, payload, c.clientVersion)
+			c.log.Error("peer c.hub.CalleeClient==nil", "payload",payload, "ver",c.clientVersion)
 			return
 		}
 
@@ -1470,19 +1449,16 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 //					c.connType, c.calleeID, tok[0], constateShort, tok[2], c.hub.CalleeClient.RemoteAddrNoPort,
 //					c.hub.CallerIpNoPort, c.hub.CallerID)
 //			} else {
-				fmt.Printf("%s (%s) PEER %s %s %s %s <- %s (%s)\n",
-					c.connType, c.calleeID, tok[0], constateShort, tok[2], c.hub.CalleeClient.RemoteAddrNoPort,
-					c.hub.CallerIpNoPort, c.hub.CallerID)
+				c.log.Info("PEER "+tok[0]+" "+constateShort, "con",tok[2], "calleeIp",c.hub.CalleeClient.RemoteAddrNoPort,
+					"callerIp",c.hub.CallerIpNoPort, "callerID",c.hub.CallerID)
 //			}
 		} else {
 			if strings.HasPrefix(constate,"Con") && !c.isConnectedToPeer.Get() {
-				fmt.Printf("%s (%s) PEER %s %s☎️ %s %s <- %s (%s)\n",
-					c.connType, c.calleeID, tok[0], constateShort, tok[2], c.hub.CalleeClient.RemoteAddrNoPort,
-					c.hub.CallerIpNoPort, c.hub.CallerID)
+				c.log.Info("PEER "+tok[0]+" "+constateShort+"☎️", "con",tok[2], "calleeIp",c.hub.CalleeClient.RemoteAddrNoPort,
+					"callerIp",c.hub.CallerIpNoPort, "callerID",c.hub.CallerID)
 			} else {
-				fmt.Printf("%s (%s) PEER %s %s %s %s <- %s (%s)\n",
-					c.connType, c.calleeID, tok[0], constateShort, tok[2], c.hub.CalleeClient.RemoteAddrNoPort,
-					c.hub.CallerIpNoPort, c.hub.CallerID)
+				c.log.Info("PEER "+tok[0]+" "+constateShort, "con",tok[2], "calleeIp",c.hub.CalleeClient.RemoteAddrNoPort,
+					"callerIp",c.hub.CallerIpNoPort, "callerID",c.hub.CallerID)
 			}
 		}
 
@@ -1517,10 +1493,10 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 						c.hub.RemoteP2p = true
 					}
 				} else {
-					fmt.Printf("# %s tok2string=%s has no slash\n", c.connType, tok2string)
+					c.log.Warn("peer con has no slash", "con",tok2string)
 				}
 			} else {
-				fmt.Printf("# %s len(tok)<3\n", c.connType)
+				c.log.Warn("peer len(tok)<3")
 			}
 
 			if constate=="Connected" || constate=="ConForce" {
@@ -1553,6 +1529,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 							compoundName := c.hub.CallerClient.callerName+"||"
 							setContact(c.calleeID, c.hub.CallerID, compoundName,
 								c.RemoteAddrNoPort, "wsClient")
+							contactCalled(c.calleeID, c.hub.CallerID)
 						}
 
 						if c.hub.maxTalkSecsIfNoP2p>0 && (!c.hub.LocalP2p || !c.hub.RemoteP2p) {
@@ -1577,8 +1554,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 						err := c.hub.CalleeClient.Write([]byte("callerConnect|"))
 						if err != nil {
 							// callee gone
-							fmt.Printf("# %s (%s) send callerConnect to callee fail %v\n",
-								c.connType, c.calleeID, err)
+							c.log.Error("send callerConnect to callee fail", "err",err)
 							c.hub.HubMutex.RUnlock()
 							c.hub.closeCallee("send callerConnect to callee: "+err.Error())
 							return
@@ -1590,10 +1566,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 						// but only if 14s has passed
 
 						if !c.hub.CallerClient.reached14s.Get() {
-							if logWantedFor("wsclose") {
-								fmt.Printf("%s (%s) peercon before reached14s, no force caller ws-disconnect\n",
-									c.connType, c.calleeID)
-							}
+							c.log.Debug("wsclose", "peercon before reached14s, no force caller ws-disconnect")
 						} else {
 							// shall caller be ws-disconnected after peer-con?
 							readConfigLock.RLock()
@@ -1601,10 +1574,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 							readConfigLock.RUnlock()
 							if myDisconCallerOnPeerConnected {
 								if c.hub.CallerClient != nil {
-									if logWantedFor("wsclose") {
-										fmt.Printf("%s (%s) peercon -> force caller ws-disconnect %s\n",
-											c.connType, c.calleeID, c.RemoteAddr)
-									}
+									c.log.Debug("wsclose", "peercon -> force caller ws-disconnect")
 									c.hub.HubMutex.RUnlock()
 									// here we disconnect the caller WITHOUT disconnecting peerCon
 									c.hub.closeCaller("disconCallerOnPeerConnected") // will clear .CallerClient
@@ -1623,21 +1593,14 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 	if len(payload)>0 {
 		// forward cmd/payload to other client
 		if c.hub!=nil {
-			if logWantedFor("wsreceive") {
-				fmt.Printf("%s recv/fw %s|%s iscallee=%v %s\n",
-					c.connType, cmd, payload, c.isCallee, c.RemoteAddr)
-			} else {
-				//fmt.Printf("%s recv/fw %s iscallee=%v %s\n",
-				//	c.connType, cmd, c.isCallee, c.RemoteAddr)
-			}
+			c.log.Debug("wsreceive", "recv/fw", "cmd",cmd, "payload",payload, "isCallee",c.isCallee)
 			c.hub.HubMutex.RLock()
 			if c.isCallee {
 				if c.hub.CallerClient!=nil {
 					err := c.hub.CallerClient.Write(message)
 					if err != nil {
 						// caller gone
-						fmt.Printf("# %s (%s) fw msg to caller fail %v\n",
-							c.connType, c.calleeID, err)
+						c.log.Error("fw msg to caller fail", "err",err)
 						// saw err = 'not connected'
 						c.hub.HubMutex.RUnlock()
 						c.hub.closePeerCon("fw msg to caller "+err.Error())
@@ -1650,8 +1613,7 @@ func (c *WsClient) handleClientMessage(message []byte, cliWsConn *websocket.Conn
 					err := c.hub.CalleeClient.Write(message)
 					if err != nil {
 						// callee gone
-						fmt.Printf("# %s (%s) fw msg to callee fail %v\n",
-							c.connType, c.calleeID, err)
+						c.log.Error("fw msg to callee fail", "err",err)
 						c.hub.HubMutex.RUnlock()
 						c.hub.closeCallee("fw msg to callee: "+err.Error())
 						return
@@ -1672,20 +1634,14 @@ func (c *WsClient) Write(b []byte) error {
 		//	c.connType, b[:max], c.calleeID, c.isCallee, c.isConnectedToPeer.Get())
 		return ErrWriteNotConnected
 	}
-	if logWantedFor("wswrite") {
-		fmt.Printf("%s Write (%s) to %s callee=%v peerCon=%v\n",
-			c.connType, b[:max], c.calleeID, c.isCallee, c.isConnectedToPeer.Get())
-	}
+	c.log.Debug("wswrite", "Write", "data",string(b[:max]), "isCallee",c.isCallee, "peerCon",c.isConnectedToPeer.Get())
 
 	return c.wsConn.WriteMessage(websocket.TextMessage, b)
 }
 
 func (c *WsClient) Close(reason string) {
 	// Close() is only called by hub.closeCaller() and hub.closeCallee()
-	if logWantedFor("wsclose") {
-		fmt.Printf("%s (%s) Close callee=%v online=%v '%s'\n",
-			c.connType, c.calleeID, c.isCallee, c.isOnline.Get(), reason)
-	}
+	c.log.Debug("wsclose", "Close", "isCallee",c.isCallee, "online",c.isOnline.Get(), "reason",reason)
 
 	if c.isOnline.Get() {
 		// this client is still ws-connected to server
@@ -1714,13 +1670,11 @@ func (c *WsClient) SendPing(maxWaitMS int) {
 		maxWaitMS = 20000
 	}
 
-	if logWantedFor("sendping") {
-		fmt.Printf("sendPing (%s) %s maxWaitMS=%d\n",c.calleeID, c.wsConn.RemoteAddr().String(), maxWaitMS)
-	}
+	c.log.Debug("sendping", "sendPing", "maxWaitMS",maxWaitMS)
 
 	err := c.wsConn.WriteMessage(websocket.PingMessage, nil)
 	if err != nil {
-		fmt.Printf("# sendPing (%s) %s err=%v\n", c.calleeID, c.wsConn.RemoteAddr().String(), err)
+		c.log.Error("sendPing", "err",err)
 		c.isOnline.Set(false) // ??? prevent Close() from trying to close this already closed connection
 		if c.hub!=nil {
 			comment := "sendPing error: "+err.Error()
@@ -1729,10 +1683,10 @@ func (c *WsClient) SendPing(maxWaitMS int) {
 			// instead:
 			c.hub.LocalP2p = false
 			c.hub.RemoteP2p = false
-			fmt.Printf("# sendPing (%s) %s setDeadline()\n", c.calleeID, c.wsConn.RemoteAddr().String())
+			c.log.Warn("sendPing setDeadline()", "addr",c.wsConn.RemoteAddr().String())
 			c.hub.setDeadline(0,comment)
 			if c.hub.CalleeClient!=nil {
-				fmt.Printf("# sendPing (%s) %s keepAliveMgr.Delete\n", c.calleeID, c.wsConn.RemoteAddr().String())
+				c.log.Warn("sendPing keepAliveMgr.Delete", "addr",c.wsConn.RemoteAddr().String())
 				keepAliveMgr.Delete(c.hub.CalleeClient.wsConn)
 				c.hub.CalleeClient.wsConn.SetReadDeadline(time.Time{})
 				c.hub.CalleeClient.isConnectedToPeer.Set(false)
@@ -1741,7 +1695,7 @@ func (c *WsClient) SendPing(maxWaitMS int) {
 			}
 */
 		}
-		fmt.Printf("# sendPing (%s) %s done\n", c.calleeID, c.wsConn.RemoteAddr().String())
+		c.log.Warn("sendPing done")
 		return
 	}
 
@@ -1820,6 +1774,7 @@ func (kaMgr *KeepAliveMgr) Run() {
 			}
 		}
 		atomic.AddInt64(&pingSentCounter, nPing)
+		metricsWsPingTotal.Add("sent", float64(nPing))
 	}
 }
 
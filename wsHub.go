@@ -22,6 +22,7 @@ type Hub struct {
 	ConnectedCallerIp string // will be set on callerOffer
 	CallerIpNoPort string
 	CallerID string
+	TurnUsername string // the TURN credentials of the current call (see runturn.go)
 	WsUrl string
 	WssUrl string
 	calleeUserAgent string // http UA
@@ -39,6 +40,12 @@ type Hub struct {
 	IsCalleeHidden bool
 	LocalP2p bool
 	RemoteP2p bool
+	cdr *CallDetailRecord // the current call attempt
+	cdrMutex sync.Mutex
+	WaitingClient *WsClient // a 2nd caller while the callee is busy (see callwaiting.go)
+	waitingMsgs [][]byte // messages of WaitingClient, forwarded to the callee on acceptWaiting
+	heldCall *HubCall // the call on hold
+	transferTarget string // the consult target of an attended transfer
 }
 
 func newHub(maxRingSecs int, maxTalkSecsIfNoP2p int, startTime int64) *Hub {
@@ -51,14 +58,19 @@ func newHub(maxRingSecs int, maxTalkSecsIfNoP2p int, startTime int64) *Hub {
 	}
 }
 
+// log returns the logger of the callee client (or the root logger if there is none)
+func (h *Hub) log() *Logger {
+	if h.CalleeClient!=nil {
+		return h.CalleeClient.log
+	}
+	return logRoot
+}
+
 func (h *Hub) setDeadline(secs int, comment string) {
 	// will disconnect peercon after some time
 	// by sending cancel to both clients and then by calling peerConHasEnded
 	if h.timer!=nil {
-		if logWantedFor("deadline") {
-			fmt.Printf("setDeadline (%s) cancel running timer; new secs=%d (%s)\n",
-				h.CalleeClient.calleeID, secs, comment)
-		}
+		h.log().Debug("deadline", "setDeadline cancel running timer", "secs",secs, "comment",comment)
 		// cancel running timer early (trigger h.timer.C below)
 		h.timerCanceled <- struct{}{}
 		// let running timer be canceled before we (might) set a new one
@@ -66,9 +78,7 @@ func (h *Hub) setDeadline(secs int, comment string) {
 	}
 
 	if(secs>0) {
-		if logWantedFor("deadline") {
-			fmt.Printf("setDeadline (%s) create %ds (%s)\n", h.CalleeClient.calleeID, secs, comment)
-		}
+		h.log().Debug("deadline", "setDeadline create", "secs",secs, "comment",comment)
 		h.timer = time.NewTimer(time.Duration(secs) * time.Second)
 		h.timerCanceled = make(chan struct{})
 		go func() {
@@ -78,16 +88,11 @@ func (h *Hub) setDeadline(secs int, comment string) {
 				// timer event: we need to disconnect the (relayed) clients (if still connected)
 				h.timer = nil
 				if h.CalleeClient!=nil && h.CalleeClient.isConnectedToPeer.Get() {
-					fmt.Printf("setDeadline (%s) reached; quit session now (secs=%d %v)\n",
-						h.CalleeClient.calleeID, secs, timeStart.Format("2006-01-02 15:04:05"))
-					calleeID := ""
-					if h.CalleeClient!=nil {
-						calleeID = h.CalleeClient.calleeID
-					}
+					h.log().Info("setDeadline reached; quit session now",
+						"secs",secs, "start",timeStart.Format("2006-01-02 15:04:05"))
 					if h.CallerClient!=nil {
 						var message = []byte("cancel|s")
-						fmt.Printf("setDeadline (%s) send to caller (%s) %s\n",
-							calleeID, message, h.CallerClient.RemoteAddr)
+						h.CallerClient.log.Info("setDeadline send to caller", "message",string(message))
 						h.CallerClient.Write(message)
 						// in response, caller will send msgboxText to server and will hangup
 					}
@@ -98,8 +103,7 @@ func (h *Hub) setDeadline(secs int, comment string) {
 					if h.CalleeClient!=nil && h.CalleeClient.isConnectedToPeer.Get() {
 						var message = []byte("cancel|c")
 						// only cancel callee if canceling caller wasn't possible
-						fmt.Printf("setDeadline (%s) send to callee (%s) %s\n",
-							calleeID, message, h.CalleeClient.RemoteAddr)
+						h.log().Info("setDeadline send to callee", "message",string(message))
 						h.CalleeClient.Write(message)
 					}
 					h.HubMutex.RUnlock()
@@ -110,10 +114,8 @@ func (h *Hub) setDeadline(secs int, comment string) {
 					h.HubMutex.Unlock()
 				}
 			case <-h.timerCanceled:
-				if logWantedFor("deadline") {
-					fmt.Printf("setDeadline (%s) timerCanceled (secs=%d %v)\n",
-						h.CalleeClient.calleeID, secs, timeStart.Format("2006-01-02 15:04:05"))
-				}
+				h.log().Debug("deadline", "setDeadline timerCanceled",
+					"secs",secs, "start",timeStart.Format("2006-01-02 15:04:05"))
 				if h.timer!=nil {
 					h.timer.Stop()
 				}
@@ -126,22 +128,14 @@ func (h *Hub) setDeadline(secs int, comment string) {
 func (h *Hub) doBroadcast(message []byte) {
 	// bad fktname! here we only send a message to BOTH clients
 	// this fkt likes to be called with h.HubMutex (r)locked
-	calleeID := ""
-	if h.CalleeClient!=nil {
-		calleeID = h.CalleeClient.calleeID
-	}
 	if h.CallerClient!=nil {
-		if logWantedFor("______") { // was "deadline" had to be removed
-			fmt.Printf("%s (%s) doBroadcast caller (%s) %s\n",
-				h.CalleeClient.connType, calleeID, message, h.CallerClient.RemoteAddr)
-		}
+		// was "deadline" had to be removed
+		h.CallerClient.log.Debug("______", "doBroadcast caller", "message",string(message))
 		h.CallerClient.Write(message)
 	}
 	if h.CalleeClient!=nil {
-		if logWantedFor("______") { // was "deadline" had to be removed
-			fmt.Printf("%s (%s) doBroadcast callee (%s) %s\n",
-				h.CalleeClient.connType, calleeID, message, h.CalleeClient.RemoteAddr)
-		}
+		// was "deadline" had to be removed
+		h.CalleeClient.log.Debug("______", "doBroadcast callee", "message",string(message))
 		h.CalleeClient.Write(message)
 	}
 }
@@ -149,17 +143,20 @@ func (h *Hub) doBroadcast(message []byte) {
 func (h *Hub) processTimeValues(comment string) {
 	if h.lastCallStartTime>0 {
 		h.CallDurationSecs = time.Now().Unix() - h.lastCallStartTime
-		if logWantedFor("hub") {
-			fmt.Printf("%s (%s) timeValues %s sec=%d %d %d\n",
-				h.CalleeClient.connType, h.CalleeClient.calleeID, comment,
-				h.CallDurationSecs, time.Now().Unix(), h.lastCallStartTime)
-		}
-		if h.CallDurationSecs>0 {
-			numberOfCallsTodayMutex.Lock()
-			numberOfCallsToday++
-			numberOfCallSecondsToday += h.CallDurationSecs
-			numberOfCallsTodayMutex.Unlock()
-		}
+		h.log().Debug("hub", "timeValues", "comment",comment,
+			"secs",h.CallDurationSecs, "now",time.Now().Unix(), "lastCallStartTime",h.lastCallStartTime)
+		countCallSecs(h.CallDurationSecs, h.LocalP2p && h.RemoteP2p)
+	}
+}
+
+// countCallSecs adds a completed call to the daily stats and to the metrics
+func countCallSecs(durationSecs int64, p2p bool) {
+	if durationSecs>0 {
+		numberOfCallsTodayMutex.Lock()
+		numberOfCallsToday++
+		numberOfCallSecondsToday += durationSecs
+		numberOfCallsTodayMutex.Unlock()
+		metricsCallEnded(durationSecs, p2p)
 	}
 }
 
@@ -168,16 +165,16 @@ func (h *Hub) peerConHasEnded(cause string) {
 	// or bc callee has unregistered or got ws-disconnected
 	// peerConHasEnded MUST be called with locking in place
 
+	h.cdrEnd(cause)
+
 	if h.CalleeClient==nil {
 		//fmt.Printf("# peerConHasEnded but h.CalleeClient==nil\n")
 		return
 	}
 
-	if logWantedFor("wsclose") {
-		fmt.Printf("%s (%s) peerConHasEnded peercon=%v media=%v (%s)\n",
-			h.CalleeClient.connType, h.CalleeClient.calleeID,
-			h.CalleeClient.isConnectedToPeer.Get(), h.CalleeClient.isMediaConnectedToPeer.Get(), cause)
-	}
+	h.log().Debug("wsclose", "peerConHasEnded",
+		"peercon",h.CalleeClient.isConnectedToPeer.Get(), "media",h.CalleeClient.isMediaConnectedToPeer.Get(),
+		"cause",cause)
 
 	if h.lastCallStartTime>0 {
 		h.processTimeValues("peerConHasEnded") // will set c.hub.CallDurationSecs
@@ -192,10 +189,9 @@ func (h *Hub) peerConHasEnded(cause string) {
 		//callerHost = c.hub.CallerClient.callerHost
 	}
 
-	// clear recentTurnCalleeIps[ipNoPort] entry (if this was a relay session)
-	recentTurnCalleeIpMutex.Lock()
-	delete(recentTurnCalleeIps,h.CallerIpNoPort)
-	recentTurnCalleeIpMutex.Unlock()
+	// revoke the TURN credentials of this call
+	turnCredentialsEnd(h.TurnUsername)
+	h.TurnUsername = ""
 
 	if h.CalleeClient.isConnectedToPeer.Get() {
 		// we are disconnecting a peer connect
@@ -218,10 +214,11 @@ func (h *Hub) peerConHasEnded(cause string) {
 		if h.CallDurationSecs > 0 {
 			title = "PEER DISCON📴"
 		}
-		fmt.Printf("%s (%s) %s %ds %s/%s %s <- %s (%s) %s\n",
-			h.CalleeClient.connType, h.CalleeClient.calleeID, title,
-			h.CallDurationSecs, localPeerCon, remotePeerCon,
-			h.CalleeClient.RemoteAddrNoPort, h.CallerIpNoPort, callerID, cause)
+		h.log().Info(title, "secs",h.CallDurationSecs, "con",localPeerCon+"/"+remotePeerCon,
+			"calleeIp",h.CalleeClient.RemoteAddrNoPort, "callerIp",h.CallerIpNoPort, "callerID",callerID, "cause",cause)
+		emitEvent(Event{Type:"hangup", CalleeID:h.CalleeClient.calleeID, CallerID:callerID, CallerName:callerName,
+			Duration:h.CallDurationSecs, Con:localPeerCon+"/"+remotePeerCon, Cause:cause})
+		presenceSet(h.CalleeClient.calleeID, presenceStateOf(h.IsCalleeHidden), "busy")
 	}
 
 	// add an entry to missed calls, but only if hub.CallDurationSecs<=0
@@ -234,8 +231,7 @@ func (h *Hub) peerConHasEnded(cause string) {
 		var dbUser DbUser
 		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
 		if err!=nil {
-			fmt.Printf("# %s (%s) failed to get dbUser err=%v\n",
-				h.CalleeClient.connType, h.CalleeClient.calleeID,err)
+			h.log().Error("failed to get dbUser", "err",err)
 		} else if dbUser.StoreMissedCalls {
 			//fmt.Printf("%s (%s) store missedCall msg=(%s)\n", c.connType, c.calleeID, c.callerTextMsg)
 			addMissedCall(h.CalleeClient.calleeID, CallerInfo{h.CallerIpNoPort, callerName, time.Now().Unix(),
@@ -249,8 +245,8 @@ func (h *Hub) peerConHasEnded(cause string) {
 	if err!=nil {
 		// err "key not found": callee has already signed off - can be ignored
 		//if strings.Index(err.Error(),"key not found")<0 {
-			fmt.Printf("# %s (%s) peerConHasEnded clr callerIp %s err=%v\n",
-				h.CalleeClient.connType, h.CalleeClient.calleeID, h.CalleeClient.globalCalleeID, err)
+			h.log().Error("peerConHasEnded clr callerIp",
+				"globalCalleeID",h.CalleeClient.globalCalleeID, "err",err)
 		//}
 	}
 
@@ -260,6 +256,10 @@ func (h *Hub) peerConHasEnded(cause string) {
 
 func (h *Hub) closeCaller(cause string) {
 	h.HubMutex.Lock()
+	if h.CalleeClient==nil || !h.CalleeClient.isConnectedToPeer.Get() {
+		// otherwise only the caller's ws-connection is closed, the call continues (disconCallerOnPeerConnected)
+		h.cdrEnd(cause)
+	}
 	if h.CallerClient!=nil {
 		h.CallerClient.Close(cause)
 		// this will prevent NO PEERCON after hangup or after calls shorter than 10s
@@ -280,14 +280,18 @@ func (h *Hub) closeCallee(cause string) {
 	comment := "closeCallee <- "+cause
 	h.HubMutex.Lock()
 	if h.CalleeClient!=nil {
-		if logWantedFor("wsclose") {
-			fmt.Printf("%s (%s) closeCallee peercon=%v (%s)\n",
-				h.CalleeClient.connType, h.CalleeClient.calleeID,
-				h.CalleeClient.isConnectedToPeer.Get(), cause)
-		}
+		h.log().Debug("wsclose", "closeCallee", "peercon",h.CalleeClient.isConnectedToPeer.Get(), "cause",cause)
 
 		// NOTE: delete(hubMap,id) might have been executed, caused by timeout22s
 
+		if h.CalleeLogin.Get() {
+			emitEvent(Event{Type:"logoff", CalleeID:h.CalleeClient.calleeID, Cause:cause})
+			presenceSet(h.CalleeClient.calleeID, "offline")
+		}
+		presenceUnsubscribe(h.CalleeClient)
+
+		h.endCallWaitingLocked(comment)
+
 		if h.lastCallStartTime>0 {
 			h.processTimeValues(comment)
 			h.lastCallStartTime = 0
@@ -296,6 +300,7 @@ func (h *Hub) closeCallee(cause string) {
 		if h.CalleeClient.isConnectedToPeer.Get() {
 			h.peerConHasEnded(comment) // will set h.CallerClient=nil
 		}
+		h.cdrEnd(comment)
 		h.LocalP2p = false
 		h.RemoteP2p = false
 		h.setDeadline(0,comment)